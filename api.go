@@ -2,6 +2,7 @@ package vertex
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -15,7 +16,6 @@ import (
 	"github.com/EverythingMe/vertex/swagger"
 
 	"github.com/alecthomas/jsonschema"
-	"github.com/dvirsky/go-pylog/logging"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -29,10 +29,141 @@ type API struct {
 	DefaultSecurityScheme SecurityScheme
 	Renderer              Renderer
 	Routes                Routes
+	Groups                []Group
 	Middleware            []Middleware
 	TestMiddleware        []Middleware
 	SwaggerMiddleware     []Middleware
 	AllowInsecure         bool
+
+	// InnerMiddleware is applied to every route after the group and route middleware, right before the handler.
+	// See RouteChain for the order middleware runs in
+	InnerMiddleware []Middleware
+
+	// DisableProcessingTime stops reporting the processing time of requests in a response header, e.g. if a proxy reports
+	// its own timing. ProcessingTimeHeader optionally renames the header, which defaults to HeaderProcessingTime
+	DisableProcessingTime bool
+	ProcessingTimeHeader  string
+
+	// The unit and precision of the processing time header. Defaults to DefaultProcessingTimeFormat if its unit is not set
+	ProcessingTimeFormat ProcessingTimeFormat
+
+	// DisableJSONP ignores the JSONP callback param of requests, responding with plain JSON
+	DisableJSONP bool
+	// JSONPCallbacks optionally whitelists the allowed JSONP callback names. Any valid identifier is allowed if empty
+	JSONPCallbacks []string
+}
+
+// processingTimeHeader returns the header reporting the processing time of the API's requests, or an empty string if
+// it is disabled
+func (a *API) processingTimeHeader() string {
+	if a.DisableProcessingTime {
+		return ""
+	}
+	if a.ProcessingTimeHeader != "" {
+		return a.ProcessingTimeHeader
+	}
+	return HeaderProcessingTime
+}
+
+// processingTimeFormat returns the format of the processing time header of the API's requests
+func (a *API) processingTimeFormat() ProcessingTimeFormat {
+	if a.ProcessingTimeFormat.Unit <= 0 {
+		return DefaultProcessingTimeFormat
+	}
+	return a.ProcessingTimeFormat
+}
+
+// valid JSONP callback names - javascript identifiers, optionally dotted (e.g. jQuery.cb_1)
+var callbackRe = regexp.MustCompile(`^[a-zA-Z_$][a-zA-Z0-9_$]*(\.[a-zA-Z_$][a-zA-Z0-9_$]*)*$`)
+
+// validateCallback checks the JSONP callback of a request. Callbacks that are not valid identifiers or are not
+// whitelisted are rejected, since the callback is written as is into the response
+func (a *API) validateCallback(r *Request) error {
+
+	if r.Callback == "" {
+		return nil
+	}
+
+	if a.DisableJSONP {
+		r.Callback = ""
+		return nil
+	}
+
+	cb := r.Callback
+	if len(cb) > 128 || !callbackRe.MatchString(cb) {
+		// don't render the error into the bad callback
+		r.Callback = ""
+		return InvalidParamError("Invalid %s param", CallbackParam)
+	}
+
+	if len(a.JSONPCallbacks) > 0 {
+		for _, allowed := range a.JSONPCallbacks {
+			if cb == allowed {
+				return nil
+			}
+		}
+		r.Callback = ""
+		return InvalidParamError("%s %s is not allowed", CallbackParam, cb)
+	}
+
+	return nil
+}
+
+// routeMiddleware returns the middleware chain of a route, in the order it runs: the API middleware, the middleware of
+// the route's groups and of the route itself, then the API's inner middleware
+func (a *API) routeMiddleware(route Route) []Middleware {
+
+	mws := make([]Middleware, 0, len(a.Middleware)+len(route.Middleware)+len(a.InnerMiddleware)+1)
+
+	// deprecated routes are marked first, so the headers are there whatever the middleware does
+	if route.Deprecated {
+		mws = append(mws, route.deprecationMiddleware())
+	}
+
+	mws = append(mws, a.Middleware...)
+	mws = append(mws, route.Middleware...)
+	return append(mws, a.InnerMiddleware...)
+}
+
+// UseFirst inserts middleware at the front of the chain of every route, before the rest of the API middleware.
+// Like the other middleware fields, it must be called before the API is added to a server
+func (a *API) UseFirst(mws ...Middleware) {
+	a.Middleware = append(append([]Middleware{}, mws...), a.Middleware...)
+}
+
+// UseLast inserts middleware at the back of the chain of every route, after the route middleware and the rest of the
+// inner middleware, right before the handler
+func (a *API) UseLast(mws ...Middleware) {
+	a.InnerMiddleware = append(a.InnerMiddleware, mws...)
+}
+
+// RouteChain returns the middleware chain of the route defined with a method and path (relative to the API root,
+// including the path of its group), in the order it runs. This helps debugging the ordering of middleware.
+// It returns false if the API has no such route
+func (a *API) RouteChain(method, pth string) ([]Middleware, bool) {
+
+	var flag MethodFlag
+	for _, m := range methodFlags {
+		if m.name == strings.ToUpper(method) {
+			flag = m.flag
+		}
+	}
+
+	// groups are expanded only when the API is configured
+	routes := append(Routes{}, a.Routes...)
+	for _, g := range a.Groups {
+		routes = append(routes, g.routes()...)
+	}
+
+	for _, route := range routes {
+		for _, r := range route.methodRoutes() {
+			if r.Path == pth && flag != 0 && r.Methods&flag == flag {
+				return a.routeMiddleware(r), true
+			}
+		}
+	}
+
+	return nil, false
 }
 
 // return an httprouter compliant handler function for a route
@@ -51,9 +182,9 @@ func (a *API) handler(route Route) func(w http.ResponseWriter, r *http.Request,
 		security = a.DefaultSecurityScheme
 	}
 
-	// Build the middleware chain for the API middleware and the rout middleware.
-	// The route middleware comes after the API middleware
-	chain := buildChain(append(a.Middleware, route.Middleware...)...)
+	mws := a.routeMiddleware(route)
+	chain := buildChain(mws...)
+	preBinders, postBinders := bindHooks(mws)
 
 	// add the handler itself as the final middleware
 	handlerMW := MiddlewareFunc(func(w http.ResponseWriter, r *Request, next HandlerFunc) (interface{}, error) {
@@ -66,12 +197,40 @@ func (a *API) handler(route Route) func(w http.ResponseWriter, r *http.Request,
 			reqHandler = route.Handler
 		}
 
+		if r.formErr != nil {
+			logError("Error parsing request data: %s", r.formErr)
+			return nil, InvalidRequestError("Error parsing request data: %s", r.formErr)
+		}
+
+		if err := checkContentType(r.Request, route.Consumes); err != nil {
+			logError("Rejecting request body: %s", err)
+			return nil, err
+		}
+
+		for _, b := range preBinders {
+			if err := b.PreBind(reqHandler, r); err != nil {
+				logError("Error preparing handler: %s", err)
+				return nil, err
+			}
+		}
+
 		//read params
-		if err := parseInput(r.Request, reqHandler, validator); err != nil {
-			logging.Error("Error reading input: %s", err)
+		if err := ParseForm(r); err != nil {
+			logError("Error reading input: %s", err)
+			return nil, NewError(err)
+		}
+		if err := bindInput(r.Request, reqHandler, validator); err != nil {
+			logError("Error reading input: %s", err)
 			return nil, NewError(err)
 		}
 
+		for _, b := range postBinders {
+			if err := b.PostBind(reqHandler, r); err != nil {
+				logError("Error preparing handler: %s", err)
+				return nil, err
+			}
+		}
+
 		return reqHandler.Handle(w, r)
 	})
 
@@ -83,19 +242,28 @@ func (a *API) handler(route Route) func(w http.ResponseWriter, r *http.Request,
 		chain.append(handlerMW)
 	}
 
-	return a.middlewareHandler(chain, security, route.Renderer)
+	return a.middlewareHandler(chain, security, route.Renderer, route.Path, validator.sensitive)
 }
 
-func (a *API) middlewareHandler(chain *step, security SecurityScheme, renderer Renderer) func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+func (a *API) middlewareHandler(chain *step, security SecurityScheme, renderer Renderer, routePath string, sensitive []string) func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 	// allow overriding the API's default renderer with a per-route one
 	if renderer == nil {
 		renderer = a.Renderer
 	}
 
+	catchAll := catchAllParam(routePath)
+
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 		req := NewRequest(r)
+		req.renderer = renderer
+		req.APIName = a.Name
+		req.RoutePath = routePath
+		req.processingTimeHeader = a.processingTimeHeader()
+		req.processingTimeFormat = a.processingTimeFormat()
+		req.sensitiveParams = sensitive
+		w.Header().Set(HeaderXRequestId, req.RequestId)
 
 		if !a.AllowInsecure && !req.Secure {
 			// local requests bypass security
@@ -105,18 +273,24 @@ func (a *API) middlewareHandler(chain *step, security SecurityScheme, renderer R
 			}
 		}
 
-		r.ParseForm()
-		// Copy values from the router params to the request params
+		// Copy values from the router params to the request params. The router captures catch-all params with their
+		// leading slash, which we strip so /files/{path:*} gives "a/b.txt" for /files/a/b.txt
+		params := make(Params, len(p))
 		for _, v := range p {
+			if v.Key == catchAll {
+				v.Value = strings.TrimPrefix(v.Value, "/")
+			}
 			r.Form.Set(v.Key, v.Value)
+			params[v.Key] = v.Value
 		}
+		req.Request = req.Request.WithContext(context.WithValue(req.Context(), pathParamsKey{}, params))
 
 		var ret interface{}
-		var err error
 
-		if security != nil {
+		err := a.validateCallback(req)
+		if err == nil && security != nil {
 			if err = security.Validate(req); err != nil {
-				logging.Warning("Error validating security scheme: %s", err)
+				logWarning("Error validating security scheme: %s", err)
 
 				if e, ok := err.(*internalError); ok {
 					e.Code = ErrUnauthorized
@@ -128,20 +302,161 @@ func (a *API) middlewareHandler(chain *step, security SecurityScheme, renderer R
 			ret, err = chain.handle(w, req)
 		}
 
-		if err != Hijacked {
+		if !IsHijacked(err) {
 
-			if err = renderer.Render(ret, err, w, req); err != nil {
-				logging.Error("Error rendering response: %s", err)
+			if err = render(renderer, ret, err, w, req); err != nil {
+				logError("Error rendering response: %s", err)
 			}
 		} else {
-			logging.Debug("Not rendering hijacked request %s", r.RequestURI)
+			logDebug("Not rendering hijacked request %s", r.RequestURI)
+		}
+
+		// the http server only removes the temporary files of forms parsed on the request it created, not on our copy
+		if req.MultipartForm != nil {
+			req.MultipartForm.RemoveAll()
 		}
 
 	}
 
 }
 
-var routeRe = regexp.MustCompile("\\{([a-zA-Z_\\.0-9]+)\\}")
+// routeRe matches path params in route paths. {name} matches a single segment, and {name:*} is a catch-all matching
+// the rest of the path
+var routeRe = regexp.MustCompile("\\{([a-zA-Z_\\.0-9]+)(:\\*)?\\}")
+
+// catchAllParam returns the name of the catch-all param of a route path, if it has one
+func catchAllParam(pth string) string {
+	for _, match := range routeRe.FindAllStringSubmatch(pth, -1) {
+		if match[2] != "" {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+// validatePath checks that a route path has at most one catch-all param, as its last segment
+func validatePath(pth string) error {
+
+	matches := routeRe.FindAllStringSubmatchIndex(pth, -1)
+	for i, match := range matches {
+		// the optional :* group is unmatched for plain params
+		if match[4] == -1 {
+			continue
+		}
+		if i != len(matches)-1 || match[1] != len(pth) {
+			return fmt.Errorf("Catch-all params must be the last segment of the path")
+		}
+		if match[0] == 0 || pth[match[0]-1] != '/' {
+			return fmt.Errorf("Catch-all params must be a whole path segment")
+		}
+	}
+
+	return nil
+}
+
+// routeTemplate converts a route path to the template the router matches, in which params are anonymous, so
+// /u/{id} and /u/{name} are the same route
+func routeTemplate(pth string) string {
+	return routeRe.ReplaceAllStringFunc(pth, func(param string) string {
+		if strings.HasSuffix(param, ":*}") {
+			return "{*}"
+		}
+		return "{}"
+	})
+}
+
+// expandRoutes expands the groups of the API into routes, and routes with per-method handlers into a route per
+// handler, dropping routes with invalid paths. The groups are cleared, so expanding the routes again changes nothing
+func (a *API) expandRoutes() {
+
+	for _, g := range a.Groups {
+		a.Routes = append(a.Routes, g.routes()...)
+	}
+	a.Groups = nil
+
+	routes := make(Routes, 0, len(a.Routes))
+	for _, route := range a.Routes {
+		if err := validatePath(route.Path); err != nil {
+			logError("Not registering route %s: %s", route.Path, err)
+			continue
+		}
+		if !ServerConfig().routeEnabled(route.Tags) {
+			logInfo("Not registering route %s with tags %v", route.Path, route.Tags)
+			continue
+		}
+		routes = append(routes, route.methodRoutes()...)
+	}
+	a.Routes = routes
+}
+
+// validate checks that the API can be added to a server: it must have a root and a renderer, its routes must have
+// handlers and valid paths, and no two routes may have the same method and path template. The routes of the API are
+// expanded if it is valid (see expandRoutes)
+func (a *API) validate() error {
+
+	var problems []string
+	if strings.Trim(a.root(), "/") == "" {
+		problems = append(problems, "no root, set its Root or its Name")
+	}
+	if a.Renderer == nil {
+		problems = append(problems, "no renderer")
+	}
+
+	routes := append(Routes{}, a.Routes...)
+	for _, g := range a.Groups {
+		routes = append(routes, g.routes()...)
+	}
+	for _, route := range routes {
+		if route.Handler == nil && len(route.Handlers) == 0 {
+			problems = append(problems, fmt.Sprintf("route %s has no handler", route.Path))
+		}
+		if err := validatePath(route.Path); err != nil {
+			problems = append(problems, fmt.Sprintf("route %s has an invalid path: %s", route.Path, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid API %s: %s", a.Name, strings.Join(problems, "; "))
+	}
+
+	a.expandRoutes()
+	return a.checkDuplicateRoutes()
+}
+
+// checkDuplicateRoutes returns an error naming all the routes of the API that have the same method and path template
+// as an earlier route
+func (a *API) checkDuplicateRoutes() error {
+
+	defined := map[string]Route{}
+	var conflicts []string
+
+	for _, route := range a.Routes {
+		tmpl := routeTemplate(route.Path)
+		for _, m := range methodFlags {
+			if route.Methods&m.flag != m.flag {
+				continue
+			}
+
+			key := m.name + " " + tmpl
+			if prev, found := defined[key]; found {
+				conflicts = append(conflicts, fmt.Sprintf("%s %s (%T) conflicts with %s (%T)", m.name, route.Path,
+					route.Handler, prev.Path, prev.Handler))
+				continue
+			}
+			defined[key] = route
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("Duplicate routes in API %s: %s", a.Name, strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// swaggerPath converts a route path to a swagger path, in which catch-all params are plain params
+func swaggerPath(pth string) string {
+	return routeRe.ReplaceAllString(pth, "{$1}")
+}
 
 func (a *API) root() string {
 	if len(a.Root) == 0 {
@@ -156,10 +471,16 @@ func (a *API) root() string {
 // e.g. if my API name is "myapi" and the version is 1.0, FullPath("/foo") returns "/myapi/1.0/foo"
 func (a *API) FullPath(relpath string) string {
 
-	relpath = routeRe.ReplaceAllString(relpath, ":$1")
+	relpath = routeRe.ReplaceAllStringFunc(relpath, func(param string) string {
+		match := routeRe.FindStringSubmatch(param)
+		if match[2] != "" {
+			return "*" + match[1]
+		}
+		return ":" + match[1]
+	})
 
 	ret := path.Join(a.root(), relpath)
-	logging.Debug("FullPath for %s => %s", relpath, ret)
+	logDebug("FullPath for %s => %s", relpath, ret)
 	return ret
 }
 
@@ -168,27 +489,40 @@ func (a *API) FullPath(relpath string) string {
 func (a *API) configure(router *httprouter.Router) *httprouter.Router {
 
 	if router == nil {
-		router = httprouter.New()
+		router = newRouter()
+	}
+
+	a.expandRoutes()
+
+	// the router panics on conflicting routes too, but without telling which routes conflict
+	if err := a.checkDuplicateRoutes(); err != nil {
+		panic(err)
 	}
 
 	for i, route := range a.Routes {
 
 		if err := route.parseInfo(route.Path); err != nil {
-			logging.Error("Error parsing info for %s: %s", route.Path, err)
+			logError("Error parsing info for %s: %s", route.Path, err)
+		}
+		for _, ct := range route.Consumes {
+			if !strings.Contains(ct, "*") && !decodable(ct) {
+				logWarning("Route %s consumes %s, but it has no body decoder, so its bodies are not bound", route.Path, ct)
+			}
 		}
 		a.Routes[i] = route
 		h := a.handler(route)
 
 		pth := a.FullPath(route.Path)
 
-		if route.Methods&GET == GET {
-			logging.Info("Registering GET handler %v to path %s", h, pth)
-			router.Handle("GET", pth, h)
+		for _, m := range methodFlags {
+			if route.Methods&m.flag == m.flag {
+				logInfo("Registering %s handler %T to path %s", m.name, route.Handler, pth)
+				router.Handle(m.name, pth, h)
+			}
 		}
-		if route.Methods&POST == POST {
-			logging.Info("Registering POST handler %v to path %s", h, pth)
-			router.Handle("POST", pth, h)
 
+		if route.Methods&GET == GET && !route.NoHead {
+			router.Handle("HEAD", pth, headHandler(h))
 		}
 
 	}
@@ -200,8 +534,9 @@ func (a *API) configure(router *httprouter.Router) *httprouter.Router {
 		chain.append(a.swaggerHandler())
 	}
 
-	// Server the API documentation swagger
-	router.GET(a.FullPath("/swagger"), a.middlewareHandler(chain, nil, nil))
+	// Server the API documentation swagger, also on swagger.json for tools expecting the well known path
+	router.GET(a.FullPath("/swagger"), a.middlewareHandler(chain, nil, nil, "/swagger", nil))
+	router.GET(a.FullPath("/swagger.json"), a.middlewareHandler(chain, nil, nil, "/swagger.json", nil))
 
 	chain = buildChain(a.TestMiddleware...)
 	if chain == nil {
@@ -210,7 +545,7 @@ func (a *API) configure(router *httprouter.Router) *httprouter.Router {
 		chain.append(a.testHandler())
 	}
 
-	router.GET(path.Join("/test", a.root(), ":category"), a.middlewareHandler(chain, nil, nil))
+	router.GET(path.Join("/test", a.root(), ":category"), a.middlewareHandler(chain, nil, nil, "/test/{category}", nil))
 
 	// Redirect /$api/$version/console => /console?url=/$api/$version/swagger
 	uiPath := fmt.Sprintf("/console?url=%s", url.QueryEscape(a.FullPath("/swagger")))
@@ -268,6 +603,35 @@ func (a *API) testHandler() MiddlewareFunc {
 	})
 }
 
+// swaggerPathParams makes sure every {param} segment of the route path is described as a required path param.
+// Handler fields matching a segment by name are moved to the path, and segments with no matching field are added as strings
+func swaggerPathParams(pth string, params []swagger.Param) []swagger.Param {
+
+	for _, match := range routeRe.FindAllStringSubmatch(pth, -1) {
+		name := match[1]
+
+		found := false
+		for i := range params {
+			if params[i].Name == name {
+				params[i].In = "path"
+				params[i].Required = true
+				found = true
+			}
+		}
+
+		if !found {
+			params = append(params, swagger.Param{
+				Name:     name,
+				In:       "path",
+				Required: true,
+				Type:     swagger.String,
+			})
+		}
+	}
+
+	return params
+}
+
 // ToSwagger Converts an API definition into a swagger API object for serialization
 func (a API) ToSwagger(serverUrl string) *swagger.API {
 
@@ -284,8 +648,21 @@ func (a API) ToSwagger(serverUrl string) *swagger.API {
 
 		ri := route.requestInfo
 
-		p := ret.AddPath(route.Path)
+		// routes with per-method handlers share their path
+		p, found := ret.Paths[swaggerPath(route.Path)]
+		if !found {
+			p = ret.AddPath(swaggerPath(route.Path))
+		}
 		method := ri.ToSwagger()
+		method.Parameters = swaggerPathParams(route.Path, method.Parameters)
+		method.Consumes = route.Consumes
+		if route.Deprecated {
+			method.Deprecated = true
+			if !route.Sunset.IsZero() {
+				method.Description = strings.TrimSpace(fmt.Sprintf("%s\n\nSunset on %s", method.Description,
+					route.Sunset.UTC().Format("2006-01-02")))
+			}
+		}
 
 		// copy response definitions to API definitions
 		for rk, resp := range method.Responses {
@@ -321,6 +698,9 @@ func (a API) ToSwagger(serverUrl string) *swagger.API {
 		if route.Methods&PUT == PUT {
 			p["put"] = method
 		}
+		if route.Methods&DELETE == DELETE {
+			p["delete"] = method
+		}
 	}
 
 	return ret
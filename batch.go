@@ -0,0 +1,247 @@
+package vertex
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// BatchPath is the path batches of requests are served on by Server.ExposeBatch
+const BatchPath = "/batch"
+
+// DefaultMaxBatchSize is the maximum number of sub-requests of a batch, if ExposeBatch is not given one
+const DefaultMaxBatchSize = 20
+
+// MaxBatchBodySize is the maximum size of the body of a batch. The bodies of the sub-requests are also limited by the
+// middleware of their routes
+const MaxBatchBodySize = 10 << 20
+
+// MaxBatchResponseSize is the maximum total size of the bodies of the sub-responses of a batch, which are buffered
+// until the whole batch is done. Sub-responses that do not fit are replaced with a 413 error
+var MaxBatchResponseSize int64 = 10 << 20
+
+// BatchRequest is a single sub-request of a batch. The path may include a query string, and the body is sent as
+// JSON, unless the headers set another content type and the body is a JSON string, which is sent as it is
+type BatchRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// BatchResponse is the response of a sub-request of a batch. JSON bodies are embedded as they are, and other bodies
+// (e.g. plain text errors) as a JSON string. Header names are canonical, e.g. X-Request-Id
+type BatchResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// the headers of the batch request that are not passed on to its sub-requests, since they describe the batch body or
+// would encode the sub-responses. Cookies are not passed on either, so a page that can make its browser send a batch
+// cannot make cookie authenticated calls with it
+var batchSkippedHeaders = []string{
+	"Content-Length", "Content-Type", "Content-Encoding", "Accept-Encoding", "Expect", "Cookie",
+}
+
+// ExposeBatch serves batches of requests on the /batch path of the server, letting clients bundle several calls to
+// the server's APIs into a single round trip. A batch is an application/json POST with a JSON array of BatchRequest
+// objects, and is answered with a JSON array of their BatchResponse objects, in the same order. Other content types are
+// rejected with a 415, so browsers cannot send batches from other sites without a CORS preflight request.
+//
+// The sub-requests are dispatched one after the other through the server itself, so they run through the middleware,
+// security schemes and binding of their routes like any request. They carry the headers of the batch request (e.g. its
+// Authorization header) except its cookies, overridden by their own headers, and its context, so they are cancelled
+// with it. Batches of more than maxSize sub-requests (DefaultMaxBatchSize if it is 0), or with bodies larger than
+// MaxBatchBodySize, are rejected with a 413, as are sub-responses that exceed what is left of MaxBatchResponseSize
+func (s *Server) ExposeBatch(maxSize int) {
+
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBatchSize
+	}
+
+	s.router.POST(BatchPath, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		s.serveUnrouted(HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+			return s.serveBatch(w, r, maxSize)
+		}), w, r)
+	})
+}
+
+// batchKey marks the contexts of sub-requests, so batches cannot be nested
+type batchKey struct{}
+
+// serveBatch decodes a batch and runs its sub-requests
+func (s *Server) serveBatch(w http.ResponseWriter, r *Request, maxSize int) (interface{}, error) {
+
+	if r.Context().Value(batchKey{}) != nil {
+		return nil, InvalidRequestError("Batches cannot be nested")
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+		return nil, UnsupportedMediaTypeError("Batches must be sent as application/json")
+	}
+	if r.ContentLength > MaxBatchBodySize {
+		return nil, RequestEntityTooLargeError("Batch body is larger than %d bytes", MaxBatchBodySize)
+	}
+
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxBatchBodySize))
+	if err != nil {
+		if len(b) >= MaxBatchBodySize {
+			return nil, RequestEntityTooLargeError("Batch body is larger than %d bytes", MaxBatchBodySize)
+		}
+		return nil, InvalidRequestError("Could not read batch: %s", err)
+	}
+
+	var batch []BatchRequest
+	if err := json.Unmarshal(b, &batch); err != nil {
+		return nil, InvalidRequestError("Could not decode batch: %s", err)
+	}
+	if len(batch) > maxSize {
+		return nil, RequestEntityTooLargeError("Batch of %d requests exceeds the limit of %d", len(batch), maxSize)
+	}
+
+	ret := make([]BatchResponse, len(batch))
+	left := MaxBatchResponseSize
+	for i, br := range batch {
+		sub, err := s.newBatchRequest(r, br, i)
+		if err != nil {
+			ret[i] = batchErrorResponse(err)
+			continue
+		}
+
+		rec := &batchRecorder{ResponseRecorder: httptest.NewRecorder(), limit: left}
+		s.ServeHTTP(rec, sub)
+		if rec.exceeded {
+			logWarning("Response of batch request %d is larger than the %d bytes left of the batch", i, left)
+			ret[i] = batchErrorResponse(RequestEntityTooLargeError("Response is larger than the %d bytes left of the batch", left))
+			continue
+		}
+		left -= int64(rec.Body.Len())
+		ret[i] = newBatchResponse(rec.ResponseRecorder)
+	}
+
+	return ret, nil
+}
+
+// newBatchRequest creates the http request of the i-th sub-request of a batch
+func (s *Server) newBatchRequest(parent *Request, br BatchRequest, i int) (*http.Request, error) {
+
+	method := strings.ToUpper(br.Method)
+	if method == "" {
+		method = "GET"
+	}
+	if !strings.HasPrefix(br.Path, "/") {
+		return nil, InvalidParamError("Invalid path %q, it must be absolute", br.Path)
+	}
+	body, contentType := batchBody(br)
+	sub, err := http.NewRequest(method, br.Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, InvalidParamError("Invalid request: %s", err)
+	}
+	sub = sub.WithContext(context.WithValue(parent.Context(), batchKey{}, true))
+
+	for k, vals := range parent.Header {
+		sub.Header[k] = append([]string(nil), vals...)
+	}
+	for _, k := range batchSkippedHeaders {
+		sub.Header.Del(k)
+	}
+	if contentType != "" {
+		sub.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range br.Headers {
+		sub.Header.Set(k, v)
+	}
+
+	// sub-requests are logged with the id of the batch, cut so the id with its index is still a valid request id
+	id, suffix := parent.RequestId, fmt.Sprintf("-%d", i)
+	if len(id)+len(suffix) > maxRequestIdLength {
+		id = id[:maxRequestIdLength-len(suffix)]
+	}
+	sub.Header.Set(HeaderXRequestId, id+suffix)
+
+	sub.Host = parent.Host
+	sub.RemoteAddr = parent.RemoteAddr
+	sub.TLS = parent.TLS
+	return sub, nil
+}
+
+// batchBody returns the body of a sub-request and its default content type
+func batchBody(br BatchRequest) ([]byte, string) {
+
+	if len(br.Body) == 0 || string(br.Body) == "null" {
+		return nil, ""
+	}
+
+	// a string body with its own content type, e.g. a urlencoded form
+	var s string
+	for k, ct := range br.Headers {
+		if http.CanonicalHeaderKey(k) == "Content-Type" && !strings.Contains(ct, "json") {
+			if json.Unmarshal(br.Body, &s) == nil {
+				return []byte(s), ""
+			}
+		}
+	}
+
+	return br.Body, "application/json"
+}
+
+// batchRecorder records the response of a sub-request, up to a limit. Writes beyond the limit fail, and are dropped
+type batchRecorder struct {
+	*httptest.ResponseRecorder
+
+	limit    int64
+	exceeded bool
+}
+
+func (r *batchRecorder) Write(b []byte) (int, error) {
+	if r.exceeded || int64(r.Body.Len()+len(b)) > r.limit {
+		r.exceeded = true
+		return 0, errors.New("batch response size exceeded")
+	}
+	return r.ResponseRecorder.Write(b)
+}
+
+func (r *batchRecorder) WriteString(s string) (int, error) {
+	return r.Write([]byte(s))
+}
+
+// newBatchResponse converts the recorded response of a sub-request
+func newBatchResponse(rec *httptest.ResponseRecorder) BatchResponse {
+
+	ret := BatchResponse{
+		Status:  rec.Code,
+		Headers: make(map[string]string, len(rec.Header())),
+	}
+	for k := range rec.Header() {
+		if k != "Content-Length" {
+			ret.Headers[k] = rec.Header().Get(k)
+		}
+	}
+
+	body := bytes.TrimSpace(rec.Body.Bytes())
+	switch {
+	case len(body) == 0:
+	case json.Valid(body):
+		ret.Body = body
+	default:
+		ret.Body, _ = json.Marshal(string(body))
+	}
+
+	return ret
+}
+
+// batchErrorResponse is the response of a sub-request that could not be made
+func batchErrorResponse(err error) BatchResponse {
+	code, msg := httpError(err)
+	b, _ := json.Marshal(map[string]string{"error": msg})
+	return BatchResponse{Status: code, Body: b}
+}
@@ -0,0 +1,323 @@
+package vertex
+
+import (
+	"fmt"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	gorilla "github.com/gorilla/schema"
+
+	"github.com/EverythingMe/vertex/schema"
+)
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	fileHeaderType = reflect.TypeOf(&multipart.FileHeader{})
+)
+
+// paramBinder maps params the schema decoder cannot handle (params tagged with path, header, slices and the like) into
+// request handler fields. The schema decoder only knows the schema tag, so we map these ourselves
+type paramBinder struct {
+	params []schema.ParamInfo
+}
+
+func newParamBinder(ri schema.RequestInfo) *paramBinder {
+
+	ret := &paramBinder{
+		params: make([]schema.ParamInfo, 0),
+	}
+
+	for _, pi := range ri.Params {
+		if pi.CustomBind {
+			ret.params = append(ret.params, pi)
+		}
+	}
+
+	return ret
+}
+
+// schemaValues returns the form values that should be passed to the schema decoder. The decoder maps untagged fields by
+// their struct name, so we remove these keys to avoid clients setting our custom bound fields through the query string
+func (b *paramBinder) schemaValues(form url.Values) url.Values {
+
+	if len(b.params) == 0 {
+		return form
+	}
+
+	ret := make(url.Values, len(form))
+	for k, v := range form {
+		ret[k] = v
+	}
+
+	for _, pi := range b.params {
+		delete(ret, pi.StructKey)
+		// slice params are keyed by their schema name
+		if pi.In != "path" && pi.In != "header" {
+			delete(ret, pi.Name)
+		}
+	}
+
+	return ret
+}
+
+// values returns the raw values of a param from the request. Header names are case insensitive.
+// If the param has a separator, each value is split by it
+func (b *paramBinder) values(pi schema.ParamInfo, r *http.Request) []string {
+
+	var vals []string
+	switch {
+	case pi.In == "header":
+		vals = r.Header[http.CanonicalHeaderKey(pi.Name)]
+	case pi.In == "path" && PathParams(r) != nil:
+		// path params are taken from the router, so fields of the body cannot override the routed resource
+		if v, found := PathParams(r)[pi.Name]; found {
+			vals = []string{v}
+		}
+	default:
+		vals = r.Form[pi.Name]
+	}
+
+	if pi.Separator == "" {
+		return vals
+	}
+
+	ret := make([]string, 0, len(vals))
+	for _, v := range vals {
+		ret = append(ret, strings.Split(v, pi.Separator)...)
+	}
+	return ret
+}
+
+// bind maps the custom bound params of the request into the input struct. Params that cannot be converted are added to verr
+func (b *paramBinder) bind(input interface{}, r *http.Request, verr *ValidationError) error {
+
+	if len(b.params) == 0 {
+		return nil
+	}
+
+	val := reflect.ValueOf(input)
+	if val.Kind() != reflect.Ptr {
+		return fmt.Errorf("Cannot bind params into non pointer %s", val.Type())
+	}
+	val = val.Elem()
+
+	for _, pi := range b.params {
+
+		field := val.FieldByName(pi.StructKey)
+		if !field.IsValid() || !field.CanSet() {
+			continue
+		}
+
+		if pi.File {
+			if err := setFiles(field, multipartFiles(r, pi.Name)); err != nil {
+				logError("Could not bind %s: %s", pi.Name, err)
+				verr.add(pi.Name, InvalidParamError("Invalid value for %s", pi.Name))
+			}
+			continue
+		}
+
+		vals := b.values(pi, r)
+		if err := convertField(field, vals, pi.TimeFormat); err != nil {
+			msg := err.Error()
+			// conversion errors quote the values
+			if pi.Sensitive {
+				msg = redactString(msg, vals)
+			}
+			logDebug("Could not bind %s: %s", pi.Name, msg)
+			verr.add(pi.Name, InvalidParamError("Invalid value for %s", pi.Name))
+		}
+	}
+
+	return nil
+}
+
+// multipartFiles returns the files uploaded in a multipart form under a name, if the request has one
+func multipartFiles(r *http.Request, name string) []*multipart.FileHeader {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	return r.MultipartForm.File[name]
+}
+
+// setFiles sets uploaded files into a *multipart.FileHeader field, which gets the last file, or a slice field, which
+// gets them all
+func setFiles(field reflect.Value, files []*multipart.FileHeader) error {
+
+	if len(files) == 0 {
+		return nil
+	}
+
+	switch field.Type() {
+	case fileHeaderType:
+		field.Set(reflect.ValueOf(files[len(files)-1]))
+	case reflect.SliceOf(fileHeaderType):
+		field.Set(reflect.ValueOf(files))
+	default:
+		return fmt.Errorf("Cannot bind files into %s", field.Type())
+	}
+
+	return nil
+}
+
+// convertField sets a field from raw request values like setField, returning an error instead of panicking if the
+// values cannot be set, e.g. when an Unmarshaler panics or returns a value of another type
+func convertField(field reflect.Value, vals []string, layout string) (err error) {
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("Could not convert %q to %s: %v", vals, field.Type(), e)
+		}
+	}()
+
+	return setField(field, vals, layout)
+}
+
+// setField converts raw request values to the field's type and sets them. Like the schema decoder, a scalar field gets
+// the last value, and empty values leave the field untouched. A slice gets all the non empty values, so a param that was
+// sent empty yields an empty, non nil slice. Time values are parsed using the given layout
+func setField(field reflect.Value, vals []string, layout string) error {
+
+	if len(vals) == 0 {
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.Ptr:
+		v := reflect.New(field.Type().Elem())
+		if err := setField(v.Elem(), vals, layout); err != nil {
+			return err
+		}
+		field.Set(v)
+
+	case reflect.Slice:
+		lst := reflect.MakeSlice(field.Type(), 0, len(vals))
+		for _, s := range vals {
+			if s == "" {
+				continue
+			}
+
+			v := reflect.New(field.Type().Elem()).Elem()
+			if err := setValue(v, s, layout); err != nil {
+				return err
+			}
+			lst = reflect.Append(lst, v)
+		}
+		field.Set(lst)
+
+	default:
+		if s := vals[len(vals)-1]; s != "" {
+			return setValue(field, s, layout)
+		}
+	}
+
+	return nil
+}
+
+// unmarshalValue unmarshals a string with a custom Unmarshaler. Unmarshalers are user code, so their panics and return
+// values of other types than t are returned as errors
+func unmarshalValue(unm Unmarshaler, t reflect.Type, s string) (ret reflect.Value, err error) {
+
+	defer func() {
+		if e := recover(); e != nil {
+			ret, err = reflect.Value{}, fmt.Errorf("%s panicked unmarshaling %q: %v", t, s, e)
+		}
+	}()
+
+	ret = reflect.ValueOf(unm.UnmarshalRequestData(s))
+	if !ret.IsValid() || !ret.Type().AssignableTo(t) {
+		return reflect.Value{}, fmt.Errorf("%s did not unmarshal %q into a %s", t, s, t)
+	}
+	return ret, nil
+}
+
+// finiteFloat converts strings to floats of the given size for the schema decoder, which would accept NaN and
+// infinities, like setValue does
+func finiteFloat(bits int) gorilla.Converter {
+	return func(s string) reflect.Value {
+		f, err := strconv.ParseFloat(s, bits)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return reflect.Value{}
+		}
+		if bits == 32 {
+			return reflect.ValueOf(float32(f))
+		}
+		return reflect.ValueOf(f)
+	}
+}
+
+func init() {
+	schemaDecoder.RegisterConverter(float32(0), finiteFloat(32))
+	schemaDecoder.RegisterConverter(float64(0), finiteFloat(64))
+}
+
+// setValue parses a single string into a scalar value
+func setValue(v reflect.Value, s string, layout string) error {
+
+	if v.Type() == timeType {
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	if v.Kind() == reflect.Struct {
+		if unm, ok := reflect.Zero(v.Type()).Interface().(Unmarshaler); ok {
+			ret, err := unmarshalValue(unm, v.Type(), s)
+			if err != nil {
+				return err
+			}
+			v.Set(ret)
+			return nil
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		// NaN and infinities parse, but no client means to send them, and they cannot even be rendered in JSON
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("%q is not a finite number", s)
+		}
+		v.SetFloat(f)
+
+	default:
+		return fmt.Errorf("Unsupported type for binding: %s", v.Type())
+	}
+
+	return nil
+}
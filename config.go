@@ -1,15 +1,28 @@
 package vertex
 
 import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
 	"github.com/EverythingMe/gofigure"
 	"github.com/EverythingMe/gofigure/autoflag"
-	"github.com/dvirsky/go-pylog/logging"
 
 	"gopkg.in/yaml.v2"
 )
 
 type serverConfig struct {
-	// Listening address for the server, e.g. ":8080"
+	// Listening address for the server, e.g. ":8080", or "unix:/path/to.sock" to listen on a Unix domain socket
 	ListenAddr string `yaml:"listen"`
 
 	// Should we allow non http access to the API? use only on dev machines
@@ -23,6 +36,82 @@ type serverConfig struct {
 
 	// Disconnect idle clients after T seconds
 	ClientTimeout int `yaml:"client_timeout_sec"`
+
+	// Timeouts for reading requests, writing responses and keeping idle connections open, in seconds.
+	// Each defaults to the client timeout if not set
+	ReadTimeout  int `yaml:"read_timeout_sec"`
+	WriteTimeout int `yaml:"write_timeout_sec"`
+	IdleTimeout  int `yaml:"idle_timeout_sec"`
+
+	// The maximum size of the request headers, in bytes, passed to the http server. Zero means http.DefaultMaxHeaderBytes
+	MaxHeaderBytes int `yaml:"max_header_bytes"`
+
+	// Requests whose URL, or any single query value, is longer than these lengths (in bytes) are rejected, the former
+	// with 414 URI Too Long and the latter with 400 Bad Request. Zero means no limit
+	MaxURLLength        int `yaml:"max_url_length"`
+	MaxQueryValueLength int `yaml:"max_query_value_length"`
+
+	// Disable recording and exposing request metrics (see Server.ExposeMetrics)
+	DisableMetrics bool `yaml:"disable_metrics"`
+
+	// How paths with and without a trailing slash are routed [strict | redirect | equivalent], see TrailingSlashPolicy
+	TrailingSlash TrailingSlashPolicy `yaml:"trailing_slash"`
+
+	// Debug mode captures stack traces of errors, and the JSON renderer returns them to clients. Never use in production
+	Debug bool `yaml:"debug"`
+
+	// Comma separated routes (as defined, e.g. /users/{id}) whose request and response bodies are logged by the
+	// DebugCaptureMiddleware, or * for all routes
+	DebugCaptureRoutes string `yaml:"debug_capture_routes"`
+
+	// TLS certificate and key files. If both are set, the server is run over HTTPS
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
+
+	// Comma separated route tags (see Route.Tags) selecting the tagged routes that are registered. If IncludeTags is
+	// set, only tagged routes with one of its tags are registered, and routes with any of the ExcludeTags are never
+	// registered. Untagged routes are always registered
+	IncludeTags string `yaml:"include_tags"`
+	ExcludeTags string `yaml:"exclude_tags"`
+}
+
+// routeEnabled checks whether a route with the given tags is registered, by the IncludeTags and ExcludeTags settings
+func (c serverConfig) routeEnabled(tags []string) bool {
+
+	if len(tags) == 0 {
+		return true
+	}
+
+	include, exclude := splitTags(c.IncludeTags), splitTags(c.ExcludeTags)
+	included := len(include) == 0
+	for _, tag := range tags {
+		if exclude[tag] {
+			return false
+		}
+		if include[tag] {
+			included = true
+		}
+	}
+	return included
+}
+
+// splitTags splits a comma separated list of tags into a set
+func splitTags(s string) map[string]bool {
+	ret := map[string]bool{}
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			ret[tag] = true
+		}
+	}
+	return ret
+}
+
+// timeout converts a timeout setting to a duration, falling back to the client timeout if it is not set
+func (c serverConfig) timeout(sec int) time.Duration {
+	if sec <= 0 {
+		sec = c.ClientTimeout
+	}
+	return time.Duration(sec) * time.Second
 }
 
 // General-purpose to just protect some urls
@@ -37,19 +126,26 @@ type confType struct {
 	APIConfigs map[string]interface{} `yaml:"apis"`
 }
 
-var Config = struct {
+// configs are the server configs and the registered API configs, read by ReadConfigs
+type configs struct {
 	Server     serverConfig           `yaml:"server"`
 	Auth       authConfig             `yaml:"auth"`
 	APIConfigs map[string]interface{} `yaml:"apis,flow"`
 
 	apiconfs map[string]interface{}
-}{
+}
+
+// Config holds the configs read on startup by ReadConfigs. Reloaded configs are not written into it, see ServerConfig
+// and APIConfig
+var Config = configs{
 	Server: serverConfig{
 		ListenAddr:       ":9944",
 		AllowInsecure:    false,
 		ConsoleFilesPath: "../console",
 		LoggingLevel:     "INFO",
 		ClientTimeout:    60,
+		MaxHeaderBytes:   http.DefaultMaxHeaderBytes,
+		MaxURLLength:     8192,
 	},
 
 	Auth: authConfig{
@@ -67,41 +163,436 @@ var Config = struct {
 //		myApi:
 //			foo: bar
 func registerAPIConfig(name string, conf interface{}) {
+	apiConfigsLock.Lock()
+	defer apiConfigsLock.Unlock()
 	Config.apiconfs[name] = conf
 }
 
+// guards the registered API configs of Config, which may be registered while the configs are reloaded
+var apiConfigsLock sync.Mutex
+
+// ConfFlag is the command line flag holding the config file path. Several files can be passed separated by commas, and
+// they are merged in order (see ReadConfigFiles)
+const ConfFlag = "conf"
+
+// ReadConfigs reads the config files set by the conf flag into Config and the registered API configs, and applies
+// environment variable overrides to them (see EnvPrefix). API configs implementing ConfigValidator are then validated,
+// and an error listing all the invalid ones is returned
 func ReadConfigs() error {
+	return Config.read()
+}
+
+// read reads the config files set by the conf flag into the configs
+func (c *configs) read() error {
+
+	if f := flag.Lookup(ConfFlag); f != nil && strings.Contains(f.Value.String(), ",") {
+		return c.readFiles(strings.Split(f.Value.String(), ",")...)
+	}
+
+	if err := autoflag.Load(gofigure.DefaultLoader, c); err != nil {
+		logError("Error loading configs: %v", err)
+		return err
+	}
+	logInfo("Read configs: %#v", c)
+
+	return c.apply()
+
+}
+
+// ReadConfigFiles reads several config files, merged in order, into Config and the registered API configs. Later files
+// override the keys set in earlier ones, and nested sections (e.g. apis) are merged key by key, so an overlay file
+// only needs to contain the keys it changes
+func ReadConfigFiles(paths ...string) error {
+	return Config.readFiles(paths...)
+}
+
+func (c *configs) readFiles(paths ...string) error {
+
+	merged := map[interface{}]interface{}{}
+	for _, pth := range paths {
+
+		b, err := ioutil.ReadFile(strings.TrimSpace(pth))
+		if err != nil {
+			logError("Error loading configs: %v", err)
+			return err
+		}
+
+		m := map[interface{}]interface{}{}
+		if err := yaml.Unmarshal(b, &m); err != nil {
+			logError("Error parsing config file %s: %v", pth, err)
+			return err
+		}
+
+		mergeConfigs(merged, m)
+	}
+
+	b, err := yaml.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		logError("Error loading configs: %v", err)
+		return err
+	}
+	logInfo("Read configs: %#v", c)
+
+	return c.apply()
+}
+
+// mergeConfigs deep merges the src config map into dst. Maps are merged recursively, other values are replaced
+func mergeConfigs(dst, src map[interface{}]interface{}) {
+
+	for k, v := range src {
+		if sm, ok := v.(map[interface{}]interface{}); ok {
+			if dm, ok := dst[k].(map[interface{}]interface{}); ok {
+				mergeConfigs(dm, sm)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+// ConfigValidator is implemented by API config structs that can check their values after the configs are read, so
+// missing or invalid values fail the server on startup and not at request time
+type ConfigValidator interface {
+	Validate() error
+}
+
+// apply applies the config values read into the configs to the registered API configs and the environment overrides,
+// and validates the result
+func (c *configs) apply() error {
+
+	c.readAPIConfigs()
 
-	if err := autoflag.Load(gofigure.DefaultLoader, &Config); err != nil {
-		logging.Error("Error loading configs: %v", err)
+	if err := c.applyEnvOverrides(); err != nil {
 		return err
 	}
-	logging.Info("Read configs: %#v", &Config)
 
-	for k, m := range Config.APIConfigs {
+	return c.validateAPIConfigs()
+}
+
+// validateAPIConfigs validates all the registered API configs implementing ConfigValidator, returning an error listing
+// every invalid one
+func (c *configs) validateAPIConfigs() error {
+
+	names := make([]string, 0, len(c.apiconfs))
+	for name := range c.apiconfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, 0)
+	for _, name := range names {
+		if v, ok := c.apiconfs[name].(ConfigValidator); ok {
+			if err := v.Validate(); err != nil {
+				msgs = append(msgs, fmt.Sprintf("%s: %s", name, err))
+			}
+		}
+	}
+
+	if len(msgs) > 0 {
+		err := fmt.Errorf("Invalid API configs: %s", strings.Join(msgs, "; "))
+		logError("%s", err)
+		return err
+	}
 
-		if conf, found := Config.apiconfs[k]; found && conf != nil {
+	return nil
+}
+
+// readAPIConfigs copies the apis sections read from the config into the registered API configs
+func (c *configs) readAPIConfigs() {
+
+	for k, m := range c.APIConfigs {
+
+		if conf, found := c.apiconfs[k]; found && conf != nil {
 
 			b, err := yaml.Marshal(m)
 			if err == nil {
 
 				if err := yaml.Unmarshal(b, conf); err != nil {
-					logging.Error("Error reading config for API %s: %s", k, err)
+					logError("Error reading config for API %s: %s", k, err)
 				} else {
-					logging.Debug("Unmarshaled API config for %s: %#v", k, conf)
+					logDebug("Unmarshaled API config for %s: %#v", k, conf)
 				}
 
 			} else {
 
-				logging.Error("Error marshalling config for API %s: %s", k, err)
+				logError("Error marshalling config for API %s: %s", k, err)
 
 			}
 		} else {
-			logging.Warning("API Section %s in config file not registered with server", k)
+			logWarning("API Section %s in config file not registered with server", k)
 		}
 
 	}
+}
+
+var reloadLock sync.Mutex
+var reloadCallbacks []func()
+var configVersion int64
+
+// ConfigVersion returns the number of times the configs have been reloaded. Handlers caching values derived from their
+// config can compare it to the version they have seen, instead of registering a callback
+func ConfigVersion() int64 {
+	return atomic.LoadInt64(&configVersion)
+}
+
+// OnConfigReload registers a callback called after the configs are reloaded, e.g. to rebuild values derived from an API
+// config struct
+func OnConfigReload(f func()) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	reloadCallbacks = append(reloadCallbacks, f)
+}
 
+// the last reloaded configs, or nil if the configs were not reloaded
+var reloadedConfigs atomic.Value
+
+func currentConfigs() *configs {
+	if c, _ := reloadedConfigs.Load().(*configs); c != nil {
+		return c
+	}
+	return &Config
+}
+
+// ServerConfig returns the current server config, that is the last reloaded one (see ReloadConfigs), or Config.Server if
+// the configs were not reloaded. Code reading settings that may change while the server runs should use it
+func ServerConfig() serverConfig {
+	return currentConfigs().Server
+}
+
+// APIConfig returns the current config struct of an API, registered with Register or Registry.Register. After the
+// configs are reloaded, it returns a new struct with the reloaded values, while the registered struct keeps the values
+// read on startup. It returns nil if no config is registered under the name
+func APIConfig(name string) interface{} {
+	if c, _ := reloadedConfigs.Load().(*configs); c != nil {
+		if conf, found := c.apiconfs[name]; found {
+			return conf
+		}
+	}
+
+	apiConfigsLock.Lock()
+	defer apiConfigsLock.Unlock()
+	return Config.apiconfs[name]
+}
+
+// ReloadConfigs re-reads the config files and notifies the reload callbacks, and returns an error (keeping the current
+// configs) if they cannot be read or are invalid.
+//
+// Since handlers may be reading the configs, they are never modified: the configs are read into copies of the current
+// config structs, which are then swapped in at once, and are returned by ServerConfig and APIConfig. Config and the
+// registered config structs keep the values read on startup, and server settings like the listen address do not take
+// effect until the server is restarted
+func ReloadConfigs() error {
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	next := currentConfigs().clone()
+	if err := next.read(); err != nil {
+		return err
+	}
+	reloadedConfigs.Store(next)
+
+	atomic.AddInt64(&configVersion, 1)
+	logInfo("Reloaded configs, version %d", ConfigVersion())
+
+	for _, f := range reloadCallbacks {
+		f()
+	}
 	return nil
+}
+
+// ReloadConfigsOnHUP installs a SIGHUP handler reloading the configs (see ReloadConfigs). Reload errors are logged,
+// keeping the current configs. It returns a func that uninstalls the handler
+func ReloadConfigsOnHUP() (stop func()) {
+
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case <-ch:
+				if err := ReloadConfigs(); err != nil {
+					logError("Could not reload configs: %s", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+// clone returns a deep copy of the configs, so configs can be read into it while the original is in use. API configs
+// registered since the configs were last reloaded are copied from Config
+func (c *configs) clone() *configs {
+
+	apiConfigsLock.Lock()
+	defer apiConfigsLock.Unlock()
+
+	ret := *c
+	ret.Server = copyValue(reflect.ValueOf(c.Server)).Interface().(serverConfig)
+	ret.APIConfigs = map[string]interface{}{}
+	ret.apiconfs = make(map[string]interface{}, len(Config.apiconfs))
+
+	for name, conf := range Config.apiconfs {
+		if current, found := c.apiconfs[name]; found {
+			conf = current
+		}
+		if conf != nil {
+			conf = copyValue(reflect.ValueOf(conf)).Interface()
+		}
+		ret.apiconfs[name] = conf
+	}
+
+	return &ret
+}
+
+// copyValue returns a deep copy of a config value. Unexported struct fields are copied as they are
+func copyValue(v reflect.Value) reflect.Value {
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		ret := reflect.New(v.Elem().Type())
+		ret.Elem().Set(copyValue(v.Elem()))
+		return ret
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		ret := reflect.New(v.Type()).Elem()
+		ret.Set(copyValue(v.Elem()))
+		return ret
+	case reflect.Struct:
+		ret := reflect.New(v.Type()).Elem()
+		ret.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if ret.Field(i).CanSet() {
+				ret.Field(i).Set(copyValue(v.Field(i)))
+			}
+		}
+		return ret
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		ret := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, k := range v.MapKeys() {
+			ret.SetMapIndex(k, copyValue(v.MapIndex(k)))
+		}
+		return ret
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		ret := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			ret.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return ret
+	}
+
+	return v
+}
+
+// EnvPrefix is the prefix of environment variables overriding config values
+const EnvPrefix = "VERTEX"
+
+// applyEnvOverrides overrides config values with environment variables, after the config file has been read.
+//
+// The variable name of a value is underscore separated path of its yaml keys in upper case, prefixed by VERTEX. e.g.
+// VERTEX_SERVER_LISTEN overrides the server's listen address, and VERTEX_APIS_MYAPI_FOO overrides the foo key of the
+// registered config of myApi. Slice values are comma separated
+func (c *configs) applyEnvOverrides() error {
+
+	val := reflect.ValueOf(c).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Type().Field(i)
+		if field.Type.Kind() != reflect.Struct {
+			continue
+		}
+
+		if err := applyEnv(envName(EnvPrefix, yamlKey(field)), val.Field(i)); err != nil {
+			return err
+		}
+	}
+
+	for name, conf := range c.apiconfs {
+		v := reflect.ValueOf(conf)
+		if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			continue
+		}
+
+		if err := applyEnv(envName(EnvPrefix, "apis", name), v.Elem()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyEnv recursively sets the fields of a config struct from the environment variables named after them
+func applyEnv(prefix string, val reflect.Value) error {
+
+	for i := 0; i < val.NumField(); i++ {
+
+		field := val.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		key := yamlKey(field)
+		if key == "-" {
+			continue
+		}
+		name := envName(prefix, key)
+
+		if field.Type.Kind() == reflect.Struct && field.Type != timeType {
+			if err := applyEnv(name, val.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, found := os.LookupEnv(name)
+		if !found {
+			continue
+		}
+
+		vals := []string{s}
+		if field.Type.Kind() == reflect.Slice {
+			vals = strings.Split(s, ",")
+		}
+
+		if err := setField(val.Field(i), vals, time.RFC3339); err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", name, err)
+		}
+		logDebug("Config value %s overridden from environment", name)
+	}
+
+	return nil
+}
+
+// yamlKey returns the key of a struct field in yaml, which is the lower cased field name if it has no yaml tag
+func yamlKey(field reflect.StructField) string {
+	if key := strings.Split(field.Tag.Get("yaml"), ",")[0]; key != "" {
+		return key
+	}
+	return strings.ToLower(field.Name)
+}
 
+// envName joins config keys to an environment variable name
+func envName(parts ...string) string {
+	return strings.ToUpper(strings.Join(parts, "_"))
 }
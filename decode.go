@@ -0,0 +1,184 @@
+package vertex
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// BodyDecoder decodes request bodies of a content type into param values, which are mapped and validated exactly
+// like query and form params. Errors returned by decoders are returned to the client, so they should be created with
+// InvalidParamError.
+//
+// Decoders are registered by content type with RegisterBodyDecoder, mirroring the renderers of responses
+type BodyDecoder interface {
+	DecodeBody(body []byte) (map[string][]string, error)
+}
+
+// BodyDecoderFunc is an adapter for using functions as body decoders
+type BodyDecoderFunc func(body []byte) (map[string][]string, error)
+
+// DecodeBody calls the function
+func (f BodyDecoderFunc) DecodeBody(body []byte) (map[string][]string, error) {
+	return f(body)
+}
+
+var (
+	bodyDecodersLock sync.RWMutex
+	bodyDecoders     = map[string]BodyDecoder{
+		"application/json":      BodyDecoderFunc(decodeJSONBody),
+		"application/x-msgpack": BodyDecoderFunc(decodeMsgpackBody),
+		"application/msgpack":   BodyDecoderFunc(decodeMsgpackBody),
+	}
+)
+
+// RegisterBodyDecoder registers a decoder for request bodies of a content type (e.g. "text/yaml"), replacing the
+// decoder registered for it if there is one. JSON and MessagePack decoders are registered by default
+func RegisterBodyDecoder(contentType string, d BodyDecoder) {
+	bodyDecodersLock.Lock()
+	defer bodyDecodersLock.Unlock()
+
+	bodyDecoders[strings.ToLower(contentType)] = d
+}
+
+// bodyDecoder returns the decoder registered for a content type, or nil if there is none
+func bodyDecoder(contentType string) BodyDecoder {
+	bodyDecodersLock.RLock()
+	defer bodyDecodersLock.RUnlock()
+
+	return bodyDecoders[strings.ToLower(contentType)]
+}
+
+// formContentTypes are the content types of form bodies, which are parsed into params without a decoder
+var formContentTypes = []string{"application/x-www-form-urlencoded", "multipart/form-data"}
+
+// DecodableContentTypes returns the content types of request bodies that are bound into params: the form content
+// types, and those with a registered BodyDecoder
+func DecodableContentTypes() []string {
+	bodyDecodersLock.RLock()
+	defer bodyDecodersLock.RUnlock()
+
+	ret := append([]string{}, formContentTypes...)
+	for ct := range bodyDecoders {
+		ret = append(ret, ct)
+	}
+	sort.Strings(ret[len(formContentTypes):])
+	return ret
+}
+
+// decodable checks whether request bodies of a content type are bound into params
+func decodable(contentType string) bool {
+	for _, ct := range formContentTypes {
+		if strings.EqualFold(ct, contentType) {
+			return true
+		}
+	}
+	return bodyDecoder(contentType) != nil
+}
+
+// mediaTypeMatches checks whether a media type matches an accepted content type, which may be a wildcard like text/*
+func mediaTypeMatches(accepted, mediaType string) bool {
+	accepted = strings.ToLower(accepted)
+	if strings.HasSuffix(accepted, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(accepted, "*"))
+	}
+	return accepted == mediaType
+}
+
+// checkContentType rejects POST and PUT requests with a body whose content type is not one of the accepted types.
+// If no types are accepted explicitly, anything is
+func checkContentType(r *http.Request, accepted []string) error {
+
+	if len(accepted) == 0 || (r.Method != "POST" && r.Method != "PUT") {
+		return nil
+	}
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil
+	}
+
+	ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil {
+		ct = strings.ToLower(ct)
+		for _, a := range accepted {
+			if mediaTypeMatches(a, ct) {
+				return nil
+			}
+		}
+	}
+
+	return UnsupportedMediaTypeError("Unsupported content type '%s', expected one of: %s", r.Header.Get("Content-Type"),
+		strings.Join(accepted, ", "))
+}
+
+// decodeJSONBody decodes the top level fields of a JSON object body
+func decodeJSONBody(body []byte) (map[string][]string, error) {
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, InvalidParamError("Error decoding JSON body: %s", err)
+	}
+
+	ret := make(map[string][]string, len(fields))
+	for k, raw := range fields {
+		vals, err := jsonFormValues(raw)
+		if err != nil {
+			return nil, InvalidParamError("Error decoding JSON field '%s': %s", k, err)
+		}
+		ret[k] = vals
+	}
+
+	return ret, nil
+}
+
+// decodeMsgpackBody decodes the top level fields of a MessagePack map body. The values are converted like JSON values
+// (see jsonFormValues), so both bodies bind the same way
+func decodeMsgpackBody(body []byte) (map[string][]string, error) {
+
+	var fields map[string]interface{}
+	if err := msgpack.Unmarshal(body, &fields); err != nil {
+		return nil, InvalidParamError("Error decoding MessagePack body: %s", err)
+	}
+
+	ret := make(map[string][]string, len(fields))
+	for k, v := range fields {
+		raw, err := json.Marshal(jsonCompatible(v))
+		if err != nil {
+			return nil, InvalidParamError("Error decoding MessagePack field '%s': %s", k, err)
+		}
+
+		if ret[k], err = jsonFormValues(raw); err != nil {
+			return nil, InvalidParamError("Error decoding MessagePack field '%s': %s", k, err)
+		}
+	}
+
+	return ret, nil
+}
+
+// jsonCompatible converts the generic maps MessagePack decodes nested maps to into maps JSON can encode
+func jsonCompatible(v interface{}) interface{} {
+
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(x))
+		for k, val := range x {
+			ret[fmt.Sprint(k)] = jsonCompatible(val)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(x))
+		for i, val := range x {
+			ret[i] = jsonCompatible(val)
+		}
+		return ret
+	case []byte:
+		return string(x)
+	}
+
+	return v
+}
@@ -0,0 +1,244 @@
+package vertex
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"reflect"
+	"time"
+
+	"github.com/EverythingMe/vertex/schema"
+	"github.com/julienschmidt/httprouter"
+)
+
+// DescribePath is the path of the server endpoint listing all the APIs and their routes as JSON, served by
+// Server.ExposeDescribe
+const DescribePath = "/describe"
+
+// SchemaPath is the path prefix of the server endpoint serving the schema of a single route as JSON, served by
+// Server.ExposeDescribe. The route is given by its full definition, e.g. /schema/myapi/1.0/users/{id}
+const SchemaPath = "/schema"
+
+// APIDescription is a machine readable description of an API and its routes, e.g. for generating client code.
+// The JSON field names are kept stable
+type APIDescription struct {
+	Name    string             `json:"name"`
+	Title   string             `json:"title"`
+	Version string             `json:"version"`
+	Root    string             `json:"root"`
+	Doc     string             `json:"doc"`
+	Routes  []RouteDescription `json:"routes"`
+}
+
+// RouteDescription describes a single route of an API
+type RouteDescription struct {
+	Path        string             `json:"path"`
+	Methods     []string           `json:"methods"`
+	Description string             `json:"description"`
+	Params      []ParamDescription `json:"params"`
+	Deprecated  bool               `json:"deprecated"`
+	Sunset      string             `json:"sunset,omitempty"`
+}
+
+// ParamDescription describes a single param bound into a route's handler
+type ParamDescription struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Type        string      `json:"type"`
+	Items       string      `json:"items,omitempty"`
+	Format      string      `json:"format,omitempty"`
+	Description string      `json:"description"`
+	Required    bool        `json:"required"`
+	Default     interface{} `json:"default,omitempty"`
+	Options     []string    `json:"options,omitempty"`
+	Min         *float64    `json:"min,omitempty"`
+	Max         *float64    `json:"max,omitempty"`
+	MinLength   int         `json:"min_length,omitempty"`
+	MaxLength   int         `json:"max_length,omitempty"`
+	Pattern     string      `json:"pattern,omitempty"`
+}
+
+// RouteSchema is a lightweight description of the input a route expects: the params bound into its handler, their
+// types, whether they are required and where they are read from (query, path, header or body)
+type RouteSchema struct {
+	API     string             `json:"api"`
+	Path    string             `json:"path"`
+	Methods []string           `json:"methods"`
+	Params  []ParamDescription `json:"params"`
+}
+
+// methodNames returns the HTTP method names set in the flag
+func (f MethodFlag) methodNames() []string {
+	ret := make([]string, 0, len(methodFlags))
+	for _, m := range methodFlags {
+		if f&m.flag == m.flag {
+			ret = append(ret, m.name)
+		}
+	}
+	return ret
+}
+
+func describeParam(p schema.ParamInfo) ParamDescription {
+	ret := ParamDescription{
+		Name:        p.Name,
+		In:          p.In,
+		Format:      p.Format,
+		Description: p.Description,
+		Required:    p.Required,
+		Options:     p.Options,
+		MinLength:   p.MinLength,
+		MaxLength:   p.MaxLength,
+		Pattern:     p.Pattern,
+	}
+
+	if p.HasDefault {
+		ret.Default = p.Default
+	}
+	if p.HasMin {
+		min := p.Min
+		ret.Min = &min
+	}
+	if p.HasMax {
+		max := p.Max
+		ret.Max = &max
+	}
+
+	tp, items := p.SwaggerType()
+	ret.Type, ret.Items = string(tp), string(items)
+	return ret
+}
+
+// Describe returns a description of the API and its routes. The routes' params are only known after the API has been
+// added to a server
+func (a *API) Describe() APIDescription {
+
+	ret := APIDescription{
+		Name:    a.Name,
+		Title:   a.Title,
+		Version: a.Version,
+		Root:    a.root(),
+		Doc:     a.Doc,
+		Routes:  make([]RouteDescription, 0, len(a.Routes)),
+	}
+
+	for _, route := range a.Routes {
+		rd := RouteDescription{
+			Path:        route.Path,
+			Methods:     route.Methods.methodNames(),
+			Description: route.Description,
+			Params:      make([]ParamDescription, 0, len(route.requestInfo.Params)),
+			Deprecated:  route.Deprecated,
+		}
+		if route.Deprecated && !route.Sunset.IsZero() {
+			rd.Sunset = route.Sunset.UTC().Format(time.RFC3339)
+		}
+
+		for _, p := range route.requestInfo.Params {
+			if !p.Hidden {
+				rd.Params = append(rd.Params, describeParam(p))
+			}
+		}
+
+		ret.Routes = append(ret.Routes, rd)
+	}
+
+	return ret
+}
+
+// Schema reflects over the handler of the route, and describes the params it binds. Unlike Describe, it does not need
+// the API to be configured. Routes with per-method Handlers are described by their shared Handler, and each of their
+// handlers is described once the API is configured (see Server.RouteSchemas)
+func (r Route) Schema() (RouteSchema, error) {
+
+	if r.Handler == nil {
+		return RouteSchema{}, errors.New("Route has no handler")
+	}
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(r.Handler), r.Path, r.Description, r.Returns)
+	if err != nil {
+		return RouteSchema{}, err
+	}
+
+	ret := RouteSchema{
+		Path:    r.Path,
+		Methods: r.Methods.methodNames(),
+		Params:  make([]ParamDescription, 0, len(ri.Params)),
+	}
+	for _, p := range ri.Params {
+		if !p.Hidden {
+			ret.Params = append(ret.Params, describeParam(p))
+		}
+	}
+
+	return ret, nil
+}
+
+// RouteSchemas returns the schemas of the routes of the server's APIs with the given full definition, e.g.
+// /myapi/1.0/users/{id}. There is a schema per method handler of the route
+func (s *Server) RouteSchemas(pth string) []RouteSchema {
+
+	var ret []RouteSchema
+	for _, a := range s.apis {
+		for _, route := range a.Routes {
+			if path.Join(a.root(), route.Path) != pth {
+				continue
+			}
+
+			rs, err := route.Schema()
+			if err != nil {
+				logError("Could not describe route %s: %s", pth, err)
+				continue
+			}
+			rs.API = a.Name
+			ret = append(ret, rs)
+		}
+	}
+
+	return ret
+}
+
+// schemaHandler serves the schemas of a single route as JSON
+func (s *Server) schemaHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+
+	schemas := s.RouteSchemas(p.ByName("route"))
+	if len(schemas) == 0 {
+		code, msg := httpError(NotFoundError("No route %s", p.ByName("route")))
+		http.Error(w, msg, code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(schemas); err != nil {
+		code, msg := httpError(NewError(err))
+		http.Error(w, msg, code)
+	}
+}
+
+// Describe returns a description of all the APIs added to the server
+func (s *Server) Describe() []APIDescription {
+	ret := make([]APIDescription, 0, len(s.apis))
+	for _, a := range s.apis {
+		ret = append(ret, a.Describe())
+	}
+	return ret
+}
+
+// ExposeDescribe serves the description of all the APIs of the server as JSON on the /describe path of the server,
+// and the schemas of single routes under the /schema path. They are not served by default, since they bypass the
+// middleware and security of the APIs, and list all their routes and params.
+//
+// The /schema path takes all the paths under it, so it cannot be exposed on servers with an API rooted at /schema
+func (s *Server) ExposeDescribe() {
+	s.router.GET(DescribePath, s.describeHandler)
+	s.router.GET(SchemaPath+"/*route", s.schemaHandler)
+}
+
+// describeHandler serves the description of the server's APIs as JSON
+func (s *Server) describeHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Describe()); err != nil {
+		code, msg := httpError(NewError(err))
+		http.Error(w, msg, code)
+	}
+}
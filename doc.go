@@ -52,6 +52,18 @@
 //
 // As you can see, the "id" parameter that is received as a post/get/path parameter is automatically parsed into the struct when the handler
 // is invoked. If it is missing or invalid, the handler won't even be invoked, but an error will be generated to the client.
+// All the invalid params of a request are reported together, in a ValidationError (rendered by JSONRenderer as an "errors" array).
+// Rules involving more than one param can be checked by implementing ValidatingHandler - its Validate method is called
+// after the params are validated, before the request is handled.
+//
+// POST and PUT requests with an "application/json" content type can send their parameters as the fields of a JSON object body.
+// They are mapped and validated just like normal form parameters, and a body that cannot be decoded fails with a 400 error.
+// Routes can limit the content types of the bodies they accept with Consumes, rejecting other bodies with a 415 error
+// before the handler is invoked.
+//
+// The context of a request (r.Context()) is cancelled when the client disconnects, when a TimeoutMiddleware's timeout
+// fires, and when the requests in flight are cancelled by a server shutting down. Long running handlers should pass it
+// to downstream calls, or check it and return early. Nothing is written for requests whose client is gone.
 //
 // Handler Field Tags List
 //
@@ -62,12 +74,19 @@
 //  - default - the default value for the parameter in case it's missing
 //  - min - the minimum allowed value for numeric fields (inclusive)
 //  - max - the maximum allowed value for numeric fields (inclusive)
-//  - maxlen - the maximal allowed length for strings
-//  - minlen - the minimal allowed length for strings
+//  - maxlen - the maximal allowed length (in characters) for strings
+//  - minlen - the minimal allowed length (in characters) for strings
 //  - required [true/false] - if set to "true", forces the request to have this parameter set
 //  - allowEmpty [true/false] - do we allow empty values?
 //  - pattern - a regular expression that a string must match if this tag is set
 //  - in [query/body/path] - optional for non path params. mainly for documentation needs
+//  - path - the name of a path parameter (e.g. "id" for "/users/{id}") mapped to this field
+//  - header - the name of a request header mapped to this field (case insensitive)
+//  - sep - a separator for splitting a single value into a slice field (e.g. "," for "a,b,c")
+//  - time_format - the layout for parsing time.Time fields (e.g. "2006-01-02"). Defaults to RFC3339
+//  - sensitive [true|false] - the value is secret (e.g. a password), and is masked in error messages and logs
+//  - file - the name of a file uploaded in a multipart form, mapped to a *multipart.FileHeader field (or a slice of them)
+//  - in [a,b,c] - a comma separated list of allowed values for string and int fields
 //
 //  TODO: Support min/max length for string lists
 //
@@ -147,7 +166,7 @@
 //		// The routes of the API
 //		Routes: vertex.RouteMap{
 //
-//			// Path parameters are defined as {param}
+//			// Path parameters are defined as {param}. A last {param:*} segment catches the rest of the path
 //			"/user/byId/{id}": {
 //
 //				// Short request description
@@ -169,6 +188,14 @@
 //		},
 //	}
 //
+// Routes handling GET also serve HEAD requests, by running the GET handler and discarding the response body while
+// keeping its headers. Set NoHead on routes whose handlers have side effects.
+// OPTIONS requests to paths with no OPTIONS route are answered with a 204 and the allowed methods in the Allow header
+// (see Server.SetOptionsHandler).
+//
+// Routes that should only be registered in some environments, e.g. debug routes or beta features, can be marked with
+// Tags. The include_tags and exclude_tags server configs select the tagged routes that are registered.
+//
 // Security Schemes
 //
 // Security Schemes are used to validate requests. The scheme simply receives the request, and returns an error if it is not valid.
@@ -181,21 +208,56 @@
 //  - Auto Recover from panic in handlers
 //  - Request Logging
 //  - OAuth authentication
+//  - JWT bearer token authentication
 //  - IP-range filter
 //  - Simple API Key validation
 //  - HTTP Basic Auth
 //  - Response Caching
 //  - Force Secure (https) Access
+//  - Per client rate limiting
+//  - Gzip compression
+//  - Request timeouts
+//  - ETags and conditional GET requests
+//  - Prometheus metrics
+//  - OpenTelemetry tracing
+//  - Request body size limits
+//  - Concurrency limits with queueing
+//  - Request and response body capture for debugging
+//
+// The middleware of a route runs in this order: the API's Middleware, the middleware of the route's groups (outer
+// groups first), the route's own Middleware, and last the API's InnerMiddleware, right before the handler.
+// API.UseFirst and API.UseLast insert middleware at the front and back of every chain, and API.RouteChain returns the
+// resolved chain of a route.
+//
+// Handlers are bound after the chain ran, so middleware cannot touch their params. Middleware implementing PreBinder or
+// PostBinder get the handler instance of the request before its params are bound (e.g. to set defaults) or after they
+// are bound and validated (e.g. to set a tenant id), and PreBindFunc and PostBindFunc make such middleware of a func.
 //
 // Renderers
 //
 // Responses have renderers - that transform the response object to some serialization format.
 //
-// The default is of course JSON, but an HTML renderer using templates also exists.
+// The default is of course JSON, but XML, MessagePack, CSV and HTML (using templates, see TemplateRenderer) renderers also exist.
+// A NegotiatingRenderer can be used to select between renderers by the request's Accept header.
+// Large responses can be returned as a Stream, which StreamRenderer writes as a JSON array element by element.
+// Handlers with nothing to return can return NoContent, which is written as an empty 204 No Content response.
+// Handlers succeeding with another status, e.g. 201 Created, can return their response in a StatusResponse.
+// Handlers returning an io.Reader (e.g. a file or an upstream response body) have it streamed to the client as is.
+// Returning a FileResponse streams a reader as a file download, with a Content-Disposition header.
+// A JSONRenderer with Envelope set wraps successful and failed responses alike in an Envelope object, with the error code,
+// error string, processing time and request id next to the response object.
+// Handlers with an already serialized JSON response (e.g. a cached one) can return it as RawJSON, which the JSONRenderer
+// writes as is instead of marshaling it again.
 //
 // Running The Server
 //
-// TODO
+// Server.ExposeDescribe serves a /describe endpoint listing all the APIs of the server and their routes and params as
+// JSON, e.g. for generating client code, and the schema of each route under /schema. They bypass the middleware and
+// security of the APIs, so they are not served by default.
+//
+// Server.ExposeBatch serves a /batch endpoint, letting clients bundle several requests to the server's APIs into a
+// single round trip. Each sub-request is dispatched through the server itself, with the headers (except cookies) and
+// context of the batch request, and gets its own status in the response. Batches must be sent as application/json.
 //
 // Integration Tests
 //
@@ -3,15 +3,44 @@ package vertex
 import (
 	"fmt"
 	"net/http"
+	"runtime/debug"
+	"strings"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
-	"github.com/dvirsky/go-pylog/logging"
 )
 
 type internalError struct {
 	Message string
 	Code    int
+
+	// the error this error wraps, if any
+	cause error
+
+	// the stack trace of the error's creation, captured only in debug mode
+	stack string
+
+	// how long clients should wait before retrying a retryable error, if known
+	retryAfter time.Duration
+
+	// the values of sensitive params were already masked in the message
+	redacted bool
+}
+
+// captureStack returns the current stack trace if the server is in debug mode
+func captureStack() string {
+	if !ServerConfig().Debug {
+		return ""
+	}
+	return string(debug.Stack())
+}
+
+// errorStack returns the stack trace captured when an error was created, if any
+func errorStack(err error) string {
+	if e, ok := err.(*internalError); ok {
+		return e.stack
+	}
+	return ""
 }
 
 const (
@@ -45,6 +74,39 @@ const (
 	// Some middleware took over the request, and the renderer should not render the response
 	ErrHijacked
 
+	// The client has sent too many requests, and should retry later
+	ErrTooManyRequests
+
+	// The request took too long to handle
+	ErrTimeout
+
+	// The requested resource does not exist
+	ErrNotFound
+
+	// The client is not allowed to access the resource, and logging in will not help
+	ErrForbidden
+
+	// The request conflicts with the current state of the resource
+	ErrConflict
+
+	// The request is well formed, but its content cannot be processed
+	ErrUnprocessableEntity
+
+	// The path exists, but does not support the request's method
+	ErrMethodNotAllowed
+
+	// The request body is larger than the server allows
+	ErrRequestEntityTooLarge
+
+	// A transient failure, e.g. of a backend service. The client may safely retry the request later
+	ErrRetryable
+
+	// The URL of the request is longer than the server allows
+	ErrURITooLong
+
+	// The content type of the request body is not accepted by the route
+	ErrUnsupportedMediaType
+
 	insecureAccessMessage = "Insecure http Access not allowed"
 )
 
@@ -57,13 +119,24 @@ func httpError(err error) (re int, rm string) {
 
 	incidentId := uuid.New()
 	if err != Hijacked {
-		logging.Error("[%s] Error processing request: %s", incidentId, err)
+		logError("[%s] Error processing request: %s", incidentId, err)
+		// the causes of redacted errors are not logged, since they are not redacted
+		if e, ok := err.(*internalError); ok && e.cause != nil && !e.redacted && e.cause.Error() != e.Message {
+			logError("[%s] Caused by: %s", incidentId, e.cause)
+		}
+		if stack := errorStack(err); stack != "" {
+			logError("[%s] Error created at:\n%s", incidentId, stack)
+		}
 	}
 
 	statusFunc := func(i int) (int, string) {
 		return i, fmt.Sprintf("[%s] %s", incidentId, http.StatusText(i))
 	}
 
+	if e, ok := err.(*ValidationError); ok {
+		return http.StatusBadRequest, e.Error()
+	}
+
 	if e, ok := err.(*internalError); !ok {
 		return statusFunc(http.StatusInternalServerError)
 	} else {
@@ -83,8 +156,28 @@ func httpError(err error) (re int, rm string) {
 			return statusFunc(http.StatusForbidden)
 		case ErrResourceUnavailable:
 			return statusFunc(http.StatusServiceUnavailable)
-		case ErrBackOff:
+		case ErrBackOff, ErrRetryable:
 			return statusFunc(http.StatusServiceUnavailable)
+		case ErrTooManyRequests:
+			return statusFunc(http.StatusTooManyRequests)
+		case ErrTimeout:
+			return statusFunc(http.StatusGatewayTimeout)
+		case ErrNotFound:
+			return http.StatusNotFound, e.Message
+		case ErrForbidden:
+			return http.StatusForbidden, e.Message
+		case ErrConflict:
+			return http.StatusConflict, e.Message
+		case ErrUnprocessableEntity:
+			return http.StatusUnprocessableEntity, e.Message
+		case ErrMethodNotAllowed:
+			return http.StatusMethodNotAllowed, e.Message
+		case ErrRequestEntityTooLarge:
+			return http.StatusRequestEntityTooLarge, e.Message
+		case ErrURITooLong:
+			return http.StatusRequestURITooLong, e.Message
+		case ErrUnsupportedMediaType:
+			return http.StatusUnsupportedMediaType, e.Message
 		case ErrGeneralFailure:
 			fallthrough
 		default:
@@ -118,6 +211,7 @@ func newErrorCode(code int, msg string) error {
 	return &internalError{
 		Message: msg,
 		Code:    code,
+		stack:   captureStack(),
 	}
 }
 
@@ -126,16 +220,36 @@ func newErrorfCode(code int, format string, args ...interface{}) error {
 	return &internalError{
 		Message: fmt.Sprintf(format, args...),
 		Code:    code,
+		stack:   captureStack(),
 	}
 }
 
 // Wrap a normal error object with an internal object
 func NewError(err error) error {
 
-	if _, ok := err.(*internalError); ok {
+	switch err.(type) {
+	case *internalError, *ValidationError:
 		return err
-	} else {
-		return newErrorCode(ErrGeneralFailure, err.Error())
+	default:
+		return wrapError(err, ErrGeneralFailure, err.Error())
+	}
+}
+
+// WrapError wraps an error with an error code and a message, keeping it as the cause of the returned error, so it can
+// be inspected with errors.Is and errors.As.
+//
+// NOTE: Like the message of the other errors, the message may be returned to the client. The wrapped error is only
+// logged, since its message may expose internals, e.g. a database error
+func WrapError(err error, code int, msg string, args ...interface{}) error {
+	return wrapError(err, code, fmt.Sprintf(msg, args...))
+}
+
+func wrapError(err error, code int, msg string) *internalError {
+	return &internalError{
+		Message: msg,
+		Code:    code,
+		cause:   err,
+		stack:   captureStack(),
 	}
 }
 
@@ -144,6 +258,7 @@ func NewErrorf(format string, args ...interface{}) error {
 	return &internalError{
 		Message: fmt.Sprintf(format, args...),
 		Code:    ErrGeneralFailure,
+		stack:   captureStack(),
 	}
 }
 
@@ -156,6 +271,11 @@ func (e *internalError) Error() string {
 	return ""
 }
 
+// Unwrap returns the error wrapped by this error, or nil if it does not wrap one
+func (e *internalError) Unwrap() error {
+	return e.cause
+}
+
 // MissingParamError Returns a formatted error stating that a parameter was missing.
 //
 // NOTE: The message will be returned to the client directly
@@ -164,7 +284,9 @@ func MissingParamError(msg string, args ...interface{}) error {
 }
 
 // InvalidRequest returns an error signifying something went bad reading the request data (not the validation process).
-// This in general should not be used by APIs
+// This in general should not be used by APIs.
+//
+// NOTE: The message will be returned to the client directly
 func InvalidRequestError(msg string, args ...interface{}) error {
 	return newErrorfCode(ErrInvalidRequest, msg, args...)
 }
@@ -191,9 +313,164 @@ func ResourceUnavailableError(msg string, args ...interface{}) error {
 	return newErrorfCode(ErrResourceUnavailable, msg, args...)
 }
 
+// TooManyRequestsError returns an error signifying the client has exceeded its request rate limit
+func TooManyRequestsError(msg string, args ...interface{}) error {
+	return newErrorfCode(ErrTooManyRequests, msg, args...)
+}
+
+// TimeoutError returns an error signifying the request was not handled in time
+func TimeoutError(msg string, args ...interface{}) error {
+	return newErrorfCode(ErrTimeout, msg, args...)
+}
+
+// NotFoundError returns an error signifying the requested resource does not exist.
+//
+// NOTE: The message will be returned to the client directly
+func NotFoundError(msg string, args ...interface{}) error {
+	return newErrorfCode(ErrNotFound, msg, args...)
+}
+
+// ForbiddenError returns an error signifying the client may not access the resource, even if it logs in.
+//
+// NOTE: The message will be returned to the client directly
+func ForbiddenError(msg string, args ...interface{}) error {
+	return newErrorfCode(ErrForbidden, msg, args...)
+}
+
+// ConflictError returns an error signifying the request conflicts with the current state of the resource, e.g. creating
+// an object that already exists.
+//
+// NOTE: The message will be returned to the client directly
+func ConflictError(msg string, args ...interface{}) error {
+	return newErrorfCode(ErrConflict, msg, args...)
+}
+
+// UnprocessableEntityError returns an error signifying the request is well formed, but its content cannot be processed.
+//
+// NOTE: The message will be returned to the client directly
+func UnprocessableEntityError(msg string, args ...interface{}) error {
+	return newErrorfCode(ErrUnprocessableEntity, msg, args...)
+}
+
 // BackOff returns a back-off error with a message formatted for the given amount of backoff time
 func BackOffError(duration time.Duration) error {
 
-	return newErrorfCode(ErrBackOff, fmt.Sprintf("Retry-Seconds: %.02f", duration.Seconds()))
+	err := newErrorfCode(ErrBackOff, "Retry-Seconds: %.02f", duration.Seconds())
+	err.(*internalError).retryAfter = duration
+	return err
+
+}
+
+// RetryableError returns an error signifying a transient failure, that the client may safely retry after the given
+// duration. It results in a 503 error with a Retry-After header, unless retryAfter is 0
+func RetryableError(retryAfter time.Duration, msg string, args ...interface{}) error {
+
+	err := newErrorfCode(ErrRetryable, msg, args...)
+	err.(*internalError).retryAfter = retryAfter
+	return err
+}
+
+// WrapRetryable marks an error, e.g. a timeout calling a backend service, as a retryable error, keeping it as the
+// cause of the returned error. See RetryableError
+func WrapRetryable(err error, retryAfter time.Duration) error {
+
+	e := wrapError(err, ErrRetryable, err.Error())
+	e.retryAfter = retryAfter
+	return e
+}
 
+// IsRetryable checks whether clients may retry a request that failed with an error
+func IsRetryable(err error) bool {
+	_, ok := retryAfter(err)
+	return ok
+}
+
+// retryAfter returns how long clients should wait before retrying a request that failed with an error, and false if
+// the error is not retryable
+func retryAfter(err error) (time.Duration, bool) {
+
+	e, ok := err.(*internalError)
+	if !ok || (e.Code != ErrRetryable && e.Code != ErrBackOff) {
+		return 0, false
+	}
+	return e.retryAfter, true
+}
+
+// FieldError is the failure of a single param in a ValidationError
+type FieldError struct {
+	Param   string `json:"param" xml:"param,attr" msgpack:"param"`
+	Message string `json:"message" xml:",chardata" msgpack:"message"`
+}
+
+// ValidationError holds all the params of a request that failed binding or validation, so clients can fix them all at
+// once. It results in a 400 response, and the JSONRenderer renders it as a JSON object with an "errors" array.
+//
+// NOTE: The messages will be returned to the client directly
+type ValidationError struct {
+	Errors []FieldError
+
+	// the values of sensitive params were already masked in the messages
+	redacted bool
+}
+
+// Error returns the messages of all the failed params
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// add records the failure of a param, unless it has already failed
+func (e *ValidationError) add(param string, err error) {
+	if !e.failed(param) {
+		e.Errors = append(e.Errors, FieldError{Param: param, Message: err.Error()})
+	}
+}
+
+// failed returns true if the param has already failed
+func (e *ValidationError) failed(param string) bool {
+	for _, fe := range e.Errors {
+		if fe.Param == param {
+			return true
+		}
+	}
+	return false
+}
+
+// errorOrNil returns the validation error if any params failed, or nil otherwise
+func (e *ValidationError) errorOrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// MethodNotAllowedError returns an error signifying the requested path does not support the request's method.
+//
+// NOTE: The message will be returned to the client directly
+func MethodNotAllowedError(msg string, args ...interface{}) error {
+	return newErrorfCode(ErrMethodNotAllowed, msg, args...)
+}
+
+// RequestEntityTooLargeError returns an error signifying the request body is larger than the server allows.
+//
+// NOTE: The message will be returned to the client directly
+func RequestEntityTooLargeError(msg string, args ...interface{}) error {
+	return newErrorfCode(ErrRequestEntityTooLarge, msg, args...)
+}
+
+// URITooLongError returns an error signifying the URL of the request is longer than the server allows.
+//
+// NOTE: The message will be returned to the client directly
+func URITooLongError(msg string, args ...interface{}) error {
+	return newErrorfCode(ErrURITooLong, msg, args...)
+}
+
+// UnsupportedMediaTypeError returns an error signifying the content type of the request body is not accepted.
+//
+// NOTE: The message will be returned to the client directly
+func UnsupportedMediaTypeError(msg string, args ...interface{}) error {
+	return newErrorfCode(ErrUnsupportedMediaType, msg, args...)
 }
@@ -0,0 +1,83 @@
+package vertex
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// headHandler serves HEAD requests with the handler of a GET route. The handler runs as it does for GET, and its
+// headers are written, but the body is discarded, and only its length is sent
+func headHandler(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		hw := &headWriter{ResponseWriter: w}
+		h(hw, r, p)
+		hw.finish()
+	}
+}
+
+// headWriter discards the body of a response, holding its headers back until the length of the body is known
+type headWriter struct {
+	http.ResponseWriter
+
+	code int
+	size int
+	// the headers were written, by finishing, flushing or hijacking the response
+	done bool
+}
+
+func (w *headWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *headWriter) Write(b []byte) (int, error) {
+	w.size += len(b)
+	return len(b), nil
+}
+
+// finish writes the headers of the response, with the length of the discarded body unless the handler set it
+func (w *headWriter) finish() {
+
+	if w.done {
+		return
+	}
+	w.done = true
+
+	if w.size > 0 && w.Header().Get("Content-Length") == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(w.size))
+	}
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+}
+
+// Flush writes the headers of a streamed response, without the length of the body, since it is not known yet
+func (w *headWriter) Flush() {
+
+	if !w.done {
+		w.done = true
+		if w.code == 0 {
+			w.code = http.StatusOK
+		}
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, if the underlying writer supports it. Nothing is written by the writer after that
+func (w *headWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := HijackConn(w.ResponseWriter)
+	if err == nil {
+		w.done = true
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,95 @@
+package vertex
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The paths of the server's liveness and readiness endpoints, e.g. for orchestrator probes
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+)
+
+// HealthStatus is the JSON body of the health endpoints. Checks maps the name of every health check to "ok" or to the
+// error it failed with, and is only reported by the readiness endpoint
+type HealthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+)
+
+// AddHealthCheck registers a check run by the server's readiness endpoint, e.g. pinging a database. The server is ready
+// when all its checks return nil. Adding a check with an existing name replaces it
+func (s *Server) AddHealthCheck(name string, check func() error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.healthChecks == nil {
+		s.healthChecks = make(map[string]func() error)
+	}
+	s.healthChecks[name] = check
+}
+
+// runHealthChecks runs all the registered health checks, in the order of their names
+func (s *Server) runHealthChecks() HealthStatus {
+
+	s.lock.Lock()
+	names := make([]string, 0, len(s.healthChecks))
+	checks := make(map[string]func() error, len(s.healthChecks))
+	for name, check := range s.healthChecks {
+		names = append(names, name)
+		checks[name] = check
+	}
+	s.lock.Unlock()
+	sort.Strings(names)
+
+	ret := HealthStatus{
+		Status: healthOK,
+		Checks: make(map[string]string, len(names)),
+	}
+
+	for _, name := range names {
+		if err := checks[name](); err != nil {
+			logWarning("Health check %s failed: %s", name, err)
+			ret.Status = healthFail
+			ret.Checks[name] = err.Error()
+		} else {
+			ret.Checks[name] = healthOK
+		}
+	}
+
+	return ret
+}
+
+func writeHealth(w http.ResponseWriter, status HealthStatus) {
+
+	code := http.StatusOK
+	if status.Status != healthOK {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logError("Error writing health status: %s", err)
+	}
+}
+
+// livenessHandler reports the server is alive, without running any checks
+func (s *Server) livenessHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeHealth(w, HealthStatus{Status: healthOK})
+}
+
+// readinessHandler reports whether all the server's health checks pass, with the result of every check
+func (s *Server) readinessHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeHealth(w, s.runHealthChecks())
+}
@@ -0,0 +1,98 @@
+package vertex
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dvirsky/go-pylog/logging"
+)
+
+// Logger is the interface of vertex's internal logging. It can be implemented on top of a structured logger like zap or
+// logrus, and set with SetLogger, so the framework's logs land in the same pipeline as the application's.
+//
+// Fields are passed as alternating keys and values, e.g. logger.Info("Starting server", "addr", ":9944"), as in zap's
+// SugaredLogger
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// pylogLogger is the default logger, writing to the standard logger through go-pylog, with the fields appended to the
+// message as key=value pairs. The minimal level is set by the logging_level server config
+type pylogLogger struct{}
+
+func formatFields(msg string, fields []interface{}) string {
+
+	if len(fields) == 0 {
+		return msg
+	}
+
+	pairs := make([]string, 0, len(fields)/2+1)
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 < len(fields) {
+			pairs = append(pairs, fmt.Sprintf("%v=%v", fields[i], fields[i+1]))
+		} else {
+			pairs = append(pairs, fmt.Sprintf("%v", fields[i]))
+		}
+	}
+
+	return msg + " " + strings.Join(pairs, " ")
+}
+
+func (pylogLogger) Debug(msg string, fields ...interface{}) {
+	logging.Debug("%s", formatFields(msg, fields))
+}
+func (pylogLogger) Info(msg string, fields ...interface{}) {
+	logging.Info("%s", formatFields(msg, fields))
+}
+func (pylogLogger) Warn(msg string, fields ...interface{}) {
+	logging.Warning("%s", formatFields(msg, fields))
+}
+func (pylogLogger) Error(msg string, fields ...interface{}) {
+	logging.Error("%s", formatFields(msg, fields))
+}
+
+// we wrap the logger so the atomic value always holds the same concrete type
+type loggerBox struct {
+	Logger
+}
+
+var currentLogger atomic.Value
+
+func init() {
+	currentLogger.Store(loggerBox{pylogLogger{}})
+}
+
+// SetLogger routes vertex's internal logging to a logger. Passing nil restores the default logger
+func SetLogger(l Logger) {
+	if l == nil {
+		l = pylogLogger{}
+	}
+	currentLogger.Store(loggerBox{l})
+}
+
+// GetLogger returns the logger vertex logs to, so middleware and handlers can log to it as well
+func GetLogger() Logger {
+	return currentLogger.Load().(loggerBox).Logger
+}
+
+// printf style helpers for the internal logging
+
+func logDebug(format string, args ...interface{}) {
+	GetLogger().Debug(fmt.Sprintf(format, args...))
+}
+
+func logInfo(format string, args ...interface{}) {
+	GetLogger().Info(fmt.Sprintf(format, args...))
+}
+
+func logWarning(format string, args ...interface{}) {
+	GetLogger().Warn(fmt.Sprintf(format, args...))
+}
+
+func logError(format string, args ...interface{}) {
+	GetLogger().Error(fmt.Sprintf(format, args...))
+}
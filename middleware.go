@@ -5,7 +5,8 @@ import "net/http"
 // Middleware are pre/post processors that can inspect, change, or fail the request. e.g. authentication, logging, etc
 //
 // Each middleware needs to call next(w,r) so its next-in-line middleware will work, or return without it if it wishes to
-// terminate the processing chain
+// terminate the processing chain. A middleware returning a value without calling next short-circuits the chain: the
+// handler is skipped and the value is rendered as the response, just as if the handler returned it (see Intercept)
 type Middleware interface {
 	Handle(w http.ResponseWriter, r *Request, next HandlerFunc) (interface{}, error)
 }
@@ -23,13 +24,87 @@ func (f MiddlewareFunc) Handle(w http.ResponseWriter, r *Request, next HandlerFu
 	return f(w, r, next)
 }
 
+// PreBinder is implemented by middleware that set up the handler instance of a request before the request's params are
+// bound into it, e.g. to set defaults that the params may override.
+//
+// Handlers are bound after the whole middleware chain ran, so the hooks of the middleware in a route's chain are
+// called in the order of the chain, right before binding. Note that handlers that are not structs are not instantiated
+// per request, and hooks modifying them modify the shared handler
+type PreBinder interface {
+	PreBind(h RequestHandler, r *Request) error
+}
+
+// PostBinder is implemented by middleware that modify the handler instance of a request after its params are bound and
+// validated, right before it handles the request, e.g. to set a tenant id resolved from the request's host, which
+// clients cannot override with a param. An error fails the request, and the handler is not called
+type PostBinder interface {
+	PostBind(h RequestHandler, r *Request) error
+}
+
+// PreBindFunc is a middleware that only runs a function as a PreBinder
+type PreBindFunc func(h RequestHandler, r *Request) error
+
+// Handle calls the next middleware, since the function is called later, when the handler is bound
+func (f PreBindFunc) Handle(w http.ResponseWriter, r *Request, next HandlerFunc) (interface{}, error) {
+	return next(w, r)
+}
+
+// PreBind runs the underlying func
+func (f PreBindFunc) PreBind(h RequestHandler, r *Request) error {
+	return f(h, r)
+}
+
+// PostBindFunc is a middleware that only runs a function as a PostBinder
+type PostBindFunc func(h RequestHandler, r *Request) error
+
+// Handle calls the next middleware, since the function is called later, when the handler is bound
+func (f PostBindFunc) Handle(w http.ResponseWriter, r *Request, next HandlerFunc) (interface{}, error) {
+	return next(w, r)
+}
+
+// PostBind runs the underlying func
+func (f PostBindFunc) PostBind(h RequestHandler, r *Request) error {
+	return f(h, r)
+}
+
+// bindHooks collects the bind hooks of a middleware chain, in the order of the chain
+func bindHooks(mws []Middleware) (pre []PreBinder, post []PostBinder) {
+	for _, mw := range mws {
+		if b, ok := mw.(PreBinder); ok {
+			pre = append(pre, b)
+		}
+		if b, ok := mw.(PostBinder); ok {
+			post = append(post, b)
+		}
+	}
+	return
+}
+
 type step struct {
 	mw   Middleware
 	next *step
 }
 
+// Intercept creates a middleware that short-circuits the chain when f handles a request, e.g. serving a cached
+// response or rejecting an unauthenticated request. If f returns handled=true, its value or error is rendered and the
+// rest of the chain and the handler are skipped. Otherwise the chain continues as usual
+func Intercept(f func(w http.ResponseWriter, r *Request) (v interface{}, handled bool, err error)) MiddlewareFunc {
+
+	return MiddlewareFunc(func(w http.ResponseWriter, r *Request, next HandlerFunc) (interface{}, error) {
+		if v, handled, err := f(w, r); handled {
+			return v, err
+		}
+		return next(w, r)
+	})
+}
+
 func (s *step) handle(w http.ResponseWriter, r *Request) (interface{}, error) {
 
+	// calling next past the end of a chain without a handler
+	if s == nil {
+		return nil, NewErrorf("No handler at the end of the middleware chain")
+	}
+
 	return s.mw.Handle(w, r, HandlerFunc(s.next.handle))
 }
 
@@ -45,10 +120,16 @@ func (s *step) append(mw Middleware) {
 	}
 }
 
+// buildChain links middleware into a chain, skipping nil middleware
 func buildChain(mws ...Middleware) *step {
 	if mws == nil {
 		return nil
 	}
+
+	for len(mws) > 0 && mws[0] == nil {
+		mws = mws[1:]
+	}
+
 	switch len(mws) {
 	case 0:
 		return nil
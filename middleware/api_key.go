@@ -35,6 +35,11 @@ func (v *APIKeyValidator) Add(keys ...string) {
 
 func (v *APIKeyValidator) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
 
+	// keys sent in POST bodies are parsed into the form only when the params are bound
+	if err := vertex.ParseForm(r); err != nil {
+		return nil, err
+	}
+
 	if _, found := v.validKeys[r.FormValue(v.paramName)]; !found {
 		return nil, vertex.UnauthorizedError("missing or invalid api key '%s'", r.FormValue(v.paramName))
 	}
@@ -1,10 +1,9 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"net/http"
 
-	"github.com/dvirsky/go-pylog/logging"
-
 	"github.com/EverythingMe/vertex"
 )
 
@@ -29,13 +28,13 @@ func (b BasicAuth) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.
 	if !r.IsLocal() || !b.BypassForLocal {
 		user, pass, ok := r.BasicAuth()
 		if !ok {
-			logging.Debug("No auth header, denying")
+			logDebug("No auth header, denying")
 			b.requireAuth(w)
 			return nil, vertex.Hijacked
 		}
 
 		if user != b.User || pass != b.Password {
-			logging.Warning("Unmatching auth: %s/%s", user, pass)
+			logWarning("Unmatching auth: %s/%s", user, pass)
 			b.requireAuth(w)
 			return nil, vertex.Hijacked
 		}
@@ -43,3 +42,57 @@ func (b BasicAuth) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.
 
 	return next(w, r)
 }
+
+// The request attribute holding the user authenticated by BasicAuthMiddleware
+const AttrBasicAuthUser = "basic_auth_user"
+
+// BasicAuthMiddleware forces basic auth authentication on requests, validating the credentials with a check function.
+//
+// Requests with missing or invalid credentials fail with an unauthorized (401) error and a WWW-Authenticate header.
+// The authenticated user is saved in the AttrBasicAuthUser attribute of the request
+type BasicAuthMiddleware struct {
+	Check          func(user, pass string) bool
+	Realm          string
+	BypassForLocal bool
+}
+
+// NewBasicAuthMiddleware creates a basic auth middleware for a realm, validating credentials with check
+func NewBasicAuthMiddleware(realm string, check func(user, pass string) bool) *BasicAuthMiddleware {
+	return &BasicAuthMiddleware{
+		Check: check,
+		Realm: realm,
+	}
+}
+
+// StaticCredentials returns a check function for BasicAuthMiddleware that allows a single user/pass pair
+func StaticCredentials(user, pass string) func(string, string) bool {
+	return func(u, p string) bool {
+		// compare both in constant time, so timing does not reveal which of them was wrong
+		userOk := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passOk := subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+		return userOk && passOk
+	}
+}
+
+func (b *BasicAuthMiddleware) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
+
+	if r.IsLocal() && b.BypassForLocal {
+		return next(w, r)
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		logDebug("No auth header, denying")
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+b.Realm+`"`)
+		return nil, vertex.UnauthorizedError("Missing credentials")
+	}
+
+	if !b.Check(user, pass) {
+		logWarning("Invalid credentials for user %s", user)
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+b.Realm+`"`)
+		return nil, vertex.UnauthorizedError("Invalid credentials")
+	}
+
+	r.SetAttribute(AttrBasicAuthUser, user)
+	return next(w, r)
+}
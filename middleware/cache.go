@@ -1,21 +1,34 @@
 package middleware
 
 import (
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/EverythingMe/vertex"
 )
 
 import (
-	"errors"
 	"sync"
 	"time"
 
 	"github.com/EverythingMe/groupcache/lru"
-	"github.com/dvirsky/go-pylog/logging"
 )
 
+// HeaderCache is set on cached routes, telling whether the response was served from the cache (HIT) or not (MISS)
+const HeaderCache = "X-Cache"
+
+// CacheStore stores the cached responses of the CacheMiddleware. Implementations must be safe for concurrent use.
+// The default store is an in-memory LRU cache, an external store like redis can be plugged with NewCacheMiddlewareStore
+type CacheStore interface {
+	// Get returns the value stored for a key, and false if it is not stored or has expired
+	Get(key string) (interface{}, bool)
+	// Set stores a value for a key, expiring after ttl
+	Set(key string, value interface{}, ttl time.Duration)
+}
+
 type entry struct {
 	value  interface{}
 	expiry time.Time
@@ -28,62 +41,151 @@ func newEntry(value interface{}, ttl time.Duration) *entry {
 	}
 }
 
-// NewCacheMiddleware creates a new Cache middleware
-func NewCacheMiddleware(maxItems int, ttl time.Duration) *CacheMiddleware {
-	return &CacheMiddleware{
+// lruStore is an in-memory CacheStore, keeping up to a given number of entries
+type lruStore struct {
+	cache *lru.Cache
+	mutex *sync.Mutex
+}
+
+// NewLRUCacheStore creates an in memory cache store, holding up to maxItems entries
+func NewLRUCacheStore(maxItems int) CacheStore {
+	return &lruStore{
 		cache: lru.New(maxItems),
-		mutex: &sync.RWMutex{},
-		ttl:   ttl,
+		mutex: &sync.Mutex{},
 	}
 }
 
-// Get gets data saved for an URL if present in cache.
-func (m *CacheMiddleware) get(key string) (*entry, error) {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
+// Get gets data saved for a key if present in cache.
+// The lru cache updates its recently used list on Get, so we need a write lock here
+func (s *lruStore) Get(key string) (interface{}, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	data, ok := m.cache.Get(key)
+	data, ok := s.cache.Get(key)
 	if !ok {
-		return nil, errors.New("not in cache")
+		return nil, false
 	}
 
 	ret, ok := data.(*entry)
 	if !ok {
-		return nil, errors.New("Invalid entry")
+		return nil, false
 	}
 
 	// This entry is expired!
 	if ret.expiry.Before(time.Now()) {
-		return nil, errors.New("Expired")
+		s.cache.Remove(key)
+		return nil, false
 	}
 
-	return ret, nil
+	return ret.value, true
+}
+
+// Set puts data of a key in cache.
+func (s *lruStore) Set(key string, value interface{}, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cache.Add(key, newEntry(value, ttl))
 }
 
-// Put puts data of an URL in cache.
-func (m *CacheMiddleware) put(key string, ent *entry) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	m.cache.Add(key, ent)
+// NewCacheMiddleware creates a new Cache middleware, caching up to maxItems responses in memory
+func NewCacheMiddleware(maxItems int, ttl time.Duration) *CacheMiddleware {
+	return NewCacheMiddlewareStore(NewLRUCacheStore(maxItems), ttl)
+}
+
+// NewCacheMiddlewareStore creates a new Cache middleware, caching responses in the given store
+func NewCacheMiddlewareStore(store CacheStore, ttl time.Duration) *CacheMiddleware {
+	return &CacheMiddleware{
+		store: store,
+		ttl:   ttl,
+	}
 }
 
 // CacheMiddleware is a middleware that caches responses for requests based on their url, method and params.
 //
-// The cache uses an LRU cache with a given size, and tries to get/set resonses from and to it.
-// The url of the request and an ancoded version of request.Form (GET + POST + path params) are used as the key.
-// Headers do not play a part in the cache key.
+// The cache uses an LRU cache with a given size (or a custom CacheStore), and tries to get/set resonses from and to it.
+// The url of the request and an ancoded version of request.Form (GET + POST + path params) are used as the key,
+// unless a KeyFunc is set. The body of the request is parsed into the form first (see vertex.ParseForm), so requests
+// with different POST params never share their cached responses. Headers do not play a part in the default cache key.
+//
+// Only successful responses are cached, and the X-Cache header tells if a response was served from the cache.
+// Streamed responses, i.e. io.Readers and FileResponses, are not cached, since they can be read only once.
+//
+// Responses that differ per user can be cached per authenticated identity with PerIdentity, so users never get each
+// other's cached responses. The identity is set by the authentication middleware, so the cache middleware must run
+// after it (e.g. in the route's Middleware).
 //
 // Note: If the request contains a "Cache-Control: no-cache" header, the middleware will be bypassed
 type CacheMiddleware struct {
-	cache *lru.Cache
-	mutex *sync.RWMutex
+	// KeyFunc returns the cache key of a request. Defaults to the method, path and sorted params of the request.
+	// The varying parts below are added to the keys it returns
+	KeyFunc func(r *vertex.Request) string
+
+	// Request headers whose values are part of the cache key, like the HTTP Vary header (e.g. Accept-Language)
+	VaryHeaders []string
+	// Cache responses separately for each authenticated identity, as returned by IdentityFunc
+	PerIdentity bool
+	// When caching per identity, do not cache the responses of anonymous requests. Otherwise anonymous requests share
+	// their cached responses
+	SkipAnonymous bool
+	// IdentityFunc returns the authenticated identity of a request, or false for anonymous requests. Defaults to
+	// RequestIdentity
+	IdentityFunc func(r *vertex.Request) (string, bool)
+
+	store CacheStore
 	ttl   time.Duration
 }
 
+// RequestIdentity returns the identity of a request authenticated by the included middleware: the subject of the
+// JWTMiddleware's token claims, or the BasicAuthMiddleware's user. It returns false for anonymous requests
+func RequestIdentity(r *vertex.Request) (string, bool) {
+
+	if v, found := r.Attribute(AttrJWTClaims); found {
+		if claims, ok := v.(map[string]interface{}); ok && claims["sub"] != nil {
+			return fmt.Sprintf("jwt:%v", claims["sub"]), true
+		}
+	}
+
+	if v, found := r.Attribute(AttrBasicAuthUser); found {
+		if user, ok := v.(string); ok && user != "" {
+			return "basic:" + user, true
+		}
+	}
+
+	return "", false
+}
+
+func (m *CacheMiddleware) identity(r *vertex.Request) (string, bool) {
+	if m.IdentityFunc != nil {
+		return m.IdentityFunc(r)
+	}
+	return RequestIdentity(r)
+}
+
 func (m *CacheMiddleware) requestKey(r *vertex.Request) string {
 
-	return r.Method + "/" + r.Request.URL.Path + "::" + r.Form.Encode()
+	var key string
+	if m.KeyFunc != nil {
+		key = m.KeyFunc(r)
+	} else {
+		// Encode sorts the values by key
+		key = r.Method + "/" + r.Request.URL.Path + "::" + r.Form.Encode()
+	}
+
+	if !m.PerIdentity && len(m.VaryHeaders) == 0 {
+		return key
+	}
 
+	// the varying parts are escaped, so no identity or header value can make a key of another request
+	vary := url.Values{}
+	if m.PerIdentity {
+		id, _ := m.identity(r)
+		vary.Set("identity", id)
+	}
+	for _, h := range m.VaryHeaders {
+		vary["header:"+strings.ToLower(h)] = r.Header[http.CanonicalHeaderKey(h)]
+	}
+
+	return key + "##" + vary.Encode()
 }
 
 func (m *CacheMiddleware) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
@@ -93,19 +195,48 @@ func (m *CacheMiddleware) Handle(w http.ResponseWriter, r *vertex.Request, next
 		return next(w, r)
 	}
 
+	if m.PerIdentity && m.SkipAnonymous {
+		if _, ok := m.identity(r); !ok {
+			return next(w, r)
+		}
+	}
+
+	// the default key holds the POST params, which are parsed into the form only when the params are bound.
+	// Requests whose body cannot be parsed fail when they are bound, so they are not cached
+	if m.KeyFunc == nil {
+		if err := vertex.ParseForm(r); err != nil {
+			return next(w, r)
+		}
+	}
+
 	key := m.requestKey(r)
-	logging.Debug("CACHING KEY: %s", key)
-	entry, err := m.get(key)
-	if err == nil && entry != nil {
-		logging.Info("Fetched cache response: %#v", entry.value)
-		return entry.value, nil
+	logDebug("CACHING KEY: %s", key)
+	if v, found := m.store.Get(key); found {
+		logDebug("Fetched cache response: %#v", v)
+		w.Header().Set(HeaderCache, "HIT")
+		return v, nil
 	}
 
+	w.Header().Set(HeaderCache, "MISS")
 	v, err := next(w, r)
-	if err == nil {
-		m.put(key, newEntry(v, m.ttl))
+	if err == nil && cacheable(v) {
+		m.store.Set(key, v, m.ttl)
 	}
 
 	return v, err
 
 }
+
+// cacheable tells if a response can be served again from the cache. Readers and file responses can be read only once,
+// so they are not cached
+func cacheable(v interface{}) bool {
+	switch x := v.(type) {
+	case io.Reader, vertex.FileResponse, *vertex.FileResponse:
+		return false
+	case vertex.StatusResponse:
+		return cacheable(x.Body)
+	case *vertex.StatusResponse:
+		return x == nil || cacheable(x.Body)
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/EverythingMe/vertex"
+)
+
+// ConcurrencyLimitMiddleware limits the number of requests handled at the same time, e.g. to protect a backend that
+// falls over under too many parallel calls.
+//
+// Unlike the ConnectionLimiter, which rejects requests over the limit right away, requests arriving when the limit is
+// reached can wait up to a queue timeout for a slot to free up. Requests that do not get a slot in time are answered
+// with 503 Service Unavailable.
+//
+// Apply an instance to the routes it should protect. Slots are released when the rest of the chain returns, also if
+// it panics, and the panic is left for the recovery middleware
+type ConcurrencyLimitMiddleware struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+// NewConcurrencyLimitMiddleware creates a middleware limiting the number of requests in flight to max. If timeout is
+// zero, requests over the limit are rejected immediately instead of waiting for a slot
+func NewConcurrencyLimitMiddleware(max int, timeout time.Duration) *ConcurrencyLimitMiddleware {
+	return &ConcurrencyLimitMiddleware{
+		slots:   make(chan struct{}, max),
+		timeout: timeout,
+	}
+}
+
+// acquire waits for a free slot, until the timeout or until the request is cancelled
+func (m *ConcurrencyLimitMiddleware) acquire(r *vertex.Request) bool {
+
+	select {
+	case m.slots <- struct{}{}:
+		return true
+	default:
+		if m.timeout <= 0 {
+			return false
+		}
+	}
+
+	timer := time.NewTimer(m.timeout)
+	defer timer.Stop()
+
+	select {
+	case m.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (m *ConcurrencyLimitMiddleware) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
+
+	if !m.acquire(r) {
+		logWarning("Concurrency limit exceeded: %d requests in flight", cap(m.slots))
+		return nil, vertex.ResourceUnavailableError("Too many concurrent requests")
+	}
+	defer func() { <-m.slots }()
+
+	return next(w, r)
+}
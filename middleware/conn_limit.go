@@ -5,7 +5,6 @@ import (
 	"sync/atomic"
 
 	"github.com/EverythingMe/vertex"
-	"github.com/dvirsky/go-pylog/logging"
 )
 
 // ConnectionLimiter limits the maximum allowed open connections (actually concurrent running requests)
@@ -34,7 +33,7 @@ func (b *ConnectionLimiter) Handle(w http.ResponseWriter, r *vertex.Request, nex
 	defer atomic.AddInt32(&b.running, -1)
 	if num > b.max {
 
-		logging.Warning("Connection limit exceeded: %d/%d", num, b.max)
+		logWarning("Connection limit exceeded: %d/%d", num, b.max)
 		return nil, vertex.ResourceUnavailableError("Connection Limit Exceeded")
 	}
 
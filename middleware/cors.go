@@ -1,26 +1,38 @@
 package middleware
 
 import (
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/EverythingMe/vertex"
 )
 
 type CORS struct {
 	AllowOrigin      string
+	allowOrigins     map[string]struct{}
 	exposeHeaders    []string
 	allowHeaders     []string
 	allowMethods     []string
 	allowCredentials bool
+	maxAge           time.Duration
 }
 
 //Access-Control-Allow-Origin
 
-// CORS is a middleware that injects Access-Control-Allow-Origin headers
+// CORS is a middleware that injects Access-Control-Allow-Origin headers.
+//
+// Preflight requests (OPTIONS requests with an Access-Control-Request-Method header) are answered directly with the
+// CORS headers, without calling the rest of the chain. Note that the route must allow the OPTIONS method for preflight
+// requests to reach the middleware
 func (c *CORS) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
-	if c.AllowOrigin != "" {
-		w.Header().Set("Access-Control-Allow-Origin", c.AllowOrigin)
+
+	if origin := c.allowedOrigin(r.Header.Get("Origin")); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if origin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
 	}
 
 	if c.allowHeaders != nil && len(c.allowHeaders) > 0 {
@@ -39,9 +51,31 @@ func (c *CORS) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.Hand
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 	}
 
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		if c.maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%d", int(c.maxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil, vertex.Hijacked
+	}
+
 	return next(w, r)
 }
 
+// allowedOrigin returns the Access-Control-Allow-Origin value for a request's origin, or an empty string if the
+// origin is not allowed
+func (c *CORS) allowedOrigin(origin string) string {
+
+	if c.allowOrigins == nil {
+		return c.AllowOrigin
+	}
+
+	if _, found := c.allowOrigins[origin]; found {
+		return origin
+	}
+	return ""
+}
+
 func NewCORS() *CORS {
 	return &CORS{
 		AllowOrigin: "*",
@@ -76,3 +110,19 @@ func (c *CORS) AllowMethods(methods ...string) *CORS {
 	c.allowMethods = methods
 	return c
 }
+
+// AllowOrigins restricts cross origin requests to the given origins (e.g. "https://example.com"), instead of the single
+// AllowOrigin value. The allowed origin of the request is echoed back to the client
+func (c *CORS) AllowOrigins(origins ...string) *CORS {
+	c.allowOrigins = make(map[string]struct{}, len(origins))
+	for _, origin := range origins {
+		c.allowOrigins[origin] = struct{}{}
+	}
+	return c
+}
+
+// MaxAge sets how long clients may cache the result of preflight requests
+func (c *CORS) MaxAge(d time.Duration) *CORS {
+	c.maxAge = d
+	return c
+}
@@ -0,0 +1,230 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/EverythingMe/vertex"
+)
+
+// DefaultDebugCaptureSize is the number of bytes of each body the DebugCaptureMiddleware logs, if no size is given
+const DefaultDebugCaptureSize = 4096
+
+// DefaultRedactedFields are the fields masked in captured bodies by default
+var DefaultRedactedFields = []string{
+	"password", "passwd", "secret", "client_secret", "token", "access_token", "refresh_token", "id_token",
+	"api_key", "apikey", "authorization",
+}
+
+const redacted = "[REDACTED]"
+
+// RedactFields returns a redaction function masking the values of the given fields in JSON and urlencoded bodies.
+// Field names are matched case insensitively. Since bodies may be truncated, they are redacted as text, and not by
+// decoding them
+func RedactFields(fields ...string) func([]byte) []byte {
+
+	quoted := make([]string, len(fields))
+	for i, f := range fields {
+		quoted[i] = regexp.QuoteMeta(f)
+	}
+	names := strings.Join(quoted, "|")
+
+	// "field": "value" or "field": 123 in JSON, and field=value in forms and query strings
+	jsonRe := regexp.MustCompile(`(?i)("(?:` + names + `)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]+)`)
+	formRe := regexp.MustCompile(`(?i)(^|[&?])((?:` + names + `)=)[^&]*`)
+
+	return func(body []byte) []byte {
+		body = jsonRe.ReplaceAll(body, []byte(`${1}"`+redacted+`"`))
+		return formRe.ReplaceAll(body, []byte("${1}${2}"+redacted))
+	}
+}
+
+// DebugCaptureMiddleware logs the request and response bodies of requests, for diagnosing client issues.
+//
+// Up to MaxSize bytes of the request body are read and restored for the handler, which gets the whole body untouched,
+// and up to MaxSize bytes of the response are captured as it is written. Bodies are redacted before they are logged,
+// masking DefaultRedactedFields (unless another Redact function is set) and the params tagged as sensitive.
+//
+// By default, only the routes listed (as defined, e.g. /users/{id}) in the comma separated debug_capture_routes
+// server config are captured, or all routes if it is "*". This way capturing can be turned on for a single endpoint in
+// production, and turned off again, by changing the config and reloading it (see vertex.ReloadConfigs). Like the
+// LoggingMiddleware, it renders the response itself, and writes to Output, or to the vertex log if it is nil
+type DebugCaptureMiddleware struct {
+	// The number of bytes of each body that are logged
+	MaxSize int
+	// Redact masks sensitive data in a captured body before it is logged
+	Redact func(body []byte) []byte
+	// Enabled tells whether to capture a request. Defaults to checking the debug_capture_routes server config
+	Enabled func(r *vertex.Request) bool
+
+	Output io.Writer
+}
+
+// NewDebugCaptureMiddleware creates a middleware capturing up to maxSize bytes of the bodies of requests to the routes
+// listed in the server config. If maxSize is 0, DefaultDebugCaptureSize is used
+func NewDebugCaptureMiddleware(maxSize int) *DebugCaptureMiddleware {
+	if maxSize <= 0 {
+		maxSize = DefaultDebugCaptureSize
+	}
+
+	return &DebugCaptureMiddleware{
+		MaxSize: maxSize,
+		Redact:  RedactFields(DefaultRedactedFields...),
+	}
+}
+
+// captureEnabled checks whether a request's route is listed in the server config
+func captureEnabled(r *vertex.Request) bool {
+	for _, route := range strings.Split(vertex.ServerConfig().DebugCaptureRoutes, ",") {
+		if route = strings.TrimSpace(route); route == "*" || (route != "" && route == r.RoutePath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *DebugCaptureMiddleware) enabled(r *vertex.Request) bool {
+	if m.Enabled != nil {
+		return m.Enabled(r)
+	}
+	return captureEnabled(r)
+}
+
+func (m *DebugCaptureMiddleware) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
+
+	if !m.enabled(r) {
+		return next(w, r)
+	}
+
+	// the head of the request body is read up front, so it is captured even if the handler does not read it, and the
+	// rest is captured as the handler reads it. The handler reads the body from the start either way
+	reqBody := &captureBuffer{limit: m.MaxSize}
+	if r.Body != nil {
+		head, _ := ioutil.ReadAll(io.LimitReader(r.Body, int64(m.MaxSize)))
+		reqBody.Write(head)
+		if r.ContentLength > int64(reqBody.size) {
+			reqBody.declared = int(r.ContentLength)
+		}
+
+		r.Body = &teeBody{
+			Reader: io.MultiReader(bytes.NewReader(head), io.TeeReader(r.Body, reqBody)),
+			Closer: r.Body,
+		}
+	}
+
+	cw := &captureWriter{ResponseWriter: w, body: captureBuffer{limit: m.MaxSize}}
+
+	v, err := next(cw, r)
+	if !vertex.IsHijacked(err) {
+		err = vertex.RenderResponse(v, err, cw, r)
+	}
+
+	line := fmt.Sprintf("Captured %s %s request_id=%s\nrequest body: %s\nresponse status=%d body: %s",
+		r.Method, r.RedactedURL(), r.RequestId, m.format(r, reqBody), cw.status(), m.format(r, &cw.body))
+
+	if m.Output == nil {
+		logInfo("%s", line)
+	} else if _, e := fmt.Fprintln(m.Output, line); e != nil {
+		logError("Could not write debug capture: %s", e)
+	}
+
+	return nil, err
+}
+
+// format redacts a captured body, and notes if it was truncated
+func (m *DebugCaptureMiddleware) format(r *vertex.Request, b *captureBuffer) string {
+
+	body := b.buf.Bytes()
+	if m.Redact != nil {
+		body = m.Redact(body)
+	}
+	if sensitive := r.SensitiveParams(); len(sensitive) > 0 {
+		body = []byte(r.Redact(string(RedactFields(sensitive...)(body))))
+	}
+
+	size := b.size
+	if b.declared > size {
+		size = b.declared
+	}
+
+	if size > b.buf.Len() {
+		return fmt.Sprintf("%s... (truncated, %d bytes)", body, size)
+	}
+	return string(body)
+}
+
+// captureBuffer keeps the first bytes written to it, up to a limit, and counts the rest
+type captureBuffer struct {
+	buf   bytes.Buffer
+	limit int
+	size  int
+
+	// the declared size of the body, if it was not all written
+	declared int
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.buf.Write(p[:room])
+	}
+	b.size += len(p)
+	return len(p), nil
+}
+
+// teeBody captures a request body as it is read, closing the original body
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// captureWriter captures a response as it is written to the underlying writer
+type captureWriter struct {
+	http.ResponseWriter
+	code int
+	body captureBuffer
+}
+
+func (w *captureWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.body.Write(b[:n])
+	return n, err
+}
+
+// Flush flushes the underlying writer, if it supports flushing
+func (w *captureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, if the underlying writer supports it. Nothing written after that is captured
+func (w *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return vertex.HijackConn(w.ResponseWriter)
+}
+
+func (w *captureWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
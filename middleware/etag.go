@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/EverythingMe/vertex"
+)
+
+// ETagMiddleware handles conditional GET requests. It computes an ETag from the response body (unless the handler set an
+// ETag header itself), and answers requests whose If-None-Match header matches it with a bare 304 Not Modified.
+//
+// Like the GzipMiddleware, the middleware renders the response itself (see vertex.RenderResponse), buffering it to hash
+// it. Only successful responses of GET and HEAD requests are tagged, and responses with "Cache-Control: no-store" or
+// that are flushed while streaming are written as they are.
+//
+// Note: when used with the GzipMiddleware, put the ETagMiddleware after it, so the ETag is computed on the
+// uncompressed body
+type ETagMiddleware struct{}
+
+// NewETagMiddleware creates a new ETag middleware
+func NewETagMiddleware() *ETagMiddleware {
+	return &ETagMiddleware{}
+}
+
+// etagMatches checks whether an If-None-Match header value matches an ETag. Weak comparison is used, as
+// recommended for If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *ETagMiddleware) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return next(w, r)
+	}
+
+	ew := &etagWriter{ResponseWriter: w}
+
+	v, err := next(ew, r)
+	if !vertex.IsHijacked(err) {
+		err = vertex.RenderResponse(v, err, ew, r)
+	}
+
+	if e := ew.finish(r.Header.Get("If-None-Match")); e != nil {
+		return nil, e
+	}
+
+	return nil, err
+}
+
+// etagWriter buffers a response so its ETag can be computed before it is written
+type etagWriter struct {
+	http.ResponseWriter
+
+	code        int
+	buf         bytes.Buffer
+	passthrough bool
+}
+
+// taggable checks whether the buffered response should get an ETag
+func (w *etagWriter) taggable() bool {
+	if w.code != 0 && w.code != http.StatusOK {
+		return false
+	}
+	return !strings.Contains(strings.ToLower(w.Header().Get("Cache-Control")), "no-store")
+}
+
+// writeThrough writes the buffered response and passes all further writes to the underlying writer
+func (w *etagWriter) writeThrough() error {
+
+	w.passthrough = true
+
+	if w.code != 0 {
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := w.ResponseWriter.Write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+// finish tags the buffered response and writes it, or writes a 304 if the client has the same version
+func (w *etagWriter) finish(ifNoneMatch string) error {
+
+	if w.passthrough {
+		return nil
+	}
+
+	if !w.taggable() {
+		return w.writeThrough()
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		sum := sha1.Sum(w.buf.Bytes())
+		etag = `"` + hex.EncodeToString(sum[:]) + `"`
+		w.Header().Set("ETag", etag)
+	}
+
+	if ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		w.passthrough = true
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Length")
+		w.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	return w.writeThrough()
+}
+
+func (w *etagWriter) WriteHeader(code int) {
+	if w.passthrough {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.code = code
+}
+
+func (w *etagWriter) Write(b []byte) (int, error) {
+	if w.passthrough {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.buf.Write(b)
+}
+
+// Hijack takes over the connection, if the underlying writer supports it. Nothing is written by the writer after that
+func (w *etagWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := vertex.HijackConn(w.ResponseWriter)
+	if err == nil {
+		w.passthrough = true
+		w.buf.Reset()
+	}
+	return conn, rw, err
+}
+
+// Flush gives up tagging the response, since a streamed response cannot be hashed before it is sent
+func (w *etagWriter) Flush() {
+
+	if !w.passthrough {
+		w.writeThrough()
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
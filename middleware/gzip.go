@@ -0,0 +1,218 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/EverythingMe/vertex"
+)
+
+// responses smaller than this are not compressed by default, as compressing them does not save much
+const defaultGzipMinSize = 1024
+
+// GzipMiddleware compresses responses for clients that accept gzip encoding.
+//
+// Since the response must be written through the compressing writer, the middleware renders the response itself
+// (see vertex.RenderResponse). Responses smaller than MinSize, and responses that are already compressed (i.e. have a
+// Content-Encoding, or a compressed content type like images) are written as they are
+type GzipMiddleware struct {
+	// The minimal size of a response to compress
+	MinSize int
+	// The gzip compression level
+	Level int
+}
+
+// NewGzipMiddleware creates a gzip middleware compressing responses of at least minSize bytes.
+// If minSize is 0, responses of at least 1KB are compressed
+func NewGzipMiddleware(minSize int) *GzipMiddleware {
+	if minSize <= 0 {
+		minSize = defaultGzipMinSize
+	}
+
+	return &GzipMiddleware{
+		MinSize: minSize,
+		Level:   gzip.DefaultCompression,
+	}
+}
+
+// acceptsGzip checks whether the Accept-Encoding header of a request allows gzip encoding
+func acceptsGzip(r *vertex.Request) bool {
+
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		name := strings.TrimSpace(parts[0])
+		if name != "gzip" && name != "*" {
+			continue
+		}
+
+		if len(parts) > 1 && strings.Replace(parts[1], " ", "", -1) == "q=0" {
+			return false
+		}
+		return true
+	}
+
+	return false
+}
+
+func (m *GzipMiddleware) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
+
+	if r.Method == "HEAD" || !acceptsGzip(r) {
+		return next(w, r)
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	gw := &gzipWriter{
+		ResponseWriter: w,
+		minSize:        m.MinSize,
+		level:          m.Level,
+	}
+
+	v, err := next(gw, r)
+	if !vertex.IsHijacked(err) {
+		err = vertex.RenderResponse(v, err, gw, r)
+	}
+
+	if e := gw.Close(); e != nil {
+		return nil, e
+	}
+
+	return nil, err
+}
+
+// gzipWriter buffers the beginning of a response until it knows whether the response should be compressed. Once the
+// buffer reaches minSize bytes, the response is compressed, and writes go through a gzip writer
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize int
+	level   int
+
+	code     int
+	buf      bytes.Buffer
+	gz       *gzip.Writer
+	decided  bool
+	hijacked bool
+}
+
+// compressible checks whether the response's headers allow compressing it
+func (w *gzipWriter) compressible() bool {
+
+	if w.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+
+	ct := w.Header().Get("Content-Type")
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/zip", "application/gzip", "application/x-gzip"} {
+		if strings.HasPrefix(ct, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decide writes the response headers, compressed or not, and the buffered data
+func (w *gzipWriter) decide(compress bool) error {
+
+	w.decided = true
+
+	if compress && w.compressible() {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+
+		gz, err := gzip.NewWriterLevel(w.ResponseWriter, w.level)
+		if err != nil {
+			return err
+		}
+		w.gz = gz
+	}
+
+	if w.code != 0 {
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := w.writeThrough(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+func (w *gzipWriter) writeThrough(b []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if w.decided {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.code = code
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+
+	if w.decided {
+		return w.writeThrough(b)
+	}
+
+	w.buf.Write(b)
+	if w.buf.Len() >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Flush sends the data written so far to the client, compressing it
+func (w *gzipWriter) Flush() {
+
+	if !w.decided {
+		w.decide(true)
+	}
+
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, if the underlying writer supports it. Nothing is written by the writer after that
+func (w *gzipWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := vertex.HijackConn(w.ResponseWriter)
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Close writes small responses as they are, and finishes the compressed stream of others
+func (w *gzipWriter) Close() error {
+
+	if w.hijacked {
+		return nil
+	}
+
+	if !w.decided {
+		return w.decide(false)
+	}
+
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
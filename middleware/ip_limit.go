@@ -4,8 +4,6 @@ import (
 	"net"
 	"net/http"
 
-	"github.com/dvirsky/go-pylog/logging"
-
 	"github.com/EverythingMe/vertex"
 )
 
@@ -44,10 +42,10 @@ func (f *IPRangeFilter) Allow(cidrs ...string) *IPRangeFilter {
 		}
 		_, ipnet, err := net.ParseCIDR(addr)
 		if err != nil {
-			logging.Error("Error parsing CIDR: %s", err)
+			logError("Error parsing CIDR: %s", err)
 			continue
 		}
-		logging.Info("Allowing traffic from %s (%s)", ipnet, addr)
+		logInfo("Allowing traffic from %s (%s)", ipnet, addr)
 		f.allowed = append(f.allowed, ipnet)
 
 	}
@@ -66,7 +64,7 @@ func (f *IPRangeFilter) Deny(cidrs ...string) *IPRangeFilter {
 		}
 		_, ipnet, err := net.ParseCIDR(addr)
 		if err != nil {
-			logging.Error("Error parsing CIDR: %s", err)
+			logError("Error parsing CIDR: %s", err)
 			continue
 		}
 		f.denied = append(f.denied, ipnet)
@@ -90,7 +88,7 @@ func (f *IPRangeFilter) Handle(w http.ResponseWriter, r *vertex.Request, next ve
 
 	for _, ipnet := range f.allowed {
 		if ipnet.Contains(ip) {
-			logging.Info("IP Address %s allowed", r.RemoteIP)
+			logInfo("IP Address %s allowed", r.RemoteIP)
 			return next(w, r)
 		}
 
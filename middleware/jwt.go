@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/EverythingMe/vertex"
+)
+
+// The request attribute holding the claims of the JWT token validated by JWTMiddleware, as a map[string]interface{}.
+// e.g. the user id of a token is usually:
+//	claims, _ := r.Attribute(middleware.AttrJWTClaims)
+//	userId := claims.(map[string]interface{})["sub"]
+const AttrJWTClaims = "jwt_claims"
+
+// JWTMiddleware authenticates requests with HMAC signed JWT tokens, sent as bearer tokens in the Authorization header.
+//
+// Requests without a token, or with a token that is malformed, expired or not signed with the key, fail with an
+// unauthorized (401) error. The claims of valid tokens are saved in the AttrJWTClaims attribute of the request
+type JWTMiddleware struct {
+	key []byte
+}
+
+// NewJWTMiddleware creates a JWT middleware validating tokens signed with the given HMAC key
+func NewJWTMiddleware(key string) *JWTMiddleware {
+	return &JWTMiddleware{
+		key: []byte(key),
+	}
+}
+
+// bearerToken extracts the bearer token from the Authorization header of a request
+func bearerToken(r *vertex.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// parse validates a token, returning its claims
+func (m *JWTMiddleware) parse(tokenString string) (map[string]interface{}, error) {
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		// we must make sure the token is signed with our method - otherwise the key can be misused
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Header["alg"])
+		}
+		return m.key, nil
+	})
+
+	if err != nil {
+		if verr, ok := err.(*jwt.ValidationError); ok {
+			switch {
+			case verr.Errors&jwt.ValidationErrorMalformed != 0:
+				return nil, vertex.UnauthorizedError("Malformed token: %s", err)
+			case verr.Errors&jwt.ValidationErrorExpired != 0:
+				return nil, vertex.UnauthorizedError("Token expired")
+			case verr.Errors&jwt.ValidationErrorNotValidYet != 0:
+				return nil, vertex.UnauthorizedError("Token not valid yet")
+			}
+		}
+		return nil, vertex.UnauthorizedError("Invalid token: %s", err)
+	}
+
+	if !token.Valid {
+		return nil, vertex.UnauthorizedError("Invalid token")
+	}
+
+	return token.Claims, nil
+}
+
+func (m *JWTMiddleware) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
+
+	tokenString := bearerToken(r)
+	if tokenString == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return nil, vertex.UnauthorizedError("Missing bearer token")
+	}
+
+	claims, err := m.parse(tokenString)
+	if err != nil {
+		logWarning("Denying request with invalid JWT token: %s", err)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, err.Error()))
+		return nil, err
+	}
+
+	r.SetAttribute(AttrJWTClaims, claims)
+	return next(w, r)
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/EverythingMe/vertex"
+)
+
+// printf style helpers logging to the logger set with vertex.SetLogger
+
+func logDebug(format string, args ...interface{}) {
+	vertex.GetLogger().Debug(fmt.Sprintf(format, args...))
+}
+
+func logInfo(format string, args ...interface{}) {
+	vertex.GetLogger().Info(fmt.Sprintf(format, args...))
+}
+
+func logWarning(format string, args ...interface{}) {
+	vertex.GetLogger().Warn(fmt.Sprintf(format, args...))
+}
+
+func logError(format string, args ...interface{}) {
+	vertex.GetLogger().Error(fmt.Sprintf(format, args...))
+}
@@ -1,23 +1,138 @@
 package middleware
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"time"
 
-	"github.com/dvirsky/go-pylog/logging"
 	"github.com/EverythingMe/vertex"
 )
 
-// RequestLogger is a middleware that logs the paths and return values of all requests
+// RequestLogger is a middleware that logs the paths and return values of all requests. The values of sensitive params
+// are masked
 var RequestLogger = vertex.MiddlewareFunc(func(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
 
-	logging.Info("Handling %s %s", r.Method, r.URL.String())
+	logInfo("Handling %s %s", r.Method, r.RedactedURL())
 
 	ret, err := next(w, r)
 
-	logging.Info("Return value was %v %v", ret, err)
+	logInfo("%s", r.Redact(fmt.Sprintf("Return value was %v %v", ret, err)))
 	return ret, err
 })
 
+// AccessLogEntry describes a single handled request
+type AccessLogEntry struct {
+	Method    string
+	Path      string
+	Status    int
+	Size      int
+	Duration  time.Duration
+	RequestId string
+}
+
+// String formats the entry as a single line of key=value pairs
+func (e AccessLogEntry) String() string {
+	return fmt.Sprintf("method=%s path=%q status=%d size=%d duration_ms=%.03f request_id=%s",
+		e.Method, e.Path, e.Status, e.Size, e.Duration.Seconds()*1000, e.RequestId)
+}
+
+// LoggingMiddleware logs a structured line for every request, with its method, path, status code, processing time and
+// request id. The values of sensitive path params are masked in the path.
+//
+// To know the status code, the middleware renders the response itself (see vertex.RenderResponse). Lines are written
+// to Output, or to the vertex log if it is nil, formatted by Format or by AccessLogEntry.String if it is nil
+type LoggingMiddleware struct {
+	Output io.Writer
+	Format func(AccessLogEntry) string
+}
+
+// NewLoggingMiddleware creates a logging middleware writing to out. If out is nil, the lines go to the vertex log
+func NewLoggingMiddleware(out io.Writer) *LoggingMiddleware {
+	return &LoggingMiddleware{
+		Output: out,
+	}
+}
+
+func (m *LoggingMiddleware) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
+
+	sw := &statusWriter{ResponseWriter: w}
+
+	v, err := next(sw, r)
+	if !vertex.IsHijacked(err) {
+		err = vertex.RenderResponse(v, err, sw, r)
+	}
+
+	entry := AccessLogEntry{
+		Method:    r.Method,
+		Path:      r.Redact(r.URL.Path),
+		Status:    sw.status(),
+		Size:      sw.size,
+		Duration:  time.Since(r.StartTime),
+		RequestId: r.RequestId,
+	}
+
+	line := ""
+	if m.Format != nil {
+		line = m.Format(entry)
+	} else {
+		line = entry.String()
+	}
+
+	if m.Output == nil {
+		logInfo("%s", line)
+	} else if _, e := fmt.Fprintln(m.Output, line); e != nil {
+		logError("Could not write access log: %s", e)
+	}
+
+	return nil, err
+}
+
+// statusWriter records the status code and size of a response
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+	size int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// Flush flushes the underlying writer, if it supports flushing
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, if the underlying writer supports it
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return vertex.HijackConn(w.ResponseWriter)
+}
+
+// status returns the status code of the response. Nothing written means an empty 200 response
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
 //func StaticText(msg string) vertex.MiddlewareFunc {
 
 //	//h := http.FileServer(dir)
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/EverythingMe/vertex"
+)
+
+// DefaultMaxBodySize is the body size limit of NewMaxBodyMiddleware if no limit is given
+const DefaultMaxBodySize = 10 << 20
+
+// MaxBodyMiddleware limits the size of request bodies, responding with 413 Request Entity Too Large to requests with
+// larger bodies. Bodies are wrapped with http.MaxBytesReader, so handlers reading them cannot read more than the limit.
+//
+// Like the ConnectionLimiter, an instance can be applied to the whole API, and instances with larger limits to specific
+// routes, e.g. uploads.
+//
+// Urlencoded and multipart forms, e.g. file uploads, are parsed when the handler's params are bound, or by middleware
+// reading body params after this one (see vertex.ParseForm), so they are limited too, and forms that are too large
+// fail with a 413, even if their length is not declared
+type MaxBodyMiddleware struct {
+	limit int64
+}
+
+// NewMaxBodyMiddleware creates a new body size limiting middleware, limiting bodies to the given number of bytes
+func NewMaxBodyMiddleware(limit int64) *MaxBodyMiddleware {
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+
+	return &MaxBodyMiddleware{
+		limit: limit,
+	}
+}
+
+func (m *MaxBodyMiddleware) tooLarge() error {
+	return vertex.RequestEntityTooLargeError("Request body is larger than %d bytes", m.limit)
+}
+
+func (m *MaxBodyMiddleware) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
+
+	if r.ContentLength > m.limit {
+		logWarning("Request body too large: %d/%d", r.ContentLength, m.limit)
+		return nil, m.tooLarge()
+	}
+
+	if r.Body == nil {
+		return next(w, r)
+	}
+
+	body := &limitedBody{
+		ReadCloser: http.MaxBytesReader(w, r.Body, m.limit),
+		limit:      m.limit,
+	}
+	r.Body = body
+
+	v, err := next(w, r)
+
+	// whatever the handler made of the failed read, the client should know why it failed
+	if body.exceeded && !vertex.IsHijacked(err) {
+		logWarning("Request body too large: more than %d bytes", m.limit)
+		return nil, m.tooLarge()
+	}
+
+	return v, err
+}
+
+// limitedBody tracks whether reading a body failed because it exceeded the limit
+type limitedBody struct {
+	io.ReadCloser
+
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		b.exceeded = true
+	}
+	return n, err
+}
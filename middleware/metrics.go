@@ -0,0 +1,322 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EverythingMe/vertex"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the request latency histogram buckets
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultLatencySamples is the number of latest requests of each route that latency percentiles are computed over
+const DefaultLatencySamples = 1024
+
+// the latency percentiles reported in the metrics and route stats
+var latencyQuantiles = []float64{0.5, 0.9, 0.99}
+
+// metric names, in the Prometheus naming convention
+const (
+	metricRequests = "vertex_requests_total"
+	metricLatency  = "vertex_request_duration_seconds"
+	metricInFlight = "vertex_requests_in_flight"
+	metricQuantile = "vertex_request_latency_seconds"
+)
+
+// a histogram of the latencies of a single label set, with a window of the latest samples for percentiles
+type histogram struct {
+	api, route, method string
+
+	counts []uint64
+	count  uint64
+	sum    float64
+
+	samples []float64
+	next    int
+}
+
+func (h *histogram) addSample(secs float64, size int) {
+	if len(h.samples) < size {
+		h.samples = append(h.samples, secs)
+		return
+	}
+	h.samples[h.next] = secs
+	h.next = (h.next + 1) % len(h.samples)
+}
+
+// quantiles returns the latency percentiles of the sampled requests, using the nearest rank method
+func (h *histogram) quantiles(qs []float64) []float64 {
+
+	sorted := append([]float64(nil), h.samples...)
+	sort.Float64s(sorted)
+
+	ret := make([]float64, len(qs))
+	if len(sorted) == 0 {
+		return ret
+	}
+
+	for i, q := range qs {
+		rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		ret[i] = sorted[rank]
+	}
+	return ret
+}
+
+// RouteStats is a snapshot of the latency of a route, see Metrics.Stats
+type RouteStats struct {
+	API    string
+	Route  string
+	Method string
+
+	// The number of requests handled by the route
+	Count uint64
+	// The mean latency of all requests
+	Mean time.Duration
+	// Latency percentiles of the latest requests
+	P50, P90, P99 time.Duration
+}
+
+// Metrics is a middleware recording request counts, latency histograms and in-flight requests, labeled by API, route,
+// method and status code. Routes are labeled by their definition (e.g. /users/{id}) and not by the actual path.
+//
+// Latencies are the processing time of the requests, as reported in the processing time header. Besides the
+// histogram, p50/p90/p99 percentiles of the latest SampleSize requests of each route are exposed as a summary, and can be
+// read with Stats.
+//
+// Metrics is also an http.Handler exposing the metrics in the Prometheus text format, see Server.ExposeMetrics.
+// If metrics are disabled in the server config, the middleware does nothing
+type Metrics struct {
+	// The upper bounds of the latency histogram buckets, in seconds
+	Buckets []float64
+	// The number of latest requests of each route that latency percentiles are computed over
+	SampleSize int
+
+	lock     sync.Mutex
+	requests map[string]uint64
+	latency  map[string]*histogram
+	inFlight map[string]int64
+}
+
+// NewMetrics creates a new metrics middleware with the default latency buckets
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Buckets:    DefaultLatencyBuckets,
+		SampleSize: DefaultLatencySamples,
+		requests:   make(map[string]uint64),
+		latency:    make(map[string]*histogram),
+		inFlight:   make(map[string]int64),
+	}
+}
+
+// formatLabels formats label pairs in the Prometheus format, e.g. {api="foo",route="/bar"}
+func formatLabels(kv ...string) string {
+	pairs := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", kv[i], strconv.Quote(kv[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *Metrics) trackInFlight(labels string, delta int64) {
+	m.lock.Lock()
+	m.inFlight[labels] += delta
+	m.lock.Unlock()
+}
+
+func (m *Metrics) observe(r *vertex.Request, status int, duration time.Duration) {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.requests[formatLabels("api", r.APIName, "route", r.RoutePath, "method", r.Method, "status", strconv.Itoa(status))]++
+
+	labels := formatLabels("api", r.APIName, "route", r.RoutePath, "method", r.Method)
+	h := m.latency[labels]
+	if h == nil {
+		h = &histogram{
+			api:    r.APIName,
+			route:  r.RoutePath,
+			method: r.Method,
+			counts: make([]uint64, len(m.Buckets)),
+		}
+		m.latency[labels] = h
+	}
+
+	secs := duration.Seconds()
+	for i, bound := range m.Buckets {
+		if secs <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += secs
+
+	size := m.SampleSize
+	if size <= 0 {
+		size = DefaultLatencySamples
+	}
+	h.addSample(secs, size)
+}
+
+func (m *Metrics) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
+
+	if vertex.ServerConfig().DisableMetrics {
+		return next(w, r)
+	}
+
+	flightLabels := formatLabels("api", r.APIName, "route", r.RoutePath)
+	m.trackInFlight(flightLabels, 1)
+	defer m.trackInFlight(flightLabels, -1)
+
+	// like the logging middleware, we render the response to know its status
+	sw := &statusWriter{ResponseWriter: w}
+
+	v, err := next(sw, r)
+	if !vertex.IsHijacked(err) {
+		err = vertex.RenderResponse(v, err, sw, r)
+	}
+
+	// the processing time is set when the response is rendered, unless the renderer skipped the meta headers
+	duration := r.ProcessingTime
+	if duration == 0 {
+		duration = time.Since(r.StartTime)
+	}
+	m.observe(r, sw.status(), duration)
+
+	return nil, err
+}
+
+// Stats returns a snapshot of the latency of every route that handled requests, sorted by API, route and method
+func (m *Metrics) Stats() []RouteStats {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ret := make([]RouteStats, 0, len(m.latency))
+	for _, labels := range sortedKeys(m.latency) {
+		h := m.latency[labels]
+		qs := h.quantiles(latencyQuantiles)
+
+		st := RouteStats{
+			API:    h.api,
+			Route:  h.route,
+			Method: h.method,
+			Count:  h.count,
+			P50:    seconds(qs[0]),
+			P90:    seconds(qs[1]),
+			P99:    seconds(qs[2]),
+		}
+		if h.count > 0 {
+			st.Mean = seconds(h.sum / float64(h.count))
+		}
+		ret = append(ret, st)
+	}
+
+	return ret
+}
+
+func seconds(secs float64) time.Duration {
+	return time.Duration(secs * float64(time.Second))
+}
+
+// sortedKeys returns the keys of a metric map in a stable order
+func sortedKeys(m interface{}) []string {
+	var ret []string
+	switch x := m.(type) {
+	case map[string]uint64:
+		for k := range x {
+			ret = append(ret, k)
+		}
+	case map[string]*histogram:
+		for k := range x {
+			ret = append(ret, k)
+		}
+	case map[string]int64:
+		for k := range x {
+			ret = append(ret, k)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// WriteTo writes all the metrics in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	lines := []string{
+		"# HELP " + metricRequests + " The number of handled requests",
+		"# TYPE " + metricRequests + " counter",
+	}
+	for _, labels := range sortedKeys(m.requests) {
+		lines = append(lines, fmt.Sprintf("%s%s %d", metricRequests, labels, m.requests[labels]))
+	}
+
+	lines = append(lines,
+		"# HELP "+metricLatency+" The latency of handled requests",
+		"# TYPE "+metricLatency+" histogram",
+	)
+	for _, labels := range sortedKeys(m.latency) {
+		h := m.latency[labels]
+
+		// bucket labels are added to the existing label set
+		prefix := strings.TrimSuffix(labels, "}") + ","
+		for i, bound := range m.Buckets {
+			lines = append(lines, fmt.Sprintf("%s_bucket%sle=%q} %d", metricLatency, prefix,
+				strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i]))
+		}
+		lines = append(lines,
+			fmt.Sprintf("%s_bucket%sle=\"+Inf\"} %d", metricLatency, prefix, h.count),
+			fmt.Sprintf("%s_sum%s %g", metricLatency, labels, h.sum),
+			fmt.Sprintf("%s_count%s %d", metricLatency, labels, h.count),
+		)
+	}
+
+	lines = append(lines,
+		"# HELP "+metricQuantile+" Latency percentiles of the latest handled requests",
+		"# TYPE "+metricQuantile+" summary",
+	)
+	for _, labels := range sortedKeys(m.latency) {
+		h := m.latency[labels]
+
+		prefix := strings.TrimSuffix(labels, "}") + ","
+		for i, v := range h.quantiles(latencyQuantiles) {
+			lines = append(lines, fmt.Sprintf("%s%squantile=%q} %g", metricQuantile, prefix,
+				strconv.FormatFloat(latencyQuantiles[i], 'g', -1, 64), v))
+		}
+		lines = append(lines,
+			fmt.Sprintf("%s_sum%s %g", metricQuantile, labels, h.sum),
+			fmt.Sprintf("%s_count%s %d", metricQuantile, labels, h.count),
+		)
+	}
+
+	lines = append(lines,
+		"# HELP "+metricInFlight+" The number of requests being handled",
+		"# TYPE "+metricInFlight+" gauge",
+	)
+	for _, labels := range sortedKeys(m.inFlight) {
+		lines = append(lines, fmt.Sprintf("%s%s %d", metricInFlight, labels, m.inFlight[labels]))
+	}
+
+	n, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return int64(n), err
+}
+
+// ServeHTTP exposes the metrics to Prometheus
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
@@ -1,11 +1,29 @@
 package middleware
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/EverythingMe/vertex"
 )
@@ -51,4 +69,1108 @@ func TestAPIKeyValidator(t *testing.T) {
 	assert.Error(t, check(""))
 	assert.Error(t, check("sdfsdfsd"))
 
+	// keys sent in the body of POST requests
+	post := func(k string) error {
+		hr, _ := http.NewRequest("POST", "/foo", strings.NewReader(url.Values{"apiKey": {k}}.Encode()))
+		hr.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		_, err := v.Handle(httptest.NewRecorder(), vertex.NewRequest(hr), mockkHandler)
+		return err
+	}
+	assert.NoError(t, post("foo"))
+	assert.Error(t, post("sdfsdfsd"))
+
+}
+
+func TestCORS(t *testing.T) {
+
+	request := func(method, origin string, preflight bool) *vertex.Request {
+		hr, _ := http.NewRequest(method, "/foo", nil)
+		if origin != "" {
+			hr.Header.Set("Origin", origin)
+		}
+		if preflight {
+			hr.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		return vertex.NewRequest(hr)
+	}
+
+	called := false
+	next := vertex.HandlerFunc(func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		called = true
+		return "ok", nil
+	})
+
+	// the default config allows any origin
+	c := NewCORS().Default()
+	w := httptest.NewRecorder()
+	v, err := c.Handle(w, request("GET", "http://foo.com", false), next)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", v)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET,POST,OPTIONS,PUT", w.Header().Get("Access-Control-Allow-Methods"))
+
+	c = NewCORS().AllowOrigins("http://foo.com", "https://bar.com").AllowMethods("GET", "POST").
+		AllowHeaders("X-Foo").MaxAge(time.Hour)
+
+	w = httptest.NewRecorder()
+	_, err = c.Handle(w, request("GET", "https://bar.com", false), next)
+	assert.NoError(t, err)
+	assert.True(t, called)
+	assert.Equal(t, "https://bar.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+	assert.Equal(t, "", w.Header().Get("Access-Control-Max-Age"))
+
+	w = httptest.NewRecorder()
+	_, err = c.Handle(w, request("GET", "http://baz.com", false), next)
+	assert.NoError(t, err)
+	assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+
+	// preflight requests are answered directly
+	called = false
+	w = httptest.NewRecorder()
+	_, err = c.Handle(w, request("OPTIONS", "http://foo.com", true), next)
+	assert.True(t, vertex.IsHijacked(err))
+	assert.False(t, called)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "http://foo.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET,POST", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "X-Foo", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "3600", w.Header().Get("Access-Control-Max-Age"))
+
+	// an OPTIONS request that is not a preflight request goes on to the handler
+	_, err = c.Handle(httptest.NewRecorder(), request("OPTIONS", "http://foo.com", false), next)
+	assert.NoError(t, err)
+	assert.True(t, called)
+}
+
+func TestRateLimiter(t *testing.T) {
+
+	now := time.Now()
+	l := NewRateLimiter(1, time.Second, 2)
+	l.now = func() time.Time { return now }
+
+	check := func(ip string) (*httptest.ResponseRecorder, error) {
+		hr, _ := http.NewRequest("GET", "/foo", nil)
+		r := vertex.NewRequest(hr)
+		r.RemoteIP = ip
+		w := httptest.NewRecorder()
+		_, err := l.Handle(w, r, mockkHandler)
+		return w, err
+	}
+
+	_, err := check("8.8.8.8")
+	assert.NoError(t, err)
+	_, err = check("8.8.8.8")
+	assert.NoError(t, err)
+
+	w, err := check("8.8.8.8")
+	assert.Error(t, err)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// other clients have their own bucket
+	_, err = check("8.8.4.4")
+	assert.NoError(t, err)
+
+	// tokens are refilled over time
+	now = now.Add(1500 * time.Millisecond)
+	_, err = check("8.8.8.8")
+	assert.NoError(t, err)
+	_, err = check("8.8.8.8")
+	assert.Error(t, err)
+
+	// limiting by a custom key
+	l = NewRateLimiter(10, time.Minute, 1)
+	l.KeyFunc = func(r *vertex.Request) string { return r.FormValue("user") }
+
+	_, err = check("8.8.8.8")
+	assert.NoError(t, err)
+	w, err = check("8.8.4.4")
+	assert.Error(t, err)
+	assert.Equal(t, "6", w.Header().Get("Retry-After"))
+
+	// without a burst, clients can burst up to the number of requests per interval
+	l = NewRateLimiter(2, time.Second, 0)
+	l.now = func() time.Time { return now }
+
+	_, err = check("8.8.8.8")
+	assert.NoError(t, err)
+	_, err = check("8.8.8.8")
+	assert.NoError(t, err)
+	_, err = check("8.8.8.8")
+	assert.Error(t, err)
+}
+
+func TestAutoRecover(t *testing.T) {
+
+	hr, _ := http.NewRequest("GET", "/foo", nil)
+	r := vertex.NewRequest(hr)
+
+	v, err := AutoRecover.Handle(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		return "ok", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", v)
+
+	w := httptest.NewRecorder()
+	_, err = AutoRecover.Handle(w, r, func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		panic("boom")
+	})
+	assert.Error(t, err)
+	assert.False(t, vertex.IsHijacked(err))
+	assert.Contains(t, err.Error(), "boom")
+
+	// a response that was already written is not replaced with an error
+	w = httptest.NewRecorder()
+	_, err = AutoRecover.Handle(w, r, func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("partial"))
+		panic("boom")
+	})
+	assert.True(t, vertex.IsHijacked(err))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "partial", w.Body.String())
+}
+
+func TestGzip(t *testing.T) {
+
+	large := strings.Repeat("foo bar baz ", 200)
+
+	handle := func(accept string, v interface{}) *httptest.ResponseRecorder {
+		hr, _ := http.NewRequest("GET", "/foo", nil)
+		if accept != "" {
+			hr.Header.Set("Accept-Encoding", accept)
+		}
+		r := vertex.NewRequest(hr)
+		w := httptest.NewRecorder()
+
+		_, err := NewGzipMiddleware(0).Handle(w, r, func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+			return v, nil
+		})
+		assert.True(t, vertex.IsHijacked(err))
+		return w
+	}
+
+	w := handle("deflate, gzip", large)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.NotEmpty(t, w.Header().Get(vertex.HeaderProcessingTime))
+
+	gz, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%q", large), string(b))
+
+	// small responses are not compressed
+	w = handle("gzip", "foo")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, `"foo"`, w.Body.String())
+
+	// clients that don't accept gzip get the response as is, rendered by the framework
+	hr, _ := http.NewRequest("GET", "/foo", nil)
+	hr.Header.Set("Accept-Encoding", "gzip;q=0")
+	v, err := NewGzipMiddleware(0).Handle(httptest.NewRecorder(), vertex.NewRequest(hr), func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		return large, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, large, v)
+
+	// errors are rendered with their status code
+	hr, _ = http.NewRequest("GET", "/foo", nil)
+	hr.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	NewGzipMiddleware(0).Handle(w, vertex.NewRequest(hr), func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		return nil, vertex.MissingParamError("missing foo")
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "missing foo\n", w.Body.String())
+}
+
+func TestTimeout(t *testing.T) {
+
+	m := NewTimeoutMiddleware(50 * time.Millisecond)
+
+	hr, _ := http.NewRequest("GET", "/foo", nil)
+	r := vertex.NewRequest(hr)
+	w := httptest.NewRecorder()
+
+	v, err := m.Handle(w, r, func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Error("No deadline on the request context")
+		}
+		w.Header().Set("X-Foo", "bar")
+		return "ok", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", v)
+	assert.Equal(t, "bar", w.Header().Get("X-Foo"))
+
+	hr, _ = http.NewRequest("GET", "/foo", nil)
+	r = vertex.NewRequest(hr)
+	w = httptest.NewRecorder()
+	cancelled := make(chan struct{})
+
+	_, err = m.Handle(w, r, func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		<-r.Context().Done()
+		close(cancelled)
+		w.Write([]byte("too late"))
+		return "too late", nil
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+	<-cancelled
+	assert.Equal(t, "", w.Body.String())
+
+	// panics are propagated to the request's goroutine
+	hr, _ = http.NewRequest("GET", "/foo", nil)
+	r = vertex.NewRequest(hr)
+	assert.Panics(t, func() {
+		m.Handle(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+			panic("boom")
+		})
+	})
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+
+	out := bytes.NewBuffer(nil)
+	m := NewLoggingMiddleware(out)
+
+	hr, _ := http.NewRequest("POST", "/foo/bar?baz=1", nil)
+	r := vertex.NewRequest(hr)
+	w := httptest.NewRecorder()
+
+	_, err := m.Handle(w, r, func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		return nil, vertex.MissingParamError("missing baz")
+	})
+	assert.True(t, vertex.IsHijacked(err))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	line := out.String()
+	assert.Contains(t, line, `method=POST path="/foo/bar" status=400 size=12 duration_ms=`)
+	assert.True(t, strings.HasSuffix(line, " request_id="+r.RequestId+"\n"), line)
+
+	// custom formatting
+	out.Reset()
+	m.Format = func(e AccessLogEntry) string {
+		return fmt.Sprintf("%s %d", e.Path, e.Status)
+	}
+	m.Handle(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		return "ok", nil
+	})
+	assert.Equal(t, "/foo/bar 200\n", out.String())
+}
+
+func TestBasicAuthMiddleware(t *testing.T) {
+
+	m := NewBasicAuthMiddleware("test", StaticCredentials("foo", "bar"))
+
+	check := func(user, pass string) (*httptest.ResponseRecorder, interface{}, error) {
+		hr, _ := http.NewRequest("GET", "/foo", nil)
+		if user != "" {
+			hr.SetBasicAuth(user, pass)
+		}
+		r := vertex.NewRequest(hr)
+		r.RemoteIP = "8.8.8.8"
+		w := httptest.NewRecorder()
+		v, err := m.Handle(w, r, func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+			user, _ := r.Attribute(AttrBasicAuthUser)
+			return user, nil
+		})
+		return w, v, err
+	}
+
+	_, v, err := check("foo", "bar")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", v)
+
+	for _, creds := range [][2]string{{"", ""}, {"foo", "baz"}, {"bar", "bar"}} {
+		w, _, err := check(creds[0], creds[1])
+		assert.Error(t, err)
+		assert.Equal(t, `Basic realm="test"`, w.Header().Get("WWW-Authenticate"))
+
+		// the error renders as a 401
+		w = httptest.NewRecorder()
+		hr, _ := http.NewRequest("GET", "/foo", nil)
+		vertex.JSONRenderer{}.Render(nil, err, w, vertex.NewRequest(hr))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestJWTMiddleware(t *testing.T) {
+
+	m := NewJWTMiddleware("secret")
+
+	sign := func(key string, claims map[string]interface{}) string {
+		token := jwt.New(jwt.SigningMethodHS256)
+		for k, v := range claims {
+			token.Claims[k] = v
+		}
+		s, err := token.SignedString([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	check := func(auth string) (interface{}, error) {
+		hr, _ := http.NewRequest("GET", "/foo", nil)
+		if auth != "" {
+			hr.Header.Set("Authorization", auth)
+		}
+		return m.Handle(httptest.NewRecorder(), vertex.NewRequest(hr), func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+			claims, _ := r.Attribute(AttrJWTClaims)
+			return claims.(map[string]interface{})["sub"], nil
+		})
+	}
+
+	v, err := check("Bearer " + sign("secret", map[string]interface{}{"sub": "user1", "exp": time.Now().Add(time.Hour).Unix()}))
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", v)
+
+	_, err = check("")
+	assert.EqualError(t, err, "Missing bearer token")
+
+	_, err = check("Bearer " + sign("secret", map[string]interface{}{"sub": "user1", "exp": time.Now().Add(-time.Hour).Unix()}))
+	assert.EqualError(t, err, "Token expired")
+
+	_, err = check("Bearer foo.bar")
+	assert.Contains(t, err.Error(), "Malformed token")
+
+	_, err = check("Bearer " + sign("other secret", map[string]interface{}{"sub": "user1"}))
+	assert.Contains(t, err.Error(), "Invalid token")
+}
+
+func TestCacheMiddleware(t *testing.T) {
+
+	calls := 0
+	handler := vertex.HandlerFunc(func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		calls++
+		if r.FormValue("fail") != "" {
+			return nil, vertex.NewErrorf("WAT")
+		}
+		return calls, nil
+	})
+
+	m := NewCacheMiddleware(10, time.Minute)
+
+	check := func(u string) (*httptest.ResponseRecorder, interface{}, error) {
+		hr, _ := http.NewRequest("GET", u, nil)
+		hr.ParseForm()
+		w := httptest.NewRecorder()
+		v, err := m.Handle(w, vertex.NewRequest(hr), handler)
+		return w, v, err
+	}
+
+	w, v, err := check("/foo?a=1&b=2")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v)
+	assert.Equal(t, "MISS", w.Header().Get(HeaderCache))
+
+	// the params are sorted in the key
+	w, v, err = check("/foo?b=2&a=1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v)
+	assert.Equal(t, "HIT", w.Header().Get(HeaderCache))
+
+	w, v, err = check("/foo?a=2")
+	assert.Equal(t, 2, v)
+	assert.Equal(t, "MISS", w.Header().Get(HeaderCache))
+
+	// errors are not cached
+	_, _, err = check("/foo?fail=1")
+	assert.Error(t, err)
+	w, _, err = check("/foo?fail=1")
+	assert.Error(t, err)
+	assert.Equal(t, "MISS", w.Header().Get(HeaderCache))
+	assert.Equal(t, 4, calls)
+
+	// entries expire after the ttl
+	m = NewCacheMiddleware(10, -time.Second)
+	check("/foo")
+	w, v, _ = check("/foo")
+	assert.Equal(t, "MISS", w.Header().Get(HeaderCache))
+	assert.Equal(t, 6, v)
+
+	// custom key
+	m = NewCacheMiddlewareStore(NewLRUCacheStore(10), time.Minute)
+	m.KeyFunc = func(r *vertex.Request) string { return r.URL.Path }
+	check("/bar?a=1")
+	w, v, _ = check("/bar?a=2")
+	assert.Equal(t, "HIT", w.Header().Get(HeaderCache))
+	assert.Equal(t, 7, v)
+
+	// the params in the body of POST requests are part of the key
+	m = NewCacheMiddleware(10, time.Minute)
+	post := func(user string) (*httptest.ResponseRecorder, interface{}) {
+		hr, _ := http.NewRequest("POST", "/hello", strings.NewReader(url.Values{"user": {user}}.Encode()))
+		hr.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		v, _ := m.Handle(w, vertex.NewRequest(hr), func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+			return "hello " + r.FormValue("user"), nil
+		})
+		return w, v
+	}
+	w, v = post("alice")
+	assert.Equal(t, "hello alice", v)
+	w, v = post("bob")
+	assert.Equal(t, "MISS", w.Header().Get(HeaderCache))
+	assert.Equal(t, "hello bob", v)
+	w, v = post("alice")
+	assert.Equal(t, "HIT", w.Header().Get(HeaderCache))
+	assert.Equal(t, "hello alice", v)
+
+	// readers can be read only once, so they are not cached
+	for _, resp := range []func() interface{}{
+		func() interface{} { return strings.NewReader("streamed") },
+		func() interface{} { return vertex.FileResponse{Reader: strings.NewReader("file"), Filename: "a"} },
+		func() interface{} { return &vertex.FileResponse{Reader: strings.NewReader("file"), Filename: "a"} },
+		func() interface{} { return vertex.StatusResponse{Status: 201, Body: strings.NewReader("streamed")} },
+	} {
+		m = NewCacheMiddleware(10, time.Minute)
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			hr, _ := http.NewRequest("GET", "/stream", nil)
+			v, err := m.Handle(w, vertex.NewRequest(hr), func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+				return resp(), nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "MISS", w.Header().Get(HeaderCache), "%T", v)
+		}
+	}
+}
+
+func TestCacheMiddlewarePerIdentity(t *testing.T) {
+
+	calls := 0
+	handler := vertex.HandlerFunc(func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		calls++
+		id, _ := RequestIdentity(r)
+		return fmt.Sprintf("%s:%d", id, calls), nil
+	})
+
+	m := NewCacheMiddleware(10, time.Minute)
+	m.PerIdentity = true
+	m.VaryHeaders = []string{"Accept-Language"}
+
+	check := func(user, lang string) (string, string) {
+		hr, _ := http.NewRequest("GET", "/foo", nil)
+		hr.Header.Set("Accept-Language", lang)
+		hr.ParseForm()
+		r := vertex.NewRequest(hr)
+		if user != "" {
+			r.SetAttribute(AttrBasicAuthUser, user)
+		}
+		w := httptest.NewRecorder()
+		v, err := m.Handle(w, r, handler)
+		assert.NoError(t, err)
+		return fmt.Sprint(v), w.Header().Get(HeaderCache)
+	}
+
+	v, cache := check("alice", "en")
+	assert.Equal(t, "basic:alice:1", v)
+	assert.Equal(t, "MISS", cache)
+
+	v, cache = check("alice", "en")
+	assert.Equal(t, "basic:alice:1", v)
+	assert.Equal(t, "HIT", cache)
+
+	// another user does not get alice's response, and neither does alice in another language
+	v, _ = check("bob", "en")
+	assert.Equal(t, "basic:bob:2", v)
+	v, _ = check("alice", "fr")
+	assert.Equal(t, "basic:alice:3", v)
+
+	// anonymous requests share their responses, unless they are skipped
+	check("", "en")
+	v, cache = check("", "en")
+	assert.Equal(t, ":4", v)
+	assert.Equal(t, "HIT", cache)
+
+	m.SkipAnonymous = true
+	v, cache = check("", "en")
+	assert.Equal(t, ":5", v)
+	assert.Empty(t, cache)
+
+	// identities of other authentication schemes
+	m.IdentityFunc = func(r *vertex.Request) (string, bool) { return r.Header.Get("Accept-Language"), true }
+	v, _ = check("", "de")
+	assert.Equal(t, ":6", v)
+
+	hr, _ := http.NewRequest("GET", "/foo", nil)
+	r := vertex.NewRequest(hr)
+	r.SetAttribute(AttrJWTClaims, map[string]interface{}{"sub": 42.0})
+	id, ok := RequestIdentity(r)
+	assert.True(t, ok)
+	assert.Equal(t, "jwt:42", id)
+}
+
+func TestETagMiddleware(t *testing.T) {
+
+	handle := func(method, ifNoneMatch string, h vertex.HandlerFunc) *httptest.ResponseRecorder {
+		hr, _ := http.NewRequest(method, "/foo", nil)
+		if ifNoneMatch != "" {
+			hr.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		NewETagMiddleware().Handle(w, vertex.NewRequest(hr), h)
+		return w
+	}
+
+	foo := vertex.HandlerFunc(func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		return "foo", nil
+	})
+
+	w := handle("GET", "", foo)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"foo"`, w.Body.String())
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	// the same response gets the same etag, and a matching client gets a 304
+	w = handle("GET", etag, foo)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, "", w.Body.String())
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	w = handle("GET", `"bar", W/`+etag, foo)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = handle("GET", `"bar"`, foo)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"foo"`, w.Body.String())
+
+	// unsafe methods are not tagged
+	w = handle("POST", etag, foo)
+	assert.Equal(t, "", w.Header().Get("ETag"))
+
+	// errors and no-store responses are not tagged
+	w = handle("GET", "*", func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		return nil, vertex.MissingParamError("missing foo")
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "", w.Header().Get("ETag"))
+
+	w = handle("GET", "*", func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		w.Header().Set("Cache-Control", "no-store")
+		return "foo", nil
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Header().Get("ETag"))
+
+	// handlers may set their own etag
+	w = handle("GET", `"v1"`, func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		w.Header().Set("ETag", `"v1"`)
+		return "foo", nil
+	})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+}
+
+func TestMetrics(t *testing.T) {
+
+	m := NewMetrics()
+	m.Buckets = []float64{0.5, 1}
+
+	a := &vertex.API{
+		Name:          "metrics",
+		Root:          "/metrics_api",
+		Renderer:      vertex.JSONRenderer{},
+		AllowInsecure: true,
+		Middleware:    []vertex.Middleware{m},
+		Routes: vertex.Routes{
+			{
+				Path: "/users/{id}",
+				Handler: vertex.HandlerFunc(func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+					if r.FormValue("id") == "0" {
+						return nil, vertex.NotFoundError("no such user")
+					}
+					return "user", nil
+				}),
+				Methods: vertex.GET,
+			},
+		},
+	}
+
+	srv := vertex.NewServer(":9952")
+	srv.AddAPI(a)
+	srv.ExposeMetrics(m)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	for _, id := range []string{"1", "2", "0"} {
+		res, err := http.Get(s.URL + a.FullPath("/users/"+id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	res, err := http.Get(s.URL + vertex.MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	out := string(b)
+
+	assert.Contains(t, out, `vertex_requests_total{api="metrics",route="/users/{id}",method="GET",status="200"} 2`)
+	assert.Contains(t, out, `vertex_requests_total{api="metrics",route="/users/{id}",method="GET",status="404"} 1`)
+	assert.Contains(t, out, `vertex_request_duration_seconds_bucket{api="metrics",route="/users/{id}",method="GET",le="0.5"} 3`)
+	assert.Contains(t, out, `vertex_request_duration_seconds_bucket{api="metrics",route="/users/{id}",method="GET",le="+Inf"} 3`)
+	assert.Contains(t, out, `vertex_request_duration_seconds_count{api="metrics",route="/users/{id}",method="GET"} 3`)
+	assert.Contains(t, out, `vertex_requests_in_flight{api="metrics",route="/users/{id}"} 0`)
+	assert.Contains(t, out, "# TYPE vertex_request_duration_seconds histogram")
+	assert.Contains(t, out, "# TYPE vertex_request_latency_seconds summary")
+	assert.Contains(t, out, `vertex_request_latency_seconds{api="metrics",route="/users/{id}",method="GET",quantile="0.99"}`)
+	assert.Contains(t, out, `vertex_request_latency_seconds_count{api="metrics",route="/users/{id}",method="GET"} 3`)
+
+	stats := m.Stats()
+	if assert.Len(t, stats, 1) {
+		assert.Equal(t, "metrics", stats[0].API)
+		assert.Equal(t, "/users/{id}", stats[0].Route)
+		assert.Equal(t, "GET", stats[0].Method)
+		assert.EqualValues(t, 3, stats[0].Count)
+		assert.True(t, stats[0].P50 > 0)
+		assert.True(t, stats[0].P50 <= stats[0].P90 && stats[0].P90 <= stats[0].P99)
+	}
+
+	// percentiles are computed over a window of the latest samples
+	h := &histogram{}
+	for i := 1; i <= 200; i++ {
+		h.addSample(float64(i), 100)
+	}
+	assert.Equal(t, []float64{150, 190, 199}, h.quantiles(latencyQuantiles))
+	assert.Equal(t, []float64{0}, (&histogram{}).quantiles([]float64{0.5}))
+
+	// disabled metrics are not recorded
+	defer func(disabled bool) {
+		vertex.Config.Server.DisableMetrics = disabled
+	}(vertex.Config.Server.DisableMetrics)
+	vertex.Config.Server.DisableMetrics = true
+
+	hr, _ := http.NewRequest("GET", "/foo", nil)
+	m = NewMetrics()
+	_, err = m.Handle(httptest.NewRecorder(), vertex.NewRequest(hr), mockkHandler)
+	assert.NoError(t, err)
+	assert.Empty(t, m.requests)
+	assert.Empty(t, m.inFlight)
+}
+
+func TestTracingMiddleware(t *testing.T) {
+
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	m := NewTracingMiddleware(tp.Tracer("test"))
+	m.Propagator = propagation.TraceContext{}
+
+	handle := func(traceparent string, err error) trace.SpanContext {
+		hr, _ := http.NewRequest("GET", "/users/5", nil)
+		if traceparent != "" {
+			hr.Header.Set("traceparent", traceparent)
+		}
+		r := vertex.NewRequest(hr)
+		r.RoutePath = "/users/{id}"
+
+		var sc trace.SpanContext
+		_, e := m.Handle(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+			sc = trace.SpanFromContext(r.Context()).SpanContext()
+			return "user", err
+		})
+		assert.True(t, vertex.IsHijacked(e))
+		return sc
+	}
+
+	sc := handle("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", nil)
+	assert.True(t, sc.IsValid(), "the span should be in the handler's context")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID().String())
+
+	handle("", vertex.NewErrorf("WAT"))
+
+	spans := rec.Ended()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, "GET /users/{id}", spans[0].Name())
+		assert.Equal(t, trace.SpanKindServer, spans[0].SpanKind())
+		assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+		assert.Contains(t, spans[0].Attributes(), attribute.Int("http.status_code", http.StatusOK))
+		assert.Contains(t, spans[0].Attributes(), attribute.String("http.route", "/users/{id}"))
+
+		assert.False(t, spans[1].Parent().IsValid())
+		assert.Contains(t, spans[1].Attributes(), attribute.Int("http.status_code", http.StatusInternalServerError))
+		assert.Equal(t, codes.Error, spans[1].Status().Code)
+		assert.Len(t, spans[1].Events(), 1, "the error should be recorded")
+	}
+}
+
+func TestMaxBodyMiddleware(t *testing.T) {
+
+	m := NewMaxBodyMiddleware(10)
+
+	readBody := func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, vertex.NewError(err)
+		}
+		return string(b), nil
+	}
+
+	handle := func(body string, contentLength int64) (interface{}, *httptest.ResponseRecorder) {
+		hr, _ := http.NewRequest("POST", "/foo", strings.NewReader(body))
+		hr.ContentLength = contentLength
+		r := vertex.NewRequest(hr)
+		w := httptest.NewRecorder()
+
+		v, err := m.Handle(w, r, readBody)
+		if err != nil {
+			vertex.RenderResponse(v, err, w, r)
+		}
+		return v, w
+	}
+
+	v, w := handle("small", 5)
+	assert.Equal(t, "small", v)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// declared too large
+	_, w = handle("way too large", 13)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "larger than 10 bytes")
+
+	// streamed too large, with an unknown length
+	_, w = handle("way too large", -1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	_, w = handle("exactly 10", -1)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, int64(DefaultMaxBodySize), NewMaxBodyMiddleware(0).limit)
+}
+
+type uploadHandler struct {
+	File *multipart.FileHeader `file:"file" required:"true"`
+}
+
+func (h uploadHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+	return h.File.Size, nil
+}
+
+func TestMaxBodyMiddlewareUploads(t *testing.T) {
+
+	a := &vertex.API{
+		Root:          "/upload",
+		Renderer:      vertex.JSONRenderer{},
+		AllowInsecure: true,
+		Middleware:    []vertex.Middleware{NewMaxBodyMiddleware(1024)},
+		Routes: vertex.Routes{
+			{Path: "/file", Handler: uploadHandler{}, Methods: vertex.POST},
+		},
+	}
+
+	srv := vertex.NewServer(":9973")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	upload := func(size int, chunked bool) int {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", "file.bin")
+		fw.Write(bytes.Repeat([]byte("x"), size))
+		mw.Close()
+
+		req, _ := http.NewRequest("POST", s.URL+a.FullPath("/file"), body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		if chunked {
+			// hide the length, so only reading the body finds it is too large
+			req.ContentLength = -1
+			req.Body = ioutil.NopCloser(io.MultiReader(body))
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, upload(100, false))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, upload(2048, false))
+	assert.Equal(t, http.StatusOK, upload(100, true))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, upload(2048, true))
+}
+
+type formHandler struct {
+	Name string `schema:"name" required:"true"`
+}
+
+func (h formHandler) Handle(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+	return len(h.Name), nil
+}
+
+func TestMaxBodyMiddlewareForms(t *testing.T) {
+
+	a := &vertex.API{
+		Root:          "/form",
+		Renderer:      vertex.JSONRenderer{},
+		AllowInsecure: true,
+		Middleware:    []vertex.Middleware{NewMaxBodyMiddleware(1024)},
+		Routes: vertex.Routes{
+			{Path: "/submit", Handler: formHandler{}, Methods: vertex.POST},
+		},
+	}
+
+	srv := vertex.NewServer(":9980")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	submit := func(size int, chunked bool) int {
+		body := strings.NewReader(url.Values{"name": {strings.Repeat("x", size)}}.Encode())
+		req, _ := http.NewRequest("POST", s.URL+a.FullPath("/submit"), body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if chunked {
+			req.ContentLength = -1
+			req.Body = ioutil.NopCloser(io.MultiReader(body))
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			assert.Equal(t, strconv.Itoa(size), strings.TrimSpace(string(b)))
+		}
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, submit(100, false))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, submit(2048, false))
+	assert.Equal(t, http.StatusOK, submit(100, true))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, submit(2048, true))
+}
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+
+	m := NewConcurrencyLimitMiddleware(1, 0)
+
+	newRequest := func() *vertex.Request {
+		hr, _ := http.NewRequest("GET", "/foo", nil)
+		return vertex.NewRequest(hr)
+	}
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		m.Handle(httptest.NewRecorder(), newRequest(), func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+			close(entered)
+			<-release
+			return nil, nil
+		})
+		close(done)
+	}()
+	<-entered
+
+	// full, and not waiting
+	_, err := m.Handle(httptest.NewRecorder(), newRequest(), mockkHandler)
+	assert.Error(t, err)
+	w := httptest.NewRecorder()
+	vertex.RenderResponse(nil, err, w, newRequest())
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// waiting for the slot to free up
+	m.timeout = time.Second
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	_, err = m.Handle(httptest.NewRecorder(), newRequest(), mockkHandler)
+	assert.NoError(t, err)
+	<-done
+
+	// slots are released on panics
+	m.timeout = 50 * time.Millisecond
+	assert.Panics(t, func() {
+		m.Handle(httptest.NewRecorder(), newRequest(), func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+			panic("boom")
+		})
+	})
+	_, err = m.Handle(httptest.NewRecorder(), newRequest(), mockkHandler)
+	assert.NoError(t, err)
+}
+
+func TestHijacking(t *testing.T) {
+
+	a := &vertex.API{
+		Root:          "/hijack",
+		Renderer:      vertex.JSONRenderer{},
+		AllowInsecure: true,
+		Middleware: []vertex.Middleware{
+			NewLoggingMiddleware(ioutil.Discard),
+			NewGzipMiddleware(1),
+			NewETagMiddleware(),
+		},
+		Routes: vertex.Routes{
+			{
+				// takes over the connection, like a WebSocket handshake
+				Path: "/conn",
+				Handler: vertex.HandlerFunc(func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+					conn, rw, err := vertex.HijackConn(w)
+					if err != nil {
+						return nil, vertex.NewError(err)
+					}
+					defer conn.Close()
+					rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: close\r\n\r\nraw ok")
+					rw.Flush()
+					return nil, vertex.Hijacked
+				}),
+				Methods: vertex.GET,
+			},
+			{
+				// writes the response itself, like an event stream
+				Path: "/events",
+				Handler: vertex.Hijacker(func(w http.ResponseWriter, r *vertex.Request) {
+					w.Header().Set("Content-Type", "text/event-stream")
+					for i := 0; i < 3; i++ {
+						fmt.Fprintf(w, "data: %d\n\n", i)
+						w.(http.Flusher).Flush()
+					}
+				}),
+				Methods: vertex.GET,
+			},
+		},
+	}
+
+	srv := vertex.NewServer(":9960")
+	srv.AddAPI(a)
+
+	errLog := bytes.NewBuffer(nil)
+	s := httptest.NewUnstartedServer(srv.Handler())
+	s.Config.ErrorLog = log.New(errLog, "", 0)
+	s.Start()
+	defer s.Close()
+
+	get := func(pth, encoding string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", s.URL+pth, nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	// the gzip writer must not finish its stream on the hijacked connection
+	res, body := get("/hijack/conn", "gzip")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "raw ok", body)
+	assert.Empty(t, res.Header.Get(vertex.HeaderProcessingTime))
+
+	res, body = get("/hijack/events", "identity")
+	assert.Equal(t, "data: 0\n\ndata: 1\n\ndata: 2\n\n", body)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	assert.Empty(t, res.Header.Get(vertex.HeaderProcessingTime))
+
+	// nothing was written to the hijacked connection
+	assert.Empty(t, errLog.String())
+}
+
+func TestDebugCaptureMiddleware(t *testing.T) {
+
+	out := &bytes.Buffer{}
+	m := NewDebugCaptureMiddleware(64)
+	m.Output = out
+
+	a := &vertex.API{
+		Name:          "capture",
+		Root:          "/capture",
+		Renderer:      vertex.JSONRenderer{},
+		AllowInsecure: true,
+		Middleware:    []vertex.Middleware{m},
+		Routes: vertex.Routes{
+			{
+				Path: "/login",
+				Handler: vertex.HandlerFunc(func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+					b, err := ioutil.ReadAll(r.Body)
+					if err != nil {
+						return nil, err
+					}
+					return map[string]interface{}{"size": len(b), "token": "t0ps3cret"}, nil
+				}),
+				Methods: vertex.POST,
+			},
+			{
+				Path: "/other",
+				Handler: vertex.HandlerFunc(func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+					return "other", nil
+				}),
+				Methods: vertex.POST,
+			},
+		},
+	}
+
+	srv := vertex.NewServer(":9964")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	defer func(routes string) {
+		vertex.Config.Server.DebugCaptureRoutes = routes
+	}(vertex.Config.Server.DebugCaptureRoutes)
+
+	post := func(pth, body string) string {
+		res, err := http.Post(s.URL+a.FullPath(pth), "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return string(b)
+	}
+
+	// capturing is off unless the route is listed in the config
+	vertex.Config.Server.DebugCaptureRoutes = ""
+	post("/login", "user=foo&password=bar")
+	assert.Empty(t, out.String())
+
+	vertex.Config.Server.DebugCaptureRoutes = "/foo, /login"
+
+	// the handler gets the whole body, and the client the whole response
+	resp := post("/login", "user=foo&password=bar")
+	assert.Contains(t, resp, `"size":21`)
+	assert.Contains(t, resp, "t0ps3cret")
+
+	logged := out.String()
+	assert.Contains(t, logged, "Captured POST /capture/login")
+	assert.Contains(t, logged, "request body: user=foo&password=[REDACTED]")
+	assert.Contains(t, logged, `"token":"[REDACTED]"`)
+	assert.Contains(t, logged, "response status=200")
+	assert.NotContains(t, logged, "t0ps3cret")
+	assert.NotContains(t, logged, "password=bar")
+
+	// other routes are not captured
+	out.Reset()
+	post("/other", "foo")
+	assert.Empty(t, out.String())
+
+	// bodies are logged up to the size cap
+	out.Reset()
+	resp = post("/login", strings.Repeat("x", 100))
+	assert.Contains(t, resp, `"size":100`)
+	assert.Contains(t, out.String(), strings.Repeat("x", 64)+"... (truncated, 100 bytes)")
+
+	vertex.Config.Server.DebugCaptureRoutes = "*"
+	out.Reset()
+	post("/other", "foo")
+	assert.Contains(t, out.String(), "request body: foo")
+
+	// fields of truncated JSON are redacted as well
+	redact := RedactFields("password")
+	assert.Equal(t, `{"user": "foo", "Password": "[REDACTED]"`, string(redact([]byte(`{"user": "foo", "Password": "s3cr`))))
+	assert.Equal(t, `{"password":"[REDACTED]","n":1}`, string(redact([]byte(`{"password":12345,"n":1}`))))
 }
@@ -168,6 +168,9 @@ func (o *OAuthMiddleware) redirect(w http.ResponseWriter, r *vertex.Request) {
 func (o *OAuthMiddleware) LoginHandler() vertex.Route {
 
 	handler := func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+		if err := vertex.ParseForm(r); err != nil {
+			return nil, err
+		}
 		code := r.FormValue("code")
 		logging.Info("Got code: %s", code)
 
@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/EverythingMe/vertex"
+)
+
+// how often we remove the buckets of clients that haven't sent requests for a while
+const rateLimitPruneInterval = time.Minute
+
+// a token bucket of a single client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits the request rate of each client of an API, using a token bucket per client.
+// Clients are identified by their IP, unless a KeyFunc is set.
+//
+// Requests exceeding the limit fail with a 429 error, and a Retry-After header telling the client when it may retry.
+//
+// Like the ConnectionLimiter, if applied to the whole API it limits the API as a whole, and an instance of the
+// limiter applied to a specific route limits only that route
+type RateLimiter struct {
+	// KeyFunc identifies the client of a request. Defaults to the request's RemoteIP
+	KeyFunc func(r *vertex.Request) string
+
+	// tokens added per second
+	rate float64
+	// the maximal number of tokens a client can accumulate
+	burst float64
+
+	buckets   map[string]*bucket
+	lastPrune time.Time
+	lock      sync.Mutex
+	now       func() time.Time
+}
+
+// NewRateLimiter creates a rate limiter allowing each client the given number of requests per interval, with bursts of
+// up to burst requests. A burst of 0 allows bursts of the number of requests per interval
+func NewRateLimiter(requests int, per time.Duration, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = requests
+	}
+	return &RateLimiter{
+		rate:    float64(requests) / per.Seconds(),
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// take takes a token from the client's bucket. If the bucket is empty, it returns how long until it has a token
+func (l *RateLimiter) take(key string) (bool, time.Duration) {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// prune removes the buckets that have refilled completely, so they don't pile up
+func (l *RateLimiter) prune(now time.Time) {
+
+	if now.Sub(l.lastPrune) < rateLimitPruneInterval {
+		return
+	}
+	l.lastPrune = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *RateLimiter) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
+
+	key := r.RemoteIP
+	if l.KeyFunc != nil {
+		key = l.KeyFunc(r)
+	}
+
+	if ok, wait := l.take(key); !ok {
+		logWarning("Rate limit exceeded for %s", key)
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+		return nil, vertex.TooManyRequestsError("Rate limit exceeded")
+	}
+
+	return next(w, r)
+}
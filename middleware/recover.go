@@ -1,27 +1,75 @@
 package middleware
 
 import (
+	"bufio"
+	"fmt"
+	"net"
 	"net/http"
-
-	"github.com/dvirsky/go-pylog/logging"
+	"runtime/debug"
 
 	"github.com/EverythingMe/vertex"
 )
 
-// AutoRecover is a middleware that recovers automatically from panics inside request handlers
+// AutoRecover is a middleware that recovers automatically from panics inside request handlers.
+//
+// The panic and its stack trace are logged, and the request fails with a general failure (500) error.
+// If the handler had already started writing the response when it panicked, the response can't be replaced with an
+// error, so it is left as it is. Place it first in the API's middleware to protect the entire chain
 var AutoRecover = vertex.MiddlewareFunc(func(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (ret interface{}, err error) {
 
+	cw := &committedWriter{ResponseWriter: w}
+
 	defer func() {
 
 		e := recover()
 		if e != nil {
-			logging.Critical("Caught panic: %v", e)
+			logError("Caught panic handling %s: %v\n%s", r.URL.Path, e, debug.Stack())
 
-			err = vertex.NewErrorf("PANIC handling %s: %s", r.URL.Path, e)
+			if cw.committed {
+				logError("Response to %s already committed, not writing an error", r.URL.Path)
+				ret, err = nil, vertex.Hijacked
+				return
+			}
+
+			ret, err = nil, vertex.NewErrorf("PANIC handling %s: %s", r.URL.Path, e)
 			return
 		}
 	}()
 
-	return next(w, r)
+	return next(cw, r)
 
 })
+
+// committedWriter tracks whether the response headers have been written
+type committedWriter struct {
+	http.ResponseWriter
+	committed bool
+}
+
+func (w *committedWriter) WriteHeader(code int) {
+	w.committed = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *committedWriter) Write(b []byte) (int, error) {
+	w.committed = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flushes the underlying writer, if it supports flushing
+func (w *committedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.committed = true
+		f.Flush()
+	}
+}
+
+// Hijack lets handlers take over the connection, if the underlying writer supports it
+func (w *committedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("The response writer does not support hijacking")
+	}
+	w.committed = true
+	return h.Hijack()
+}
@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/EverythingMe/vertex"
+)
+
+// TimeoutMiddleware fails requests that are not handled within a timeout with a 504 error.
+//
+// The request's context is given the timeout as its deadline, so handlers can pass r.Context() to downstream calls
+// and stop working once the request has timed out. Until the handler returns, whatever it writes is buffered, and once
+// the request has timed out its writes are discarded.
+//
+// Like the other limiters, it can be applied to the whole API, and another instance with a longer timeout can be
+// applied to slow routes.
+//
+// Since responses are buffered, connections of requests under a timeout cannot be hijacked (see vertex.HijackConn)
+type TimeoutMiddleware struct {
+	timeout time.Duration
+}
+
+// NewTimeoutMiddleware creates a middleware timing out requests after the given duration
+func NewTimeoutMiddleware(timeout time.Duration) *TimeoutMiddleware {
+	return &TimeoutMiddleware{
+		timeout: timeout,
+	}
+}
+
+type handlerResult struct {
+	v   interface{}
+	err error
+}
+
+func (m *TimeoutMiddleware) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), m.timeout)
+	defer cancel()
+	r.Request = r.Request.WithContext(ctx)
+	if r.Deadline.IsZero() || r.StartTime.Add(m.timeout).Before(r.Deadline) {
+		r.Deadline = r.StartTime.Add(m.timeout)
+	}
+
+	tw := &timeoutWriter{
+		w:      w,
+		header: make(http.Header),
+	}
+
+	done := make(chan handlerResult, 1)
+	panics := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				panics <- e
+			}
+		}()
+
+		v, err := next(tw, r)
+		done <- handlerResult{v, err}
+	}()
+
+	select {
+	case res := <-done:
+		tw.flush()
+		return res.v, res.err
+
+	case e := <-panics:
+		// re-panic in the request's goroutine, so recovery middleware can handle it
+		panic(e)
+
+	case <-ctx.Done():
+		tw.timeout()
+		logWarning("Request %s timed out after %s", r.URL.Path, m.timeout)
+		return nil, vertex.TimeoutError("Request timed out")
+	}
+}
+
+// timeoutWriter buffers the headers and data a handler writes, so they can be discarded if the request times out
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	buf    bytes.Buffer
+	code   int
+
+	lock     sync.Mutex
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.code == 0 {
+		tw.code = http.StatusOK
+	}
+	return tw.buf.Write(b)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	if !tw.timedOut && tw.code == 0 {
+		tw.code = code
+	}
+}
+
+// timeout marks the request as timed out, discarding further writes
+func (tw *timeoutWriter) timeout() {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	tw.timedOut = true
+}
+
+// flush copies what the handler wrote to the real writer
+func (tw *timeoutWriter) flush() {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	for k, v := range tw.header {
+		tw.w.Header()[k] = v
+	}
+
+	if tw.code != 0 {
+		tw.w.WriteHeader(tw.code)
+		tw.w.Write(tw.buf.Bytes())
+	}
+}
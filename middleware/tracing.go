@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/EverythingMe/vertex"
+)
+
+// the instrumentation name of the tracer used by default
+const tracerName = "github.com/EverythingMe/vertex"
+
+// TracingMiddleware starts an OpenTelemetry span for every request, continuing the trace of the caller if the request
+// carries a trace context in its headers.
+//
+// Spans are named by the method and route definition (e.g. "GET /users/{id}") and not by the actual path, to keep the
+// number of span names low. The span is put in the request's context, so handlers can start child spans from
+// r.Context(). Like the LoggingMiddleware, the middleware renders the response itself to tag the span with its status
+type TracingMiddleware struct {
+	Tracer     trace.Tracer
+	Propagator propagation.TextMapPropagator
+}
+
+// NewTracingMiddleware creates a tracing middleware starting spans with the given tracer. If tracer is nil, the tracer
+// of the global OpenTelemetry tracer provider is used. Trace context is read with the global propagator
+func NewTracingMiddleware(tracer trace.Tracer) *TracingMiddleware {
+	if tracer == nil {
+		tracer = otel.Tracer(tracerName)
+	}
+
+	return &TracingMiddleware{
+		Tracer:     tracer,
+		Propagator: otel.GetTextMapPropagator(),
+	}
+}
+
+func (m *TracingMiddleware) Handle(w http.ResponseWriter, r *vertex.Request, next vertex.HandlerFunc) (interface{}, error) {
+
+	ctx := m.Propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	name := r.Method
+	if r.RoutePath != "" {
+		name += " " + r.RoutePath
+	}
+
+	ctx, span := m.Tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", r.RoutePath),
+			attribute.String("vertex.api", r.APIName),
+			attribute.String("vertex.request_id", r.RequestId),
+		),
+	)
+	defer span.End()
+
+	r.Request = r.Request.WithContext(ctx)
+
+	sw := &statusWriter{ResponseWriter: w}
+
+	v, err := next(sw, r)
+	if err != nil && !vertex.IsHijacked(err) {
+		span.RecordError(err)
+	}
+	if !vertex.IsHijacked(err) {
+		err = vertex.RenderResponse(v, err, sw, r)
+	}
+
+	status := sw.status()
+	span.SetAttributes(attribute.Int("http.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+
+	return nil, err
+}
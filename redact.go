@@ -0,0 +1,116 @@
+package vertex
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// RedactedPlaceholder replaces the values of sensitive params in error messages and logs.
+//
+// Params are tagged as sensitive with the `sensitive:"true"` field tag, e.g. passwords and tokens. Their submitted
+// values are masked in the binding and validation errors of the request, in any error rendered for it, and by the
+// logging middleware (see Request.Redact)
+const RedactedPlaceholder = "[redacted]"
+
+// sensitiveValues returns the values submitted for the named params of a request, in the form or in the headers.
+// Longer values come first, so values containing other values are masked whole
+func sensitiveValues(names []string, r *http.Request) []string {
+
+	var ret []string
+	for _, name := range names {
+		for _, v := range append(r.Form[name], r.Header[http.CanonicalHeaderKey(name)]...) {
+			if v != "" {
+				ret = append(ret, v)
+			}
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return len(ret[i]) > len(ret[j]) })
+	return ret
+}
+
+// redactString masks the given values in a string. The values are replaced in a single pass, so the placeholder
+// itself is never masked
+func redactString(s string, values []string) string {
+
+	pairs := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		pairs = append(pairs, v, RedactedPlaceholder)
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+// redactError returns a copy of an error with the given values masked in its message, unless it was already redacted.
+// Errors that are not vertex errors are wrapped, keeping them as the cause
+func redactError(err error, values []string) error {
+
+	if err == nil || len(values) == 0 || IsHijacked(err) {
+		return err
+	}
+
+	switch e := err.(type) {
+	case *internalError:
+		if !e.redacted {
+			cp := *e
+			cp.Message = redactString(e.Message, values)
+			cp.redacted = true
+			return &cp
+		}
+	case *ValidationError:
+		if !e.redacted {
+			ret := &ValidationError{Errors: make([]FieldError, len(e.Errors)), redacted: true}
+			for i, fe := range e.Errors {
+				ret.Errors[i] = FieldError{Param: fe.Param, Message: redactString(fe.Message, values)}
+			}
+			return ret
+		}
+	default:
+		if msg := redactString(err.Error(), values); msg != err.Error() {
+			return &internalError{
+				Message:  msg,
+				Code:     ErrGeneralFailure,
+				cause:    err,
+				stack:    errorStack(err),
+				redacted: true,
+			}
+		}
+	}
+
+	return err
+}
+
+// SensitiveParams returns the names of the params of the request's handler that are tagged as sensitive
+func (r *Request) SensitiveParams() []string {
+	return r.sensitiveParams
+}
+
+// Redact masks the submitted values of the request's sensitive params in a string, e.g. a log line
+func (r *Request) Redact(s string) string {
+	if len(r.sensitiveParams) == 0 {
+		return s
+	}
+	return redactString(s, sensitiveValues(r.sensitiveParams, r.Request))
+}
+
+// RedactedURL returns the URL of the request as a string, with the values of sensitive params masked
+func (r *Request) RedactedURL() string {
+
+	if len(r.sensitiveParams) == 0 {
+		return r.URL.String()
+	}
+
+	u := *r.URL
+	if q := u.Query(); len(q) > 0 {
+		for _, name := range r.sensitiveParams {
+			if _, found := q[name]; found {
+				q.Set(name, RedactedPlaceholder)
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	// sensitive path params are masked in the path
+	return r.Redact(strings.Replace(u.String(), url.QueryEscape(RedactedPlaceholder), RedactedPlaceholder, -1))
+}
@@ -0,0 +1,71 @@
+package vertex
+
+import "sync"
+
+type builderFunc func() *API
+
+// Registry holds the builders of APIs, for servers to build and add with InitAPIs. APIs are usually registered in the
+// global DefaultRegistry with Register, and a server can have its own registry (see NewServerWithRegistry)
+type Registry struct {
+	lock     sync.Mutex
+	builders map[string]builderFunc
+	// the registered names, in the order they were registered
+	names []string
+}
+
+// NewRegistry creates a new empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		builders: map[string]builderFunc{},
+	}
+}
+
+// DefaultRegistry is the registry of Register, used by servers created with NewServer
+var DefaultRegistry = NewRegistry()
+
+// Register lest you automatically add an API to the server from your module's init() function.
+//
+// name is a unique name for your API (doesn't have to match the API name exactly).
+//
+// builder is a func that creates the API when we are ready to start the server.
+//
+// Optionally, you can pass a pointer to a config struct, or nil if you don't need to. This way, we can read the config struct's values
+// from a unified config file BEFORE we call the builder, so the builder can use values in the config struct.
+//
+// The config struct is read once, on startup: ReloadConfigs reads the reloaded values into a copy of it, so handlers
+// that need them should read their config with APIConfig(name) instead of keeping the registered pointer
+func Register(name string, builder func() *API, config interface{}) {
+	DefaultRegistry.Register(name, builder, config)
+}
+
+// Register registers an API builder in the registry, replacing any builder registered under the same name.
+// Config structs are read from the config files like those of Register, since configs are global
+func (r *Registry) Register(name string, builder func() *API, config interface{}) {
+
+	r.lock.Lock()
+	if _, found := r.builders[name]; !found {
+		r.names = append(r.names, name)
+	}
+	r.builders[name] = builderFunc(builder)
+	r.lock.Unlock()
+
+	if config != nil {
+		registerAPIConfig(name, config)
+	}
+}
+
+// Names returns the names of the registered APIs, in the order they were registered
+func (r *Registry) Names() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]string(nil), r.names...)
+}
+
+func (r *Registry) get(name string) (builderFunc, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	b, found := r.builders[name]
+	return b, found
+}
@@ -1,14 +1,29 @@
 package vertex
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"path"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/dvirsky/go-pylog/logging"
+	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
 // Renderer is an interface for response renderers. A renderer gets the response object after the entire
@@ -18,6 +33,307 @@ type Renderer interface {
 	ContentTypes() []string
 }
 
+// RenderResponse renders a response with the request's renderer (the route's renderer, or the API's default renderer),
+// and returns Hijacked so the framework does not render it again.
+//
+// This lets middleware render a response themselves, e.g. into a wrapped writer, instead of leaving it for the
+// framework to render after the chain returns. Middleware should return the error it returns
+func RenderResponse(v interface{}, err error, w http.ResponseWriter, r *Request) error {
+
+	renderer := r.renderer
+	if renderer == nil {
+		renderer = JSONRenderer{}
+	}
+
+	if e := render(renderer, v, err, w, r); e != nil {
+		logError("Error rendering response: %s", e)
+	}
+
+	return Hijacked
+}
+
+type noContent struct{}
+
+// NoContent can be returned by handlers that have no response, e.g. deletes. Instead of rendering it, vertex responds
+// with a 204 No Content status and no body
+var NoContent interface{} = noContent{}
+
+// StatusResponse can be returned by handlers to respond with a success status other than 200, e.g. 201 Created or
+// 202 Accepted. The body is rendered as usual, by the renderer or as a reader or file, only with the given status.
+// Statuses that are not 2xx are ignored, responding with a 200, and 204 responds like NoContent, without a body
+type StatusResponse struct {
+	Status int
+	Body   interface{}
+}
+
+// statusResponse unwraps a StatusResponse, returning the body and status of the response
+func statusResponse(v interface{}) (interface{}, int) {
+
+	var sr StatusResponse
+	switch x := v.(type) {
+	case StatusResponse:
+		sr = x
+	case *StatusResponse:
+		if x == nil {
+			return v, 0
+		}
+		sr = *x
+	default:
+		return v, 0
+	}
+
+	if sr.Status < 200 || sr.Status > 299 {
+		logWarning("Ignoring the invalid success status %d of a response", sr.Status)
+		return sr.Body, 0
+	}
+	if sr.Status == http.StatusNoContent {
+		return NoContent, 0
+	}
+	return sr.Body, sr.Status
+}
+
+// ContentTyper can be implemented by io.Reader responses to set the content type they are written with
+type ContentTyper interface {
+	ContentType() string
+}
+
+// render renders a response with the renderer, unless the response is NoContent or an io.Reader.
+// Nothing is written for requests cancelled while they were handled, since no one is left to read the response
+func render(renderer Renderer, v interface{}, err error, w http.ResponseWriter, r *Request) error {
+
+	if e := r.cancelled(); e != nil {
+		logWarning("Request %s was cancelled before it was handled (%s), not writing a response", r.URL.Path, e)
+		return nil
+	}
+
+	// errors of handlers may echo the values of sensitive params
+	if err != nil && len(r.sensitiveParams) > 0 {
+		err = redactError(err, sensitiveValues(r.sensitiveParams, r.Request))
+	}
+
+	if after, ok := retryAfter(err); ok && after > 0 {
+		w.Header().Set(HeaderRetryAfter, strconv.Itoa(int(math.Ceil(after.Seconds()))))
+	}
+
+	if err == nil {
+		var status int
+		if v, status = statusResponse(v); status != 0 && status != http.StatusOK {
+			w = &statusWriter{ResponseWriter: w, status: status}
+		}
+	}
+
+	if _, ok := v.(noContent); ok && err == nil {
+		writeMetaHeaders(w, r)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if err == nil {
+		switch x := v.(type) {
+		case FileResponse:
+			return writeOrFail(w, func(w http.ResponseWriter) error { return writeFile(w, r, &x) })
+		case *FileResponse:
+			return writeOrFail(w, func(w http.ResponseWriter) error { return writeFile(w, r, x) })
+		case io.Reader:
+			return writeOrFail(w, func(w http.ResponseWriter) error { return writeReader(w, r, x) })
+		}
+	}
+
+	return writeOrFail(w, func(w http.ResponseWriter) error { return renderer.Render(v, err, w, r) })
+}
+
+// writeOrFail writes a response with a renderer (or as a file or reader), falling back to a generic 500 error if
+// writing fails or panics before anything is written. If the response was already started, nothing more is written
+// over it, and the connection is left to end with a partial response
+func writeOrFail(w http.ResponseWriter, write func(http.ResponseWriter) error) (err error) {
+
+	rw := &renderWriter{ResponseWriter: w}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("Renderer panicked: %v\n%s", p, debug.Stack())
+		}
+		if err != nil && !rw.written {
+			// the headers of the response that was not written do not describe the error
+			w.Header().Del("Content-Length")
+			w.Header().Del("Content-Disposition")
+			writeError(w, renderErrorMessage)
+		}
+	}()
+
+	return write(rw)
+}
+
+// the message of the error written when a response cannot be rendered
+const renderErrorMessage = "Error rendering response"
+
+// renderFailed logs the error of a renderer that could not render a response, and writes a generic 500 error instead,
+// unless the response was already started
+func renderFailed(w http.ResponseWriter, err error) {
+
+	logError("Error rendering response: %s", err)
+	if rw, ok := w.(*renderWriter); ok && rw.written {
+		return
+	}
+	writeError(w, renderErrorMessage)
+}
+
+// statusWriter writes a response with the status of a StatusResponse instead of the 200 it is written with. Other
+// statuses, e.g. of partial file responses, are written as they are
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if code == http.StatusOK {
+		code = w.status
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flushes the underlying writer, if it supports flushing
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, if the underlying writer supports it
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return HijackConn(w.ResponseWriter)
+}
+
+// renderWriter tracks whether a renderer started writing the response, so a failed rendering is not written over
+type renderWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *renderWriter) WriteHeader(code int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *renderWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flushes the underlying writer, if it supports flushing
+func (w *renderWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.written = true
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, if the underlying writer supports it
+func (w *renderWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := HijackConn(w.ResponseWriter)
+	if err == nil {
+		w.written = true
+	}
+	return conn, rw, err
+}
+
+// writeReader streams an io.Reader response to the client as is, without buffering it. The content type is that of
+// the reader if it is a ContentTyper, or the one set by the handler, or application/octet-stream.
+// Readers that are also io.Closers (e.g. files and upstream response bodies) are closed when they are written
+func writeReader(w http.ResponseWriter, r *Request, rd io.Reader) error {
+
+	if ct, ok := rd.(ContentTyper); ok && ct.ContentType() != "" {
+		w.Header().Set("Content-Type", ct.ContentType())
+	} else if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	return copyResponse(w, r, rd)
+}
+
+// copyResponse writes the meta headers of a response and copies a reader into it, closing the reader if needed
+func copyResponse(w http.ResponseWriter, r *Request, rd io.Reader) error {
+
+	if c, ok := rd.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	writeMetaHeaders(w, r)
+
+	_, err := io.Copy(w, rd)
+	return err
+}
+
+// FileResponse can be returned by handlers to have a file downloaded by the client. The reader is streamed with a
+// Content-Disposition header telling the client to save it as Filename.
+//
+// If ContentType is not set, it is guessed from the extension of the file name. The Content-Length header is set if
+// the size of the reader is known, e.g. for files and in-memory readers
+type FileResponse struct {
+	Reader      io.Reader
+	Filename    string
+	ContentType string
+}
+
+// readerSize returns the number of bytes left to read from a reader, or -1 if it is not known
+func readerSize(rd io.Reader) int64 {
+
+	switch x := rd.(type) {
+	case interface{ Len() int }:
+		return int64(x.Len())
+	case *os.File:
+		if st, err := x.Stat(); err == nil && st.Mode().IsRegular() {
+			if pos, err := x.Seek(0, io.SeekCurrent); err == nil {
+				return st.Size() - pos
+			}
+		}
+	}
+
+	return -1
+}
+
+func writeFile(w http.ResponseWriter, r *Request, f *FileResponse) error {
+
+	if f.Reader == nil {
+		return errors.New("FileResponse has no reader")
+	}
+
+	ct := f.ContentType
+	if ct == "" {
+		ct = mime.TypeByExtension(path.Ext(f.Filename))
+	}
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ct)
+
+	disposition := "attachment"
+	if f.Filename != "" {
+		if d := mime.FormatMediaType("attachment", map[string]string{"filename": f.Filename}); d != "" {
+			disposition = d
+		}
+	}
+	w.Header().Set("Content-Disposition", disposition)
+
+	if size := readerSize(f.Reader); size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	return copyResponse(w, r, f.Reader)
+}
+
 type funcRenderer struct {
 	f            func(interface{}, error, http.ResponseWriter, *Request) error
 	contentTypes []string
@@ -39,19 +355,81 @@ func (f funcRenderer) ContentTypes() []string {
 }
 
 // JSONRenderer renders a response as a JSON object
-type JSONRenderer struct{}
+type JSONRenderer struct {
+	// Indent the JSON output. Clients can also ask for an indented response with the pretty=1 param
+	Pretty bool
+
+	// Wrap successful and failed responses alike in an Envelope, instead of writing the bare response object.
+	// Since renderers are set per API (or per route), clients can be migrated to the envelope one API at a time
+	Envelope bool
+}
+
+// Envelope is the object responses are wrapped in by a JSONRenderer with Envelope set. The HTTP status of the
+// response is the same as without the envelope
+type Envelope struct {
+	// The vertex error code of the response, e.g. Ok or ErrInvalidParam
+	ErrorCode int `json:"errorCode"`
+	// The error message, or "OK" if the request succeeded
+	ErrorString string `json:"errorString"`
+	// The processing time of the request, in milliseconds
+	ProcessingTime float64 `json:"processingTime"`
+	RequestId      string  `json:"requestId"`
+	// The response object of the handler, or nil if it failed
+	Response interface{} `json:"response"`
+	// The failed params of a request that failed validation
+	Errors []FieldError `json:"errors,omitempty"`
+}
 
-func (JSONRenderer) Render(v interface{}, e error, w http.ResponseWriter, r *Request) error {
+func (j JSONRenderer) Render(v interface{}, e error, w http.ResponseWriter, r *Request) error {
 
-	if err := writeResponse(w, r, v, e); err != nil {
-		writeError(w, "Error sending response")
+	pretty, _ := strconv.ParseBool(r.FormValue(PrettyParam))
+
+	var err error
+	if j.Envelope {
+		err = writeEnvelope(w, r, v, e, j.Pretty || pretty)
+	} else {
+		err = writeResponse(w, r, v, e, j.Pretty || pretty)
+	}
+	if err != nil {
+		renderFailed(w, err)
 	}
 
 	return nil
 }
 
+// ContentTypes returns application/json, and the legacy text/json as an alias
 func (JSONRenderer) ContentTypes() []string {
-	return []string{"text/json"}
+	return []string{"application/json", "text/json"}
+}
+
+// ProcessingTimeFormat is the unit and precision of the processing time header of responses
+type ProcessingTimeFormat struct {
+	// The unit of the value, e.g. time.Millisecond or time.Microsecond
+	Unit time.Duration
+	// The number of decimal places of the value
+	Precision int
+}
+
+// DefaultProcessingTimeFormat is the format of the processing time header of APIs that do not set their own: milliseconds
+// with 3 decimal places, e.g. 12.345
+var DefaultProcessingTimeFormat = ProcessingTimeFormat{Unit: time.Millisecond, Precision: 3}
+
+// Format formats a processing time in the format's unit and precision
+func (f ProcessingTimeFormat) Format(d time.Duration) string {
+	unit := f.Unit
+	if unit <= 0 {
+		unit = time.Millisecond
+	}
+	return strconv.FormatFloat(float64(d)/float64(unit), 'f', f.Precision, 64)
+}
+
+// writeMetaHeaders writes the processing time and request id headers of a response
+func writeMetaHeaders(w http.ResponseWriter, r *Request) {
+	r.ProcessingTime = time.Since(r.StartTime)
+	if r.processingTimeHeader != "" {
+		w.Header().Set(r.processingTimeHeader, r.processingTimeFormat.Format(r.ProcessingTime))
+	}
+	w.Header().Set(HeaderRequestId, r.RequestId)
 }
 
 //serialize an error string inside an object
@@ -61,7 +439,7 @@ func writeError(w http.ResponseWriter, message string) {
 	defer func() {
 		e := recover()
 		if e != nil {
-			logging.Error("Could not write error response! %s", e)
+			logError("Could not write error response! %s", e)
 		}
 	}()
 
@@ -70,24 +448,143 @@ func writeError(w http.ResponseWriter, message string) {
 }
 
 //serialize a response object to JSON
-func writeResponse(w http.ResponseWriter, r *Request, response interface{}, e error) (err error) {
+func writeResponse(w http.ResponseWriter, r *Request, response interface{}, e error, pretty bool) (err error) {
 
 	// Dump meta-data headers
-	w.Header().Set(HeaderProcessingTime, fmt.Sprintf("%.03f", time.Since(r.StartTime).Seconds()*1000))
-	w.Header().Set(HeaderRequestId, r.RequestId)
+	writeMetaHeaders(w, r)
+
+	// Validation errors are rendered as an object with all the failed params
+	if verr, ok := e.(*ValidationError); ok {
+		logError("Invalid request: %s", verr)
+		return writeJSON(w, r, http.StatusBadRequest, map[string]interface{}{"errors": verr.Errors}, pretty)
+	}
 
 	// Dump Error if the request failed
 	if e != nil {
 		code, message := httpError(e)
+
+		// In debug mode, the error is rendered with the stack trace of its creation
+		if stack := errorStack(e); ServerConfig().Debug && stack != "" {
+			return writeJSON(w, r, code, errorBody(e, message, map[string]interface{}{"debug": map[string]string{"stack": stack}}), pretty)
+		}
+
+		// Retryable errors are rendered as an object telling the client it may retry
+		if IsRetryable(e) {
+			return writeJSON(w, r, code, errorBody(e, message, nil), pretty)
+		}
+
 		http.Error(w, message, code)
 		return
 	}
 
-	var buf []byte
-	buf, err = json.Marshal(response)
+	return writeJSON(w, r, http.StatusOK, response, pretty)
+}
+
+// writeEnvelope serializes a response or an error to JSON, wrapped in an Envelope
+func writeEnvelope(w http.ResponseWriter, r *Request, response interface{}, e error, pretty bool) error {
+
+	writeMetaHeaders(w, r)
+
+	env := Envelope{
+		ErrorCode:      errorCode(e),
+		ProcessingTime: r.ProcessingTime.Seconds() * 1000,
+		RequestId:      r.RequestId,
+	}
+
+	code := http.StatusOK
+	if verr, ok := e.(*ValidationError); ok {
+		logError("Invalid request: %s", verr)
+		code, env.ErrorString, env.Errors = http.StatusBadRequest, verr.Error(), verr.Errors
+	} else {
+		code, env.ErrorString = httpError(e)
+		if e == nil {
+			env.Response = response
+		}
+	}
+
+	return writeJSON(w, r, code, env, pretty)
+}
+
+// errorCode returns the vertex error code of an error: Ok for nil, ErrInvalidRequest for validation errors, and
+// ErrGeneralFailure for errors that are not vertex errors
+func errorCode(e error) int {
+	switch err := e.(type) {
+	case nil:
+		return Ok
+	case *internalError:
+		return err.Code
+	case *ValidationError:
+		return ErrInvalidRequest
+	}
+	return ErrGeneralFailure
+}
+
+// errorBody creates the object an error is rendered as by the JSON and MessagePack renderers, with the error's
+// message, whether the request may be retried, and any extra fields
+func errorBody(e error, message string, extra map[string]interface{}) map[string]interface{} {
+
+	body := map[string]interface{}{"error": message}
+	if after, ok := retryAfter(e); ok {
+		body["retryable"] = true
+		if after > 0 {
+			body["retry_after"] = after.Seconds()
+		}
+	}
+
+	for k, v := range extra {
+		body[k] = v
+	}
+	return body
+}
+
+// RawJSON is an already serialized JSON response, e.g. a cached response or one from an upstream service. Handlers can
+// return it to have the JSONRenderer write it as is instead of marshaling it again. The bytes are checked to be valid
+// JSON before they are written, and are still indented for pretty responses and wrapped in the JSONP callback and the
+// envelope if the request or renderer asks for them
+type RawJSON []byte
+
+// MarshalJSON returns the raw bytes, or null if there are none, so RawJSON can be embedded in other responses
+func (j RawJSON) MarshalJSON() ([]byte, error) {
+	if len(j) == 0 {
+		return []byte("null"), nil
+	}
+	if !json.Valid(j) {
+		return nil, errors.New("vertex: invalid RawJSON response")
+	}
+	return j, nil
+}
+
+// marshalJSON serializes a response to JSON. RawJSON responses are only validated, or indented if pretty is set
+func marshalJSON(response interface{}, pretty bool) ([]byte, error) {
+
+	if raw, ok := response.(RawJSON); ok {
+		buf, err := raw.MarshalJSON()
+		if err != nil || !pretty {
+			return buf, err
+		}
+
+		var out bytes.Buffer
+		if err := json.Indent(&out, buf, "", "  "); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	}
+
+	if pretty {
+		return json.MarshalIndent(response, "", "  ")
+	}
+	return json.Marshal(response)
+}
+
+// writeJSON serializes a value to JSON and writes it with the given status code, wrapped in the request's JSONP
+// callback if it has one
+func writeJSON(w http.ResponseWriter, r *Request, code int, response interface{}, pretty bool) (err error) {
+
+	buf, err := marshalJSON(response, pretty)
 	if err == nil {
 
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(code)
 
 		if r.Callback != "" {
 			if _, err = fmt.Fprintf(w, "%s(", r.Callback); err != nil {
@@ -110,6 +607,523 @@ func writeResponse(w http.ResponseWriter, r *Request, response interface{}, e er
 	return
 }
 
+// XMLRenderer renders a response as an XML document. The response object must be marshalable by encoding/xml
+type XMLRenderer struct{}
+
+// xmlErrors wraps the failed params of a ValidationError in a single document
+type xmlErrors struct {
+	XMLName xml.Name     `xml:"errors"`
+	Errors  []FieldError `xml:"error"`
+}
+
+func (XMLRenderer) Render(v interface{}, e error, w http.ResponseWriter, r *Request) error {
+
+	if err := writeXMLResponse(w, r, v, e); err != nil {
+		renderFailed(w, err)
+	}
+
+	return nil
+}
+
+func (XMLRenderer) ContentTypes() []string {
+	return []string{"application/xml"}
+}
+
+//serialize a response object to XML
+func writeXMLResponse(w http.ResponseWriter, r *Request, response interface{}, e error) error {
+
+	writeMetaHeaders(w, r)
+
+	code := http.StatusOK
+	if verr, ok := e.(*ValidationError); ok {
+		code, response = http.StatusBadRequest, xmlErrors{Errors: verr.Errors}
+	} else if e != nil {
+		// Dump Error if the request failed
+		code, message := httpError(e)
+		http.Error(w, message, code)
+		return nil
+	}
+
+	buf, err := xml.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(code)
+
+	if _, err = w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// NegotiatingRenderer selects the renderer of a response by the request's Accept header, so a single API can serve
+// clients that want different formats. If no renderer matches the Accept header, the Default renderer is used
+type NegotiatingRenderer struct {
+	// Renderers by the content type they produce
+	Renderers map[string]Renderer
+	// The renderer used when nothing else matches. Defaults to a JSONRenderer
+	Default Renderer
+}
+
+// NewNegotiatingRenderer creates a negotiating renderer that selects between the given renderers by their content types,
+// falling back to the default renderer
+func NewNegotiatingRenderer(def Renderer, renderers ...Renderer) *NegotiatingRenderer {
+
+	ret := &NegotiatingRenderer{
+		Renderers: make(map[string]Renderer),
+		Default:   def,
+	}
+
+	for _, rn := range append([]Renderer{ret.defaultRenderer()}, renderers...) {
+		for _, ct := range rn.ContentTypes() {
+			if _, found := ret.Renderers[ct]; !found {
+				ret.Renderers[ct] = rn
+			}
+		}
+	}
+
+	return ret
+}
+
+// acceptedType is a single media range of an Accept header
+type acceptedType struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept parses an Accept header into its media ranges, ordered by preference
+func parseAccept(header string) []acceptedType {
+
+	ret := make([]acceptedType, 0)
+	for _, part := range strings.Split(header, ",") {
+
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if qs, found := params["q"]; found {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+
+		if q > 0 {
+			ret = append(ret, acceptedType{mediaType, q})
+		}
+	}
+
+	sort.Stable(byQuality(ret))
+	return ret
+}
+
+type byQuality []acceptedType
+
+func (b byQuality) Len() int           { return len(b) }
+func (b byQuality) Less(i, j int) bool { return b[i].q > b[j].q }
+func (b byQuality) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// defaultRenderer returns the Default renderer, or a JSONRenderer if none is set
+func (n *NegotiatingRenderer) defaultRenderer() Renderer {
+	if n.Default == nil {
+		return JSONRenderer{}
+	}
+	return n.Default
+}
+
+// rendererFor selects the renderer for a request
+func (n *NegotiatingRenderer) rendererFor(r *Request) Renderer {
+
+	for _, at := range parseAccept(r.Header.Get("Accept")) {
+
+		if rn, found := n.Renderers[at.mediaType]; found {
+			return rn
+		}
+
+		if at.mediaType == "*/*" {
+			return n.defaultRenderer()
+		}
+
+		// a wildcard subtype (e.g. "text/*") matches the first of our content types with that type
+		if strings.HasSuffix(at.mediaType, "/*") {
+			prefix := strings.TrimSuffix(at.mediaType, "*")
+			for _, ct := range n.ContentTypes() {
+				if strings.HasPrefix(ct, prefix) {
+					// the default renderer's types are not necessarily in the map
+					if rn := n.Renderers[ct]; rn != nil {
+						return rn
+					}
+					return n.defaultRenderer()
+				}
+			}
+		}
+	}
+
+	return n.defaultRenderer()
+}
+
+func (n *NegotiatingRenderer) Render(v interface{}, e error, w http.ResponseWriter, r *Request) error {
+	w.Header().Add("Vary", "Accept")
+	return n.rendererFor(r).Render(v, e, w, r)
+}
+
+// ContentTypes returns the content types of all the renderers, starting with the default renderer's
+func (n *NegotiatingRenderer) ContentTypes() []string {
+
+	ret := append([]string{}, n.defaultRenderer().ContentTypes()...)
+
+	others := make([]string, 0, len(n.Renderers))
+	for ct := range n.Renderers {
+		found := false
+		for _, dct := range ret {
+			if dct == ct {
+				found = true
+				break
+			}
+		}
+		if !found {
+			others = append(others, ct)
+		}
+	}
+	sort.Strings(others)
+
+	return append(ret, others...)
+}
+
+// MsgpackRenderer renders a response in the compact binary MessagePack format.
+//
+// Unlike the JSON renderer, errors are MessagePack encoded too, so clients can always decode the response.
+// A ValidationError is rendered as a map with an "errors" list, and other errors as a map with an "error" message
+type MsgpackRenderer struct{}
+
+func (MsgpackRenderer) Render(v interface{}, e error, w http.ResponseWriter, r *Request) error {
+
+	if err := writeMsgpackResponse(w, r, v, e); err != nil {
+		renderFailed(w, err)
+	}
+
+	return nil
+}
+
+func (MsgpackRenderer) ContentTypes() []string {
+	return []string{"application/x-msgpack"}
+}
+
+//serialize a response object to MessagePack
+func writeMsgpackResponse(w http.ResponseWriter, r *Request, response interface{}, e error) error {
+
+	writeMetaHeaders(w, r)
+
+	code := http.StatusOK
+	if verr, ok := e.(*ValidationError); ok {
+		logError("Invalid request: %s", verr)
+		code, response = http.StatusBadRequest, map[string]interface{}{"errors": verr.Errors}
+	} else if e != nil {
+		var message string
+		code, message = httpError(e)
+		response = errorBody(e, message, nil)
+	}
+
+	buf, err := msgpack.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/x-msgpack")
+	w.WriteHeader(code)
+	_, err = w.Write(buf)
+	return err
+}
+
+// TemplateRenderer renders a response by executing a named template of a parsed html/template
+type TemplateRenderer struct {
+	template *template.Template
+	name     string
+}
+
+// NewTemplateRenderer creates a renderer executing the template with the given name from tpl, with the response
+// object as its data
+func NewTemplateRenderer(tpl *template.Template, name string) *TemplateRenderer {
+	return &TemplateRenderer{
+		template: tpl,
+		name:     name,
+	}
+}
+
+func (t *TemplateRenderer) Render(v interface{}, e error, w http.ResponseWriter, r *Request) error {
+
+	writeMetaHeaders(w, r)
+
+	// Dump Error if the request failed
+	if e != nil {
+		code, message := httpError(e)
+		http.Error(w, message, code)
+		return nil
+	}
+
+	// we execute the template into a buffer so a failing template does not leave a partial page
+	buf := bytes.NewBuffer(nil)
+	if err := t.template.ExecuteTemplate(buf, t.name, v); err != nil {
+		renderFailed(w, fmt.Errorf("Could not execute template %s: %s", t.name, err))
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		logError("Could not write response: %s", err)
+	}
+	return nil
+}
+
+func (t *TemplateRenderer) ContentTypes() []string {
+	return []string{"text/html"}
+}
+
+// CSVRenderer renders tabular responses as a CSV file attachment.
+//
+// The response should be a slice of structs or a slice of maps. The header row is made of the struct field names
+// (or their csv tag, "-" skips a field) or of the map keys, and each element is a row. A single struct or map is rendered
+// as a single row
+type CSVRenderer struct {
+	// The file name of the attachment. Defaults to "export.csv"
+	Filename string
+}
+
+func (c CSVRenderer) Render(v interface{}, e error, w http.ResponseWriter, r *Request) error {
+
+	writeMetaHeaders(w, r)
+
+	// Dump Error if the request failed
+	if e != nil {
+		code, message := httpError(e)
+		http.Error(w, message, code)
+		return nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := writeCSV(buf, v); err != nil {
+		renderFailed(w, fmt.Errorf("Could not render CSV: %s", err))
+		return nil
+	}
+
+	filename := c.Filename
+	if filename == "" {
+		filename = "export.csv"
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if _, err := buf.WriteTo(w); err != nil {
+		logError("Could not write response: %s", err)
+	}
+	return nil
+}
+
+func (CSVRenderer) ContentTypes() []string {
+	return []string{"text/csv"}
+}
+
+// writeCSV writes a slice of structs or maps (or a single struct or map) as CSV rows, with a header row
+func writeCSV(out io.Writer, v interface{}) error {
+
+	val := reflect.Indirect(reflect.ValueOf(v))
+	if !val.IsValid() {
+		return fmt.Errorf("Cannot render nil as CSV")
+	}
+
+	rows := val
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		rows = reflect.Append(reflect.MakeSlice(reflect.SliceOf(val.Type()), 0, 1), val)
+	}
+
+	elemType := rows.Type().Elem()
+	for elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+
+	var header []string
+	var row func(reflect.Value) []string
+
+	switch elemType.Kind() {
+	case reflect.Struct:
+		fields := make([]int, 0, elemType.NumField())
+		for i := 0; i < elemType.NumField(); i++ {
+			f := elemType.Field(i)
+			name := getTagOr(f, "csv", f.Name)
+			if f.PkgPath != "" || name == "-" {
+				continue
+			}
+			fields = append(fields, i)
+			header = append(header, name)
+		}
+		row = func(elem reflect.Value) []string {
+			ret := make([]string, len(fields))
+			for i, idx := range fields {
+				ret[i] = fmt.Sprint(elem.Field(idx).Interface())
+			}
+			return ret
+		}
+
+	case reflect.Map:
+		// the header is the sorted union of all the keys, so rows with missing keys are aligned
+		keys := map[string]reflect.Value{}
+		for i := 0; i < rows.Len(); i++ {
+			elem := reflect.Indirect(rows.Index(i))
+			if !elem.IsValid() {
+				continue
+			}
+			for _, k := range elem.MapKeys() {
+				keys[fmt.Sprint(k.Interface())] = k
+			}
+		}
+		for k := range keys {
+			header = append(header, k)
+		}
+		sort.Strings(header)
+		row = func(elem reflect.Value) []string {
+			ret := make([]string, len(header))
+			for i, k := range header {
+				if mv := elem.MapIndex(keys[k]); mv.IsValid() {
+					ret[i] = fmt.Sprint(mv.Interface())
+				}
+			}
+			return ret
+		}
+
+	default:
+		return fmt.Errorf("Cannot render %s as CSV", val.Type())
+	}
+
+	cw := csv.NewWriter(out)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for i := 0; i < rows.Len(); i++ {
+		elem := reflect.Indirect(rows.Index(i))
+		if !elem.IsValid() {
+			continue
+		}
+		if err := cw.Write(row(elem)); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// getTagOr returns the value of a field's tag, or def if the field doesn't have it
+func getTagOr(f reflect.StructField, tag, def string) string {
+	if v := f.Tag.Get(tag); v != "" {
+		return v
+	}
+	return def
+}
+
+// Stream is a handler response that StreamRenderer writes as a JSON array element by element, instead of marshaling
+// the entire response in memory.
+//
+// The stream function should call emit for each element, and stop if emit returns an error.
+// If it returns an error after writing has started, the array is closed so the response is still valid JSON, and the
+// error is reported in the X-Vertex-Stream-Error trailer
+type Stream func(emit func(interface{}) error) error
+
+// StreamChannel creates a stream that emits the values received from ch until it is closed.
+//
+// NOTE: If the stream stops early (e.g. the client has gone away), ch is no longer read from, so producers should not
+// block on it forever
+func StreamChannel(ch <-chan interface{}) Stream {
+	return func(emit func(interface{}) error) error {
+		for v := range ch {
+			if err := emit(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// the number of elements a StreamRenderer writes between flushes, unless configured otherwise
+const defaultStreamFlushInterval = 100
+
+// StreamRenderer renders Stream responses as a JSON array, writing and flushing the elements as they are emitted.
+// Other responses and errors are rendered like the JSONRenderer does
+type StreamRenderer struct {
+	// Flush the response every FlushInterval elements. Defaults to 100
+	FlushInterval int
+}
+
+func (s StreamRenderer) Render(v interface{}, e error, w http.ResponseWriter, r *Request) error {
+
+	stream, ok := v.(Stream)
+	if !ok || e != nil {
+		return JSONRenderer{}.Render(v, e, w, r)
+	}
+
+	writeMetaHeaders(w, r)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Trailer", HeaderStreamError)
+
+	interval := s.FlushInterval
+	if interval <= 0 {
+		interval = defaultStreamFlushInterval
+	}
+	flusher, _ := w.(http.Flusher)
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		logError("Could not write response: %s", err)
+		return nil
+	}
+
+	// once writing fails, we keep returning the error to the stream so it stops
+	var writeErr error
+	n := 0
+	err := stream(func(item interface{}) error {
+		if writeErr != nil {
+			return writeErr
+		}
+
+		buf, err := json.Marshal(item)
+		if err != nil {
+			writeErr = err
+			return err
+		}
+
+		if n > 0 {
+			buf = append([]byte{','}, buf...)
+		}
+		if _, writeErr = w.Write(buf); writeErr != nil {
+			return writeErr
+		}
+
+		n++
+		if flusher != nil && n%interval == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+
+	if _, e := io.WriteString(w, "]"); e != nil {
+		logError("Could not write response: %s", e)
+	}
+
+	if err != nil {
+		logError("Error streaming response after %d elements: %s", n, err)
+		w.Header().Set(HeaderStreamError, err.Error())
+	}
+
+	return nil
+}
+
+func (StreamRenderer) ContentTypes() []string {
+	return []string{"application/json", "text/json"}
+}
+
 type HTMLRenderer struct {
 	template *template.Template
 }
@@ -125,7 +1139,7 @@ func NewHTMLRendererFiles(funcMap map[string]interface{}, fileNames ...string) *
 		panic(err)
 	}
 
-	logging.Info("Created template from files %s (%#v)", fileNames, tpl)
+	logInfo("Created template from files %s (%#v)", fileNames, tpl)
 	tpl.ExecuteTemplate(os.Stderr, "html", nil)
 	return &HTMLRenderer{
 		template: tpl,
@@ -152,8 +1166,7 @@ func NewHTMLRenderer(src string, funcMap template.FuncMap) *HTMLRenderer {
 func (h *HTMLRenderer) Render(v interface{}, e error, w http.ResponseWriter, r *Request) error {
 
 	// Dump meta-data headers
-	w.Header().Set(HeaderProcessingTime, fmt.Sprintf("%.03f", time.Since(r.StartTime).Seconds()*1000))
-	w.Header().Set(HeaderRequestId, r.RequestId)
+	writeMetaHeaders(w, r)
 
 	// Dump Error if the request failed
 	if e != nil {
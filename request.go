@@ -1,16 +1,18 @@
 package vertex
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/dvirsky/go-pylog/logging"
-
 	"code.google.com/p/go-uuid/uuid"
 	"golang.org/x/text/language"
 )
@@ -28,7 +30,46 @@ type Request struct {
 	Callback  string
 	Secure    bool
 
+	// The time it took to process the request, measured when the response headers are written. This is the value
+	// reported in the processing time header
+	ProcessingTime time.Duration
+
+	// The name of the API and the path of the route handling the request, as it was defined (e.g. /users/{id})
+	APIName   string
+	RoutePath string
+
 	attributes map[string]interface{}
+
+	// the renderer of the request's route
+	renderer Renderer
+
+	// the header reporting the processing time of the request, or empty if it is disabled for the request's API, and
+	// the format of its value
+	processingTimeHeader string
+	processingTimeFormat ProcessingTimeFormat
+
+	// the names of the handler's params tagged as sensitive
+	sensitiveParams []string
+
+	// the context of the request as the server created it, before middleware derived their own contexts from it
+	serverCtx context.Context
+
+	// the error of parsing the query of the request, e.g. a malformed percent-encoding, which is reported when the
+	// params are bound
+	formErr error
+
+	// whether the body of the request was parsed into its form, and the error of parsing it (see ParseForm)
+	bodyParsed bool
+	bodyErr    error
+}
+
+// cancelled returns the error of the request's server context, if the client disconnected or the server cancelled
+// the request when shutting down
+func (r *Request) cancelled() error {
+	if r.serverCtx == nil {
+		return nil
+	}
+	return r.serverCtx.Err()
 }
 
 func (r *Request) String() string {
@@ -63,12 +104,12 @@ func (r *Request) parseLocale() {
 
 	tags, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
 	if err != nil {
-		logging.Warning("Could not parse accept lang header: %s", err)
+		logWarning("Could not parse accept lang header: %s", err)
 		return
 	}
 
 	if len(tags) > 0 {
-		logging.Debug("Locale for request: %s", tags[0])
+		logDebug("Locale for request: %s", tags[0])
 		r.Locale = tags[0].String()
 	}
 }
@@ -86,18 +127,18 @@ func (r *Request) parseAddr() {
 		addrs := strings.Split(xff, ",")
 		lastFwd := addrs[len(addrs)-1]
 		if ip := net.ParseIP(lastFwd); ip != nil {
-			logging.Debug("Setting IP based on XFF header to %s", ip)
+			logDebug("Setting IP based on XFF header to %s", ip)
 			r.RemoteIP = ip.String()
 		}
 
 	} else if xri := r.Header.Get("X-Real-Ip"); len(xri) > 0 {
 		if ip := net.ParseIP(xri); ip != nil {
-			logging.Debug("Setting IP based on XRI header to %s", ip)
+			logDebug("Setting IP based on XRI header to %s", ip)
 			r.RemoteIP = ip.String()
 		}
 	}
 
-	logging.Debug("Request ip: %s", r.RemoteIP)
+	logDebug("Request ip: %s", r.RemoteIP)
 
 }
 
@@ -125,7 +166,7 @@ func (r *Request) parseLocation() {
 // Detect if the request is secure or not, based on either TLS info or http headers/url
 func (r *Request) parseSecure() {
 
-	logging.Info("Parsing secure. TLS: %v, URI: %s, Headers: %#v", r.TLS, r.RequestURI, r.Header)
+	logInfo("Parsing secure. TLS: %v, URI: %s, Headers: %#v", r.TLS, r.RequestURI, r.Header)
 	if r.TLS != nil {
 		r.Secure = true
 		return
@@ -149,18 +190,161 @@ func (r *Request) parseSecure() {
 	}
 }
 
-// NewRequest wraps a new http request with a vertex request
+type requestIdKey struct{}
+
+// valid incoming request ids. We don't want clients to inject arbitrary content into our logs and headers
+var requestIdRe = regexp.MustCompile(`^[a-zA-Z0-9_\-\.:/+=]{1,128}$`)
+
+// the maximum length of incoming request ids, as matched by requestIdRe
+const maxRequestIdLength = 128
+
+// RequestIdFromContext returns the id of the request a context belongs to, or an empty string if it has none. This
+// lets code that only has a request's context, e.g. loggers, read its id
+func RequestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+type pathParamsKey struct{}
+
+// PathParams returns the path params the router captured for a request, e.g. {"id": "5"} for /users/5 routed by
+// /users/{id}. It returns nil for requests not routed to a route with path params.
+//
+// Inside handlers and middleware, pass the embedded http.Request of the vertex Request
+func PathParams(r *http.Request) Params {
+	params, _ := r.Context().Value(pathParamsKey{}).(Params)
+	return params
+}
+
+// Param returns a single path param the router captured for a request, or an empty string if it has none by that name
+func Param(r *http.Request, name string) string {
+	return PathParams(r)[name]
+}
+
+// queryValue parses the value of a request param into v, with the semantics of the struct binder: the last value of
+// the param is used, and an empty value counts as missing. It returns false if the param is missing or cannot be parsed
+func queryValue(r *http.Request, name string, v interface{}) bool {
+
+	if r.Form == nil {
+		// like http.Request.FormValue, so the helpers work on requests that were not parsed yet
+		r.ParseMultipartForm(32 << 20)
+	}
+
+	vals := r.Form[name]
+	if len(vals) == 0 || vals[len(vals)-1] == "" {
+		return false
+	}
+
+	return setValue(reflect.ValueOf(v).Elem(), vals[len(vals)-1], time.RFC3339) == nil
+}
+
+// QueryString returns the value of a request param (in the query, the form or the path), or def if it is missing.
+// Like the other Query helpers, it is meant for handlers that do not bind their params to a struct. Inside handlers
+// and middleware, pass the embedded http.Request of the vertex Request
+func QueryString(r *http.Request, name string, def string) string {
+	var ret string
+	if !queryValue(r, name, &ret) {
+		return def
+	}
+	return ret
+}
+
+// QueryInt returns the value of a request param as an int, or def if it is missing or is not an int
+func QueryInt(r *http.Request, name string, def int) int {
+	var ret int
+	if !queryValue(r, name, &ret) {
+		return def
+	}
+	return ret
+}
+
+// QueryFloat returns the value of a request param as a float64, or def if it is missing or is not a number
+func QueryFloat(r *http.Request, name string, def float64) float64 {
+	var ret float64
+	if !queryValue(r, name, &ret) {
+		return def
+	}
+	return ret
+}
+
+// QueryBool returns the value of a request param as a bool (e.g. 1, true, false), or def if it is missing or is not
+// a bool
+func QueryBool(r *http.Request, name string, def bool) bool {
+	var ret bool
+	if !queryValue(r, name, &ret) {
+		return def
+	}
+	return ret
+}
+
+// DefaultRequestIdFunc mints the ids of requests, unless another function is set with SetRequestIdFunc. The ids are
+// random UUIDs
+func DefaultRequestIdFunc(r *http.Request) string {
+	return uuid.New()
+}
+
+// we wrap the function so the atomic value always holds the same concrete type
+type requestIdFuncBox struct {
+	f func(*http.Request) string
+}
+
+var currentRequestIdFunc atomic.Value
+
+func init() {
+	currentRequestIdFunc.Store(requestIdFuncBox{DefaultRequestIdFunc})
+}
+
+// SetRequestIdFunc sets the function minting the ids of requests that do not carry a valid id in their X-Request-ID
+// header, e.g. to make ids prefixed or sortable to match logging conventions. An incoming id is always kept. If the
+// function returns an empty id, a default one is used. Passing nil restores DefaultRequestIdFunc
+func SetRequestIdFunc(f func(*http.Request) string) {
+	if f == nil {
+		f = DefaultRequestIdFunc
+	}
+	currentRequestIdFunc.Store(requestIdFuncBox{f})
+}
+
+// requestId returns the id of an incoming request, the id in its X-Request-ID header if it is valid, or a new one
+func requestId(r *http.Request) string {
+	if id := r.Header.Get(HeaderXRequestId); requestIdRe.MatchString(id) {
+		return id
+	}
+	if id := currentRequestIdFunc.Load().(requestIdFuncBox).f(r); id != "" {
+		return id
+	}
+	return DefaultRequestIdFunc(r)
+}
+
+// NewRequest wraps a new http request with a vertex request.
+// The request id is put in the request's context (see RequestIdFromContext)
 func NewRequest(r *http.Request) *Request {
+
+	// only the query is parsed here. Bodies, including urlencoded forms, are parsed when the params are bound, after the
+	// middleware runs, so the middleware can limit their size first. Middleware reading body params parse the body
+	// themselves (see ParseForm)
+	var formErr error
+	if r.Form == nil {
+		r.Form, formErr = url.ParseQuery(r.URL.RawQuery)
+	}
+
 	req := &Request{
 		Request:    r,
 		StartTime:  time.Now(),
 		Locale:     DefaultLocale,
 		UserAgent:  r.UserAgent(),
-		RequestId:  uuid.New(),
-		Callback:   r.FormValue(CallbackParam),
+		RequestId:  requestId(r),
+		Callback:   r.Form.Get(CallbackParam),
 		attributes: make(map[string]interface{}),
+
+		processingTimeHeader: HeaderProcessingTime,
+		processingTimeFormat: DefaultProcessingTimeFormat,
+		serverCtx:            r.Context(),
+		formErr:              formErr,
 	}
 
+	// the query was parsed, so the original request and its copy share the form
+	req.Request = r.WithContext(context.WithValue(r.Context(), requestIdKey{}, req.RequestId))
+
 	req.parseLocale()
 	req.parseAddr()
 	req.parseLocation()
@@ -1,9 +1,11 @@
 package vertex
 
 import (
+	"net/http"
+	"path"
 	"reflect"
+	"time"
 
-	"github.com/dvirsky/go-pylog/logging"
 	gorilla "github.com/gorilla/schema"
 
 	"github.com/EverythingMe/vertex/schema"
@@ -12,18 +14,134 @@ import (
 // A routing map for an API
 type Routes []Route
 
-// Route represents a single route (path) in the API and its handler and optional extra middleware
+// Route represents a single route (path) in the API and its handler and optional extra middleware.
+//
+// A route can dispatch different methods to different handlers with Handlers, e.g. for modeling a REST resource.
+// Methods not in Handlers are handled by Handler, if Methods includes them.
+//
+// Routes handling GET also serve HEAD requests, running the GET handler and discarding the response body
 type Route struct {
 	Path        string
 	Description string
 	Handler     RequestHandler
+	Handlers    map[MethodFlag]RequestHandler
 	Methods     MethodFlag
 	Security    SecurityScheme
 	Middleware  []Middleware
 	Test        Tester
 	Returns     interface{}
 	Renderer    Renderer
+
+	// Deprecated routes keep working, but their responses carry a Deprecation header, and a Sunset header with the
+	// date they are going away, if it is set
+	Deprecated bool
+	Sunset     time.Time
+
+	// Do not serve HEAD requests with the GET handler, e.g. for handlers with side effects
+	NoHead bool
+
+	// The content types accepted in the bodies of POST and PUT requests, e.g. "application/json" or "text/*". Requests
+	// with other bodies are rejected with 415 Unsupported Media Type before the handler is invoked. If it is empty,
+	// any content type is accepted. See DecodableContentTypes for the types bound into params
+	Consumes []string
+
+	// Tags mark routes that are registered only in some environments, e.g. "debug" or "beta". Tagged routes can be
+	// left unregistered with the include_tags and exclude_tags server configs
+	Tags []string
+
 	requestInfo schema.RequestInfo
+
+	// set on the routes expanded from a route's Handlers but the first one, so its test is run once
+	sharesTest bool
+}
+
+// methodRoutes expands a route with per-method Handlers into a route per handler. Routes without Handlers are
+// returned as they are
+func (r Route) methodRoutes() Routes {
+
+	if len(r.Handlers) == 0 {
+		return Routes{r}
+	}
+
+	ret := make(Routes, 0, len(r.Handlers)+1)
+	for _, m := range methodFlags {
+
+		h, found := r.Handlers[m.flag]
+		if !found {
+			continue
+		}
+
+		route := r
+		route.Handler = h
+		route.Methods = m.flag
+		route.Handlers = nil
+		route.sharesTest = len(ret) > 0
+		ret = append(ret, route)
+	}
+
+	// the shared handler takes the methods left
+	var rest MethodFlag
+	for _, m := range methodFlags {
+		if r.Methods&m.flag == m.flag && r.Handlers[m.flag] == nil {
+			rest |= m.flag
+		}
+	}
+	if r.Handler != nil && rest != 0 {
+		route := r
+		route.Methods = rest
+		route.Handlers = nil
+		route.sharesTest = len(ret) > 0
+		ret = append(ret, route)
+	}
+
+	return ret
+}
+
+// Group is a set of routes sharing a path prefix and middleware, e.g. all the admin routes of an API.
+// Groups can be nested, and are expanded into plain routes when the API is configured.
+//
+// The middleware of a group runs after the API's middleware and before the middleware of its routes, and the middleware
+// of a nested group runs after that of its parent
+type Group struct {
+	Path       string
+	Middleware []Middleware
+	Routes     Routes
+	Groups     []Group
+}
+
+// routes expands the group and its nested groups into routes with the group's path prefix and middleware
+func (g Group) routes() Routes {
+
+	ret := make(Routes, 0, len(g.Routes))
+
+	for _, route := range g.Routes {
+		route.Path = path.Join(g.Path, route.Path)
+		route.Middleware = append(append([]Middleware{}, g.Middleware...), route.Middleware...)
+		ret = append(ret, route)
+	}
+
+	for _, sub := range g.Groups {
+		sub.Path = path.Join(g.Path, sub.Path)
+		sub.Middleware = append(append([]Middleware{}, g.Middleware...), sub.Middleware...)
+		ret = append(ret, sub.routes()...)
+	}
+
+	return ret
+}
+
+// deprecationMiddleware marks the responses of a deprecated route, and warns about the route being used
+func (r Route) deprecationMiddleware() MiddlewareFunc {
+
+	return MiddlewareFunc(func(w http.ResponseWriter, req *Request, next HandlerFunc) (interface{}, error) {
+
+		w.Header().Set("Deprecation", "true")
+		if !r.Sunset.IsZero() {
+			w.Header().Set("Sunset", r.Sunset.UTC().Format(http.TimeFormat))
+		}
+		logWarning("Deprecated route %s called by %s (%s)", r.Path, req.RemoteIP, req.UserAgent)
+
+		return next(w, req)
+	})
 }
 
 func (r *Route) parseInfo(path string) error {
@@ -37,14 +155,20 @@ func (r *Route) parseInfo(path string) error {
 	for _, param := range ri.Params {
 		if param.Type.Kind() == reflect.Struct {
 
-			logging.Debug("Checking unmarshaller for %s", param.Type)
+			logDebug("Checking unmarshaller for %s", param.Type)
 			val := reflect.Zero(param.Type).Interface()
 
 			if unm, ok := val.(Unmarshaler); ok {
-				logging.Info("Registering unmarshaller for %#v", val)
+				logInfo("Registering unmarshaller for %#v", val)
 
+				t := param.Type
 				schemaDecoder.RegisterConverter(val, gorilla.Converter(func(s string) reflect.Value {
-					return reflect.ValueOf(unm.UnmarshalRequestData(s))
+					// an invalid value makes the decoder fail the param
+					ret, err := unmarshalValue(unm, t, s)
+					if err != nil {
+						logDebug("Could not unmarshal param: %s", err)
+					}
+					return ret
 				}))
 
 			}
@@ -17,7 +17,8 @@ func parseDefault(val string, t reflect.Kind) (interface{}, bool) {
 	}
 
 	switch t {
-	case reflect.Int, reflect.Int32, reflect.Int16, reflect.Int64:
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		if i, err := parseInt(val); err == nil {
 			return i, true
 		} else {
@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/EverythingMe/vertex/swagger"
 
@@ -26,8 +27,16 @@ const (
 	PatternTag    = "pattern"
 	InTag         = "in"
 	GlobalTag     = "global"
+	PathTag       = "path"
+	HeaderTag     = "header"
+	SepTag        = "sep"
+	TimeFormatTag = "time_format"
+	SensitiveTag  = "sensitive"
+	FileTag       = "file"
 )
 
+var timeType = reflect.TypeOf(time.Time{})
+
 // ParamInfo represents metadata about a requests parameter
 type ParamInfo struct {
 	// the struct name of the param
@@ -80,7 +89,7 @@ type ParamInfo struct {
 	// Regex pattern match. TODO: add to the validator logic
 	Pattern string
 
-	// One-of string selection
+	// One-of value selection, for string and int params
 	Options []string
 
 	// Where is the param in. empty is query/body. should be set only to "path" in case of path params
@@ -91,6 +100,22 @@ type ParamInfo struct {
 	// Is this param a reference to a global definition? If so, we copy its definition to the parameters type
 	// of the generated swagger
 	Global bool
+
+	// Separator for splitting a single value into a slice param, e.g. "," for "a,b,c"
+	Separator string
+
+	// Layout for parsing time.Time params. Defaults to RFC3339
+	TimeFormat string
+
+	// Is the param's value secret (e.g. a password or token), and should be masked in error messages and logs
+	Sensitive bool
+
+	// Is the param a file uploaded in a multipart form, bound into a *multipart.FileHeader or a slice of them
+	File bool
+
+	// Is the param mapped by a field tag other than schema (e.g. path, header), or is it a slice or time. Such params
+	// are mapped by vertex itself and not by the schema decoder
+	CustomBind bool
 }
 
 func getTag(f reflect.StructField, key, def string) string {
@@ -144,6 +169,25 @@ func intTag(f reflect.StructField, tag string, deflt int) (int, bool) {
 
 }
 
+// param locations that can be given in the "in" tag. Any other value is treated as a list of allowed values
+var locations = map[string]struct{}{
+	"query":    struct{}{},
+	"path":     struct{}{},
+	"body":     struct{}{},
+	"header":   struct{}{},
+	"formData": struct{}{},
+}
+
+func isScalar(k reflect.Kind) bool {
+	switch k {
+	case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
 func newParamInfo(field reflect.StructField) ParamInfo {
 
 	ret := ParamInfo{Name: field.Name, StructKey: field.Name}
@@ -155,11 +199,50 @@ func newParamInfo(field reflect.StructField) ParamInfo {
 	}
 
 	ret.In = getTag(field, InTag, "query")
+	if _, found := locations[ret.In]; !found {
+		ret.Options, _ = parseList(ret.In)
+		ret.In = "query"
+	}
 	ret.Description = field.Tag.Get(DocTag)
 
+	// path params are always present if the route matched
+	if pathName := field.Tag.Get(PathTag); pathName != "" {
+		ret.Name = pathName
+		ret.In = "path"
+		ret.CustomBind = true
+	}
+
+	if headerName := field.Tag.Get(HeaderTag); headerName != "" {
+		ret.Name = headerName
+		ret.In = "header"
+		ret.CustomBind = true
+	}
+
+	if fileName := field.Tag.Get(FileTag); fileName != "" {
+		ret.Name = fileName
+		ret.In = "formData"
+		ret.File = true
+		ret.CustomBind = true
+	}
+
 	ret.Kind = field.Type.Kind()
 	ret.Type = field.Type
-	ret.Required = boolTag(field, RequiredTag, false)
+
+	// slices of scalars are bound by vertex, so they can be split by a separator
+	if ret.Kind == reflect.Slice && isScalar(field.Type.Elem().Kind()) {
+		ret.Separator = field.Tag.Get(SepTag)
+		ret.CustomBind = true
+	}
+
+	if field.Type == timeType {
+		ret.TimeFormat = getTag(field, TimeFormatTag, time.RFC3339)
+		if ret.TimeFormat == time.RFC3339 {
+			ret.Format = "date-time"
+		}
+		ret.CustomBind = true
+	}
+
+	ret.Required = boolTag(field, RequiredTag, ret.In == "path")
 	ret.Pattern = field.Tag.Get(PatternTag)
 
 	ret.Min, ret.HasMin = floatTag(field, MinTag, 0)
@@ -168,6 +251,7 @@ func newParamInfo(field reflect.StructField) ParamInfo {
 	ret.MinLength, _ = intTag(field, MinLenTag, 0)
 	ret.Hidden = boolTag(field, HiddenTag, false)
 	ret.Global = boolTag(field, GlobalTag, false)
+	ret.Sensitive = boolTag(field, SensitiveTag, false)
 
 	ret.RawDefault = getTag(field, DefaultTag, "")
 	ret.Default, ret.HasDefault = parseDefault(getTag(field, DefaultTag, ""), field.Type.Kind())
@@ -232,7 +316,7 @@ func extractParams(T reflect.Type) (ret []ParamInfo) {
 		}
 
 		// a struct means this is an embedded request object
-		if field.Type.Kind() == reflect.Struct {
+		if field.Type.Kind() == reflect.Struct && field.Type != timeType {
 			ret = append(extractParams(field.Type), ret...)
 		} else {
 
@@ -316,6 +400,15 @@ func (p ParamInfo) ToSwagger() swagger.Param {
 		Global:    p.Global,
 	}
 
-	ret.Type, ret.Items = swagger.TypeOf(p.Type, swagger.String)
+	ret.Type, ret.Items = p.SwaggerType()
 	return ret
 }
+
+// SwaggerType returns the swagger type of the param, and of its items if it is an array. Types that do not map to a
+// swagger type are strings, or files for uploaded files
+func (p ParamInfo) SwaggerType() (tp swagger.Type, items swagger.Type) {
+	if p.File {
+		return swagger.TypeOf(p.Type, swagger.File)
+	}
+	return swagger.TypeOf(p.Type, swagger.String)
+}
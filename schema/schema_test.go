@@ -1,6 +1,7 @@
 package schema
 
 import (
+	"mime/multipart"
 	"reflect"
 	"testing"
 
@@ -122,3 +123,31 @@ func TestRequestInfo(t *testing.T) {
 
 	}
 }
+
+func TestFileParams(t *testing.T) {
+
+	type uploadHandler struct {
+		Avatar *multipart.FileHeader   `file:"avatar" required:"true"`
+		Extras []*multipart.FileHeader `file:"extra"`
+	}
+
+	ri, err := NewRequestInfo(reflect.TypeOf(uploadHandler{}), "/upload", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	avatar, extras := ri.Params[0], ri.Params[1]
+	if avatar.Name != "avatar" || avatar.In != "formData" || !avatar.File || !avatar.CustomBind || !avatar.Required {
+		t.Errorf("Bad file param info: %#v", avatar)
+	}
+	if !extras.File || extras.Separator != "" {
+		t.Errorf("Bad file slice param info: %#v", extras)
+	}
+
+	if p := avatar.ToSwagger(); p.Type != swagger.File {
+		t.Errorf("Expected file swagger type, got %s", p.Type)
+	}
+	if tp, items := extras.SwaggerType(); tp != swagger.Array || items != swagger.File {
+		t.Errorf("Expected array of files swagger type, got %s of %s", tp, items)
+	}
+}
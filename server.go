@@ -1,60 +1,160 @@
 package vertex
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/dvirsky/go-pylog/logging"
 	"github.com/hydrogen18/stoppableListener"
 	"github.com/julienschmidt/httprouter"
 )
 
 // Server represents a multi-API http server with a single router
 type Server struct {
-	addr     string
-	apis     []*API
-	router   *httprouter.Router
-	listener net.Listener
-	wg       sync.WaitGroup
+	addr       string
+	apis       []*API
+	router     *httprouter.Router
+	listener   net.Listener
+	httpServer *http.Server
+	lock       sync.Mutex
+	wg         sync.WaitGroup
+
+	notFoundHandler         RequestHandler
+	methodNotAllowedHandler RequestHandler
+	optionsHandler          RequestHandler
+	trailingSlash           TrailingSlashPolicy
+	healthChecks            map[string]func() error
+	registry                *Registry
+
+	// cancels the contexts of the requests still in flight when shutting down
+	cancelRequests context.CancelFunc
+
+	// customizes the http server before it starts serving, see ConfigureHTTPServer
+	configureHTTPServer func(*http.Server)
 }
 
-type builderFunc func() *API
+// TrailingSlashPolicy tells how a server routes requests to /foo/ if only /foo is defined, and vice versa
+type TrailingSlashPolicy string
 
-var apiBuilders = map[string]builderFunc{}
+const (
+	// TrailingSlashStrict treats /foo and /foo/ as different paths. This is the default
+	TrailingSlashStrict TrailingSlashPolicy = "strict"
+	// TrailingSlashRedirect redirects requests to the defined path with a 308 Permanent Redirect
+	TrailingSlashRedirect TrailingSlashPolicy = "redirect"
+	// TrailingSlashEquivalent serves requests to either path with the handler of the defined one
+	TrailingSlashEquivalent TrailingSlashPolicy = "equivalent"
+)
 
-// Register lest you automatically add an API to the server from your module's init() function.
-//
-// name is a unique name for your API (doesn't have to match the API name exactly).
+// newRouter creates the router of a server or a stand-alone API.
 //
-// builder is a func that creates the API when we are ready to start the server.
+// Requests to a defined path with a method not registered for it are answered with a 405 Method Not Allowed and an
+// Allow header listing the path's methods, and not with a 404. Trailing slashes are left for the server's
+// TrailingSlashPolicy, so the router does not redirect them itself
+func newRouter() *httprouter.Router {
+	router := httprouter.New()
+	router.HandleMethodNotAllowed = true
+	router.HandleOPTIONS = true
+	router.RedirectTrailingSlash = false
+	return router
+}
+
+// DefaultNotFoundHandler handles requests to undefined paths on servers that do not set their own handler
+var DefaultNotFoundHandler RequestHandler = HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return nil, NotFoundError("No route for %s", r.URL.Path)
+})
+
+// DefaultMethodNotAllowedHandler handles requests with undefined methods to defined paths on servers that do not set
+// their own handler. The Allow header is already set when it is called
+var DefaultMethodNotAllowedHandler RequestHandler = HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return nil, MethodNotAllowedError("%s is not allowed for %s", r.Method, r.URL.Path)
+})
+
+// DefaultOptionsHandler answers OPTIONS requests to defined paths with no OPTIONS route of their own, on servers that
+// do not set their own handler. The Allow header, listing the methods of the path, is already set when it is called
+var DefaultOptionsHandler RequestHandler = NoContentHandler{}
+
+// NewServer creates a new blank server to add APIs to. InitAPIs adds to it the APIs registered with Register.
 //
-// Optionally, you can pass a pointer to a config struct, or nil if you don't need to. This way, we can read the config struct's values
-// from a unified config file BEFORE we call the builder, so the builder can use values in the config struct.
-func Register(name string, builder func() *API, config interface{}) {
-	//logging.Info("Adding api builder %s", name)
-	apiBuilders[name] = builderFunc(builder)
+// The server listens on addr, a TCP address (e.g. ":9944"), or the path of a Unix domain socket prefixed with
+// UnixAddrPrefix (e.g. "unix:/var/run/api.sock"). The socket file is removed when the server is stopped
+func NewServer(addr string) *Server {
+	return NewServerWithRegistry(addr, DefaultRegistry)
+}
 
-	if config != nil {
-		registerAPIConfig(name, config)
+// NewServerWithRegistry creates a new blank server, whose InitAPIs adds the APIs registered in the given registry
+// instead of the global one. This lets independent servers run in the same process, e.g. in tests
+func NewServerWithRegistry(addr string, registry *Registry) *Server {
+	s := &Server{
+		addr:     addr,
+		apis:     make([]*API, 0),
+		router:   newRouter(),
+		registry: registry,
 	}
+
+
+	// Serve the liveness and readiness probes
+	s.router.GET(HealthzPath, s.livenessHandler)
+	s.router.GET(ReadyzPath, s.readinessHandler)
+
+	s.router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := s.notFoundHandler
+		if h == nil {
+			h = DefaultNotFoundHandler
+		}
+		s.serveUnrouted(h, w, r)
+	})
+	s.router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := s.methodNotAllowedHandler
+		if h == nil {
+			h = DefaultMethodNotAllowedHandler
+		}
+		s.serveUnrouted(h, w, r)
+	})
+	s.router.GlobalOPTIONS = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := s.optionsHandler
+		if h == nil {
+			h = DefaultOptionsHandler
+		}
+		s.serveUnrouted(h, w, r)
+	})
+
+	return s
 }
 
-// NewServer creates a new blank server to add APIs to
-func NewServer(addr string) *Server {
-	return &Server{
-		addr:   addr,
-		apis:   make([]*API, 0),
-		router: httprouter.New(),
+// AddAPI adds an API to the server manually. It's preferred to use Register in an init() function.
+//
+// It returns an error, without adding the API, if the API is invalid: if it has no root or no renderer, if a route has
+// no handler or an invalid path (e.g. a catch-all param that is not the last segment), or if routes conflict, having
+// the same method and path template (e.g. GET /u/{id} and GET /u/{name}).
+//
+// It also returns an error if a route conflicts with the routes already on the server, e.g. of another API with the
+// same root. The routes of the API registered before the conflicting one stay registered, so the server should be
+// discarded in that case
+func (s *Server) AddAPI(a *API) (err error) {
+
+	if a == nil {
+		return errors.New("Cannot add a nil API")
+	}
+	if err := a.validate(); err != nil {
+		return err
 	}
-}
 
-// AddAPI adds an API to the server manually. It's preferred to use Register in an init() function
-func (s *Server) AddAPI(a *API) {
+	// the router panics on routes conflicting with routes it already has, e.g. of another API with the same root
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("Could not add API %s: %v", a.Name, e)
+		}
+	}()
+
 	a.configure(s.router)
 
 	s.router.PanicHandler = func(w http.ResponseWriter, r *http.Request, v interface{}) {
@@ -64,22 +164,224 @@ func (s *Server) AddAPI(a *API) {
 	}
 
 	s.apis = append(s.apis, a)
+	return nil
+}
+
+// SetNotFoundHandler sets the handler of requests to undefined paths, instead of DefaultNotFoundHandler.
+// Its response is rendered like those of the APIs, see serveUnrouted
+func (s *Server) SetNotFoundHandler(h RequestHandler) {
+	s.notFoundHandler = h
+}
+
+// SetMethodNotAllowedHandler sets the handler of requests with undefined methods to defined paths, instead of
+// DefaultMethodNotAllowedHandler. Its response is rendered like those of the APIs, see serveUnrouted
+func (s *Server) SetMethodNotAllowedHandler(h RequestHandler) {
+	s.methodNotAllowedHandler = h
+}
+
+// SetOptionsHandler sets the handler of OPTIONS requests to defined paths with no OPTIONS route, instead of
+// DefaultOptionsHandler. Its response is rendered like those of the APIs, see serveUnrouted
+func (s *Server) SetOptionsHandler(h RequestHandler) {
+	s.optionsHandler = h
+}
+
+// serveUnrouted handles a request that matches no route. The response is rendered by the renderer of the API whose
+// root the path is under, with its JSONP policy, or as JSON without a callback if there is no such API
+func (s *Server) serveUnrouted(h RequestHandler, w http.ResponseWriter, r *http.Request) {
+
+	req := NewRequest(r)
+	req.renderer = JSONRenderer{}
+	var api *API
+	for _, a := range s.apis {
+		if a.Renderer != nil && (r.URL.Path == a.root() || strings.HasPrefix(r.URL.Path, a.root()+"/")) {
+			api = a
+			req.renderer = a.Renderer
+			req.APIName = a.Name
+			req.processingTimeHeader = a.processingTimeHeader()
+			req.processingTimeFormat = a.processingTimeFormat()
+			break
+		}
+	}
+
+	// callbacks that are not allowed are dropped, keeping the response of the handler
+	if api == nil {
+		req.Callback = ""
+	} else if err := api.validateCallback(req); err != nil {
+		logWarning("Not rendering JSONP for %s: %s", r.URL.Path, err)
+	}
+	w.Header().Set(HeaderXRequestId, req.RequestId)
+
+	v, err := h.Handle(w, req)
+	if !IsHijacked(err) {
+		if err = render(req.renderer, v, err, w, req); err != nil {
+			logError("Error rendering response: %s", err)
+		}
+	}
+}
+
+// MetricsPath is the path metrics are exposed on by Server.ExposeMetrics
+const MetricsPath = "/metrics"
+
+// ExposeMetrics serves metrics on the /metrics path of the server, e.g. the metrics collected by middleware.Metrics
+// in the Prometheus format. While metrics are disabled in the server config, the path is not found, so metrics can be
+// enabled and disabled by reloading the config
+func (s *Server) ExposeMetrics(h http.Handler) {
+
+	s.router.GET(MetricsPath, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if ServerConfig().DisableMetrics {
+			s.router.NotFound.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// SetTrailingSlashPolicy sets how the server routes paths differing only by a trailing slash, instead of the policy
+// of the server config
+func (s *Server) SetTrailingSlashPolicy(p TrailingSlashPolicy) {
+	s.trailingSlash = p
 }
 
-// Handler returns the underlying router, mainly for testing
+func (s *Server) trailingSlashPolicy() TrailingSlashPolicy {
+	if s.trailingSlash != "" {
+		return s.trailingSlash
+	}
+	return ServerConfig().TrailingSlash
+}
+
+// ServeHTTP routes a request, applying the trailing slash policy to paths that are not defined but would be with a
+// trailing slash added or removed
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	conf := ServerConfig()
+	if err := checkURLLength(r, conf.MaxURLLength, conf.MaxQueryValueLength); err != nil {
+		s.serveUnrouted(HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+			return nil, err
+		}), w, r)
+		return
+	}
+
+	policy := s.trailingSlashPolicy()
+	if policy == TrailingSlashRedirect || policy == TrailingSlashEquivalent {
+
+		pth := r.URL.Path
+		if h, _, _ := s.router.Lookup(r.Method, pth); h == nil && pth != "/" {
+
+			alt := pth + "/"
+			if strings.HasSuffix(pth, "/") {
+				alt = strings.TrimSuffix(pth, "/")
+			}
+
+			if h, _, _ := s.router.Lookup(r.Method, alt); h != nil {
+				if policy == TrailingSlashRedirect {
+					u := *r.URL
+					u.Path = alt
+					http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+					return
+				}
+				r.URL.Path = alt
+			}
+		}
+	}
+
+	s.router.ServeHTTP(w, r)
+}
+
+// checkURLLength rejects requests whose URL, or any of its query values, is longer than the given limits. Limits of
+// zero are not checked
+func checkURLLength(r *http.Request, maxURL, maxValue int) error {
+
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	if maxURL > 0 && len(uri) > maxURL {
+		logWarning("Rejecting request with a URL of %d bytes from %s", len(uri), r.RemoteAddr)
+		return URITooLongError("URL is longer than %d bytes", maxURL)
+	}
+
+	if maxValue > 0 && len(r.URL.RawQuery) > maxValue {
+		for name, values := range r.URL.Query() {
+			for _, v := range values {
+				if len(v) > maxValue {
+					logWarning("Rejecting request with a %s param of %d bytes from %s", name, len(v), r.RemoteAddr)
+					return InvalidParamError("Value of %s is longer than %d bytes", name, maxValue)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Handler returns the server as an http handler, mainly for testing
 func (s *Server) Handler() http.Handler {
-	return s.router
+	return s
 }
 
-// InitAPIs initializes and adds all the APIs registered from API builders
-func (s *Server) InitAPIs() {
-	for _, builder := range apiBuilders {
-		s.AddAPI(builder())
+// InitAPIs initializes and adds all the APIs registered from API builders. APIs that cannot be added are skipped, and
+// their errors are returned together, so callers can decide whether the server can run without them
+func (s *Server) InitAPIs() error {
+
+	var errs []string
+	for _, name := range s.registry.Names() {
+		builder, _ := s.registry.get(name)
+		if err := s.AddAPI(builder()); err != nil {
+			logError("Could not add API %s: %s", name, err)
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Could not add %d APIs: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// AddAPIBuilder registers an API builder in the server's registry, to be built and added by InitAPIs (see Register).
+// On servers created with NewServer, this registers the builder globally
+func (s *Server) AddAPIBuilder(name string, builder func() *API, config interface{}) {
+	s.registry.Register(name, builder, config)
+}
+
+// RunTests runs the tests of all the routes of the server's APIs in the given category (or all of them if the category
+// is empty or "all"), and returns their results. The tests are run in process, against a local test server serving
+// the APIs, so RunTests can be called without running the server
+func (s *Server) RunTests(category string) TestResults {
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	ret := make(TestResults, 0)
+	for _, a := range s.apis {
+		runner := newTestRunner(ioutil.Discard, a, ts.URL, category, TestFormatText)
+		for _, res := range runner.run() {
+			res.API = a.Name
+			ret = append(ret, res)
+		}
 	}
+
+	return ret
 }
 
-// Run runs the server if it has any APIs registered on it
+// Run runs the server if it has any APIs registered on it.
+// If a TLS certificate and key are set in the server config, the server is run over HTTPS
 func (s *Server) Run() (err error) {
+	return s.serve(Config.Server.TLSCertFile, Config.Server.TLSKeyFile)
+}
+
+// RunTLS runs the server over HTTPS, with the given certificate and key files
+func (s *Server) RunTLS(certFile, keyFile string) error {
+
+	if certFile == "" || keyFile == "" {
+		return errors.New("Missing TLS certificate or key file")
+	}
+
+	return s.serve(certFile, keyFile)
+}
+
+// serve runs the server, over HTTPS if it has both a certificate and a key file
+func (s *Server) serve(certFile, keyFile string) (err error) {
 
 	if len(s.apis) == 0 {
 		return errors.New("No APIs defined for server")
@@ -91,37 +393,155 @@ func (s *Server) Run() (err error) {
 	// Start a stoppable listener
 	var l net.Listener
 
-	if l, err = net.Listen("tcp", s.addr); err != nil {
+	network, address := listenAddress(s.addr)
+	if network == "unix" {
+		removeStaleSocket(address)
+	}
+
+	if l, err = net.Listen(network, address); err != nil {
 		return fmt.Errorf("Could not listen in server: %s", err)
 	}
 
-	if s.listener, err = stoppableListener.New(l); err != nil {
+	s.lock.Lock()
+	if network == "unix" {
+		// the stoppable listener only wraps TCP listeners. Closing a unix listener removes its socket file
+		s.listener = l
+	} else if s.listener, err = stoppableListener.New(l); err != nil {
+		s.lock.Unlock()
 		return fmt.Errorf("Could not start stoppable listener in server: %s", err)
 	}
 
-	logging.Info("Starting server on %s", s.listener.Addr().String())
+	logInfo("Starting server on %s", s.listener.Addr().String())
 
 	s.wg.Add(1)
 	defer func() {
 		s.wg.Done()
 		// don't return an error on server stopped
-		if err == stoppableListener.StoppedError {
+		if err == stoppableListener.StoppedError || err == http.ErrServerClosed {
 			err = nil
 		}
 	}()
 
-	srv := http.Server{
-		Handler:      s.router,
-		ReadTimeout:  time.Duration(Config.Server.ClientTimeout) * time.Second,
-		WriteTimeout: time.Duration(Config.Server.ClientTimeout) * time.Second, // maximum duration before timing out write of the response
+	s.httpServer = s.newHTTPServer()
+	if s.configureHTTPServer != nil {
+		s.configureHTTPServer(s.httpServer)
+	}
+	srv := s.httpServer
+	s.lock.Unlock()
+
+	if certFile != "" && keyFile != "" {
+		logInfo("Serving HTTPS with certificate %s", certFile)
+		return srv.ServeTLS(s.listener, certFile, keyFile)
+	}
+
+	// the certificates may also be set in the TLS config of the http server
+	if cfg := srv.TLSConfig; cfg != nil && (len(cfg.Certificates) > 0 || cfg.GetCertificate != nil) {
+		logInfo("Serving HTTPS with the certificates of the TLS config")
+		return srv.ServeTLS(s.listener, "", "")
 	}
+
 	return srv.Serve(s.listener)
 
 }
 
-// Stop waits up to a second and closes the server
-func (s *Server) Stop() {
+// UnixAddrPrefix prefixes server addresses that are the path of a Unix domain socket to listen on, e.g.
+// "unix:/var/run/api.sock", instead of a TCP address
+const UnixAddrPrefix = "unix:"
+
+// listenAddress returns the network and address a server listens on
+func listenAddress(addr string) (network, address string) {
+	if strings.HasPrefix(addr, UnixAddrPrefix) {
+		return "unix", strings.TrimPrefix(addr, UnixAddrPrefix)
+	}
+	return "tcp", addr
+}
+
+// removeStaleSocket removes the socket file left at a path by a server that did not shut down cleanly, so it can be
+// listened on again. Files that are not sockets, or sockets still accepting connections, are left alone
+func removeStaleSocket(path string) {
+
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
 
-	s.listener.(*stoppableListener.StoppableListener).Stop()
+	logWarning("Removing stale socket file %s", path)
+	if err := os.Remove(path); err != nil {
+		logError("Could not remove stale socket file %s: %s", path, err)
+	}
+}
+
+// newHTTPServer creates the http server serving the router, with the timeouts of the server config.
+// The contexts of its requests derive from a context cancelled by Shutdown
+func (s *Server) newHTTPServer() *http.Server {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancelRequests = cancel
+
+	return &http.Server{
+		Handler:      s,
+		ReadTimeout:  Config.Server.timeout(Config.Server.ReadTimeout),
+		WriteTimeout: Config.Server.timeout(Config.Server.WriteTimeout), // maximum duration before timing out write of the response
+		IdleTimeout:  Config.Server.timeout(Config.Server.IdleTimeout),
+
+		MaxHeaderBytes: Config.Server.MaxHeaderBytes,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+}
+
+// ConfigureHTTPServer sets a function customizing the underlying http server when the server is run, after the server
+// config is applied to it and before it starts serving, e.g. to set its ConnState hook or its TLSConfig. This is an
+// escape hatch for settings the server has no options for.
+//
+// The function may override anything, including the Handler and the BaseContext, which cancels the requests still in
+// flight when shutting down. It must be called before the server is run
+func (s *Server) ConfigureHTTPServer(f func(*http.Server)) {
+	s.lock.Lock()
+	s.configureHTTPServer = f
+	s.lock.Unlock()
+}
+
+// HTTPServer returns the underlying http server of the server while it runs, or nil if it was not run yet
+func (s *Server) HTTPServer() *http.Server {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.httpServer
+}
+
+// Shutdown stops the server gracefully. It stops accepting new connections, and waits for the requests in flight to
+// finish, until the context is done. The contexts of the requests still in flight after that are cancelled, so their
+// handlers can stop. It returns the error of shutting down the http server, if any
+func (s *Server) Shutdown(ctx context.Context) error {
+
+	s.lock.Lock()
+	srv := s.httpServer
+	cancel := s.cancelRequests
+	s.lock.Unlock()
+
+	if srv == nil {
+		return errors.New("Server is not running")
+	}
+
+	err := srv.Shutdown(ctx)
+	cancel()
 	s.wg.Wait()
+	return err
+}
+
+// Stop shuts down the server, waiting up to a second for requests in flight to finish
+func (s *Server) Stop() {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		logError("Error shutting down server: %s", err)
+	}
 }
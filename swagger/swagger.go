@@ -18,6 +18,7 @@ const (
 	Integer Type = "integer"
 	Array   Type = "array"
 	Object  Type = "object"
+	File    Type = "file"
 )
 
 func TypeOf(t reflect.Type, defaultType Type) (tp Type, items Type) {
@@ -100,9 +101,11 @@ type Method struct {
 	Description string              `json:"description,omitempty"`
 	Operationid string              `json:"operationId,omitempty"`
 	Produces    []string            `json:"produces,omitempty"`
+	Consumes    []string            `json:"consumes,omitempty"`
 	Parameters  []Param             `json:"parameters,omitempty"`
 	Responses   map[string]Response `json:"responses"`
 	Tags        []string            `json:"tags",omitempty`
+	Deprecated  bool                `json:"deprecated,omitempty"`
 }
 
 type Path map[string]Method
@@ -113,3 +113,72 @@ func TestSwagger(t *testing.T) {
 	//fmt.Println(sw)
 
 }
+
+func TestSwaggerPathParams(t *testing.T) {
+
+	a := &vertex.API{
+		Name:          "testung",
+		Version:       "1.0",
+		Renderer:      vertex.JSONRenderer{},
+		AllowInsecure: true,
+		Routes: vertex.Routes{
+			{
+				Path:        "/user/{id}",
+				Description: "Get User Info by id",
+				Handler:     UserHandler{},
+				Methods:     vertex.GET,
+			},
+			{
+				Path:        "/group/{gid}/user/{uid}",
+				Description: "Get a user in a group",
+				Handler: vertex.HandlerFunc(func(w http.ResponseWriter, r *vertex.Request) (interface{}, error) {
+					return "WAT WAT", nil
+				}),
+				Methods: vertex.GET,
+			},
+		},
+	}
+
+	srv := vertex.NewServer(":9948")
+	srv.AddAPI(a)
+
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	res, err := http.Get(fmt.Sprintf("http://%s%s", s.Listener.Addr().String(), a.FullPath("/swagger.json")))
+	if err != nil {
+		t.Fatalf("Could not get swagger data: %s", err)
+	}
+	defer res.Body.Close()
+
+	var sw swagger.API
+	if err = json.NewDecoder(res.Body).Decode(&sw); err != nil {
+		t.Fatalf("Could not decode swagger def: %s", err)
+	}
+
+	params := map[string]swagger.Param{}
+	for _, p := range sw.Paths["/group/{gid}/user/{uid}"]["get"].Parameters {
+		params[p.Name] = p
+	}
+	for _, name := range []string{"gid", "uid"} {
+		p, found := params[name]
+		if !found {
+			t.Fatalf("Path param %s missing from swagger", name)
+		}
+		assertEqual(t, p.In, "path")
+		assertEqual(t, p.Required, true)
+		assertEqual(t, p.Type, swagger.String)
+	}
+
+	found := false
+	for _, p := range sw.Paths["/user/{id}"]["get"].Parameters {
+		if p.Name == "id" {
+			found = true
+			assertEqual(t, p.In, "path")
+			assertEqual(t, p.Required, true)
+		}
+	}
+	if !found {
+		t.Errorf("Path param id missing from swagger")
+	}
+}
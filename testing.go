@@ -10,12 +10,12 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"reflect"
 	"runtime"
+	"strings"
 	"sync"
 	"text/tabwriter"
 	"time"
-
-	"github.com/dvirsky/go-pylog/logging"
 )
 
 // Tester represents a testcase the API runs for a certain API.
@@ -71,12 +71,26 @@ type TestContext struct {
 	category  string
 	messages  []string
 	startTime time.Time
+
+	// the maximum number of bytes of a response body read by GetJSON and the Expect methods
+	maxResponseSize int64
+}
+
+// DefaultMaxTestResponseSize is the maximum number of bytes of a response body that test requests read, unless set
+// otherwise with TestContext.SetMaxResponseSize
+const DefaultMaxTestResponseSize = 10 << 20
+
+// SetMaxResponseSize sets the maximum number of bytes of a response body that GetJSON and the Expect methods read.
+// Requests with larger responses fail, so a test of a large or endless streaming response does not buffer all of it.
+// Zero restores DefaultMaxTestResponseSize
+func (t *TestContext) SetMaxResponseSize(n int64) {
+	t.maxResponseSize = n
 }
 
 // Log writes a message to be displayed alongside the test result ONLY if the test failed
 func (t *TestContext) Log(format string, params ...interface{}) {
 	msg := fmt.Sprintf("%v> %s", time.Now().Format("15:04:05.000"), fmt.Sprintf(format, params...))
-	logging.Info(msg)
+	logInfo("%s", msg)
 	t.messages = append(t.messages, msg)
 
 }
@@ -109,7 +123,7 @@ func (t *TestContext) FormatUrl(pathParams Params) string {
 
 	u := fmt.Sprintf("%s%s", t.serverURl, t.api.FullPath(FormatPath(t.routePath, pathParams)))
 
-	logging.Debug("Formatted url: %s", u)
+	logDebug("Formatted url: %s", u)
 	return u
 }
 
@@ -137,28 +151,268 @@ func (t *TestContext) NewRequest(method string, values url.Values, pathParams Pa
 	return req, err
 }
 
+// NewJSONRequest creates a new http request to the route we are testing now, with the body marshaled to JSON, and
+// optional path params. This is mainly useful for POST and PUT requests, whose JSON bodies are bound into
+// the request handler
+func (t *TestContext) NewJSONRequest(method string, body interface{}, pathParams Params) (*http.Request, error) {
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal request body: %s", err)
+	}
+
+	req, err := http.NewRequest(method, t.FormatUrl(pathParams), bytes.NewReader(b))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, err
+}
+
 // GetJSON performs the given request, and tries to deserialize the response object to v.
 // If we received an error or decoding is impossible, we return an error.
-// The raw http response is also returned for inspection
+// The raw http response is also returned for inspection, whenever the request got one: a failed request, e.g. a 500
+// with an HTML body, fails with its status and the head of its body rather than with the error decoding it
 func (t *TestContext) GetJSON(r *http.Request, v interface{}) (*http.Response, error) {
 
-	resp, err := http.DefaultClient.Do(r)
+	resp, b, err := t.do(r)
 	if err != nil {
 		return resp, err
 	}
 
-	b, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	err = json.Unmarshal(b, v)
+	if resp.StatusCode >= 400 {
+		if err != nil {
+			return resp, fmt.Errorf("Bad HTTP response code: %s: %s", resp.Status, bodyHead(b))
+		}
+		return resp, fmt.Errorf("Bad HTTP response code: %s", resp.Status)
+	}
+	if err != nil {
+		return resp, fmt.Errorf("Could not decode %s response (%s): %s", resp.Header.Get("Content-Type"), resp.Status, err)
+	}
+	return resp, nil
+
+}
+
+// bodyHead returns the start of a response body for error messages
+func bodyHead(b []byte) string {
+	const max = 200
+
+	b = bytes.TrimSpace(b)
+	if len(b) > max {
+		return string(b[:max]) + "..."
+	}
+	return string(b)
+}
+
+// failExpectation fails the test from an Expect method, with the fail point of the test calling it
+func (t *TestContext) failExpectation(format string, params ...interface{}) {
+	panic(newTestResult(resultFailed, fmt.Sprintf(format, params...), 3, t))
+}
+
+// do performs a request and reads its response body, up to the maximum response size. The body is replaced so the
+// caller can still read it
+func (t *TestContext) do(r *http.Request) (*http.Response, []byte, error) {
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	// We replace the request's body with a fake one if the caller wants to peek inside
+	limit := t.maxResponseSize
+	if limit <= 0 {
+		limit = DefaultMaxTestResponseSize
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	resp.Body.Close()
+	if err == nil && int64(len(b)) > limit {
+		b = b[:limit]
+		err = fmt.Errorf("Response body of %s is larger than %d bytes", resp.Status, limit)
+	}
 	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
 
-	err = json.Unmarshal(b, v)
-	if err == nil && resp.StatusCode >= 400 {
-		err = fmt.Errorf("Bad HTTP response code: %s", resp.Status)
+	return resp, b, err
+}
+
+// ExpectStatus performs the given request, and fails the test if the response status code is not the expected one.
+// The response is returned for further inspection
+func (t *TestContext) ExpectStatus(r *http.Request, code int) *http.Response {
+
+	resp, b, err := t.do(r)
+	if err != nil {
+		t.failExpectation("Error performing request: %s", err)
 	}
-	return resp, err
 
+	if resp.StatusCode != code {
+		t.failExpectation("Expected status %d, got %s: %s", code, resp.Status, bytes.TrimSpace(b))
+	}
+
+	return resp
+}
+
+// ExpectJSONField performs the given request, and fails the test if it failed, or if the field of its JSON response
+// object does not equal the expected value. Nested fields can be accessed with a dotted path, e.g. "user.name".
+//
+// Values are compared by their JSON representation, so e.g. an expected int matches a JSON number
+func (t *TestContext) ExpectJSONField(r *http.Request, field string, expected interface{}) *http.Response {
+
+	var v interface{}
+	resp, err := t.GetJSON(r, &v)
+	if err != nil {
+		t.failExpectation("Error getting JSON response: %s", err)
+	}
+
+	for _, key := range strings.Split(field, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			t.failExpectation("Field %s not found in response", field)
+		}
+		if v, ok = m[key]; !ok {
+			t.failExpectation("Field %s not found in response", field)
+		}
+	}
+
+	// normalize the expected value to what it would look like decoded from JSON
+	var exp interface{}
+	b, err := json.Marshal(expected)
+	if err == nil {
+		err = json.Unmarshal(b, &exp)
+	}
+	if err != nil {
+		t.failExpectation("Invalid expected value for %s: %s", field, err)
+	}
+
+	if !reflect.DeepEqual(exp, v) {
+		t.failExpectation("Expected %s to be %#v, got %#v", field, exp, v)
+	}
+
+	return resp
+}
+
+// ExpectError performs the given request, and fails the test unless it failed with the expected status code.
+// The error message of the response is returned
+func (t *TestContext) ExpectError(r *http.Request, code int) string {
+
+	resp, b, err := t.do(r)
+	if err != nil {
+		t.failExpectation("Error performing request: %s", err)
+	}
+
+	if resp.StatusCode < 400 {
+		t.failExpectation("Expected an error with status %d, got %s", code, resp.Status)
+	}
+	if resp.StatusCode != code {
+		t.failExpectation("Expected an error with status %d, got %s: %s", code, resp.Status, bytes.TrimSpace(b))
+	}
+
+	return string(bytes.TrimSpace(b))
+}
+
+// ExpectHeader performs the given request, and fails the test unless the response has the header with the expected
+// value. Headers with several values pass if any of them is the expected one. The response is returned for further
+// inspection
+func (t *TestContext) ExpectHeader(r *http.Request, name, value string) *http.Response {
+
+	resp, _, err := t.do(r)
+	if err != nil {
+		t.failExpectation("Error performing request: %s", err)
+	}
+
+	values, found := resp.Header[http.CanonicalHeaderKey(name)]
+	if !found {
+		t.failExpectation("Expected header %s to be %q, but it is missing (status %s)", name, value, resp.Status)
+	}
+	for _, v := range values {
+		if v == value {
+			return resp
+		}
+	}
+
+	t.failExpectation("Expected header %s to be %q, got %q", name, value, strings.Join(values, ", "))
+	return resp
+}
+
+// ExpectHeaderPresent performs the given request, and fails the test unless the response has the header, with any
+// value. The value of the header is returned
+func (t *TestContext) ExpectHeaderPresent(r *http.Request, name string) string {
+
+	resp, _, err := t.do(r)
+	if err != nil {
+		t.failExpectation("Error performing request: %s", err)
+	}
+
+	if _, found := resp.Header[http.CanonicalHeaderKey(name)]; !found {
+		t.failExpectation("Expected header %s in the response, but it is missing (status %s)", name, resp.Status)
+	}
+
+	return resp.Header.Get(name)
+}
+
+// TestCounts counts the results of tests by their outcome. Failed includes fatal and missing tests
+type TestCounts struct {
+	Passed  int `json:"passed"`
+	Failed  int `json:"failed"`
+	Skipped int `json:"skipped"`
+}
+
+func (c TestCounts) String() string {
+	return fmt.Sprintf("%d passed, %d failed, %d skipped", c.Passed, c.Failed, c.Skipped)
+}
+
+// TestSummary counts test results separately for critical and warning tests
+type TestSummary struct {
+	Critical TestCounts `json:"critical"`
+	Warning  TestCounts `json:"warning"`
+}
+
+func (s TestSummary) String() string {
+	return fmt.Sprintf("critical: %s; warning: %s", s.Critical, s.Warning)
+}
+
+// Summary counts the results by category and outcome. Missing tests are counted as failed warning tests
+func (r TestResults) Summary() TestSummary {
+
+	var ret TestSummary
+	for _, res := range r {
+
+		counts := &ret.Warning
+		if res.Category == CriticalTests {
+			counts = &ret.Critical
+		}
+
+		switch {
+		case res.isFailure():
+			counts.Failed++
+		case res.Result == resultSkipped:
+			counts.Skipped++
+		default:
+			counts.Passed++
+		}
+	}
+
+	return ret
+}
+
+// CriticalError returns an error listing the failed critical tests, or nil if all of them passed. Failed warning tests
+// do not cause an error, so this can be used to gate deploys, e.g.
+//	if err := srv.RunTests(vertex.AllTests).CriticalError(); err != nil {
+//		fmt.Fprintln(os.Stderr, err)
+//		os.Exit(1)
+//	}
+func (r TestResults) CriticalError() error {
+
+	failed := make([]string, 0)
+	for _, res := range r {
+		if res.Category == CriticalTests && res.isFailure() {
+			failed = append(failed, fmt.Sprintf("%s%s [%s]", res.API, res.Path, res.Result))
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("Critical tests failed: %s", strings.Join(failed, ", "))
 }
 
 type testRunner struct {
@@ -167,9 +421,11 @@ type testRunner struct {
 	api       *API
 	output    io.Writer
 	formatter resultFormatter
+	// formatLock serializes the formatter, which writes to the shared output from concurrent tests
+	formatLock sync.Mutex
 }
 type resultFormatter interface {
-	format(testResult) error
+	format(TestResult) error
 }
 
 const (
@@ -189,7 +445,7 @@ func newJsonResultFormatter(out io.Writer) *jsonResultFormatter {
 	}
 }
 
-func (f jsonResultFormatter) format(r testResult) error {
+func (f jsonResultFormatter) format(r TestResult) error {
 
 	if err := f.encoder.Encode(r); err != nil {
 		return err
@@ -209,7 +465,7 @@ func newTextResultFormatter(w io.Writer) *textResultFormatter {
 	}
 }
 
-func (f textResultFormatter) format(result testResult) error {
+func (f textResultFormatter) format(result TestResult) error {
 
 	if _, err := fmt.Fprintf(f.w, "- %s\t(category: %s)\t[%s]\t(%v)\n", result.Path, result.Category, result.Result, result.Duration); err != nil {
 		return err
@@ -268,7 +524,9 @@ const (
 	resultPass    = "PASS"
 )
 
-type testResult struct {
+// TestResult is the result of running the test of a single route
+type TestResult struct {
+	API       string        `json:"api,omitempty"`
 	Result    string        `json:"result"`
 	Path      string        `json:"path,omitempty"`
 	Category  string        `json:"category,omitempty"`
@@ -278,13 +536,26 @@ type testResult struct {
 	Duration  time.Duration `json:"duration,omitempty"`
 }
 
-func (r testResult) isFailure() bool {
+func (r TestResult) isFailure() bool {
 	return !(r.Result == resultPass || r.Result == resultSkipped)
 }
 
-func newTestResult(result, message string, depth int, ctx *TestContext) testResult {
+// TestResults are the results of running the tests of one or more APIs
+type TestResults []TestResult
+
+// Passed returns true if none of the tests failed. Skipped tests are considered passing
+func (r TestResults) Passed() bool {
+	for _, res := range r {
+		if res.isFailure() {
+			return false
+		}
+	}
+	return true
+}
+
+func newTestResult(result, message string, depth int, ctx *TestContext) TestResult {
 
-	ret := testResult{
+	ret := TestResult{
 		Path:     ctx.routePath,
 		Category: ctx.category,
 		Result:   result,
@@ -307,7 +578,7 @@ func newTestResult(result, message string, depth int, ctx *TestContext) testResu
 }
 
 // runTest safely runs a test and catches its output and panics
-func (t *testRunner) runTest(tc Tester, path string) (res testResult) {
+func (t *testRunner) runTest(tc Tester, path string) (res TestResult) {
 
 	// missing testers fail as missing
 	if tc == nil {
@@ -331,7 +602,7 @@ func (t *testRunner) runTest(tc Tester, path string) (res testResult) {
 		if e != nil {
 
 			switch x := e.(type) {
-			case testResult:
+			case TestResult:
 				res = x
 			default:
 				res = newTestResult(resultFatal, fmt.Sprintf("Panic handling test: %v", x), 6, ctx)
@@ -371,17 +642,19 @@ func getTestCategory(tc Tester) string {
 }
 
 // invokeTest runs a tester and prints the output
-func (t *testRunner) invokeTest(path string, tc Tester) *testResult {
+func (t *testRunner) invokeTest(path string, tc Tester) *TestResult {
 
 	if t.shouldRun(tc) {
 
-		var result testResult
+		var result TestResult
 		if tc == nil || t.shouldRun(tc) {
 			result = t.runTest(tc, path)
-			logging.Info("Test result for %s: %#v", path, result)
+			logInfo("Test result for %s: %#v", path, result)
+			t.formatLock.Lock()
 			if err := t.formatter.format(result); err != nil {
-				logging.Error("Error running formatter: %s", err)
+				logError("Error running formatter: %s", err)
 			}
+			t.formatLock.Unlock()
 			return &result
 		}
 
@@ -390,44 +663,48 @@ func (t *testRunner) invokeTest(path string, tc Tester) *testResult {
 	return nil
 }
 
+// Run runs the tests of the API, writing their results to the output, and returns true if all of them passed
 func (t *testRunner) Run() bool {
+	return t.run().Passed()
+}
 
-	reschan := make(chan *testResult)
+// run runs the tests of the API concurrently, and returns their results ordered by the API's routes
+func (t *testRunner) run() TestResults {
+
+	results := make([]*TestResult, len(t.api.Routes))
 	wg := sync.WaitGroup{}
-	for _, route := range t.api.Routes {
+	for i, route := range t.api.Routes {
+
+		// routes expanded from per-method handlers are tested once
+		if route.sharesTest {
+			continue
+		}
 		wg.Add(1)
 
-		go func(route Route) {
+		go func(i int, route Route) {
 
-			reschan <- t.invokeTest(route.Path, route.Test)
+			results[i] = t.invokeTest(route.Path, route.Test)
 			wg.Done()
-		}(route)
+		}(i, route)
 
 	}
 
-	go func() {
-		wg.Wait()
-		close(reschan)
-	}()
-
-	success := true
-	for res := range reschan {
-		if res == nil {
-			continue
-		}
+	wg.Wait()
 
-		if res.isFailure() {
-			success = false
+	ret := make(TestResults, 0, len(results))
+	for _, res := range results {
+		if res != nil {
+			ret = append(ret, *res)
 		}
 	}
 
-	return success
+	return ret
 
 }
 
 func RunCLITest(apiName, serverAddr, category, format string, out io.Writer) bool {
 
-	builder, ok := apiBuilders[apiName]
+	builder, ok := DefaultRegistry.get(apiName)
 	if !ok {
 		fmt.Fprintf(os.Stderr, "Error: API %s not found\n", apiName)
 		return false
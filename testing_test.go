@@ -3,6 +3,9 @@ package vertex
 import (
 	"bytes"
 	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
@@ -55,12 +58,12 @@ func TestTestContext(t *testing.T) {
 	assert.Nil(t, req.Body)
 	assert.Equal(t, req.URL.String(), "http://localhost:1277/mock/test?foo=bar")
 
-	testResults := func(f func()) (ret testResult) {
+	testResults := func(f func()) (ret TestResult) {
 
 		defer func() {
 			x := recover()
 			if x != nil {
-				ret = x.(testResult)
+				ret = x.(TestResult)
 			}
 		}()
 
@@ -138,8 +141,278 @@ func TestJsonFormatter(t *testing.T) {
 
 	assert.NoError(t, formatter.format(res))
 
-	var tr2 testResult
+	var tr2 TestResult
 	assert.NoError(t, json.Unmarshal(buf.Bytes(), &tr2))
 	assert.Equal(t, res, tr2)
 
 }
+
+func TestTestContextExpectations(t *testing.T) {
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("fail") != "" {
+			http.Error(w, "missing foo", http.StatusBadRequest)
+			return
+		}
+		w.Header().Add("Vary", "Accept")
+		w.Header().Add("Vary", "Origin")
+		w.Write([]byte(`{"foo": "bar", "user": {"id": 5}}`))
+	}))
+	defer s.Close()
+
+	tc := &TestContext{
+		api:       api,
+		serverURl: s.URL,
+		routePath: "/test",
+		messages:  []string{},
+	}
+
+	expect := func(f func()) (ret *TestResult) {
+		defer func() {
+			if x := recover(); x != nil {
+				res := x.(TestResult)
+				ret = &res
+			}
+		}()
+		f()
+		return nil
+	}
+
+	req := func(fail bool) *http.Request {
+		vals := url.Values{}
+		if fail {
+			vals.Set("fail", "1")
+		}
+		r, err := tc.NewRequest("GET", vals, nil)
+		assert.NoError(t, err)
+		return r
+	}
+
+	assert.Nil(t, expect(func() { tc.ExpectStatus(req(false), http.StatusOK) }))
+	assert.Nil(t, expect(func() { tc.ExpectJSONField(req(false), "foo", "bar") }))
+	assert.Nil(t, expect(func() { tc.ExpectJSONField(req(false), "user.id", 5) }))
+	assert.Nil(t, expect(func() {
+		assert.Equal(t, "missing foo", tc.ExpectError(req(true), http.StatusBadRequest))
+	}))
+
+	res := expect(func() { tc.ExpectStatus(req(true), http.StatusOK) })
+	if assert.NotNil(t, res) {
+		assert.Equal(t, resultFailed, res.Result)
+		assert.Equal(t, "Expected status 200, got 400 Bad Request: missing foo", res.Message)
+		assert.True(t, strings.HasPrefix(res.FailPoint, "vertex.TestTestContextExpectations.func"), res.FailPoint)
+	}
+
+	res = expect(func() { tc.ExpectJSONField(req(false), "foo", "baz") })
+	if assert.NotNil(t, res) {
+		assert.Equal(t, `Expected foo to be "baz", got "bar"`, res.Message)
+	}
+
+	res = expect(func() { tc.ExpectJSONField(req(false), "user.name", "baz") })
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "Field user.name not found in response", res.Message)
+	}
+
+	res = expect(func() { tc.ExpectError(req(false), http.StatusBadRequest) })
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "Expected an error with status 400, got 200 OK", res.Message)
+	}
+
+	assert.Nil(t, expect(func() { tc.ExpectHeader(req(false), "vary", "Origin") }))
+	assert.Nil(t, expect(func() {
+		assert.Equal(t, "Accept", tc.ExpectHeaderPresent(req(false), "Vary"))
+	}))
+
+	res = expect(func() { tc.ExpectHeader(req(false), "Vary", "Cookie") })
+	if assert.NotNil(t, res) {
+		assert.Equal(t, `Expected header Vary to be "Cookie", got "Accept, Origin"`, res.Message)
+		assert.True(t, strings.HasPrefix(res.FailPoint, "vertex.TestTestContextExpectations.func"), res.FailPoint)
+	}
+
+	res = expect(func() { tc.ExpectHeader(req(true), "Vary", "Origin") })
+	if assert.NotNil(t, res) {
+		assert.Equal(t, `Expected header Vary to be "Origin", but it is missing (status 400 Bad Request)`, res.Message)
+	}
+
+	res = expect(func() { tc.ExpectHeaderPresent(req(false), "ETag") })
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "Expected header ETag in the response, but it is missing (status 200 OK)", res.Message)
+	}
+}
+
+func TestGetJSON(t *testing.T) {
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/html":
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("<html>upstream failed</html>"))
+		case "/text":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("not json"))
+		case "/error":
+			http.Error(w, `{"error": "missing foo"}`, http.StatusBadRequest)
+		default:
+			w.Write([]byte(`{"foo": "` + strings.Repeat("x", 100) + `"}`))
+		}
+	}))
+	defer s.Close()
+
+	tc := &TestContext{api: api, serverURl: s.URL, messages: []string{}}
+	get := func(pth string) (*http.Response, map[string]interface{}, error) {
+		req, _ := http.NewRequest("GET", s.URL+pth, nil)
+		v := map[string]interface{}{}
+		res, err := tc.GetJSON(req, &v)
+		return res, v, err
+	}
+
+	res, v, err := get("/")
+	assert.NoError(t, err)
+	assert.Len(t, v["foo"], 100)
+
+	res, _, err = get("/html")
+	assert.EqualError(t, err, "Bad HTTP response code: 500 Internal Server Error: <html>upstream failed</html>")
+	if assert.NotNil(t, res) {
+		assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+		assert.Equal(t, "text/html", res.Header.Get("Content-Type"))
+		b, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, "<html>upstream failed</html>", string(b))
+	}
+
+	res, _, err = get("/text")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Could not decode text/plain response (200 OK)")
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	_, v, err = get("/error")
+	assert.EqualError(t, err, "Bad HTTP response code: 400 Bad Request")
+	assert.Equal(t, "missing foo", v["error"])
+
+	// responses larger than the limit are not buffered whole
+	tc.SetMaxResponseSize(50)
+	res, _, err = get("/")
+	assert.EqualError(t, err, "Response body of 200 OK is larger than 50 bytes")
+	if assert.NotNil(t, res) {
+		b, _ := ioutil.ReadAll(res.Body)
+		assert.Len(t, b, 50)
+	}
+}
+
+func TestNewJSONRequest(t *testing.T) {
+
+	a := &API{
+		Root:          "/jsonmock",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path:    "/test",
+				Handler: MockHandler{},
+				Methods: POST | PUT,
+			},
+		},
+	}
+
+	srv := NewServer(":9949")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	tc := &TestContext{
+		api:       a,
+		serverURl: s.URL,
+		routePath: "/test",
+		messages:  []string{},
+	}
+
+	req, err := tc.NewJSONRequest("POST", map[string]string{"foo": "foo", "bar": "bar"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, s.URL+"/jsonmock/test", req.URL.String())
+
+	tc.ExpectJSONField(req, "foo", "foo")
+
+	req, err = tc.NewJSONRequest("PUT", map[string]string{"foo": "foo"}, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, tc.ExpectError(req, http.StatusBadRequest), "missing required param 'bar'")
+
+	_, err = tc.NewJSONRequest("POST", func() {}, nil)
+	assert.Error(t, err)
+}
+
+func TestServerRunTests(t *testing.T) {
+
+	a := &API{
+		Name:          "runtests",
+		Version:       "1.0",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path:    "/mock",
+				Handler: MockHandler{},
+				Methods: GET,
+				Test: CriticalTest(func(t *TestContext) {
+					req, _ := t.NewRequest("GET", url.Values{"foo": {"foo"}, "bar": {"bar"}}, nil)
+					t.ExpectJSONField(req, "bar", "bar")
+				}),
+			},
+			{
+				Path:    "/fail",
+				Handler: MockHandler{},
+				Methods: GET,
+				Test: WarningTest(func(t *TestContext) {
+					req, _ := t.NewRequest("GET", nil, nil)
+					t.ExpectStatus(req, http.StatusOK)
+				}),
+			},
+		},
+	}
+
+	srv := NewServer(":9950")
+	srv.AddAPI(a)
+
+	results := srv.RunTests(CriticalTests)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "runtests", results[0].API)
+		assert.Equal(t, "/mock", results[0].Path)
+		assert.Equal(t, resultPass, results[0].Result, results[0].Message)
+	}
+	assert.True(t, results.Passed())
+
+	results = srv.RunTests(AllTests)
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, "/fail", results[1].Path)
+		assert.Equal(t, resultFailed, results[1].Result)
+		assert.Equal(t, WarningTests, results[1].Category)
+	}
+	assert.False(t, results.Passed())
+}
+
+func TestTestSummary(t *testing.T) {
+
+	results := TestResults{
+		{API: "foo", Path: "/bar", Category: CriticalTests, Result: resultPass},
+		{API: "foo", Path: "/baz", Category: CriticalTests, Result: resultSkipped},
+		{API: "foo", Path: "/warn", Category: WarningTests, Result: resultFailed},
+		{API: "foo", Path: "/missing", Category: WarningTests, Result: resultMissing},
+		{API: "foo", Path: "/pass", Category: WarningTests, Result: resultPass},
+	}
+
+	summary := results.Summary()
+	assert.Equal(t, TestCounts{Passed: 1, Skipped: 1}, summary.Critical)
+	assert.Equal(t, TestCounts{Passed: 1, Failed: 2}, summary.Warning)
+	assert.Equal(t, "critical: 1 passed, 0 failed, 1 skipped; warning: 1 passed, 2 failed, 0 skipped", summary.String())
+
+	// failed warnings do not fail the gate
+	assert.False(t, results.Passed())
+	assert.NoError(t, results.CriticalError())
+
+	results = append(results,
+		TestResult{API: "foo", Path: "/fail", Category: CriticalTests, Result: resultFailed},
+		TestResult{API: "foo", Path: "/fatal", Category: CriticalTests, Result: resultFatal},
+	)
+	assert.Equal(t, 2, results.Summary().Critical.Failed)
+	assert.EqualError(t, results.CriticalError(), "Critical tests failed: foo/fail [FAIL], foo/fatal [FATAL]")
+}
@@ -0,0 +1,119 @@
+package vertex
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// the maximum number of bytes of an upstream error response read by ErrorFromResponse
+const maxUpstreamErrorSize = 1 << 20
+
+// statusErrorCodes maps the statuses of failed responses back to the error codes rendered with them (see httpError)
+var statusErrorCodes = map[int]int{
+	http.StatusBadRequest:            ErrInvalidRequest,
+	http.StatusUnauthorized:          ErrUnauthorized,
+	http.StatusForbidden:             ErrForbidden,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusMethodNotAllowed:      ErrMethodNotAllowed,
+	http.StatusConflict:              ErrConflict,
+	http.StatusRequestEntityTooLarge: ErrRequestEntityTooLarge,
+	http.StatusRequestURITooLong:     ErrURITooLong,
+	http.StatusUnsupportedMediaType:  ErrUnsupportedMediaType,
+	http.StatusUnprocessableEntity:   ErrUnprocessableEntity,
+	http.StatusTooManyRequests:       ErrTooManyRequests,
+	http.StatusServiceUnavailable:    ErrResourceUnavailable,
+	http.StatusGatewayTimeout:        ErrTimeout,
+}
+
+// upstreamError is the body of an error response of a vertex API, in any of the forms the JSON and MessagePack
+// renderers write errors in: an Envelope, an "errors" list of a ValidationError, or an "error" message
+type upstreamError struct {
+	ErrorCode   *int         `json:"errorCode" msgpack:"errorCode"`
+	ErrorString string       `json:"errorString" msgpack:"errorString"`
+	Errors      []FieldError `json:"errors" msgpack:"errors"`
+	Error       string       `json:"error" msgpack:"error"`
+	Retryable   bool         `json:"retryable" msgpack:"retryable"`
+	RetryAfter  float64      `json:"retry_after" msgpack:"retry_after"`
+}
+
+// ErrorFromResponse reconstructs the error of a failed response of another vertex API, so a handler calling it can
+// return the error with the same error code, and its client gets the same status, instead of a 500.
+//
+// The error code is read from the response if it is an Envelope, and is otherwise derived from the status. Validation
+// errors are returned as a ValidationError with the same failed params, and retryable errors keep their retry delay.
+// Responses that are not vertex errors get their body (or status) as the message. It returns nil if the response did
+// not fail. The body is read and replaced, so the caller can still read it
+func ErrorFromResponse(res *http.Response) error {
+
+	if res == nil || res.StatusCode < 400 {
+		return nil
+	}
+
+	var b []byte
+	if res.Body != nil {
+		b, _ = ioutil.ReadAll(io.LimitReader(res.Body, maxUpstreamErrorSize))
+		res.Body.Close()
+		res.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+
+	code, found := statusErrorCodes[res.StatusCode]
+	if !found {
+		code = ErrGeneralFailure
+	}
+
+	var body upstreamError
+	msg := strings.TrimSpace(string(b))
+	if decodeUpstreamError(res.Header.Get("Content-Type"), b, &body) {
+		if len(body.Errors) > 0 {
+			return &ValidationError{Errors: body.Errors}
+		}
+
+		msg = body.Error
+		if body.ErrorCode != nil {
+			code, msg = *body.ErrorCode, body.ErrorString
+		}
+	}
+	if msg == "" {
+		msg = res.Status
+	}
+
+	// renderers that cannot tell a retryable error in the body still set the Retry-After header
+	sec, err := strconv.Atoi(res.Header.Get(HeaderRetryAfter))
+	if code == ErrResourceUnavailable && (body.Retryable || err == nil) {
+		code = ErrRetryable
+	}
+
+	e := &internalError{Message: msg, Code: code, stack: captureStack()}
+	if code == ErrRetryable || code == ErrBackOff {
+		e.retryAfter = time.Duration(body.RetryAfter * float64(time.Second))
+		if e.retryAfter == 0 && err == nil {
+			e.retryAfter = time.Duration(sec) * time.Second
+		}
+	}
+	return e
+}
+
+// decodeUpstreamError decodes a JSON or MessagePack error body, and reports whether it is a vertex error
+func decodeUpstreamError(contentType string, b []byte, v *upstreamError) bool {
+
+	ct, _, _ := mime.ParseMediaType(contentType)
+
+	var err error
+	switch ct {
+	case "application/x-msgpack", "application/msgpack":
+		err = msgpack.Unmarshal(b, v)
+	default:
+		err = json.Unmarshal(b, v)
+	}
+
+	return err == nil && (v.ErrorCode != nil || v.Error != "" || len(v.Errors) > 0)
+}
@@ -1,12 +1,14 @@
 package vertex
 
 import (
+	"fmt"
 	"github.com/EverythingMe/vertex/schema"
 	"net/http"
 	"reflect"
 	"regexp"
-
-	"github.com/dvirsky/go-pylog/logging"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 // Param validator interface
@@ -15,12 +17,14 @@ type validator interface {
 	GetDefault() (interface{}, bool)
 	GetKey() string
 	IsOptional() bool
+	IsSet(r *http.Request) bool
 	GetParamName() string
 }
 
 // Base param validator
 type fieldValidator struct {
 	schema.ParamInfo
+	options map[string]struct{}
 }
 
 func (v *fieldValidator) Validate(field reflect.Value, r *http.Request) error {
@@ -28,7 +32,7 @@ func (v *fieldValidator) Validate(field reflect.Value, r *http.Request) error {
 	//validate required fields
 	if v.Required {
 
-		if _, found := r.Form[v.Name]; !found || !field.IsValid() {
+		if !v.IsSet(r) || !field.IsValid() {
 			return MissingParamError("missing required param '%s'", v.Name)
 		}
 
@@ -37,6 +41,45 @@ func (v *fieldValidator) Validate(field reflect.Value, r *http.Request) error {
 	return nil
 }
 
+// IsSet returns true if the param was explicitly sent in the request, even if it was empty
+func (v *fieldValidator) IsSet(r *http.Request) bool {
+	if v.File {
+		return len(multipartFiles(r, v.Name)) > 0
+	}
+	if v.In == "header" {
+		_, found := r.Header[http.CanonicalHeaderKey(v.Name)]
+		return found
+	}
+
+	_, found := r.Form[v.Name]
+	return found
+}
+
+// checkRange validates a numeric value against the param's min/max bounds
+func (v *fieldValidator) checkRange(f float64) error {
+	if v.HasMin && f < v.Min {
+		return InvalidParamError("Value too small for %s", v.GetParamName())
+	}
+	if v.HasMax && f > v.Max {
+		return InvalidParamError("Value too large for %s", v.GetParamName())
+	}
+
+	return nil
+}
+
+// checkOptions validates a value against the param's allowed values, if it has any
+func (v *fieldValidator) checkOptions(s string) error {
+	if v.options == nil {
+		return nil
+	}
+
+	if _, found := v.options[s]; !found {
+		return InvalidParamError("Invalid value for %s, allowed values: %s", v.GetParamName(), strings.Join(v.Options, ", "))
+	}
+
+	return nil
+}
+
 func (v *fieldValidator) GetKey() string {
 	return v.StructKey
 }
@@ -63,6 +106,13 @@ func newFieldValidator(pi schema.ParamInfo) *fieldValidator {
 		ParamInfo: pi,
 	}
 
+	if len(pi.Options) > 0 {
+		ret.options = make(map[string]struct{}, len(pi.Options))
+		for _, opt := range pi.Options {
+			ret.options[opt] = struct{}{}
+		}
+	}
+
 	return ret
 }
 
@@ -81,16 +131,23 @@ func (v *intValidator) Validate(field reflect.Value, r *http.Request) error {
 		return err
 	}
 
-	i := field.Int()
-
-	if v.HasMin && i < int64(v.Min) {
-		return InvalidParamError("Value too small for %s", v.GetParamName())
-	}
-	if v.HasMax && i > int64(v.Max) {
-		return InvalidParamError("Value too large for %s", v.GetParamName())
+	// optional params that were not sent are not range checked
+	if !v.Required && !v.IsSet(r) {
+		return nil
 	}
 
-	return nil
+	switch field.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if err := v.checkOptions(strconv.FormatUint(field.Uint(), 10)); err != nil {
+			return err
+		}
+		return v.checkRange(float64(field.Uint()))
+	default:
+		if err := v.checkOptions(strconv.FormatInt(field.Int(), 10)); err != nil {
+			return err
+		}
+		return v.checkRange(float64(field.Int()))
+	}
 
 }
 
@@ -118,21 +175,29 @@ func (v *stringValidator) Validate(field reflect.Value, r *http.Request) error {
 		return err
 	}
 
+	// optional params that were not sent are not validated
+	if !v.Required && !v.IsSet(r) {
+		return nil
+	}
+
 	s := field.String()
 
-	if v.MaxLength > 0 && len(s) > v.MaxLength {
-		return InvalidParamError("%s is too long", v.GetParamName())
+	// lengths are counted in characters, not bytes
+	length := utf8.RuneCountInString(s)
+
+	if v.MaxLength > 0 && length > v.MaxLength {
+		return InvalidParamError("%s is too long (max length %d)", v.GetParamName(), v.MaxLength)
 	}
 
-	if v.MinLength > 0 && len(s) < v.MinLength {
-		return InvalidParamError("%s is too short", v.GetParamName())
+	if v.MinLength > 0 && length < v.MinLength {
+		return InvalidParamError("%s is too short (min length %d)", v.GetParamName(), v.MinLength)
 	}
 
 	if v.re != nil && !v.re.MatchString(s) {
-		return InvalidParamError("%s does not match regex pattern", v.GetParamName())
+		return InvalidParamError("field '%s' does not match required pattern", v.GetParamName())
 	}
 
-	return nil
+	return v.checkOptions(s)
 
 }
 
@@ -142,13 +207,15 @@ func newStringValidator(pi schema.ParamInfo) *stringValidator {
 		fieldValidator: newFieldValidator(pi),
 	}
 
+	// The pattern is compiled once when the API is configured, so an invalid pattern fails on startup
 	if pi.Pattern != "" {
 		re, err := regexp.Compile(pi.Pattern)
 		if err != nil {
-			logging.Error("Could not create regexp validator - invalid regexp: %s - %s", pi.Pattern, err)
-		} else {
-			ret.re = re
+			err = fmt.Errorf("Could not create regexp validator for %s - invalid regexp: %s - %s", pi.Name, pi.Pattern, err)
+			logError("%s", err)
+			panic(err)
 		}
+		ret.re = re
 	}
 
 	return ret
@@ -172,15 +239,12 @@ func (v *floatValidator) Validate(field reflect.Value, r *http.Request) error {
 		return err
 	}
 
-	f := field.Float()
-	if v.HasMin && f < v.Min {
-		return InvalidParamError("Value too small for %s", v.GetParamName())
-	}
-	if v.HasMax && f > v.Max {
-		return InvalidParamError("Value too large for %s", v.GetParamName())
+	// optional params that were not sent are not range checked
+	if !v.Required && !v.IsSet(r) {
+		return nil
 	}
 
-	return nil
+	return v.checkRange(field.Float())
 }
 
 func newFloatValidator(pi schema.ParamInfo) *floatValidator {
@@ -215,10 +279,24 @@ func newBoolValidator(pi schema.ParamInfo) *boolValidator {
 
 type RequestValidator struct {
 	fieldValidators []validator
+	binder          *paramBinder
+
+	// the names of the params tagged as sensitive
+	sensitive []string
 }
 
+// Validate validates all the params of the request, and returns a *ValidationError holding every param that failed
 func (rv *RequestValidator) Validate(request interface{}, r *http.Request) error {
 
+	verr := &ValidationError{}
+	rv.validate(request, r, verr)
+	return verr.errorOrNil()
+}
+
+// validate sets default values and validates the params of the request, adding failures to verr.
+// Params that have already failed binding are skipped
+func (rv *RequestValidator) validate(request interface{}, r *http.Request, verr *ValidationError) {
+
 	val := reflect.ValueOf(request)
 	if val.Kind() == reflect.Ptr {
 		val = val.Elem()
@@ -227,14 +305,20 @@ func (rv *RequestValidator) Validate(request interface{}, r *http.Request) error
 	//go over all the validators
 	for _, v := range rv.fieldValidators {
 
+		if verr.failed(v.GetParamName()) {
+			continue
+		}
+
 		// find the field in the struct. we assume it's there since we build the validators on start time
 		field := val.FieldByName(v.GetKey())
 
-		// if the arg is optional and not set, we set the default
-		if v.IsOptional() && (!field.IsValid() || r.FormValue(v.GetParamName()) == "") {
+		// if the arg is optional and missing from the request entirely, we set the default.
+		// A param that was sent empty keeps its empty value
+		if v.IsOptional() && (!field.IsValid() || !v.IsSet(r)) {
+			// list defaults are parsed as strings, and can't be set on slices of other types
 			def, ok := v.GetDefault()
-			if ok {
-				logging.Info("Default value for %s: %v", v.GetKey(), def)
+			if ok && reflect.TypeOf(def).ConvertibleTo(field.Type()) {
+				logInfo("Default value for %s: %v", v.GetKey(), def)
 				field.Set(reflect.ValueOf(def).Convert(field.Type()))
 			}
 		}
@@ -243,13 +327,11 @@ func (rv *RequestValidator) Validate(request interface{}, r *http.Request) error
 		e := v.Validate(field, r)
 
 		if e != nil {
-			logging.Error("Could not validate field %s: %s", v.GetParamName(), e)
-			return e
+			logError("Could not validate field %s: %s", v.GetParamName(), e)
+			verr.add(v.GetParamName(), e)
 		}
 
 	}
-
-	return nil
 }
 
 // Create new request validator for a request handler interface.
@@ -262,11 +344,22 @@ func NewRequestValidator(ri schema.RequestInfo) *RequestValidator {
 
 	ret := &RequestValidator{
 		fieldValidators: make([]validator, 0),
+		binder:          newParamBinder(ri),
 	}
 
 	//iterate over the fields and create a validator for each
 	for _, pi := range ri.Params {
 
+		if pi.Sensitive {
+			ret.sensitive = append(ret.sensitive, pi.Name)
+		}
+
+		// uploaded files are bound by the binder, we only need to check they are present
+		if pi.File {
+			ret.fieldValidators = append(ret.fieldValidators, newFieldValidator(pi))
+			continue
+		}
+
 		var vali validator
 		switch pi.Kind {
 		//		case reflect.Struct:
@@ -281,20 +374,31 @@ func NewRequestValidator(ri schema.RequestInfo) *RequestValidator {
 		case reflect.String:
 			vali = newStringValidator(pi)
 
-		case reflect.Int, reflect.Int32, reflect.Int64:
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 			vali = newIntValidator(pi)
 
 		case reflect.Float32, reflect.Float64:
 			vali = newFloatValidator(pi)
 		case reflect.Bool:
 			vali = newBoolValidator(pi)
+		case reflect.Struct:
+			// time params are parsed by the binder, we only need to check they are present
+			if pi.Type != timeType {
+				logError("I don't know how to validate %s", pi.Type)
+				continue
+			}
+			vali = newFieldValidator(pi)
+		case reflect.Slice:
+			// slice elements are parsed by the binder, we only need to check required slices are present
+			vali = newFieldValidator(pi)
 		default:
-			logging.Error("I don't know how to validate %s", pi.Kind)
+			logError("I don't know how to validate %s", pi.Kind)
 			continue
 		}
 
 		if vali != nil {
-			logging.Debug("Adding validator %v to request validator %v", vali, ri)
+			logDebug("Adding validator %v to request validator %v", vali, ri)
 			ret.fieldValidators = append(ret.fieldValidators, vali)
 		}
 
@@ -14,7 +14,9 @@ func main() {
 
 	logging.SetMinimalLevelByName(vertex.Config.Server.LoggingLevel)
 	srv := vertex.NewServer(vertex.Config.Server.ListenAddr)
-	srv.InitAPIs()
+	if err := srv.InitAPIs(); err != nil {
+		panic(err)
+	}
 	if err := srv.Run(); err != nil {
 		panic(err)
 	}
@@ -1,14 +1,21 @@
 package vertex
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"reflect"
+	"sort"
 	"strings"
 
 	gorilla "github.com/gorilla/schema"
-
-	"github.com/dvirsky/go-pylog/logging"
 )
 
 // Headers for responses
@@ -17,10 +24,25 @@ const (
 	// The POST/GET param we pass if we want a JSONP callback response
 	CallbackParam = "callback"
 
+	// The POST/GET param we pass if we want an indented JSON response, e.g. pretty=1
+	PrettyParam = "pretty"
+
+	// The header reporting the processing time of a request, in milliseconds with 3 decimal places (e.g. 12.345) unless
+	// set otherwise by the API's ProcessingTimeFormat
 	HeaderProcessingTime = "X-Vertex-ProcessingTime"
 	HeaderRequestId      = "X-Vertex-RequestId"
 	HeaderHost           = "X-Vertex-Host"
 	HeaderServerVersion  = "X-Vertex-Version"
+
+	// The conventional request id header. An incoming request id is reused as the request's id, and the id is echoed
+	// back in the response
+	HeaderXRequestId = "X-Request-ID"
+
+	// The trailer reporting errors that occurred after a streamed response had started
+	HeaderStreamError = "X-Vertex-Stream-Error"
+
+	// Tells clients of retryable errors how many seconds to wait before retrying (see RetryableError)
+	HeaderRetryAfter = "Retry-After"
 )
 
 // RequestHandler is the interface that request handler structs should implement.
@@ -45,6 +67,15 @@ type RequestHandler interface {
 	Handle(w http.ResponseWriter, r *Request) (interface{}, error)
 }
 
+// ValidatingHandler is an optional interface for request handlers with validation rules that param tags cannot
+// express, e.g. a "start" param that must be before an "end" param.
+//
+// Validate is called after the params have been mapped and validated, before Handle is called. A plain error
+// returned from it results in a 400 response, while vertex errors (e.g. UnauthorizedError) keep their own status code
+type ValidatingHandler interface {
+	Validate() error
+}
+
 // HandlerFunc is an adapter that allows you to register normal functions as handlers. It is used mainly by middleware
 // and should not be used in an application context
 type HandlerFunc func(http.ResponseWriter, *Request) (interface{}, error)
@@ -77,7 +108,8 @@ type Unmarshaler interface {
 // Params are a string map for path formatting
 type Params map[string]string
 
-// FormatPath takes a path template and formats it according to the given path params
+// FormatPath takes a path template and formats it according to the given path params. Catch-all params (e.g.
+// {path:*}) are formatted like the other params
 //
 // e.g.
 //	FormatPath("/foo/{id}", Params{"id":"bar"})
@@ -87,6 +119,7 @@ func FormatPath(path string, params Params) string {
 	if params != nil {
 		for k, v := range params {
 			path = strings.Replace(path, fmt.Sprintf("{%s}", k), v, -1)
+			path = strings.Replace(path, fmt.Sprintf("{%s:*}", k), v, -1)
 		}
 	}
 	return path
@@ -121,6 +154,12 @@ func Wrap(f func(w http.ResponseWriter, r *http.Request)) RequestHandler {
 	})
 }
 
+// Hijacker wraps a function that writes the response itself, e.g. a server-sent events stream or a WebSocket
+// handshake, as a handler. The handler returns Hijacked, so the response is not rendered again.
+//
+// Hijacking is the way for handlers to take over a response: a handler that wrote its response itself returns
+// Hijacked, and the framework and the included middleware write nothing more, not even the meta headers. To take over
+// the connection itself, see HijackConn
 func Hijacker(f func(w http.ResponseWriter, r *Request)) RequestHandler {
 
 	return HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
@@ -131,6 +170,20 @@ func Hijacker(f func(w http.ResponseWriter, r *Request)) RequestHandler {
 	})
 }
 
+// HijackConn takes over the connection of a response, e.g. for WebSockets, and returns it.
+// After taking over the connection nothing can be written to the response writer, and the handler must return Hijacked.
+//
+// The writers the included middleware wrap responses with support hijacking, and write nothing after it
+func HijackConn(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("The response writer does not support hijacking")
+	}
+
+	return h.Hijack()
+}
+
 // VoidHandler is a batteries-included handler that does nothing, useful for testing, or when
 // a middleware takes over the request completely
 type VoidHandler struct{}
@@ -140,6 +193,15 @@ func (VoidHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error
 	return nil, nil
 }
 
+// NoContentHandler is a batteries-included handler that does nothing, and responds with a 204 No Content status and
+// an empty body, unlike VoidHandler which renders an empty response
+type NoContentHandler struct{}
+
+// Handle does nothing, with no content
+func (NoContentHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return NoContent, nil
+}
+
 // SecurityScheme is a special interface that validates a request and is outside the middleware chain.
 // An API has a default security scheme, and each route can override it
 type SecurityScheme interface {
@@ -163,32 +225,100 @@ type MethodFlag int
 const (
 	GET  MethodFlag = 0x01
 	POST MethodFlag = 0x02
-	PUT  MethodFlag = 0x03
+	PUT  MethodFlag = 0x04
+	// OPTIONS routes requests through the middleware chain, e.g. for CORS preflight requests
+	OPTIONS MethodFlag = 0x08
+	DELETE  MethodFlag = 0x10
 )
 
-var schemaDecoder = gorilla.NewDecoder()
+// the HTTP method names of the method flags, in the order we register them
+var methodFlags = []struct {
+	flag MethodFlag
+	name string
+}{{GET, "GET"}, {POST, "POST"}, {PUT, "PUT"}, {DELETE, "DELETE"}, {OPTIONS, "OPTIONS"}}
+
+// the decoder is shared by concurrent requests, so it is only configured here
+var schemaDecoder = func() *gorilla.Decoder {
+	d := gorilla.NewDecoder()
+	d.IgnoreUnknownKeys(true)
+	return d
+}()
+
+// decodeSchema maps form values into a request handler struct with the schema decoder. Malformed keys and values must
+// fail the request, so a panic of the decoder (or of a converter it calls) is returned as an error
+func decodeSchema(input interface{}, values url.Values) (err error) {
+
+	defer func() {
+		if e := recover(); e != nil {
+			logError("Schema decoder panicked: %v", e)
+			err = fmt.Errorf("malformed params")
+		}
+	}()
+
+	return schemaDecoder.Decode(input, values)
+}
 
 // Parse the user input into a request handler struct, with input validation
 func parseInput(r *http.Request, input interface{}, validator *RequestValidator) error {
 
-	schemaDecoder.IgnoreUnknownKeys(true)
-
-	if err := r.ParseForm(); err != nil {
-		return InvalidRequestError("Error parsing request data: %s", err)
+	if err := parseRequestBody(r); err != nil {
+		return err
 	}
 
+	return bindInput(r, input, validator)
+}
+
+// bindInput maps the params of a request whose body was already parsed into a request handler struct, and validates them
+func bindInput(r *http.Request, input interface{}, validator *RequestValidator) error {
+
 	// We do not map and validate input to non-struct handlers
 	if reflect.TypeOf(input).Kind() != reflect.Func {
 
-		if err := schemaDecoder.Decode(input, r.Form); err != nil {
-			return InvalidRequestError("Error decoding schema: %s", err)
+		// we collect all the params that failed decoding and validation, and return them together
+		verr := &ValidationError{}
+
+		if err := decodeSchema(input, validator.binder.schemaValues(r.Form)); err != nil {
+			merr, ok := err.(gorilla.MultiError)
+			if !ok {
+				return InvalidRequestError("Error decoding schema: %s", err)
+			}
+
+			keys := make([]string, 0, len(merr))
+			for k := range merr {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				verr.add(k, InvalidParamError("Invalid value for %s", k))
+			}
 		}
 
-		// Validate the input based on the API spec
-		if err := validator.Validate(input, r); err != nil {
-			logging.Error("Error validating http.Request!: %s", err)
-			return NewError(err)
+		if err := validator.binder.bind(input, r, verr); err != nil {
+			return err
+		}
 
+		// Validate the input based on the API spec. The messages of the validators name the params, and never hold their
+		// values, so they need no redaction
+		validator.validate(input, r, verr)
+		verr.redacted = true
+		if err := verr.errorOrNil(); err != nil {
+			logError("Error validating http.Request!: %s", err)
+			return err
+		}
+
+		// Let the handler validate rules involving more than a single param
+		if vh, ok := input.(ValidatingHandler); ok {
+			if err := vh.Validate(); err != nil {
+				switch err.(type) {
+				case *internalError, *ValidationError:
+				default:
+					err = newErrorCode(ErrInvalidParam, err.Error())
+				}
+				// handlers may echo the values of sensitive params in their errors
+				err = redactError(err, sensitiveValues(validator.sensitive, r))
+				logError("Request rejected by handler validation: %s", err)
+				return err
+			}
 		}
 
 	}
@@ -197,6 +327,143 @@ func parseInput(r *http.Request, input interface{}, validator *RequestValidator)
 
 }
 
+// MultipartMemory is the number of bytes of the files of a multipart form kept in memory when it is parsed. Larger
+// files are stored in temporary files, which are removed when the request is done
+var MultipartMemory int64 = 32 << 20
+
+// ParseForm parses the body of a request into its form, so middleware can read the params sent in urlencoded,
+// multipart and decoded (e.g. JSON) bodies, and not only the query params. Bodies are parsed only once, and are
+// otherwise parsed when the handler's params are bound.
+//
+// Bodies are read through the body wrappers of the middleware that ran before, so middleware calling ParseForm
+// should run after the MaxBodyMiddleware, to keep the body size limited
+func ParseForm(r *Request) error {
+	if !r.bodyParsed {
+		r.bodyParsed = true
+		r.bodyErr = parseRequestBody(r.Request)
+	}
+	return r.bodyErr
+}
+
+// parseRequestBody parses the form and the decoded fields of a request's body into its form
+func parseRequestBody(r *http.Request) error {
+
+	if err := parseForm(r); err != nil {
+		return InvalidRequestError("Error parsing request data: %s", err)
+	}
+
+	return parseBody(r)
+}
+
+// parseForm parses the query and the form in the body of a request. Forms are parsed only here, when the params are
+// bound or a middleware asks for them (see ParseForm), so the middleware can limit their size first (see
+// middleware.MaxBodyMiddleware)
+func parseForm(r *http.Request) error {
+
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "multipart/form-data" {
+		if err := r.ParseMultipartForm(MultipartMemory); err != nil && err != http.ErrNotMultipart {
+			return err
+		}
+		return nil
+	}
+
+	if r.Form == nil || r.PostForm != nil {
+		return r.ParseForm()
+	}
+
+	// the query was parsed with the request (see NewRequest), so net/http only parses the body here, and its values
+	// are put before the query values, as net/http does
+	err := r.ParseForm()
+	for k, vals := range r.PostForm {
+		r.Form[k] = append(append([]string(nil), vals...), r.Form[k]...)
+	}
+	return err
+}
+
+// parseBody merges the top level fields of a POST/PUT body into the request form, so they are mapped and validated
+// exactly like query and form params. Values in the body replace query values of the same key, but not path params.
+//
+// The body is decoded by the decoder registered for its content type (see RegisterBodyDecoder). Bodies of other
+// content types are left for the handler, like urlencoded and multipart forms which are parsed by net/http.
+// The body is restored after reading it, so handlers can still decode it themselves
+func parseBody(r *http.Request) error {
+
+	if r.Body == nil || (r.Method != "POST" && r.Method != "PUT") {
+		return nil
+	}
+
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	decoder := bodyDecoder(ct)
+	if decoder == nil {
+		return nil
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return InvalidRequestError("Error reading request body: %s", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil
+	}
+
+	fields, err := decoder.DecodeBody(b)
+	if err != nil {
+		return err
+	}
+
+	pathParams := PathParams(r)
+	for k, vals := range fields {
+		if _, found := pathParams[k]; found {
+			continue
+		}
+		// nil values are treated as missing params
+		if vals != nil {
+			r.Form[k] = vals
+		}
+	}
+
+	return nil
+}
+
+// jsonFormValues converts a JSON value to form values. Strings are unquoted, arrays are flattened to multiple
+// values, and anything else (numbers, bools, objects for Unmarshalers) is passed as raw JSON text
+func jsonFormValues(raw json.RawMessage) ([]string, error) {
+
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	switch raw[0] {
+	case '"':
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, err
+		}
+
+		ret := make([]string, 0, len(items))
+		for _, item := range items {
+			vals, err := jsonFormValues(item)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, vals...)
+		}
+		return ret, nil
+	}
+
+	return []string{string(raw)}, nil
+}
+
 // FormValueDefault returns the value from  a form param, with an optional default argument if the value was not set
 func formValueDefault(r *Request, key, def string) string {
 	ret := r.FormValue(key)
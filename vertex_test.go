@@ -2,23 +2,44 @@ package vertex
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/EverythingMe/vertex/schema"
 
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
 type MockHandler struct {
@@ -91,6 +112,79 @@ func TestMiddleware(t *testing.T) {
 
 }
 
+func TestShortCircuit(t *testing.T) {
+
+	handled := 0
+	a := &API{
+		Root:          "/short",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Middleware: []Middleware{
+			nil,
+			Intercept(func(w http.ResponseWriter, r *Request) (interface{}, bool, error) {
+				switch r.FormValue("mode") {
+				case "cached":
+					w.Header().Set("X-Cache", "HIT")
+					return "from cache", true, nil
+				case "denied":
+					return nil, true, ForbiddenError("go away")
+				}
+				return nil, false, nil
+			}),
+		},
+		Routes: Routes{
+			{
+				Path: "/foo",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					handled++
+					return "from handler", nil
+				}),
+				Methods: GET,
+			},
+		},
+	}
+
+	srv := NewServer(":9963")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	get := func(mode string) (*http.Response, string) {
+		res, err := http.Get(s.URL + a.FullPath("/foo") + "?mode=" + mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, strings.TrimSpace(string(b))
+	}
+
+	// short-circuited responses are rendered like handler responses
+	res, body := get("cached")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `"from cache"`, body)
+	assert.Equal(t, "HIT", res.Header.Get("X-Cache"))
+	assert.NotEmpty(t, res.Header.Get(HeaderProcessingTime))
+	assert.Equal(t, 0, handled)
+
+	res, _ = get("denied")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Equal(t, 0, handled)
+
+	res, body = get("")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `"from handler"`, body)
+	assert.Equal(t, 1, handled)
+
+	// calling next at the end of a chain without a handler fails instead of panicking
+	chain := buildChain(makeMockMW("a"), nil, makeMockMW("b"))
+	hr, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	_, err := chain.handle(w, NewRequest(hr))
+	assert.Error(t, err)
+	assert.Equal(t, []string{"a", "b"}, w.Header()[middlewareHeader])
+}
+
 var mockAPI = &API{
 	Root:                  "/mock",
 	Name:                  "testung",
@@ -156,8 +250,8 @@ func TestRegistration(t *testing.T) {
 
 	Register("testung", builder, nil)
 
-	if len(apiBuilders) != 1 {
-		t.Fatalf("Wrong number of registered APIs: %d", len(apiBuilders))
+	if len(DefaultRegistry.Names()) != 1 {
+		t.Fatalf("Wrong number of registered APIs: %d", len(DefaultRegistry.Names()))
 	}
 	srv := NewServer(":9947")
 	srv.InitAPIs()
@@ -167,6 +261,40 @@ func TestRegistration(t *testing.T) {
 
 }
 
+func TestServerRegistry(t *testing.T) {
+
+	names := DefaultRegistry.Names()
+
+	build := func(name string) func() *API {
+		return func() *API {
+			return &API{Name: name, Root: "/" + name, Renderer: JSONRenderer{}, AllowInsecure: true}
+		}
+	}
+
+	// servers with their own registries do not share their APIs
+	s1 := NewServerWithRegistry(":9966", NewRegistry())
+	s1.AddAPIBuilder("foo", build("foo"), nil)
+	s1.AddAPIBuilder("bar", build("bar"), nil)
+	s1.AddAPIBuilder("foo", build("foo"), nil)
+
+	s2 := NewServerWithRegistry(":9967", NewRegistry())
+	s2.AddAPIBuilder("baz", build("baz"), nil)
+
+	s1.InitAPIs()
+	s2.InitAPIs()
+
+	if assert.Len(t, s1.apis, 2) {
+		assert.Equal(t, "foo", s1.apis[0].Name)
+		assert.Equal(t, "bar", s1.apis[1].Name)
+	}
+	if assert.Len(t, s2.apis, 1) {
+		assert.Equal(t, "baz", s2.apis[0].Name)
+	}
+
+	// and the global registry is left untouched
+	assert.Equal(t, names, DefaultRegistry.Names())
+}
+
 func TestIntegration(t *testing.T) {
 	////t.SkipNow()
 	srv := NewServer(":9947")
@@ -409,264 +537,3861 @@ func TestRenderer(t *testing.T) {
 	writeError(out, "watwat")
 	assert.Equal(t, "watwat\n", out.Body.String())
 
-}
-
-const mockConfs = `
-server:
-  listen: :8686
-apis:
-  testung:
-     foo: baz
-`
+	// test pretty printing, set on the renderer or by the request
+	v := map[string]int{"foo": 1}
 
-func TestConfigs(t *testing.T) {
-	//t.SkipNow()
-	var apiConf = struct {
-		Foo string `yaml:"foo"`
-	}{"not baz"}
+	out = httptest.NewRecorder()
+	hr, _ = http.NewRequest("GET", "http://foo.bar", nil)
+	assert.NoError(t, jr.Render(v, nil, out, NewRequest(hr)))
+	assert.Equal(t, `{"foo":1}`, out.Body.String())
 
-	registerAPIConfig("testung", &apiConf)
+	out = httptest.NewRecorder()
+	assert.NoError(t, JSONRenderer{Pretty: true}.Render(v, nil, out, NewRequest(hr)))
+	assert.Equal(t, "{\n  \"foo\": 1\n}", out.Body.String())
 
-	confile := "/tmp/apiconf.test.yaml"
-	fp, err := os.Create(confile)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if _, err = fp.WriteString(mockConfs); err != nil {
-		t.Fatal(err)
-	}
-	fp.Close()
+	out = httptest.NewRecorder()
+	hr, _ = http.NewRequest("GET", "http://foo.bar?pretty=1", nil)
+	assert.NoError(t, jr.Render(v, nil, out, NewRequest(hr)))
+	assert.Equal(t, "{\n  \"foo\": 1\n}", out.Body.String())
 
-	flag.Set("conf", confile)
-	assert.NoError(t, ReadConfigs())
-	assert.Equal(t, Config.Server.ListenAddr, ":8686")
-	assert.Equal(t, "baz", apiConf.Foo)
 }
 
-func TestErrors(t *testing.T) {
-	//t.SkipNow()
-	err := NewError(errors.New("wat"))
-	if e, ok := err.(*internalError); !ok {
-		t.Fatal("returned not an internal error")
-	} else {
-		assert.Equal(t, e.Code, ErrGeneralFailure)
-		assert.Equal(t, e.Message, "wat")
+func TestEnvelopeRenderer(t *testing.T) {
+
+	jr := JSONRenderer{Envelope: true}
+	render := func(v interface{}, e error) (int, map[string]interface{}) {
+		out := httptest.NewRecorder()
+		hr, _ := http.NewRequest("GET", "http://foo.bar", nil)
+		req := NewRequest(hr)
+		req.RequestId = "reqid"
+		assert.NoError(t, jr.Render(v, e, out, req))
+
+		var env map[string]interface{}
+		assert.NoError(t, json.Unmarshal(out.Body.Bytes(), &env))
+		assert.Equal(t, "reqid", env["requestId"])
+		assert.Contains(t, env, "processingTime")
+		return out.Code, env
 	}
 
-	err = UnauthorizedError("word")
-	if e, ok := err.(*internalError); !ok {
-		t.Fatal("returned not an internal error")
-	} else {
-		assert.Equal(t, e.Code, ErrUnauthorized)
-		assert.Equal(t, e.Message, "word")
+	code, env := render(map[string]int{"foo": 1}, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, Ok, env["errorCode"])
+	assert.Equal(t, "OK", env["errorString"])
+	assert.Equal(t, map[string]interface{}{"foo": 1.0}, env["response"])
+
+	code, env = render("ello", InvalidParamError("bad foo"))
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.EqualValues(t, ErrInvalidParam, env["errorCode"])
+	assert.Equal(t, "bad foo", env["errorString"])
+	assert.Nil(t, env["response"])
+
+	code, env = render(nil, &ValidationError{Errors: []FieldError{{Param: "foo", Message: "missing"}}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.EqualValues(t, ErrInvalidRequest, env["errorCode"])
+	assert.Len(t, env["errors"], 1)
+
+	code, env = render(nil, errors.New("boom"))
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.EqualValues(t, ErrGeneralFailure, env["errorCode"])
+	assert.NotContains(t, env["errorString"], "boom")
+}
 
-		code, msg := httpError(e)
-		assert.Equal(t, http.StatusUnauthorized, code)
-		fmt.Println(msg)
+func TestRawJSONResponse(t *testing.T) {
+
+	jr := JSONRenderer{}
+	render := func(renderer Renderer, u string, v interface{}) *httptest.ResponseRecorder {
+		out := httptest.NewRecorder()
+		hr, _ := http.NewRequest("GET", u, nil)
+		req := NewRequest(hr)
+		assert.NoError(t, renderer.Render(v, nil, out, req))
+		return out
 	}
 
-	err = NewErrorf("word %s", "dawg")
-	if e, ok := err.(*internalError); !ok {
-		t.Fatal("returned not an internal error")
-	} else {
-		assert.Equal(t, e.Code, ErrGeneralFailure)
-		assert.Equal(t, e.Message, "word dawg")
+	raw := RawJSON(`{"foo": [1, 2]}`)
 
-		code, msg := httpError(e)
-		assert.Equal(t, http.StatusInternalServerError, code)
-		fmt.Println(msg)
-	}
+	out := render(jr, "http://foo.bar", raw)
+	assert.Equal(t, http.StatusOK, out.Code)
+	assert.Equal(t, "application/json; charset=utf-8", out.Header().Get("Content-Type"))
+	assert.Equal(t, `{"foo": [1, 2]}`, out.Body.String())
 
-	testErr := func(err error, code int, httpCode int) {
+	out = render(jr, "http://foo.bar?callback=foo", raw)
+	assert.Equal(t, "foo({\"foo\": [1, 2]});\n", out.Body.String())
 
-		if e, ok := err.(*internalError); !ok {
-			t.Error("returned not an internal error")
-		} else {
-			assert.Equal(t, e.Code, code)
-			hcode, _ := httpError(e)
-			assert.Equal(t, httpCode, hcode)
-		}
+	out = render(jr, "http://foo.bar?pretty=1", RawJSON(`{"foo":1}`))
+	assert.Equal(t, "{\n  \"foo\": 1\n}", out.Body.String())
 
-	}
+	out = render(JSONRenderer{Envelope: true}, "http://foo.bar", raw)
+	var env map[string]interface{}
+	assert.NoError(t, json.Unmarshal(out.Body.Bytes(), &env))
+	assert.Equal(t, map[string]interface{}{"foo": []interface{}{1.0, 2.0}}, env["response"])
 
-	testErr(MissingParamError("foo"), ErrMissingParam, http.StatusBadRequest)
-	testErr(InvalidParamError("foo"), ErrInvalidParam, http.StatusBadRequest)
-	testErr(InvalidRequestError("sdfsd"), ErrInvalidRequest, http.StatusBadRequest)
-	testErr(UnauthorizedError("sdfsd"), ErrUnauthorized, http.StatusUnauthorized)
-	testErr(InsecureAccessDenied("sdfsd"), ErrInsecureAccessDenied, http.StatusForbidden)
-	testErr(ResourceUnavailableError("sdfsd"), ErrResourceUnavailable, http.StatusServiceUnavailable)
-	testErr(BackOffError(0), ErrBackOff, http.StatusServiceUnavailable)
+	out = render(jr, "http://foo.bar", RawJSON(nil))
+	assert.Equal(t, "null", out.Body.String())
 
+	// invalid bytes are not written
+	out = render(jr, "http://foo.bar", RawJSON(`{"foo":`))
+	assert.Equal(t, http.StatusInternalServerError, out.Code)
+	assert.NotContains(t, out.Body.String(), "foo")
 }
 
-func TestServer(t *testing.T) {
-	//t.SkipNow()
-	s := NewServer(":9934")
+func TestStatusResponse(t *testing.T) {
 
-	s.AddAPI(mockAPI)
+	try := func(renderer Renderer, v interface{}) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		hr, _ := http.NewRequest("POST", "http://foo.bar", nil)
+		assert.NoError(t, render(renderer, v, nil, w, NewRequest(hr)))
+		return w
+	}
 
-	go func() {
-		if err := s.Run(); err != nil {
-			t.Fatal(err)
-		}
-	}()
+	w := try(JSONRenderer{}, StatusResponse{Status: http.StatusCreated, Body: map[string]int{"id": 5}})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, `{"id":5}`, w.Body.String())
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+
+	w = try(JSONRenderer{Envelope: true}, &StatusResponse{Status: http.StatusAccepted, Body: "queued"})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var env map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &env))
+	assert.Equal(t, "queued", env["response"])
+
+	w = try(JSONRenderer{}, StatusResponse{Status: http.StatusCreated, Body: strings.NewReader("raw")})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "raw", w.Body.String())
+
+	w = try(XMLRenderer{}, StatusResponse{Status: http.StatusCreated, Body: struct {
+		XMLName xml.Name `xml:"item"`
+	}{}})
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = try(JSONRenderer{}, StatusResponse{Status: http.StatusNoContent, Body: "ignored"})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	// only success statuses can be set
+	w = try(JSONRenderer{}, StatusResponse{Status: http.StatusFound, Body: "foo"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"foo"`, w.Body.String())
+
+	// errors are rendered with their own status
+	w = httptest.NewRecorder()
+	hr, _ := http.NewRequest("POST", "http://foo.bar", nil)
+	render(JSONRenderer{}, StatusResponse{Status: http.StatusCreated}, ConflictError("exists"), w, NewRequest(hr))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
 
-	time.Sleep(100 * time.Millisecond)
+func TestRenderFailures(t *testing.T) {
 
-	s.Stop()
+	try := func(renderer Renderer, v interface{}) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		hr, _ := http.NewRequest("GET", "http://foo.bar", nil)
+		req := NewRequest(hr)
+		render(renderer, v, nil, w, req)
+		return w
+	}
 
+	// an unmarshalable object is not partially written
+	type node struct {
+		Next *node
+	}
+	cycle := &node{}
+	cycle.Next = cycle
+
+	w := try(JSONRenderer{}, cycle)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "Error rendering response\n", w.Body.String())
+
+	w = try(RenderFunc(func(interface{}, error, http.ResponseWriter, *Request) error {
+		return errors.New("boom")
+	}), "foo")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "Error rendering response\n", w.Body.String())
+
+	w = try(RenderFunc(func(interface{}, error, http.ResponseWriter, *Request) error {
+		panic("boom")
+	}), "foo")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "Error rendering response\n", w.Body.String())
+
+	// a started response is not written over
+	w = try(RenderFunc(func(v interface{}, e error, w http.ResponseWriter, r *Request) error {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("partial"))
+		return errors.New("boom")
+	}), "foo")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "partial", w.Body.String())
+
+	// files and readers that cannot be written fail the same way
+	w = try(JSONRenderer{}, FileResponse{Filename: "report.csv"})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "Error rendering response\n", w.Body.String())
+	assert.Empty(t, w.Header().Get("Content-Disposition"))
+
+	w = try(JSONRenderer{}, &FileResponse{Reader: iotest.ErrReader(errors.New("boom")), Filename: "report.csv"})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "Error rendering response\n", w.Body.String())
+
+	w = try(JSONRenderer{}, iotest.ErrReader(errors.New("boom")))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "Error rendering response\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	hr, _ := http.NewRequest("GET", "http://foo.bar", nil)
+	assert.Equal(t, Hijacked, RenderResponse(FileResponse{}, nil, w, NewRequest(hr)))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
 }
 
-type MockHandlerV struct {
-	Int    int      `schema:"int" required:"true" doc:"integer field" min:"-100" max:"100" default:"4"`
-	Float  float64  `schema:"float" required:"true" doc:"float field" min:"-100" max:"100" default:"3.141"`
-	Bool   bool     `schema:"bool" required:"false" doc:"bool field" default:"true"`
-	String string   `schema:"string" required:"false" doc:"string field" default:"WAT WAT" minlen:"1" maxlen:"4" pattern:"^[a-zA-Z]+$"`
-	Lst    []string `schema:"list" required:"false" doc:"string list field" default:"  foo, bar, baz    "`
-}
+func TestXMLRenderer(t *testing.T) {
 
-func TestValidation(t *testing.T) {
-	//t.SkipNow()
-	req, err := http.NewRequest("GET", "http://example.com/foo?int=4&float=1.4&string=word&bool=true&list=foo&list=bar", nil)
-	if err != nil {
-		t.Fatal(err)
+	type item struct {
+		XMLName xml.Name `xml:"item"`
+		Id      int      `xml:"id,attr"`
+		Name    string   `xml:"name"`
 	}
 
-	if err := req.ParseForm(); err != nil {
-		t.Fatal(err)
-	}
+	xr := XMLRenderer{}
+	assert.Equal(t, []string{"application/xml"}, xr.ContentTypes())
 
-	h := MockHandlerV{
-		Int:    4,
-		Float:  3.14,
-		Bool:   true,
-		Lst:    []string{"foo", "bar"},
-		String: "word",
-	}
+	hr, _ := http.NewRequest("GET", "http://foo.bar", nil)
+	req := NewRequest(hr)
 
-	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockHandlerV{}), "/foo", "bar", nil)
-	if err != nil {
-		t.Error(err)
-	}
+	out := httptest.NewRecorder()
+	assert.NoError(t, xr.Render(item{Id: 1, Name: "foo"}, nil, out, req))
+	assert.Equal(t, http.StatusOK, out.Code)
+	assert.Equal(t, "application/xml; charset=utf-8", out.Header().Get("Content-Type"))
+	assert.Equal(t, xml.Header+`<item id="1"><name>foo</name></item>`, out.Body.String())
+	assert.Equal(t, req.RequestId, out.Header().Get(HeaderRequestId))
 
-	v := NewRequestValidator(ri)
-	if v == nil {
-		t.Fatal("nil request validator")
-	}
+	out = httptest.NewRecorder()
+	assert.NoError(t, xr.Render(nil, InvalidParamError("bad request"), out, req))
+	assert.Equal(t, http.StatusBadRequest, out.Code)
+	assert.Equal(t, "bad request\n", out.Body.String())
 
-	if err = v.Validate(h, req); err != nil {
-		t.Errorf("Failed validation: %s", err)
-	}
+	out = httptest.NewRecorder()
+	verr := &ValidationError{Errors: []FieldError{{Param: "id", Message: "missing required param 'id'"}}}
+	assert.NoError(t, xr.Render(nil, verr, out, req))
+	assert.Equal(t, http.StatusBadRequest, out.Code)
+	assert.Equal(t, xml.Header+`<errors><error param="id">missing required param &#39;id&#39;</error></errors>`, out.Body.String())
+}
 
-	// fail on missing param
-	badreq, _ := http.NewRequest("GET", "http://example.com/foo?float=1.4&string=word&bool=true&list=foo&list=bar", nil)
-	badreq.ParseForm()
-	if err = v.Validate(h, badreq); err == nil {
-		t.Errorf("We didn't fail on missing int from request: %s", err)
-	}
+func TestNegotiatingRenderer(t *testing.T) {
 
-	// fail on bad string value
-	h.String = " wat" // spaces not allowed
-	if err = v.Validate(h, req); err == nil || err.Error() != "string does not match regex pattern" {
-		t.Errorf("We didn't fail on regex: %s", err)
-	}
+	nr := NewNegotiatingRenderer(JSONRenderer{}, XMLRenderer{}, &HTMLRenderer{})
+	assert.Equal(t, []string{"application/json", "text/json", "application/xml", "text/html"}, nr.ContentTypes())
 
-	h.String = "watwatwat" // spaces not allowed
-	if err = v.Validate(h, req); err == nil || err.Error() != "string is too long" {
-		t.Errorf("We didn't fail on maxlen: %s", err)
+	check := func(accept string, expected Renderer) {
+		hr, _ := http.NewRequest("GET", "http://foo.bar", nil)
+		if accept != "" {
+			hr.Header.Set("Accept", accept)
+		}
+		assert.Equal(t, expected, nr.rendererFor(NewRequest(hr)), "Accept: %s", accept)
 	}
 
-	h.String = ""
-	if err = v.Validate(h, req); err == nil || err.Error() != "string is too short" {
-		t.Errorf("We didn't fail on minlen: %s", err)
-	}
-	h.String = "wat"
+	check("", JSONRenderer{})
+	check("application/xml", XMLRenderer{})
+	check("text/html;q=0.5, application/xml", XMLRenderer{})
+	check("text/html;q=0.9, application/xml;q=0.2", nr.Renderers["text/html"])
+	// application/json is the first application type
+	check("image/png, application/*", JSONRenderer{})
+	check("image/png", JSONRenderer{})
+	check("application/xml;q=0, */*", JSONRenderer{})
+	check("text/json", JSONRenderer{})
+
+	// JSON is served to JSON clients even if it is not the default
+	nr = NewNegotiatingRenderer(XMLRenderer{}, JSONRenderer{})
+	check("application/json", JSONRenderer{})
+	check("application/json;q=0.8, application/xml;q=0.5", JSONRenderer{})
+	check("", XMLRenderer{})
+	check("image/png, application/*", XMLRenderer{})
+
+	// no default renderer falls back to JSON
+	nr = NewNegotiatingRenderer(nil, XMLRenderer{})
+	check("image/png", JSONRenderer{})
+	check("application/xml", XMLRenderer{})
+	nr = &NegotiatingRenderer{}
+	check("", JSONRenderer{})
+	assert.Equal(t, []string{"application/json", "text/json"}, nr.ContentTypes())
+
+	// a wildcard matching the default renderer's type, when the default is not in the renderers map
+	nr = &NegotiatingRenderer{Default: XMLRenderer{}, Renderers: map[string]Renderer{"application/json": JSONRenderer{}}}
+	check("application/*", XMLRenderer{})
+	check("application/json;q=0.5, application/*", XMLRenderer{})
+
+	nr = NewNegotiatingRenderer(JSONRenderer{}, XMLRenderer{}, &HTMLRenderer{})
+
+	hr, _ := http.NewRequest("GET", "http://foo.bar", nil)
+	hr.Header.Set("Accept", "application/xml")
+	out := httptest.NewRecorder()
+	assert.NoError(t, nr.Render("foo", nil, out, NewRequest(hr)))
+	assert.Equal(t, "application/xml; charset=utf-8", out.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", out.Header().Get("Vary"))
+}
 
-	// Fail on bad int value
-	h.Int = -1000
-	if err = v.Validate(h, req); err == nil || err.Error() != "Value too small for int" {
-		t.Errorf("We didn't fail on min: %s", err)
-	}
+func TestMsgpackRenderer(t *testing.T) {
 
-	h.Int = 1000
-	if err = v.Validate(h, req); err == nil || err.Error() != "Value too large for int" {
-		t.Errorf("We didn't fail on max: %s", err)
-	}
+	mr := MsgpackRenderer{}
+	assert.Equal(t, []string{"application/x-msgpack"}, mr.ContentTypes())
 
-	h.Int = 5
+	hr, _ := http.NewRequest("GET", "http://foo.bar", nil)
+	req := NewRequest(hr)
 
-	// Fail on bad float value
-	h.Float = -1000
-	if err = v.Validate(h, req); err == nil || err.Error() != "Value too small for float" {
-		t.Errorf("We didn't fail on min: %s", err)
-	}
+	out := httptest.NewRecorder()
+	assert.NoError(t, mr.Render(map[string]interface{}{"foo": "bar"}, nil, out, req))
+	assert.Equal(t, http.StatusOK, out.Code)
+	assert.Equal(t, "application/x-msgpack", out.Header().Get("Content-Type"))
 
-	h.Float = 1000
-	if err = v.Validate(h, req); err == nil || err.Error() != "Value too large for float" {
-		t.Errorf("We didn't fail on max: %s", err)
+	var resp map[string]string
+	assert.NoError(t, msgpack.Unmarshal(out.Body.Bytes(), &resp))
+	assert.Equal(t, map[string]string{"foo": "bar"}, resp)
+
+	out = httptest.NewRecorder()
+	assert.NoError(t, mr.Render(nil, InvalidParamError("bad param"), out, req))
+	assert.Equal(t, http.StatusBadRequest, out.Code)
+	resp = nil
+	assert.NoError(t, msgpack.Unmarshal(out.Body.Bytes(), &resp))
+	assert.Equal(t, map[string]string{"error": "bad param"}, resp)
+
+	out = httptest.NewRecorder()
+	verr := &ValidationError{Errors: []FieldError{{Param: "id", Message: "missing required param 'id'"}}}
+	assert.NoError(t, mr.Render(nil, verr, out, req))
+	assert.Equal(t, http.StatusBadRequest, out.Code)
+
+	var errs struct {
+		Errors []FieldError `msgpack:"errors"`
 	}
+	assert.NoError(t, msgpack.Unmarshal(out.Body.Bytes(), &errs))
+	assert.Equal(t, verr.Errors, errs.Errors)
 }
 
-func TestRequest(t *testing.T) {
-
-	req, err := http.NewRequest("GET", "http://example.com?callback=foo", nil)
+func TestTemplateRenderer(t *testing.T) {
 
-	assert.NoError(t, err)
-	req.Header.Set("X-Forwarded-For", "1.1.1.1,2.2.2.2,,,")
-	req.Header.Set("Accept-Language", "en-GB,en;q=0.8,he;q=0.6,da;q=0.4")
-	req.Header.Set("X-Forwarded-Proto", "https")
-	req.Header.Set(HeaderGeoPosition, "32.4,31.8")
-	req.Header.Set("User-Agent", "Vertex/test")
-	r := NewRequest(req)
+	tpl := template.Must(template.New("page").Parse(`{{define "user"}}<b>{{.Name}}</b>{{end}}{{define "broken"}}{{.Foo.Bar}}{{end}}`))
 
-	assert.True(t, r.Secure)
-	assert.Equal(t, "2.2.2.2", r.RemoteIP)
-	assert.Equal(t, "en-GB", r.Locale)
-	assert.Equal(t, "foo", r.Callback)
-	assert.Equal(t, 32.4, r.Location.Lat)
-	assert.Equal(t, 31.8, r.Location.Long)
-	assert.NotEmpty(t, r.UserAgent)
-	assert.NotEmpty(t, r.RequestId)
+	hr, _ := http.NewRequest("GET", "http://foo.bar", nil)
+	req := NewRequest(hr)
 
-	// Test attributes
-	r.SetAttribute("Foo", 123)
-	v, found := r.Attribute("Foo")
-	assert.True(t, found)
-	assert.Equal(t, 123, v)
+	tr := NewTemplateRenderer(tpl, "user")
+	assert.Equal(t, []string{"text/html"}, tr.ContentTypes())
 
-	// Test Secure parsing
-	req.Header.Del("X-Forwarded-Proto")
-	assert.False(t, NewRequest(req).Secure)
-	req.Header.Set("X-Scheme", "https")
-	assert.True(t, NewRequest(req).Secure)
-	req, _ = http.NewRequest("GET", "https://example.com?callback=foo", nil)
-	req.RequestURI = req.URL.String()
-	assert.True(t, NewRequest(req).Secure)
+	out := httptest.NewRecorder()
+	assert.NoError(t, tr.Render(struct{ Name string }{"<foo>"}, nil, out, req))
+	assert.Equal(t, http.StatusOK, out.Code)
+	assert.Equal(t, "text/html; charset=utf-8", out.Header().Get("Content-Type"))
+	assert.Equal(t, "<b>&lt;foo&gt;</b>", out.Body.String())
 
-	// default locale if no header set
-	assert.Equal(t, "en-US", NewRequest(req).Locale)
+	out = httptest.NewRecorder()
+	assert.NoError(t, tr.Render(nil, MissingParamError("missing foo"), out, req))
+	assert.Equal(t, http.StatusBadRequest, out.Code)
 
-	// try fucked up ips in XFF
-	req.Header.Set("X-Forwarded-For", "1.1.1.1,2.2.2.2,word up")
-	assert.Empty(t, NewRequest(req).RemoteIP)
-	req.Header.Set("X-Real-Ip", "1.1.1.1")
-	assert.Equal(t, "1.1.1.1", NewRequest(req).RemoteIP)
+	out = httptest.NewRecorder()
+	assert.NoError(t, NewTemplateRenderer(tpl, "broken").Render(struct{ Foo string }{"foo"}, nil, out, req))
+	assert.Equal(t, http.StatusInternalServerError, out.Code)
+	assert.Equal(t, "Error rendering response\n", out.Body.String())
 }
 
-func TestRunCLIClient(t *testing.T) {
-	srv := NewServer(":9947")
-	srv.AddAPI(mockAPI)
-
-	s := httptest.NewServer(srv.Handler())
-	defer s.Close()
+func TestCSVRenderer(t *testing.T) {
 
-	builder := func() *API {
-		return mockAPI
+	type row struct {
+		Id     int    `csv:"id"`
+		Name   string `csv:"name"`
+		Secret string `csv:"-"`
+		hidden string
 	}
 
-	Register("testung", builder, nil)
+	hr, _ := http.NewRequest("GET", "http://foo.bar", nil)
+	req := NewRequest(hr)
 
-	buf := bytes.NewBuffer(nil)
+	cr := CSVRenderer{}
+	assert.Equal(t, []string{"text/csv"}, cr.ContentTypes())
+
+	out := httptest.NewRecorder()
+	assert.NoError(t, cr.Render([]row{{1, "foo", "x", "y"}, {2, "bar, baz", "x", "y"}}, nil, out, req))
+	assert.Equal(t, http.StatusOK, out.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", out.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="export.csv"`, out.Header().Get("Content-Disposition"))
+	assert.Equal(t, "id,name\n1,foo\n2,\"bar, baz\"\n", out.Body.String())
+
+	out = httptest.NewRecorder()
+	assert.NoError(t, CSVRenderer{Filename: "users.csv"}.Render([]map[string]interface{}{{"b": 1, "a": "x"}, {"c": true}}, nil, out, req))
+	assert.Equal(t, `attachment; filename="users.csv"`, out.Header().Get("Content-Disposition"))
+	assert.Equal(t, "a,b,c\nx,1,\n,,true\n", out.Body.String())
+
+	// a single struct is a single row
+	out = httptest.NewRecorder()
+	assert.NoError(t, cr.Render(&row{Id: 3, Name: "foo"}, nil, out, req))
+	assert.Equal(t, "id,name\n3,foo\n", out.Body.String())
+
+	out = httptest.NewRecorder()
+	assert.NoError(t, cr.Render("foo", nil, out, req))
+	assert.Equal(t, http.StatusInternalServerError, out.Code)
+
+	out = httptest.NewRecorder()
+	assert.NoError(t, cr.Render(nil, InvalidParamError("bad param"), out, req))
+	assert.Equal(t, http.StatusBadRequest, out.Code)
+}
+
+func TestStreamRenderer(t *testing.T) {
+
+	hr, _ := http.NewRequest("GET", "http://foo.bar", nil)
+	req := NewRequest(hr)
+
+	sr := StreamRenderer{FlushInterval: 2}
+
+	ch := make(chan interface{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			ch <- map[string]int{"i": i}
+		}
+		close(ch)
+	}()
+
+	out := httptest.NewRecorder()
+	assert.NoError(t, sr.Render(StreamChannel(ch), nil, out, req))
+	assert.Equal(t, http.StatusOK, out.Code)
+	assert.True(t, out.Flushed)
+	assert.Equal(t, "application/json; charset=utf-8", out.Header().Get("Content-Type"))
+	assert.Equal(t, `[{"i":0},{"i":1},{"i":2},{"i":3},{"i":4}]`, out.Body.String())
+
+	// a stream failing midway still produces a valid document, with the error in the trailer
+	out = httptest.NewRecorder()
+	assert.NoError(t, sr.Render(Stream(func(emit func(interface{}) error) error {
+		emit("foo")
+		emit("bar")
+		return errors.New("database went away")
+	}), nil, out, req))
+
+	var lst []string
+	assert.NoError(t, json.Unmarshal(out.Body.Bytes(), &lst))
+	assert.Equal(t, []string{"foo", "bar"}, lst)
+	assert.Equal(t, "database went away", out.Result().Trailer.Get(HeaderStreamError))
+
+	// an empty stream is an empty array
+	out = httptest.NewRecorder()
+	empty := make(chan interface{})
+	close(empty)
+	assert.NoError(t, sr.Render(StreamChannel(empty), nil, out, req))
+	assert.Equal(t, "[]", out.Body.String())
+
+	// non stream responses are rendered as JSON
+	out = httptest.NewRecorder()
+	assert.NoError(t, sr.Render("foo", nil, out, req))
+	assert.Equal(t, `"foo"`, out.Body.String())
+
+	out = httptest.NewRecorder()
+	assert.NoError(t, sr.Render(nil, InvalidParamError("bad param"), out, req))
+	assert.Equal(t, http.StatusBadRequest, out.Code)
+}
+
+func TestNoContent(t *testing.T) {
+
+	a := &API{
+		Root:          "/nocontent",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path:    "/delete",
+				Handler: NoContentHandler{},
+				Methods: POST,
+			},
+			{
+				Path:    "/void",
+				Handler: VoidHandler{},
+				Methods: GET,
+			},
+		},
+	}
+
+	srv := NewServer(":9951")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	res, err := http.Post(s.URL+a.FullPath("/delete"), "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.Empty(t, b)
+	assert.NotEmpty(t, res.Header.Get(HeaderRequestId))
+
+	// the void handler still renders its empty response
+	res, err = http.Get(s.URL + a.FullPath("/void"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "null", string(b))
+
+	// middleware rendering the response themselves get the same behavior
+	hr, _ := http.NewRequest("GET", "/foo", nil)
+	w := httptest.NewRecorder()
+	assert.Equal(t, Hijacked, RenderResponse(NoContent, nil, w, NewRequest(hr)))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func TestRequestId(t *testing.T) {
+
+	a := &API{
+		Root:          "/reqid",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path: "/id",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					return []string{r.RequestId, RequestIdFromContext(r.Context())}, nil
+				}),
+				Methods: GET,
+			},
+		},
+	}
+
+	srv := NewServer(":9953")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	get := func(id string) (*http.Response, []string) {
+		req, _ := http.NewRequest("GET", s.URL+a.FullPath("/id"), nil)
+		if id != "" {
+			req.Header.Set(HeaderXRequestId, id)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var ids []string
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&ids))
+		return res, ids
+	}
+
+	// incoming ids are reused and echoed
+	res, ids := get("abc-123")
+	assert.Equal(t, []string{"abc-123", "abc-123"}, ids)
+	assert.Equal(t, "abc-123", res.Header.Get(HeaderXRequestId))
+	assert.Equal(t, "abc-123", res.Header.Get(HeaderRequestId))
+
+	// otherwise, and for invalid ids, a new one is generated
+	for _, id := range []string{"", "bad id; rm -rf", strings.Repeat("a", 129)} {
+		res, ids = get(id)
+		assert.NotEmpty(t, ids[0])
+		assert.NotEqual(t, id, ids[0])
+		assert.Equal(t, ids[0], ids[1])
+		assert.Equal(t, ids[0], res.Header.Get(HeaderXRequestId))
+	}
+
+	// new ids are minted by the request id func
+	var seq int
+	SetRequestIdFunc(func(r *http.Request) string {
+		seq++
+		if seq == 2 {
+			return ""
+		}
+		return fmt.Sprintf("req-%06d", seq)
+	})
+	defer SetRequestIdFunc(nil)
+
+	res, ids = get("")
+	assert.Equal(t, []string{"req-000001", "req-000001"}, ids)
+	assert.Equal(t, "req-000001", res.Header.Get(HeaderXRequestId))
+
+	// an empty id falls back to a default one
+	_, ids = get("")
+	assert.NotEmpty(t, ids[0])
+
+	_, ids = get("abc-123")
+	assert.Equal(t, "abc-123", ids[0])
+	assert.Equal(t, 2, seq)
+}
+
+func TestGroups(t *testing.T) {
+
+	a := &API{
+		Root:          "/groups",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Middleware:    []Middleware{makeMockMW("api")},
+		Routes: Routes{
+			{Path: "/public", Handler: VoidHandler{}, Methods: GET},
+		},
+		Groups: []Group{
+			{
+				Path:       "/admin",
+				Middleware: []Middleware{makeMockMW("group")},
+				Routes: Routes{
+					{Path: "/stats", Handler: VoidHandler{}, Methods: GET},
+				},
+				Groups: []Group{
+					{
+						Path:       "/users",
+						Middleware: []Middleware{makeMockMW("subgroup")},
+						Routes: Routes{
+							{
+								Path:       "/{id}",
+								Handler:    VoidHandler{},
+								Methods:    GET,
+								Middleware: []Middleware{makeMockMW("route")},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	srv := NewServer(":9954")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	if assert.Len(t, a.Routes, 3) {
+		assert.Equal(t, "/admin/stats", a.Routes[1].Path)
+		assert.Equal(t, "/admin/users/{id}", a.Routes[2].Path)
+	}
+
+	get := func(pth string) []string {
+		res, err := http.Get(s.URL + a.FullPath(pth))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode, pth)
+		return res.Header[middlewareHeader]
+	}
+
+	assert.Equal(t, []string{"api"}, get("/public"))
+	assert.Equal(t, []string{"api", "group"}, get("/admin/stats"))
+	assert.Equal(t, []string{"api", "group", "subgroup", "route"}, get("/admin/users/5"))
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+
+	a := &API{
+		Root:            "/order",
+		Renderer:        JSONRenderer{},
+		AllowInsecure:   true,
+		Middleware:      []Middleware{makeMockMW("api")},
+		InnerMiddleware: []Middleware{makeMockMW("inner")},
+		Groups: []Group{
+			{
+				Path:       "/admin",
+				Middleware: []Middleware{makeMockMW("group")},
+				Routes: Routes{
+					{
+						Path:       "/stats",
+						Handler:    VoidHandler{},
+						Methods:    GET,
+						Middleware: []Middleware{makeMockMW("route")},
+					},
+				},
+			},
+		},
+	}
+	a.UseFirst(makeMockMW("first"))
+	a.UseLast(makeMockMW("last"))
+
+	expected := []string{"first", "api", "group", "route", "inner", "last"}
+
+	// the resolved chain can be inspected before the API is configured
+	names := func(chain []Middleware) []string {
+		w := httptest.NewRecorder()
+		hr, _ := http.NewRequest("GET", "/", nil)
+		for _, mw := range chain {
+			mw.Handle(w, NewRequest(hr), func(http.ResponseWriter, *Request) (interface{}, error) { return nil, nil })
+		}
+		return w.Header()[middlewareHeader]
+	}
+
+	chain, found := a.RouteChain("GET", "/admin/stats")
+	assert.True(t, found)
+	assert.Equal(t, expected, names(chain))
+
+	_, found = a.RouteChain("POST", "/admin/stats")
+	assert.False(t, found)
+	_, found = a.RouteChain("GET", "/stats")
+	assert.False(t, found)
+
+	srv := NewServer(":9962")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	res, err := http.Get(s.URL + a.FullPath("/admin/stats"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, expected, res.Header[middlewareHeader])
+
+	chain, found = a.RouteChain("get", "/admin/stats")
+	assert.True(t, found)
+	assert.Equal(t, expected, names(chain))
+}
+
+type tenantHandler struct {
+	Tenant string `schema:"tenant"`
+	Limit  int    `schema:"limit"`
+}
+
+func (h *tenantHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return fmt.Sprintf("%s:%d", h.Tenant, h.Limit), nil
+}
+
+func TestBindHooks(t *testing.T) {
+
+	a := &API{
+		Root:          "/hooks",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Middleware: []Middleware{
+			PreBindFunc(func(h RequestHandler, r *Request) error {
+				h.(*tenantHandler).Limit = 10
+				return nil
+			}),
+		},
+		Routes: Routes{
+			{
+				Path:    "/items",
+				Handler: &tenantHandler{},
+				Methods: GET,
+				Middleware: []Middleware{
+					PostBindFunc(func(h RequestHandler, r *Request) error {
+						if r.Header.Get("X-Tenant") == "" {
+							return UnauthorizedError("no tenant")
+						}
+						h.(*tenantHandler).Tenant = r.Header.Get("X-Tenant")
+						return nil
+					}),
+				},
+			},
+		},
+	}
+
+	s := httptest.NewServer(a.configure(nil))
+	defer s.Close()
+
+	get := func(query, tenant string) (int, string) {
+		req, _ := http.NewRequest("GET", s.URL+"/hooks/items"+query, nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	// the defaults are overridden by params, and the tenant is not
+	code, body := get("", "acme")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `"acme:10"`, body)
+
+	code, body = get("?limit=5&tenant=evil", "acme")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `"acme:5"`, body)
+
+	code, _ = get("", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+// per-method handlers of a resource, returning their names
+type getResourceHandler struct{}
+type putResourceHandler struct{}
+type deleteResourceHandler struct{}
+type sharedResourceHandler struct{}
+
+func (getResourceHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return "get", nil
+}
+func (putResourceHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return "put", nil
+}
+func (deleteResourceHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return "delete", nil
+}
+func (sharedResourceHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return "shared", nil
+}
+
+func TestMethodHandlers(t *testing.T) {
+
+	a := &API{
+		Root:          "/resources",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path: "/users/{id}",
+				Handlers: map[MethodFlag]RequestHandler{
+					GET:    getResourceHandler{},
+					PUT:    putResourceHandler{},
+					DELETE: deleteResourceHandler{},
+				},
+				Handler: sharedResourceHandler{},
+				Methods: POST,
+			},
+		},
+	}
+
+	srv := NewServer(":9955")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	if assert.Len(t, a.Routes, 4) {
+		assert.False(t, a.Routes[0].sharesTest)
+		assert.True(t, a.Routes[3].sharesTest)
+		assert.Equal(t, POST, a.Routes[3].Methods)
+	}
+
+	do := func(method string) (int, string, http.Header) {
+		req, _ := http.NewRequest(method, s.URL+a.FullPath("/users/5"), nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, strings.TrimSpace(string(b)), res.Header
+	}
+
+	for method, expected := range map[string]string{"GET": "get", "PUT": "put", "DELETE": "delete", "POST": "shared"} {
+		code, body, _ := do(method)
+		assert.Equal(t, http.StatusOK, code, method)
+		assert.Equal(t, `"`+expected+`"`, body, method)
+	}
+
+	code, _, h := do("PATCH")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	assert.Contains(t, h.Get("Allow"), "DELETE")
+
+	sw := a.ToSwagger("localhost")
+	p := sw.Paths["/users/{id}"]
+	for _, m := range []string{"get", "post", "put", "delete"} {
+		assert.Contains(t, p, m)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+
+	a := &API{
+		Root:          "/notallowed",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/foo", Handler: VoidHandler{}, Methods: GET | PUT},
+		},
+	}
+
+	s := httptest.NewServer(a.configure(nil))
+	defer s.Close()
+
+	res, err := http.Post(s.URL+a.FullPath("/foo"), "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	assert.Equal(t, "GET, HEAD, OPTIONS, PUT", res.Header.Get("Allow"))
+
+	// undefined paths are still not found
+	res, err = http.Post(s.URL+a.FullPath("/bar"), "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestUnroutedHandlers(t *testing.T) {
+
+	a := &API{
+		Root: "/unrouted",
+		Renderer: RenderFunc(func(v interface{}, err error, w http.ResponseWriter, r *Request) error {
+			code, msg := httpError(err)
+			w.WriteHeader(code)
+			_, e := fmt.Fprintf(w, "custom: %s", msg)
+			return e
+		}, "text/plain"),
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/foo", Handler: VoidHandler{}, Methods: GET},
+		},
+	}
+
+	srv := NewServer(":9956")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	do := func(method, pth string) (int, string, http.Header) {
+		req, _ := http.NewRequest(method, s.URL+pth, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, strings.TrimSpace(string(b)), res.Header
+	}
+
+	// paths outside the APIs are rendered by the JSON renderer
+	code, body, h := do("GET", "/nothing/here")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "No route for /nothing/here", body)
+	assert.NotEmpty(t, h.Get(HeaderXRequestId))
+
+	// paths under an API are rendered by its renderer
+	code, body, _ = do("GET", a.FullPath("/bar"))
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "custom: No route for /unrouted/bar", body)
+
+	code, body, h = do("POST", a.FullPath("/foo"))
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	assert.Equal(t, "custom: POST is not allowed for /unrouted/foo", body)
+	assert.Equal(t, "GET, HEAD, OPTIONS", h.Get("Allow"))
+
+	srv.SetNotFoundHandler(HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+		return nil, NotFoundError("gone fishing")
+	}))
+	srv.SetMethodNotAllowedHandler(HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+		return nil, MethodNotAllowedError("no way")
+	}))
+
+	code, body, _ = do("GET", a.FullPath("/bar"))
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "custom: gone fishing", body)
+
+	code, body, _ = do("PUT", a.FullPath("/foo"))
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	assert.Equal(t, "custom: no way", body)
+}
+
+func TestTrailingSlash(t *testing.T) {
+
+	a := &API{
+		Root:          "/slashes",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/foo", Handler: VoidHandler{}, Methods: GET},
+		},
+	}
+
+	srv := NewServer(":9957")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(pth string) *http.Response {
+		res, err := client.Get(s.URL + pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	// strict by default
+	assert.Equal(t, http.StatusOK, get("/slashes/foo").StatusCode)
+	assert.Equal(t, http.StatusNotFound, get("/slashes/foo/").StatusCode)
+
+	srv.SetTrailingSlashPolicy(TrailingSlashRedirect)
+	res := get("/slashes/foo/?bar=baz")
+	assert.Equal(t, http.StatusPermanentRedirect, res.StatusCode)
+	assert.Equal(t, "/slashes/foo?bar=baz", res.Header.Get("Location"))
+	assert.Equal(t, http.StatusNotFound, get("/slashes/bar/").StatusCode)
+
+	srv.SetTrailingSlashPolicy(TrailingSlashEquivalent)
+	assert.Equal(t, http.StatusOK, get("/slashes/foo/").StatusCode)
+	assert.Equal(t, http.StatusOK, get("/slashes/foo").StatusCode)
+	assert.Equal(t, http.StatusNotFound, get("/slashes/bar/").StatusCode)
+}
+
+type fileHandler struct {
+	Path string `schema:"path" in:"path"`
+}
+
+func (h fileHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return h.Path, nil
+}
+
+func TestDuplicateRoutes(t *testing.T) {
+
+	a := &API{
+		Name:          "dups",
+		Root:          "/dups",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/u/{id}", Handler: VoidHandler{}, Methods: GET | POST},
+			{Path: "/u/{name}", Handler: MockHandler{}, Methods: GET},
+			{Path: "/u/{id}", Handler: VoidHandler{}, Methods: PUT},
+			{Path: "/files/{path:*}", Handler: VoidHandler{}, Methods: GET},
+		},
+		Groups: []Group{
+			{Path: "/files", Routes: Routes{{Path: "/{rest:*}", Handler: VoidHandler{}, Methods: GET}}},
+		},
+	}
+
+	srv := NewServer(":9968")
+	err := srv.AddAPI(a)
+	if !assert.Error(t, err) {
+		return
+	}
+	msg := err.Error()
+	assert.Empty(t, srv.apis)
+
+	assert.Contains(t, msg, "Duplicate routes in API dups")
+	assert.Contains(t, msg, "GET /u/{name} (vertex.MockHandler) conflicts with /u/{id} (vertex.VoidHandler)")
+	assert.Contains(t, msg, "GET /files/{rest:*} (vertex.VoidHandler) conflicts with /files/{path:*}")
+	assert.NotContains(t, msg, "POST")
+	assert.NotContains(t, msg, "PUT")
+
+	// routes differing by method or template are fine
+	b := &API{
+		Root: "/nodups",
+		Routes: Routes{
+			{Path: "/u/{id}", Handler: VoidHandler{}, Methods: GET},
+			{Path: "/u/{id}", Handler: VoidHandler{}, Methods: POST},
+			{Path: "/u/{id}/friends", Handler: VoidHandler{}, Methods: GET},
+		},
+	}
+	assert.NoError(t, b.checkDuplicateRoutes())
+	assert.Equal(t, "/u/{}/files/{*}", routeTemplate("/u/{id}/files/{path:*}"))
+}
+
+func TestAddAPIErrors(t *testing.T) {
+
+	srv := NewServer(":9974")
+
+	assert.Error(t, srv.AddAPI(nil))
+
+	err := srv.AddAPI(&API{Routes: Routes{{Path: "/foo", Methods: GET}}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no root")
+		assert.Contains(t, err.Error(), "no renderer")
+		assert.Contains(t, err.Error(), "route /foo has no handler")
+	}
+
+	valid := func() *API {
+		return &API{Name: "valid", Renderer: JSONRenderer{}, Routes: Routes{{Path: "/foo", Handler: VoidHandler{}, Methods: GET}}}
+	}
+	assert.NoError(t, srv.AddAPI(valid()))
+
+	// conflicts with routes already on the server are reported too
+	err = srv.AddAPI(valid())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Could not add API valid")
+	}
+	assert.Len(t, srv.apis, 1)
+
+	// InitAPIs adds the valid APIs, and returns the errors of the others
+	reg := NewRegistry()
+	reg.Register("good", valid, nil)
+	reg.Register("bad", func() *API { return &API{Name: "bad"} }, nil)
+
+	srv = NewServerWithRegistry(":9974", reg)
+	err = srv.InitAPIs()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Could not add 1 APIs: bad: Invalid API bad: no renderer")
+	}
+	assert.Len(t, srv.apis, 1)
+}
+
+func TestCatchAll(t *testing.T) {
+
+	assert.NoError(t, validatePath("/files/{path:*}"))
+	assert.NoError(t, validatePath("/files/{id}/{path:*}"))
+	assert.Error(t, validatePath("/files/{path:*}/foo"))
+	assert.Error(t, validatePath("/files/{path:*}/{id}"))
+	assert.Error(t, validatePath("/files/{a:*}/{b:*}"))
+	assert.Error(t, validatePath("/files/x{path:*}"))
+
+	a := &API{
+		Root:          "/catchall",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/files/{path:*}", Handler: fileHandler{}, Methods: GET},
+			{Path: "/bad/{path:*}/foo", Handler: fileHandler{}, Methods: GET},
+		},
+	}
+
+	assert.Equal(t, "/catchall/files/*path", a.FullPath("/files/{path:*}"))
+	assert.Equal(t, "/files/a/b.txt", FormatPath("/files/{path:*}", Params{"path": "a/b.txt"}))
+
+	srv := NewServer(":9958")
+
+	// APIs with invalid route paths are not added
+	err := srv.AddAPI(a)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "route /bad/{path:*}/foo has an invalid path: Catch-all params must be the last segment")
+	}
+	assert.Len(t, srv.apis, 0)
+
+	a.Routes = a.Routes[:1]
+	assert.NoError(t, srv.AddAPI(a))
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	res, err := http.Get(s.URL + "/catchall/files/a/b/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `"a/b/c.txt"`, strings.TrimSpace(string(b)))
+
+	sw := a.ToSwagger("localhost")
+	if assert.Contains(t, sw.Paths, "/files/{path}") {
+		params := sw.Paths["/files/{path}"]["get"].Parameters
+		if assert.Len(t, params, 1) {
+			assert.Equal(t, "path", params[0].In)
+		}
+	}
+}
+
+func TestQueryAccessors(t *testing.T) {
+
+	r := httptest.NewRequest("GET", "/foo?limit=20&bad=x&active=1&q=foo&q=bar&empty=&ratio=0.5", nil)
+
+	assert.Equal(t, 20, QueryInt(r, "limit", 10))
+	assert.Equal(t, 10, QueryInt(r, "missing", 10))
+	assert.Equal(t, 10, QueryInt(r, "bad", 10))
+	assert.Equal(t, 10, QueryInt(r, "empty", 10))
+
+	assert.Equal(t, 0.5, QueryFloat(r, "ratio", 1))
+	assert.Equal(t, 1.0, QueryFloat(r, "bad", 1))
+
+	assert.True(t, QueryBool(r, "active", false))
+	assert.True(t, QueryBool(r, "bad", true))
+	assert.False(t, QueryBool(r, "missing", false))
+
+	// like the binder, the last value is used, and empty values are missing
+	assert.Equal(t, "bar", QueryString(r, "q", ""))
+	assert.Equal(t, "def", QueryString(r, "empty", "def"))
+
+	// form bodies are parsed as well
+	r = httptest.NewRequest("POST", "/foo?limit=5", strings.NewReader("active=false"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.False(t, QueryBool(r, "active", true))
+	assert.Equal(t, 5, QueryInt(r, "limit", 10))
+}
+
+func TestPathParamAccessors(t *testing.T) {
+
+	a := &API{
+		Root:          "/params",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path: "/users/{id}/files/{path:*}",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					return map[string]interface{}{
+						"id":     Param(r.Request, "id"),
+						"none":   Param(r.Request, "none"),
+						"params": PathParams(r.Request),
+					}, nil
+				}),
+				Methods: GET,
+			},
+		},
+	}
+
+	assert.Nil(t, PathParams(httptest.NewRequest("GET", "/foo", nil)))
+	assert.Equal(t, "", Param(httptest.NewRequest("GET", "/foo", nil), "id"))
+
+	s := httptest.NewServer(a.configure(nil))
+	defer s.Close()
+
+	res, err := http.Get(s.URL + "/params/users/5/files/a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var ret struct {
+		Id     string
+		None   string
+		Params Params
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&ret))
+	assert.Equal(t, "5", ret.Id)
+	assert.Equal(t, "", ret.None)
+	assert.Equal(t, Params{"id": "5", "path": "a/b.txt"}, ret.Params)
+}
+
+type mockLogger struct {
+	lines []string
+}
+
+func (l *mockLogger) log(level, msg string, fields []interface{}) {
+	l.lines = append(l.lines, level+" "+formatFields(msg, fields))
+}
+
+func (l *mockLogger) Debug(msg string, fields ...interface{}) { l.log("DEBUG", msg, fields) }
+func (l *mockLogger) Info(msg string, fields ...interface{})  { l.log("INFO", msg, fields) }
+func (l *mockLogger) Warn(msg string, fields ...interface{})  { l.log("WARN", msg, fields) }
+func (l *mockLogger) Error(msg string, fields ...interface{}) { l.log("ERROR", msg, fields) }
+
+func TestLogger(t *testing.T) {
+
+	assert.Equal(t, "foo", formatFields("foo", nil))
+	assert.Equal(t, "foo a=1 b=bar", formatFields("foo", []interface{}{"a", 1, "b", "bar"}))
+	assert.Equal(t, "foo a=1 b", formatFields("foo", []interface{}{"a", 1, "b"}))
+
+	assert.IsType(t, pylogLogger{}, GetLogger())
+
+	l := &mockLogger{}
+	SetLogger(l)
+	defer SetLogger(nil)
+	assert.Equal(t, l, GetLogger())
+
+	code, _ := httpError(NewErrorf("logged"))
+	assert.Equal(t, http.StatusInternalServerError, code)
+	if assert.Len(t, l.lines, 1) {
+		assert.True(t, strings.HasPrefix(l.lines[0], "ERROR ["), l.lines[0])
+		assert.True(t, strings.HasSuffix(l.lines[0], "] Error processing request: logged"), l.lines[0])
+	}
+
+	SetLogger(nil)
+	assert.IsType(t, pylogLogger{}, GetLogger())
+}
+
+func TestJSONPCallbacks(t *testing.T) {
+
+	a := &API{
+		Root:          "/jsonp",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path: "/foo",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					return "bar", nil
+				}),
+				Methods: GET,
+			},
+		},
+	}
+
+	s := httptest.NewServer(a.configure(nil))
+	defer s.Close()
+
+	get := func(callback string) (int, string) {
+		res, err := http.Get(s.URL + "/jsonp/foo?callback=" + url.QueryEscape(callback))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	code, body := get("jQuery.cb_1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `jQuery.cb_1("bar");`, body)
+
+	for _, cb := range []string{"alert(1)//", "<script>", "a b", "1abc", "foo..bar", strings.Repeat("a", 129)} {
+		code, body = get(cb)
+		assert.Equal(t, http.StatusBadRequest, code, cb)
+		assert.NotContains(t, body, cb)
+	}
+
+	a.JSONPCallbacks = []string{"allowed"}
+	code, body = get("allowed")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `allowed("bar");`, body)
+	code, _ = get("other")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	a.DisableJSONP = true
+	code, body = get("allowed")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `"bar"`, body)
+}
+
+func TestUnroutedJSONP(t *testing.T) {
+
+	a := &API{
+		Root:           "/jsonpunrouted",
+		Renderer:       JSONRenderer{},
+		AllowInsecure:  true,
+		JSONPCallbacks: []string{"allowed"},
+		Routes: Routes{
+			{Path: "/foo", Handler: VoidHandler{}, Methods: GET},
+		},
+	}
+
+	srv := NewServer(":9979")
+	srv.AddAPI(a)
+	srv.SetNotFoundHandler(HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+		return "missing", nil
+	}))
+
+	get := func(pth string) (int, string) {
+		w := httptest.NewRecorder()
+		hr, _ := http.NewRequest("GET", pth, nil)
+		srv.ServeHTTP(w, hr)
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+
+	// unrouted responses follow the JSONP policy of the API
+	_, body := get("/jsonpunrouted/nope?callback=allowed")
+	assert.Equal(t, `allowed("missing");`, body)
+
+	_, body = get("/jsonpunrouted/nope?callback=other")
+	assert.Equal(t, `"missing"`, body)
+
+	_, body = get("/jsonpunrouted/nope?callback=alert(1)//")
+	assert.Equal(t, `"missing"`, body)
+
+	w := httptest.NewRecorder()
+	hr, _ := http.NewRequest("DELETE", "/jsonpunrouted/foo?callback=other", nil)
+	srv.ServeHTTP(w, hr)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.NotContains(t, w.Body.String(), "other")
+
+	a.DisableJSONP = true
+	_, body = get("/jsonpunrouted/nope?callback=allowed")
+	assert.Equal(t, `"missing"`, body)
+
+	// paths of no API have no JSONP policy, so they get no callback
+	_, body = get("/nosuchapi?callback=foo")
+	assert.Equal(t, `"missing"`, body)
+}
+
+func TestProcessingTimeHeader(t *testing.T) {
+
+	a := &API{
+		Root:          "/timing",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/foo", Handler: VoidHandler{}, Methods: GET},
+		},
+	}
+
+	s := httptest.NewServer(a.configure(nil))
+	defer s.Close()
+
+	get := func() http.Header {
+		res, err := http.Get(s.URL + "/timing/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.Header
+	}
+
+	assert.NotEmpty(t, get().Get(HeaderProcessingTime))
+
+	a.ProcessingTimeHeader = "X-Upstream-Time"
+	h := get()
+	assert.NotEmpty(t, h.Get("X-Upstream-Time"))
+	assert.Empty(t, h.Get(HeaderProcessingTime))
+
+	a.DisableProcessingTime = true
+	h = get()
+	assert.Empty(t, h.Get("X-Upstream-Time"))
+	assert.Empty(t, h.Get(HeaderProcessingTime))
+	assert.NotEmpty(t, h.Get(HeaderRequestId))
+}
+
+func TestProcessingTimeFormat(t *testing.T) {
+
+	d := 12345678 * time.Nanosecond
+	assert.Equal(t, "12.346", DefaultProcessingTimeFormat.Format(d))
+	assert.Equal(t, "12", ProcessingTimeFormat{Unit: time.Millisecond}.Format(d))
+	assert.Equal(t, "12345.7", ProcessingTimeFormat{Unit: time.Microsecond, Precision: 1}.Format(d))
+
+	a := &API{
+		Root:                 "/timing",
+		Renderer:             JSONRenderer{},
+		AllowInsecure:        true,
+		ProcessingTimeFormat: ProcessingTimeFormat{Unit: time.Microsecond},
+		Routes: Routes{
+			{Path: "/foo", Handler: VoidHandler{}, Methods: GET},
+		},
+	}
+
+	s := httptest.NewServer(a.configure(nil))
+	defer s.Close()
+
+	res, err := http.Get(s.URL + "/timing/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	v := res.Header.Get(HeaderProcessingTime)
+	assert.NotContains(t, v, ".")
+	_, err = strconv.Atoi(v)
+	assert.NoError(t, err)
+}
+
+func TestDeprecatedRoutes(t *testing.T) {
+
+	sunset := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+	a := &API{
+		Root:          "/deprecated",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/old", Description: "Old stuff", Handler: VoidHandler{}, Methods: GET, Deprecated: true, Sunset: sunset},
+			{Path: "/new", Handler: VoidHandler{}, Methods: GET},
+		},
+	}
+
+	s := httptest.NewServer(a.configure(nil))
+	defer s.Close()
+
+	get := func(pth string) *http.Response {
+		res, err := http.Get(s.URL + pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := get("/deprecated/old")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "true", res.Header.Get("Deprecation"))
+	assert.Equal(t, "Wed, 02 Jan 2030 00:00:00 GMT", res.Header.Get("Sunset"))
+
+	res = get("/deprecated/new")
+	assert.Empty(t, res.Header.Get("Deprecation"))
+	assert.Empty(t, res.Header.Get("Sunset"))
+
+	sw := a.ToSwagger("localhost")
+	assert.True(t, sw.Paths["/old"]["get"].Deprecated)
+	assert.Contains(t, sw.Paths["/old"]["get"].Description, "Sunset on 2030-01-02")
+	assert.False(t, sw.Paths["/new"]["get"].Deprecated)
+
+	desc := a.Describe()
+	assert.True(t, desc.Routes[0].Deprecated)
+	assert.Equal(t, "2030-01-02T00:00:00Z", desc.Routes[0].Sunset)
+	assert.False(t, desc.Routes[1].Deprecated)
+}
+
+func TestHealthChecks(t *testing.T) {
+
+	srv := NewServer(":9959")
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	get := func(pth string) (int, HealthStatus) {
+		res, err := http.Get(s.URL + pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var status HealthStatus
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&status))
+		return res.StatusCode, status
+	}
+
+	code, status := get(ReadyzPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", status.Status)
+
+	var dbErr error
+	checked := 0
+	srv.AddHealthCheck("db", func() error {
+		checked++
+		return dbErr
+	})
+	srv.AddHealthCheck("cache", func() error { return nil })
+
+	code, status = get(ReadyzPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthStatus{Status: "ok", Checks: map[string]string{"db": "ok", "cache": "ok"}}, status)
+
+	dbErr = errors.New("connection refused")
+	code, status = get(ReadyzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, HealthStatus{Status: "fail", Checks: map[string]string{"db": "connection refused", "cache": "ok"}}, status)
+
+	// liveness does not run the checks
+	code, status = get(HealthzPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthStatus{Status: "ok"}, status)
+	assert.Equal(t, 2, checked)
+}
+
+// a reader response with a content type, tracking whether it was closed
+type typedReader struct {
+	io.Reader
+	closed bool
+}
+
+func (r *typedReader) ContentType() string {
+	return "text/csv"
+}
+
+func (r *typedReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestReaderResponses(t *testing.T) {
+
+	typed := &typedReader{Reader: strings.NewReader("a,b\n1,2\n")}
+
+	a := &API{
+		Root:          "/readers",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path: "/plain",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					return strings.NewReader("raw bytes"), nil
+				}),
+				Methods: GET,
+			},
+			{
+				Path: "/typed",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					return typed, nil
+				}),
+				Methods: GET,
+			},
+			{
+				Path: "/header",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					w.Header().Set("Content-Type", "image/png")
+					return bytes.NewReader([]byte{0x89, 'P', 'N', 'G'}), nil
+				}),
+				Methods: GET,
+			},
+		},
+	}
+
+	s := httptest.NewServer(a.configure(nil))
+	defer s.Close()
+
+	get := func(pth string) (*http.Response, string) {
+		res, err := http.Get(s.URL + pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	res, body := get("/readers/plain")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/octet-stream", res.Header.Get("Content-Type"))
+	assert.Equal(t, "raw bytes", body)
+	assert.NotEmpty(t, res.Header.Get(HeaderProcessingTime))
+
+	res, body = get("/readers/typed")
+	assert.Equal(t, "text/csv", res.Header.Get("Content-Type"))
+	assert.Equal(t, "a,b\n1,2\n", body)
+	assert.True(t, typed.closed)
+
+	res, body = get("/readers/header")
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+	assert.Equal(t, "\x89PNG", body)
+}
+
+func TestFileResponses(t *testing.T) {
+
+	fp, err := ioutil.TempFile("", "vertex-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+	fp.WriteString("id,name\n1,foo\n")
+	fp.Close()
+
+	a := &API{
+		Root:          "/files",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path: "/report",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					f, err := os.Open(fp.Name())
+					if err != nil {
+						return nil, NewError(err)
+					}
+					return FileResponse{Reader: f, Filename: "report.csv"}, nil
+				}),
+				Methods: GET,
+			},
+			{
+				Path: "/blob",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					return &FileResponse{Reader: strings.NewReader("blob"), Filename: "naïve blob", ContentType: "application/x-blob"}, nil
+				}),
+				Methods: GET,
+			},
+			{
+				Path: "/stream",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					return FileResponse{Reader: ioutil.NopCloser(strings.NewReader("data"))}, nil
+				}),
+				Methods: GET,
+			},
+		},
+	}
+
+	s := httptest.NewServer(a.configure(nil))
+	defer s.Close()
+
+	get := func(pth string) (*http.Response, string) {
+		res, err := http.Get(s.URL + pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	res, body := get("/files/report")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "id,name\n1,foo\n", body)
+	assert.Equal(t, "text/csv; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, "attachment; filename=report.csv", res.Header.Get("Content-Disposition"))
+	assert.Equal(t, int64(len(body)), res.ContentLength)
+	assert.NotEmpty(t, res.Header.Get(HeaderProcessingTime))
+
+	res, body = get("/files/blob")
+	assert.Equal(t, "blob", body)
+	assert.Equal(t, "application/x-blob", res.Header.Get("Content-Type"))
+	assert.Equal(t, "attachment; filename*=utf-8''na%C3%AFve%20blob", res.Header.Get("Content-Disposition"))
+	assert.Equal(t, int64(4), res.ContentLength)
+
+	// unknown size and name
+	res, body = get("/files/stream")
+	assert.Equal(t, "data", body)
+	assert.Equal(t, "application/octet-stream", res.Header.Get("Content-Type"))
+	assert.Equal(t, "attachment", res.Header.Get("Content-Disposition"))
+	assert.Equal(t, int64(-1), readerSize(ioutil.NopCloser(strings.NewReader("data"))))
+}
+
+const mockConfs = `
+server:
+  listen: :8686
+apis:
+  testung:
+     foo: baz
+`
+
+func TestConfigs(t *testing.T) {
+	//t.SkipNow()
+	var apiConf = struct {
+		Foo string `yaml:"foo"`
+	}{"not baz"}
+
+	registerAPIConfig("testung", &apiConf)
+
+	confile := "/tmp/apiconf.test.yaml"
+	fp, err := os.Create(confile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fp.WriteString(mockConfs); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	flag.Set("conf", confile)
+	assert.NoError(t, ReadConfigs())
+	assert.Equal(t, Config.Server.ListenAddr, ":8686")
+	assert.Equal(t, "baz", apiConf.Foo)
+}
+
+func TestMergedConfigs(t *testing.T) {
+
+	defer func(conf serverConfig) {
+		Config.Server = conf
+	}(Config.Server)
+
+	var apiConf = struct {
+		Foo string `yaml:"foo"`
+		Bar string `yaml:"bar"`
+	}{}
+	registerAPIConfig("mergetest", &apiConf)
+	defer delete(Config.apiconfs, "mergetest")
+
+	files := map[string]string{
+		"/tmp/apiconf.base.yaml": `
+server:
+  listen: :8686
+  logging_level: DEBUG
+apis:
+  mergetest:
+    foo: base foo
+    bar: base bar
+`,
+		"/tmp/apiconf.overlay.yaml": `
+server:
+  listen: :8787
+apis:
+  mergetest:
+    bar: overlay bar
+`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(name)
+	}
+
+	defer flag.Set(ConfFlag, "")
+	flag.Set(ConfFlag, "/tmp/apiconf.base.yaml, /tmp/apiconf.overlay.yaml")
+	assert.NoError(t, ReadConfigs())
+
+	assert.Equal(t, ":8787", Config.Server.ListenAddr)
+	assert.Equal(t, "DEBUG", Config.Server.LoggingLevel)
+	assert.Equal(t, "base foo", apiConf.Foo)
+	assert.Equal(t, "overlay bar", apiConf.Bar)
+
+	assert.Error(t, ReadConfigFiles("/tmp/apiconf.base.yaml", "/tmp/no.such.conf.yaml"))
+}
+
+type mockReloadConf struct {
+	Foo   string            `yaml:"foo"`
+	Names map[string]string `yaml:"names"`
+}
+
+func TestReloadConfigs(t *testing.T) {
+
+	defer func(conf serverConfig) {
+		Config.Server = conf
+		reloadedConfigs.Store((*configs)(nil))
+	}(Config.Server)
+
+	apiConf := &mockReloadConf{}
+	registerAPIConfig("reloadtest", apiConf)
+	defer delete(Config.apiconfs, "reloadtest")
+
+	confile := "/tmp/apiconf.reload.yaml"
+	write := func(foo string) {
+		if err := ioutil.WriteFile(confile, []byte("apis:\n  reloadtest:\n    foo: "+foo+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Remove(confile)
+
+	write("before")
+	flag.Set(ConfFlag, confile)
+	defer flag.Set(ConfFlag, "")
+	assert.NoError(t, ReadConfigs())
+	assert.Equal(t, "before", apiConf.Foo)
+	assert.Equal(t, apiConf, APIConfig("reloadtest"))
+
+	reloaded := make(chan string, 1)
+	OnConfigReload(func() {
+		// callbacks cannot be removed, so this one runs on the reloads of later tests too
+		conf, ok := APIConfig("reloadtest").(*mockReloadConf)
+		if !ok {
+			return
+		}
+		select {
+		case reloaded <- conf.Foo:
+		default:
+		}
+	})
+
+	stop := ReloadConfigsOnHUP()
+	defer stop()
+
+	version := ConfigVersion()
+	write("after")
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+	select {
+	case foo := <-reloaded:
+		assert.Equal(t, "after", foo)
+		assert.Equal(t, version+1, ConfigVersion())
+	case <-time.After(time.Second):
+		t.Fatal("Configs not reloaded on SIGHUP")
+	}
+
+	// the registered struct is not modified while handlers may be reading it
+	assert.Equal(t, "before", apiConf.Foo)
+	assert.Nil(t, APIConfig("nosuchapi"))
+}
+
+// run with -race: requests read the configs while they are reloaded
+func TestReloadConfigsWhileServing(t *testing.T) {
+
+	defer func(conf serverConfig) {
+		Config.Server = conf
+		reloadedConfigs.Store((*configs)(nil))
+	}(Config.Server)
+
+	registerAPIConfig("reloadrace", &mockReloadConf{Names: map[string]string{"a": "b"}})
+	defer delete(Config.apiconfs, "reloadrace")
+
+	confile := "/tmp/apiconf.reloadrace.yaml"
+	write := func(i int) {
+		conf := fmt.Sprintf("server:\n  debug: %v\napis:\n  reloadrace:\n    foo: v%d\n    names:\n      n%d: x\n", i%2 == 0, i, i)
+		if err := ioutil.WriteFile(confile, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Remove(confile)
+
+	write(0)
+	flag.Set(ConfFlag, confile)
+	defer flag.Set(ConfFlag, "")
+
+	a := &API{
+		Root:          "/reloadrace",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path: "/conf",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					conf := APIConfig("reloadrace").(*mockReloadConf)
+					if len(conf.Names) == 0 {
+						return nil, NewErrorf("no names")
+					}
+					return nil, NotFoundError("%s not found", conf.Foo)
+				}),
+				Methods: GET,
+			},
+		},
+	}
+	srv := NewServer(":9978")
+	srv.AddAPI(a)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				w := httptest.NewRecorder()
+				hr, _ := http.NewRequest("GET", "/reloadrace/conf", nil)
+				srv.ServeHTTP(w, hr)
+				if w.Code != http.StatusNotFound {
+					t.Errorf("Unexpected status %d", w.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 20; i++ {
+		write(i)
+		assert.NoError(t, ReloadConfigs())
+	}
+	close(done)
+	wg.Wait()
+
+	conf := APIConfig("reloadrace").(*mockReloadConf)
+	assert.Equal(t, "v20", conf.Foo)
+	assert.Equal(t, "x", conf.Names["n20"])
+	assert.Equal(t, "b", conf.Names["a"])
+	assert.True(t, ServerConfig().Debug)
+}
+
+func TestExposeMetricsReload(t *testing.T) {
+
+	defer reloadedConfigs.Store((*configs)(nil))
+
+	srv := NewServer(":9982")
+	srv.ExposeMetrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "metrics")
+	}))
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	get := func() int {
+		res, err := http.Get(s.URL + MetricsPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, get())
+
+	// metrics are disabled and enabled by reloading the config
+	conf := currentConfigs().clone()
+	conf.Server.DisableMetrics = true
+	reloadedConfigs.Store(conf)
+	assert.Equal(t, http.StatusNotFound, get())
+
+	conf = currentConfigs().clone()
+	conf.Server.DisableMetrics = false
+	reloadedConfigs.Store(conf)
+	assert.Equal(t, http.StatusOK, get())
+}
+
+type mockValidatedConf struct {
+	Foo string `yaml:"foo"`
+}
+
+func (c *mockValidatedConf) Validate() error {
+	if c.Foo == "" {
+		return errors.New("missing foo")
+	}
+	return nil
+}
+
+func TestValidateConfigs(t *testing.T) {
+
+	confs := map[string]*mockValidatedConf{"valid1": {}, "invalid1": {}, "invalid2": {}}
+	for name, conf := range confs {
+		registerAPIConfig(name, conf)
+		defer delete(Config.apiconfs, name)
+	}
+
+	confile := "/tmp/apiconf.validate.yaml"
+	if err := ioutil.WriteFile(confile, []byte("apis:\n  valid1:\n    foo: bar\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(confile)
+
+	err := ReadConfigFiles(confile)
+	if assert.Error(t, err) {
+		assert.Equal(t, "Invalid API configs: invalid1: missing foo; invalid2: missing foo", err.Error())
+	}
+	assert.Equal(t, "bar", confs["valid1"].Foo)
+
+	confs["invalid1"].Foo = "bar"
+	confs["invalid2"].Foo = "bar"
+	assert.NoError(t, Config.validateAPIConfigs())
+}
+
+func TestEnvConfigs(t *testing.T) {
+
+	defer func(conf serverConfig) {
+		Config.Server = conf
+	}(Config.Server)
+
+	var apiConf = struct {
+		Foo  string `yaml:"foo"`
+		Bars []int  `yaml:"bars"`
+		Baz  bool
+	}{Foo: "not baz"}
+	registerAPIConfig("envtest", &apiConf)
+	defer delete(Config.apiconfs, "envtest")
+
+	env := map[string]string{
+		"VERTEX_SERVER_LISTEN":             ":8787",
+		"VERTEX_SERVER_CLIENT_TIMEOUT_SEC": "10",
+		"VERTEX_APIS_ENVTEST_FOO":          "from env",
+		"VERTEX_APIS_ENVTEST_BARS":         "1,2,3",
+		"VERTEX_APIS_ENVTEST_BAZ":          "true",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	assert.NoError(t, Config.applyEnvOverrides())
+	assert.Equal(t, ":8787", Config.Server.ListenAddr)
+	assert.Equal(t, 10, Config.Server.ClientTimeout)
+	assert.Equal(t, "from env", apiConf.Foo)
+	assert.Equal(t, []int{1, 2, 3}, apiConf.Bars)
+	assert.True(t, apiConf.Baz)
+
+	os.Setenv("VERTEX_SERVER_CLIENT_TIMEOUT_SEC", "ten")
+	assert.Error(t, Config.applyEnvOverrides())
+}
+
+func TestErrors(t *testing.T) {
+	//t.SkipNow()
+	err := NewError(errors.New("wat"))
+	if e, ok := err.(*internalError); !ok {
+		t.Fatal("returned not an internal error")
+	} else {
+		assert.Equal(t, e.Code, ErrGeneralFailure)
+		assert.Equal(t, e.Message, "wat")
+	}
+
+	err = UnauthorizedError("word")
+	if e, ok := err.(*internalError); !ok {
+		t.Fatal("returned not an internal error")
+	} else {
+		assert.Equal(t, e.Code, ErrUnauthorized)
+		assert.Equal(t, e.Message, "word")
+
+		code, msg := httpError(e)
+		assert.Equal(t, http.StatusUnauthorized, code)
+		fmt.Println(msg)
+	}
+
+	err = NewErrorf("word %s", "dawg")
+	if e, ok := err.(*internalError); !ok {
+		t.Fatal("returned not an internal error")
+	} else {
+		assert.Equal(t, e.Code, ErrGeneralFailure)
+		assert.Equal(t, e.Message, "word dawg")
+
+		code, msg := httpError(e)
+		assert.Equal(t, http.StatusInternalServerError, code)
+		fmt.Println(msg)
+	}
+
+	testErr := func(err error, code int, httpCode int) {
+
+		if e, ok := err.(*internalError); !ok {
+			t.Error("returned not an internal error")
+		} else {
+			assert.Equal(t, e.Code, code)
+			hcode, _ := httpError(e)
+			assert.Equal(t, httpCode, hcode)
+		}
+
+	}
+
+	testErr(MissingParamError("foo"), ErrMissingParam, http.StatusBadRequest)
+	testErr(InvalidParamError("foo"), ErrInvalidParam, http.StatusBadRequest)
+	testErr(InvalidRequestError("sdfsd"), ErrInvalidRequest, http.StatusBadRequest)
+	testErr(UnauthorizedError("sdfsd"), ErrUnauthorized, http.StatusUnauthorized)
+	testErr(InsecureAccessDenied("sdfsd"), ErrInsecureAccessDenied, http.StatusForbidden)
+	testErr(ResourceUnavailableError("sdfsd"), ErrResourceUnavailable, http.StatusServiceUnavailable)
+	testErr(BackOffError(0), ErrBackOff, http.StatusServiceUnavailable)
+	testErr(TooManyRequestsError("sdfsd"), ErrTooManyRequests, http.StatusTooManyRequests)
+	testErr(TimeoutError("sdfsd"), ErrTimeout, http.StatusGatewayTimeout)
+	testErr(NotFoundError("sdfsd"), ErrNotFound, http.StatusNotFound)
+	testErr(ForbiddenError("sdfsd"), ErrForbidden, http.StatusForbidden)
+	testErr(ConflictError("sdfsd"), ErrConflict, http.StatusConflict)
+	testErr(UnprocessableEntityError("sdfsd"), ErrUnprocessableEntity, http.StatusUnprocessableEntity)
+	testErr(MethodNotAllowedError("sdfsd"), ErrMethodNotAllowed, http.StatusMethodNotAllowed)
+	testErr(RequestEntityTooLargeError("sdfsd"), ErrRequestEntityTooLarge, http.StatusRequestEntityTooLarge)
+	testErr(RetryableError(0, "sdfsd"), ErrRetryable, http.StatusServiceUnavailable)
+	testErr(URITooLongError("sdfsd"), ErrURITooLong, http.StatusRequestURITooLong)
+	testErr(UnsupportedMediaTypeError("sdfsd"), ErrUnsupportedMediaType, http.StatusUnsupportedMediaType)
+
+	// the messages of client errors are returned to the client
+	_, msg := httpError(NotFoundError("no user %d", 5))
+	assert.Equal(t, "no user 5", msg)
+
+}
+
+func TestRetryableErrors(t *testing.T) {
+
+	handle := func(renderer Renderer, err error) *httptest.ResponseRecorder {
+		hr, _ := http.NewRequest("GET", "/foo", nil)
+		w := httptest.NewRecorder()
+		assert.NoError(t, render(renderer, nil, err, w, NewRequest(hr)))
+		return w
+	}
+
+	w := handle(JSONRenderer{}, RetryableError(1500*time.Millisecond, "backend is down"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "2", w.Header().Get(HeaderRetryAfter))
+
+	var body map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, true, body["retryable"])
+	assert.Equal(t, 1.5, body["retry_after"])
+	assert.Contains(t, body["error"], http.StatusText(http.StatusServiceUnavailable))
+
+	// without a known duration, clients are told they may retry, but not when
+	w = handle(JSONRenderer{}, RetryableError(0, "backend is down"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Empty(t, w.Header().Get(HeaderRetryAfter))
+	body = nil
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, true, body["retryable"])
+	assert.NotContains(t, body, "retry_after")
+
+	// other renderers get the header as well
+	w = handle(XMLRenderer{}, BackOffError(3*time.Second))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "3", w.Header().Get(HeaderRetryAfter))
+
+	// errors that are not retryable are rendered as before
+	w = handle(JSONRenderer{}, ResourceUnavailableError("go away"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Empty(t, w.Header().Get(HeaderRetryAfter))
+	assert.False(t, IsRetryable(ResourceUnavailableError("go away")))
+	assert.False(t, IsRetryable(errors.New("foo")))
+
+	// wrapped errors keep their cause
+	cause := errors.New("connection refused")
+	err := WrapRetryable(cause, time.Second)
+	assert.True(t, IsRetryable(err))
+	assert.True(t, errors.Is(err, cause))
+	code, _ := httpError(err)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestErrorFromResponse(t *testing.T) {
+
+	// renders an error like an upstream API would, and reconstructs it from the response
+	roundTrip := func(renderer Renderer, err error) error {
+		hr, _ := http.NewRequest("GET", "/foo", nil)
+		w := httptest.NewRecorder()
+		assert.NoError(t, render(renderer, nil, err, w, NewRequest(hr)))
+		return ErrorFromResponse(w.Result())
+	}
+
+	for _, renderer := range []Renderer{JSONRenderer{}, JSONRenderer{Envelope: true}, MsgpackRenderer{}, XMLRenderer{}} {
+		for _, orig := range []error{
+			NotFoundError("no such user"),
+			InvalidParamError("bad foo"),
+			ConflictError("already exists"),
+			UnauthorizedError("who are you"),
+			TooManyRequestsError("slow down"),
+			RetryableError(2*time.Second, "backend is down"),
+			errors.New("boom"),
+		} {
+			err := roundTrip(renderer, orig)
+			if !assert.Error(t, err) {
+				continue
+			}
+
+			expected, _ := httpError(orig)
+			code, _ := httpError(err)
+			assert.Equal(t, expected, code, "%T: %s", renderer, orig)
+			assert.Equal(t, IsRetryable(orig), IsRetryable(err), "%T: %s", renderer, orig)
+		}
+	}
+
+	// the envelope keeps the exact error code
+	err := roundTrip(JSONRenderer{Envelope: true}, InvalidParamError("bad foo"))
+	if e, ok := err.(*internalError); assert.True(t, ok) {
+		assert.Equal(t, ErrInvalidParam, e.Code)
+		assert.Equal(t, "bad foo", e.Message)
+	}
+
+	err = roundTrip(JSONRenderer{}, NotFoundError("no such user"))
+	assert.EqualError(t, err, "no such user")
+
+	err = roundTrip(JSONRenderer{}, RetryableError(2*time.Second, "backend is down"))
+	after, ok := retryAfter(err)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Second, after)
+
+	verr := &ValidationError{Errors: []FieldError{{Param: "foo", Message: "missing"}}}
+	for _, renderer := range []Renderer{JSONRenderer{}, JSONRenderer{Envelope: true}, MsgpackRenderer{}} {
+		err = roundTrip(renderer, verr)
+		assert.Equal(t, verr, err, "%T", renderer)
+	}
+
+	// responses that are not vertex errors
+	res := &http.Response{
+		StatusCode: http.StatusBadGateway,
+		Status:     "502 Bad Gateway",
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       ioutil.NopCloser(strings.NewReader("<html>bad gateway</html>")),
+	}
+	err = ErrorFromResponse(res)
+	assert.EqualError(t, err, "<html>bad gateway</html>")
+	code, _ := httpError(err)
+	assert.Equal(t, http.StatusInternalServerError, code)
+	b, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, "<html>bad gateway</html>", string(b))
+
+	assert.NoError(t, ErrorFromResponse(&http.Response{StatusCode: http.StatusOK}))
+	assert.NoError(t, ErrorFromResponse(nil))
+}
+
+type mockCauseError struct {
+	id int
+}
+
+func (e mockCauseError) Error() string {
+	return fmt.Sprintf("no such id %d", e.id)
+}
+
+func TestWrapError(t *testing.T) {
+
+	errNoRows := errors.New("no rows")
+
+	err := WrapError(errNoRows, ErrNotFound, "No user %d", 5)
+	assert.Equal(t, "No user 5", err.Error())
+	assert.True(t, errors.Is(err, errNoRows))
+	assert.Equal(t, errNoRows, errors.Unwrap(err))
+
+	// the cause is logged, but not sent to the client
+	logged := &mockLogger{}
+	SetLogger(logged)
+	defer SetLogger(nil)
+
+	code, msg := httpError(err)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "No user 5", msg)
+	assert.Contains(t, strings.Join(logged.lines, "\n"), "] Caused by: no rows")
+
+	// wrapping a wrapped error keeps the whole chain
+	err = WrapError(fmt.Errorf("loading user: %w", mockCauseError{5}), ErrGeneralFailure, "Could not load user")
+	var cause mockCauseError
+	if assert.True(t, errors.As(err, &cause)) {
+		assert.Equal(t, 5, cause.id)
+	}
+
+	// the cause is not exposed to clients of internal errors
+	code, msg = httpError(err)
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.NotContains(t, msg, "no such id")
+
+	// errors wrapped by NewError keep their cause too
+	assert.True(t, errors.Is(NewError(errNoRows), errNoRows))
+	assert.Nil(t, errors.Unwrap(NewErrorf("wat")))
+}
+
+func TestErrorStacks(t *testing.T) {
+
+	render := func(err error) *httptest.ResponseRecorder {
+		hr, _ := http.NewRequest("GET", "http://foo.bar", nil)
+		w := httptest.NewRecorder()
+		assert.NoError(t, JSONRenderer{}.Render(nil, err, w, NewRequest(hr)))
+		return w
+	}
+
+	// stacks are not captured or rendered by default
+	err := NewErrorf("wat")
+	assert.Empty(t, errorStack(err))
+	w := render(err)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NotContains(t, w.Body.String(), "debug")
+
+	defer func(debug bool) {
+		Config.Server.Debug = debug
+	}(Config.Server.Debug)
+	Config.Server.Debug = true
+
+	for _, err := range []error{NewErrorf("wat"), NewError(errors.New("wat")), InvalidParamError("wat")} {
+		assert.Contains(t, errorStack(err), "TestErrorStacks")
+	}
+
+	w = render(InvalidParamError("bad foo"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var resp struct {
+		Error string
+		Debug struct {
+			Stack string
+		}
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "bad foo", resp.Error)
+	assert.Contains(t, resp.Debug.Stack, "TestErrorStacks")
+}
+
+func TestServer(t *testing.T) {
+	//t.SkipNow()
+	s := NewServer(":9934")
+
+	s.AddAPI(mockAPI)
+
+	go func() {
+		if err := s.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	s.Stop()
+
+}
+
+func TestUnixSocketServer(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vertex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "api.sock")
+
+	// a socket file left by a server that did not stop cleanly
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	s := NewServer(UnixAddrPrefix + sock)
+	assert.NoError(t, s.AddAPI(&API{
+		Root:          "/unix",
+		Name:          "unix",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/foo", Handler: VoidHandler{}, Methods: GET},
+		},
+	}))
+
+	ran := make(chan error, 1)
+	go func() {
+		ran <- s.Run()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+
+	res, err := client.Get("http://vertex/unix/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	s.Stop()
+	assert.NoError(t, <-ran)
+
+	_, err = os.Stat(sock)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestServerShutdown(t *testing.T) {
+
+	started := make(chan struct{})
+	api := &API{
+		Root:          "/shutdown",
+		Name:          "shutdown",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path:        "/slow",
+				Description: "slow",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					close(started)
+					time.Sleep(200 * time.Millisecond)
+					return "done", nil
+				}),
+				Methods: GET,
+			},
+		},
+	}
+
+	s := NewServer("127.0.0.1:9936")
+	s.AddAPI(api)
+
+	assert.Error(t, s.Shutdown(context.Background()))
+
+	ran := make(chan error, 1)
+	go func() {
+		ran <- s.Run()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		res, err := http.Get("http://127.0.0.1:9936/shutdown/slow")
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		responses <- result{string(b), err}
+	}()
+
+	<-started
+	assert.NoError(t, s.Shutdown(context.Background()))
+	assert.NoError(t, <-ran)
+
+	// the request in flight was completed before shutting down
+	res := <-responses
+	assert.NoError(t, res.err)
+	assert.Equal(t, `"done"`, res.body)
+
+	_, err := http.Get("http://127.0.0.1:9936/shutdown/slow")
+	assert.Error(t, err)
+}
+
+func TestRequestCancellation(t *testing.T) {
+
+	// nothing is written for requests whose client is gone
+	ctx, cancel := context.WithCancel(context.Background())
+	hr, _ := http.NewRequest("GET", "/foo", nil)
+	req := NewRequest(hr.WithContext(ctx))
+	cancel()
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, render(JSONRenderer{}, "foo", nil, w, req))
+	assert.Equal(t, 0, w.Body.Len())
+	assert.Empty(t, w.Header().Get(HeaderProcessingTime))
+
+	// requests still in flight when the shutdown deadline passes are cancelled
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	api := &API{
+		Root:          "/cancel",
+		Name:          "cancel",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path:        "/wait",
+				Description: "wait",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					close(started)
+					select {
+					case <-r.Context().Done():
+						cancelled <- r.Context().Err()
+					case <-time.After(2 * time.Second):
+						cancelled <- nil
+					}
+					return "done", nil
+				}),
+				Methods: GET,
+			},
+		},
+	}
+
+	s := NewServer("127.0.0.1:9961")
+	s.AddAPI(api)
+
+	ran := make(chan error, 1)
+	go func() {
+		ran <- s.Run()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	go func() {
+		if res, err := http.Get("http://127.0.0.1:9961/cancel/wait"); err == nil {
+			res.Body.Close()
+		}
+	}()
+
+	<-started
+	sctx, scancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer scancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(sctx))
+	assert.Equal(t, context.Canceled, <-cancelled)
+	assert.NoError(t, <-ran)
+}
+
+// writeTestCert writes a self signed certificate and key for 127.0.0.1 to dir
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"vertex"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestServerTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vertex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	// an API that does not allow insecure access
+	api := &API{
+		Root:     "/tlstest",
+		Name:     "tlstest",
+		Renderer: JSONRenderer{},
+		Routes: Routes{
+			{
+				Path:        "/secure",
+				Description: "secure",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					return r.Secure, nil
+				}),
+				Methods: GET,
+			},
+		},
+	}
+
+	s := NewServer("127.0.0.1:9937")
+	s.AddAPI(api)
+
+	assert.Error(t, s.RunTLS("", keyFile))
+
+	go func() {
+		if err := s.RunTLS(certFile, keyFile); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	defer s.Stop()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	res, err := client.Get("https://127.0.0.1:9937/tlstest/secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "true", string(b))
+}
+
+func TestConfigureHTTPServer(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vertex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, err := tls.LoadX509KeyPair(writeTestCert(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer("127.0.0.1:9975")
+	s.AddAPI(&API{
+		Root:          "/custom",
+		Name:          "custom",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/foo", Handler: VoidHandler{}, Methods: GET},
+		},
+	})
+
+	conns := make(chan http.ConnState, 10)
+	s.ConfigureHTTPServer(func(srv *http.Server) {
+		assert.Equal(t, s, srv.Handler)
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		srv.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns <- state
+			}
+		}
+	})
+	assert.Nil(t, s.HTTPServer())
+
+	go func() {
+		if err := s.Run(); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	defer s.Stop()
+
+	assert.NotNil(t, s.HTTPServer())
+
+	// the server is served over HTTPS with the certificate of its TLS config
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	res, err := client.Get("https://127.0.0.1:9975/custom/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, http.StateNew, <-conns)
+}
+
+func TestRouteTags(t *testing.T) {
+
+	defer func(conf serverConfig) {
+		Config.Server = conf
+	}(Config.Server)
+
+	newAPI := func() *API {
+		return &API{
+			Root:          "/tagged",
+			Name:          "tagged",
+			Renderer:      JSONRenderer{},
+			AllowInsecure: true,
+			Routes: Routes{
+				{Path: "/plain", Handler: VoidHandler{}, Methods: GET},
+				{Path: "/debug", Handler: VoidHandler{}, Methods: GET, Tags: []string{"debug"}},
+				{Path: "/beta", Handler: VoidHandler{}, Methods: GET, Tags: []string{"beta"}},
+				{Path: "/internal", Handler: VoidHandler{}, Methods: GET, Tags: []string{"beta", "debug"}},
+			},
+		}
+	}
+
+	registered := func(include, exclude string) []string {
+		Config.Server.IncludeTags, Config.Server.ExcludeTags = include, exclude
+
+		srv := NewServerWithRegistry(":9976", NewRegistry())
+		srv.AddAPIBuilder("tagged", newAPI, nil)
+		assert.NoError(t, srv.InitAPIs())
+
+		var ret []string
+		for _, pth := range []string{"/plain", "/debug", "/beta", "/internal"} {
+			w := httptest.NewRecorder()
+			hr, _ := http.NewRequest("GET", "/tagged"+pth, nil)
+			srv.ServeHTTP(w, hr)
+			if w.Code == http.StatusOK {
+				ret = append(ret, pth)
+			}
+		}
+		return ret
+	}
+
+	assert.Equal(t, []string{"/plain", "/debug", "/beta", "/internal"}, registered("", ""))
+	assert.Equal(t, []string{"/plain", "/beta"}, registered("", "debug"))
+	assert.Equal(t, []string{"/plain", "/debug", "/internal"}, registered("debug", ""))
+	assert.Equal(t, []string{"/plain", "/beta"}, registered(" debug, beta ", "debug"))
+
+	// servers created after the configs are reloaded register their routes by the reloaded tags
+	defer reloadedConfigs.Store((*configs)(nil))
+	conf := currentConfigs().clone()
+	conf.Server.ExcludeTags = "beta"
+	reloadedConfigs.Store(conf)
+	assert.Equal(t, []string{"/plain", "/debug"}, registered("", ""))
+
+	assert.True(t, Config.Server.routeEnabled(nil))
+}
+
+func TestServerTimeouts(t *testing.T) {
+
+	defer func(conf serverConfig) {
+		Config.Server = conf
+	}(Config.Server)
+
+	s := NewServer(":9938")
+
+	Config.Server.ClientTimeout = 30
+	srv := s.newHTTPServer()
+	assert.Equal(t, 30*time.Second, srv.ReadTimeout)
+	assert.Equal(t, 30*time.Second, srv.WriteTimeout)
+	assert.Equal(t, 30*time.Second, srv.IdleTimeout)
+
+	Config.Server.ReadTimeout = 5
+	Config.Server.WriteTimeout = 10
+	Config.Server.IdleTimeout = 120
+	srv = s.newHTTPServer()
+	assert.Equal(t, 5*time.Second, srv.ReadTimeout)
+	assert.Equal(t, 10*time.Second, srv.WriteTimeout)
+	assert.Equal(t, 120*time.Second, srv.IdleTimeout)
+}
+
+func TestDescribe(t *testing.T) {
+
+	a := &API{
+		Name:          "describe",
+		Title:         "Describe API",
+		Version:       "1.0",
+		Doc:           "Describing APIs",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path:        "/mock",
+				Description: "A mock handler",
+				Handler:     MockHandler{},
+				Methods:     GET | POST,
+			},
+			{
+				Path:    "/users/{id}/{name}",
+				Handler: MockPathHandler{},
+				Methods: GET,
+			},
+		},
+	}
+
+	srv := NewServer(":9939")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	// the description is not served unless it is exposed
+	res, err := http.Get(s.URL + DescribePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	srv.ExposeDescribe()
+	res, err = http.Get(s.URL + DescribePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var desc []APIDescription
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&desc))
+	assert.Equal(t, srv.Describe(), desc)
+
+	if assert.Len(t, desc, 1) {
+		d := desc[0]
+		assert.Equal(t, "describe", d.Name)
+		assert.Equal(t, "/describe/1.0", d.Root)
+		assert.Equal(t, "1.0", d.Version)
+
+		if assert.Len(t, d.Routes, 2) {
+			assert.Equal(t, []string{"GET", "POST"}, d.Routes[0].Methods)
+			assert.Equal(t, "A mock handler", d.Routes[0].Description)
+			assert.Equal(t, ParamDescription{Name: "foo", In: "query", Type: "string", Required: true}, d.Routes[0].Params[0])
+
+			assert.Equal(t, ParamDescription{Name: "id", In: "path", Type: "integer", Required: true}, d.Routes[1].Params[0])
+		}
+	}
+}
+
+func TestRouteSchema(t *testing.T) {
+
+	route := Route{Path: "/users/{id}/{name}", Handler: MockPathHandler{}, Methods: GET}
+	rs, err := route.Schema()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"GET"}, rs.Methods)
+	assert.Equal(t, ParamDescription{Name: "id", In: "path", Type: "integer", Required: true}, rs.Params[0])
+
+	_, err = Route{Path: "/nothing"}.Schema()
+	assert.Error(t, err)
+
+	a := &API{
+		Name:          "schemas",
+		Root:          "/schemas",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/mock", Handler: MockHandler{}, Methods: GET | POST},
+			route,
+		},
+	}
+
+	srv := NewServer(":9972")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	// the schemas are not served unless they are exposed
+	res, err := http.Get(s.URL + SchemaPath + "/schemas/mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	srv.ExposeDescribe()
+	res, err = http.Get(s.URL + SchemaPath + "/schemas/mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var schemas []RouteSchema
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&schemas))
+	if assert.Len(t, schemas, 1) {
+		assert.Equal(t, "schemas", schemas[0].API)
+		assert.Equal(t, "/mock", schemas[0].Path)
+		assert.Equal(t, ParamDescription{Name: "foo", In: "query", Type: "string", Required: true}, schemas[0].Params[0])
+	}
+
+	assert.Len(t, srv.RouteSchemas("/schemas/users/{id}/{name}"), 1)
+
+	res, err = http.Get(s.URL + SchemaPath + "/schemas/nothing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// APIs can be rooted at /schema when the schemas are not exposed
+	sa := &API{Root: "/schema", Renderer: JSONRenderer{}, AllowInsecure: true, Routes: Routes{route}}
+	assert.NoError(t, NewServer(":9981").AddAPI(sa))
+}
+
+type MockHandlerV struct {
+	Int    int      `schema:"int" required:"true" doc:"integer field" min:"-100" max:"100" default:"4"`
+	Float  float64  `schema:"float" required:"true" doc:"float field" min:"-100" max:"100" default:"3.141"`
+	Bool   bool     `schema:"bool" required:"false" doc:"bool field" default:"true"`
+	String string   `schema:"string" required:"false" doc:"string field" default:"WAT WAT" minlen:"1" maxlen:"4" pattern:"^[a-zA-Z]+$"`
+	Lst    []string `schema:"list" required:"false" doc:"string list field" default:"  foo, bar, baz    "`
+}
+
+func TestValidation(t *testing.T) {
+	//t.SkipNow()
+	req, err := http.NewRequest("GET", "http://example.com/foo?int=4&float=1.4&string=word&bool=true&list=foo&list=bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := req.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := MockHandlerV{
+		Int:    4,
+		Float:  3.14,
+		Bool:   true,
+		Lst:    []string{"foo", "bar"},
+		String: "word",
+	}
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockHandlerV{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	v := NewRequestValidator(ri)
+	if v == nil {
+		t.Fatal("nil request validator")
+	}
+
+	if err = v.Validate(h, req); err != nil {
+		t.Errorf("Failed validation: %s", err)
+	}
+
+	// fail on missing param
+	badreq, _ := http.NewRequest("GET", "http://example.com/foo?float=1.4&string=word&bool=true&list=foo&list=bar", nil)
+	badreq.ParseForm()
+	if err = v.Validate(h, badreq); err == nil {
+		t.Errorf("We didn't fail on missing int from request: %s", err)
+	}
+
+	// fail on bad string value
+	h.String = " wat" // spaces not allowed
+	if err = v.Validate(h, req); err == nil || err.Error() != "field 'string' does not match required pattern" {
+		t.Errorf("We didn't fail on regex: %s", err)
+	}
+
+	h.String = "watwatwat" // spaces not allowed
+	if err = v.Validate(h, req); err == nil || err.Error() != "string is too long (max length 4)" {
+		t.Errorf("We didn't fail on maxlen: %s", err)
+	}
+
+	h.String = ""
+	if err = v.Validate(h, req); err == nil || err.Error() != "string is too short (min length 1)" {
+		t.Errorf("We didn't fail on minlen: %s", err)
+	}
+	h.String = "wat"
+
+	// Fail on bad int value
+	h.Int = -1000
+	if err = v.Validate(h, req); err == nil || err.Error() != "Value too small for int" {
+		t.Errorf("We didn't fail on min: %s", err)
+	}
+
+	h.Int = 1000
+	if err = v.Validate(h, req); err == nil || err.Error() != "Value too large for int" {
+		t.Errorf("We didn't fail on max: %s", err)
+	}
+
+	h.Int = 5
+
+	// Fail on bad float value
+	h.Float = -1000
+	if err = v.Validate(h, req); err == nil || err.Error() != "Value too small for float" {
+		t.Errorf("We didn't fail on min: %s", err)
+	}
+
+	h.Float = 1000
+	if err = v.Validate(h, req); err == nil || err.Error() != "Value too large for float" {
+		t.Errorf("We didn't fail on max: %s", err)
+	}
+}
+
+type MockHandlerRange struct {
+	Age   int     `schema:"age" min:"0" max:"120"`
+	Count uint8   `schema:"count" required:"true" min:"1" max:"10"`
+	Ratio float32 `schema:"ratio" min:"1"`
+}
+
+func TestRangeValidation(t *testing.T) {
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockHandlerRange{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	check := func(query string, h MockHandlerRange) error {
+		req, _ := http.NewRequest("GET", "http://example.com/foo?"+query, nil)
+		req.ParseForm()
+		return v.Validate(h, req)
+	}
+
+	assert.NoError(t, check("age=30&count=5", MockHandlerRange{Age: 30, Count: 5}))
+
+	// missing optional fields are not range checked, even though their zero value is out of range
+	assert.NoError(t, check("count=5", MockHandlerRange{Count: 5}))
+
+	err = check("age=130&count=5", MockHandlerRange{Age: 130, Count: 5})
+	assert.EqualError(t, err, "Value too large for age")
+
+	err = check("age=-1&count=5", MockHandlerRange{Age: -1, Count: 5})
+	assert.EqualError(t, err, "Value too small for age")
+
+	err = check("count=0", MockHandlerRange{Count: 0})
+	assert.EqualError(t, err, "Value too small for count")
+	code, _ := httpError(err)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	err = check("count=4&ratio=0.5", MockHandlerRange{Count: 4, Ratio: 0.5})
+	assert.EqualError(t, err, "Value too small for ratio")
+
+	// required fields are checked for presence before the range
+	err = check("age=4", MockHandlerRange{Age: 4})
+	assert.EqualError(t, err, "missing required param 'count'")
+}
+
+func TestPatternValidation(t *testing.T) {
+
+	type skuHandler struct {
+		Sku  string `schema:"sku" required:"true" pattern:"^[A-Z0-9]{6}$"`
+		Code string `schema:"code" pattern:"^[a-z]+$"`
+	}
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(skuHandler{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	check := func(query string, h skuHandler) error {
+		req, _ := http.NewRequest("GET", "http://example.com/foo?"+query, nil)
+		req.ParseForm()
+		return v.Validate(h, req)
+	}
+
+	assert.NoError(t, check("sku=AB12CD&code=abc", skuHandler{Sku: "AB12CD", Code: "abc"}))
+	assert.EqualError(t, check("sku=ab12cd", skuHandler{Sku: "ab12cd"}), "field 'sku' does not match required pattern")
+
+	// an optional param that was not sent is not matched
+	assert.NoError(t, check("sku=AB12CD", skuHandler{Sku: "AB12CD"}))
+	assert.EqualError(t, check("sku=AB12CD&code=", skuHandler{Sku: "AB12CD"}), "field 'code' does not match required pattern")
+
+	// invalid patterns fail when the validator is built
+	type badHandler struct {
+		Foo string `schema:"foo" pattern:"^[A-Z"`
+	}
+	ri, err = schema.NewRequestInfo(reflect.TypeOf(badHandler{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Panics(t, func() { NewRequestValidator(ri) })
+}
+
+type MockHandlerDefaults struct {
+	Limit  int     `schema:"limit" default:"20"`
+	Page   uint    `schema:"page" default:"1"`
+	Sort   string  `schema:"sort" default:"asc"`
+	Active bool    `schema:"active" default:"true"`
+	Ratio  float32 `schema:"ratio" default:"0.5"`
+}
+
+func TestDefaults(t *testing.T) {
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockHandlerDefaults{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	bind := func(query string) *MockHandlerDefaults {
+		req, _ := http.NewRequest("GET", "http://example.com/foo?"+query, nil)
+		h := &MockHandlerDefaults{}
+		if err := parseInput(req, h, v); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	assert.Equal(t, &MockHandlerDefaults{Limit: 20, Page: 1, Sort: "asc", Active: true, Ratio: 0.5}, bind(""))
+	assert.Equal(t, &MockHandlerDefaults{Limit: 5, Page: 3, Sort: "desc", Active: false, Ratio: 0.25},
+		bind("limit=5&page=3&sort=desc&active=false&ratio=0.25"))
+
+	// params that were sent empty do not get the default value
+	h := bind("sort=&limit=")
+	assert.Equal(t, "", h.Sort)
+	assert.Equal(t, 0, h.Limit)
+	assert.Equal(t, uint(1), h.Page)
+}
+
+func TestOptionsValidation(t *testing.T) {
+
+	type statusHandler struct {
+		Status string `schema:"status" required:"true" in:"open,closed,pending"`
+		Level  int    `schema:"level" in:"1, 2, 3"`
+		Id     string `schema:"id" in:"path"`
+	}
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(statusHandler{}), "/foo/{id}", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"open", "closed", "pending"}, ri.Params[0].Options)
+	assert.Equal(t, "query", ri.Params[0].In)
+	assert.Equal(t, "path", ri.Params[2].In)
+	assert.Nil(t, ri.Params[2].Options)
+
+	v := NewRequestValidator(ri)
+
+	check := func(query string, h statusHandler) error {
+		req, _ := http.NewRequest("GET", "http://example.com/foo?id=bar&"+query, nil)
+		req.ParseForm()
+		return v.Validate(h, req)
+	}
+
+	assert.NoError(t, check("status=open&level=2", statusHandler{Status: "open", Level: 2}))
+	assert.NoError(t, check("status=closed", statusHandler{Status: "closed"}))
+
+	err = check("status=wat", statusHandler{Status: "wat"})
+	assert.EqualError(t, err, "Invalid value for status, allowed values: open, closed, pending")
+	code, _ := httpError(err)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	err = check("status=open&level=4", statusHandler{Status: "open", Level: 4})
+	assert.EqualError(t, err, "Invalid value for level, allowed values: 1, 2, 3")
+}
+
+type MockHandlerJSON struct {
+	Int    int      `schema:"int" required:"true"`
+	Float  float64  `schema:"float" required:"true"`
+	Bool   bool     `schema:"bool" default:"true"`
+	String string   `schema:"string" default:"wat"`
+	Lst    []string `schema:"list"`
+}
+
+func TestJSONBody(t *testing.T) {
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockHandlerJSON{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	bind := func(method, contentType, body string) (*MockHandlerJSON, error) {
+		req, _ := http.NewRequest(method, "http://example.com/foo?int=3", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		h := &MockHandlerJSON{}
+		return h, parseInput(req, h, v)
+	}
+
+	h, err := bind("POST", "application/json; charset=utf-8", `{"int": 5, "float": 1.5, "bool": false, "string": "word", "list": ["a", "b"]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, &MockHandlerJSON{Int: 5, Float: 1.5, Bool: false, String: "word", Lst: []string{"a", "b"}}, h)
+
+	h, err = bind("PUT", "application/json", `{"float": 2}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, h.Int, "query params should be used when missing from the body")
+	assert.Equal(t, "wat", h.String)
+
+	// required fields missing from the body and the query fail
+	_, err = bind("POST", "application/json", `{"int": 5, "float": null}`)
+	assert.EqualError(t, err, "missing required param 'float'")
+
+	_, err = bind("POST", "application/json", `{"int": 5,`)
+	if assert.Error(t, err) {
+		code, msg := httpError(err)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.True(t, strings.HasPrefix(msg, "Error decoding JSON body"), msg)
+	}
+
+	// non JSON bodies are not decoded as JSON
+	h, err = bind("POST", "application/x-www-form-urlencoded", "float=4.5")
+	assert.NoError(t, err)
+	assert.Equal(t, 4.5, h.Float)
+}
+
+func TestBodyDecoders(t *testing.T) {
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockHandlerJSON{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	bind := func(contentType string, body []byte) (*MockHandlerJSON, error) {
+		req, _ := http.NewRequest("POST", "http://example.com/foo?int=3", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		h := &MockHandlerJSON{}
+		return h, parseInput(req, h, v)
+	}
+
+	// MessagePack bodies bind like JSON bodies
+	body, _ := msgpack.Marshal(map[string]interface{}{"int": 5, "float": 1.5, "list": []string{"a", "b"}})
+	h, err := bind("application/x-msgpack", body)
+	assert.NoError(t, err)
+	assert.Equal(t, &MockHandlerJSON{Int: 5, Float: 1.5, Bool: true, String: "wat", Lst: []string{"a", "b"}}, h)
+
+	_, err = bind("application/msgpack", []byte{0xc1})
+	if assert.Error(t, err) {
+		code, _ := httpError(err)
+		assert.Equal(t, http.StatusBadRequest, code)
+	}
+
+	// unregistered content types are not decoded
+	_, err = bind("text/x-lines", []byte("int=5\nfloat=2.5"))
+	assert.EqualError(t, err, "missing required param 'float'")
+
+	RegisterBodyDecoder("text/x-lines", BodyDecoderFunc(func(body []byte) (map[string][]string, error) {
+		ret := map[string][]string{}
+		for _, line := range strings.Split(string(body), "\n") {
+			if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+				ret[kv[0]] = append(ret[kv[0]], kv[1])
+			}
+		}
+		return ret, nil
+	}))
+	defer func() {
+		bodyDecodersLock.Lock()
+		delete(bodyDecoders, "text/x-lines")
+		bodyDecodersLock.Unlock()
+	}()
+
+	h, err = bind("text/x-lines; charset=utf-8", []byte("int=5\nfloat=2.5\nlist=x\nlist=y"))
+	assert.NoError(t, err)
+	assert.Equal(t, &MockHandlerJSON{Int: 5, Float: 2.5, Bool: true, String: "wat", Lst: []string{"x", "y"}}, h)
+}
+
+func TestConsumes(t *testing.T) {
+
+	a := &API{
+		Root:          "/consumes",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/json", Handler: VoidHandler{}, Methods: GET | POST, Consumes: []string{"application/json"}},
+			{Path: "/text", Handler: VoidHandler{}, Methods: PUT, Consumes: []string{"text/*"}},
+			{Path: "/any", Handler: VoidHandler{}, Methods: POST},
+		},
+	}
+
+	s := httptest.NewServer(a.configure(nil))
+	defer s.Close()
+
+	do := func(method, pth, contentType, body string) int {
+		req, _ := http.NewRequest(method, s.URL+a.FullPath(pth), strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, do("POST", "/json", "application/json; charset=utf-8", `{"float": 1.5}`))
+	assert.Equal(t, http.StatusUnsupportedMediaType, do("POST", "/json", "application/x-www-form-urlencoded", "float=1.5"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, do("POST", "/json", "", "float=1.5"))
+
+	// requests without a body, and methods without bodies, are not checked
+	assert.Equal(t, http.StatusOK, do("POST", "/json?float=1", "", ""))
+	assert.Equal(t, http.StatusOK, do("GET", "/json?float=1", "text/plain", ""))
+
+	assert.Equal(t, http.StatusOK, do("PUT", "/text", "text/csv", "a,b"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, do("PUT", "/text", "image/png", "png"))
+	assert.Equal(t, http.StatusOK, do("POST", "/any", "image/png", "png"))
+
+	assert.Equal(t, []string{"application/x-www-form-urlencoded", "multipart/form-data", "application/json",
+		"application/msgpack", "application/x-msgpack"}, DecodableContentTypes())
+	assert.True(t, decodable("Application/JSON"))
+	assert.False(t, decodable("text/csv"))
+}
+
+type MockPathHandler struct {
+	Id   int    `path:"id"`
+	Name string `path:"name"`
+}
+
+func (h MockPathHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return map[string]interface{}{"id": h.Id, "name": h.Name}, nil
+}
+
+func TestPathParams(t *testing.T) {
+
+	a := &API{
+		Root:          "/pathtest",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path:    "/users/{id}/{name}",
+				Handler: MockPathHandler{},
+				Methods: GET | POST,
+			},
+		},
+	}
+
+	srv := NewServer(":9947")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	pi := a.Routes[0].requestInfo.Params[0]
+	assert.Equal(t, "path", pi.In)
+	assert.True(t, pi.Required)
+
+	get := func(pth string) (*http.Response, map[string]interface{}) {
+		res, err := http.Get(s.URL + a.FullPath(pth))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		m := map[string]interface{}{}
+		if res.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&m))
+		}
+		return res, m
+	}
+
+	res, m := get("/users/12/foo")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, map[string]interface{}{"id": float64(12), "name": "foo"}, m)
+
+	// the struct field name cannot be used to override the path param
+	res, m = get("/users/12/foo?Name=bar")
+	assert.Equal(t, "foo", m["name"])
+
+	res, _ = get("/users/abc/foo")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// nor can the body
+	res, err := http.Post(s.URL+a.FullPath("/users/12/foo?id=7"), "application/json",
+		strings.NewReader(`{"id": "99", "name": "bar"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&m))
+	res.Body.Close()
+	assert.Equal(t, map[string]interface{}{"id": float64(12), "name": "foo"}, m)
+}
+
+type MockHeaderHandler struct {
+	Source string   `header:"X-Request-Source" required:"true"`
+	Accept []string `header:"accept"`
+	Limit  int      `header:"X-Limit" default:"10"`
+}
+
+func TestHeaderParams(t *testing.T) {
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockHeaderHandler{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	bind := func(headers http.Header) (*MockHeaderHandler, error) {
+		req, _ := http.NewRequest("GET", "http://example.com/foo?Source=query", nil)
+		for k, vals := range headers {
+			req.Header[k] = vals
+		}
+		h := &MockHeaderHandler{}
+		return h, parseInput(req, h, v)
+	}
+
+	h, err := bind(http.Header{"X-Request-Source": {"mobile"}, "Accept": {"text/json", "text/xml"}, "X-Limit": {"3"}})
+	assert.NoError(t, err)
+	assert.Equal(t, &MockHeaderHandler{Source: "mobile", Accept: []string{"text/json", "text/xml"}, Limit: 3}, h)
+
+	h, err = bind(http.Header{"X-Request-Source": {"web"}})
+	assert.NoError(t, err)
+	assert.Equal(t, &MockHeaderHandler{Source: "web", Limit: 10}, h)
+
+	// missing required headers are not taken from the query
+	_, err = bind(http.Header{})
+	assert.EqualError(t, err, "missing required param 'X-Request-Source'")
+
+	_, err = bind(http.Header{"X-Request-Source": {"web"}, "X-Limit": {"lots"}})
+	assert.EqualError(t, err, "Invalid value for X-Limit")
+}
+
+type MockSliceHandler struct {
+	Tags   []string  `schema:"tag"`
+	Ids    []int     `schema:"ids" sep:","`
+	Scores []float64 `schema:"scores" sep:"|"`
+}
+
+func TestSliceParams(t *testing.T) {
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockSliceHandler{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	bind := func(query string) (*MockSliceHandler, error) {
+		req, _ := http.NewRequest("GET", "http://example.com/foo?"+query, nil)
+		h := &MockSliceHandler{}
+		return h, parseInput(req, h, v)
+	}
+
+	h, err := bind("tag=a&tag=b&tag=c&ids=1,2,3&scores=0.5|1.5")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, h.Tags)
+	assert.Equal(t, []int{1, 2, 3}, h.Ids)
+	assert.Equal(t, []float64{0.5, 1.5}, h.Scores)
+
+	// repeated params are split too
+	h, err = bind("ids=1,2&ids=3")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, h.Ids)
+	assert.Nil(t, h.Tags)
+
+	h, err = bind("tag=&ids=")
+	assert.NoError(t, err)
+	assert.NotNil(t, h.Tags)
+	assert.Len(t, h.Tags, 0)
+	assert.NotNil(t, h.Ids)
+	assert.Len(t, h.Ids, 0)
+
+	_, err = bind("ids=1,foo")
+	assert.EqualError(t, err, "Invalid value for ids")
+}
+
+type MockRequiredSliceHandler struct {
+	Tags    []string `schema:"tag" required:"true"`
+	Locales []string `header:"Accept-Language" required:"true"`
+}
+
+func TestRequiredSliceParams(t *testing.T) {
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockRequiredSliceHandler{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	bind := func(query string, headers http.Header) (*MockRequiredSliceHandler, error) {
+		req, _ := http.NewRequest("GET", "http://example.com/foo?"+query, nil)
+		for k, vals := range headers {
+			req.Header[k] = vals
+		}
+		h := &MockRequiredSliceHandler{}
+		return h, parseInput(req, h, v)
+	}
+
+	h, err := bind("tag=a&tag=b", http.Header{"Accept-Language": {"en", "fr"}})
+	assert.NoError(t, err)
+	assert.Equal(t, &MockRequiredSliceHandler{Tags: []string{"a", "b"}, Locales: []string{"en", "fr"}}, h)
+
+	_, err = bind("", http.Header{"Accept-Language": {"en"}})
+	assert.EqualError(t, err, "missing required param 'tag'")
+
+	_, err = bind("tag=a", http.Header{})
+	assert.EqualError(t, err, "missing required param 'Accept-Language'")
+}
+
+type MockTimeHandler struct {
+	Since time.Time `schema:"since" time_format:"2006-01-02"`
+	Until time.Time `schema:"until"`
+}
+
+func TestTimeParams(t *testing.T) {
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockTimeHandler{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	bind := func(query string) (*MockTimeHandler, error) {
+		req, _ := http.NewRequest("GET", "http://example.com/foo?"+query, nil)
+		h := &MockTimeHandler{}
+		return h, parseInput(req, h, v)
+	}
+
+	h, err := bind("since=2015-06-01&until=2015-06-02T10:00:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC), h.Since)
+	assert.Equal(t, time.Date(2015, 6, 2, 10, 0, 0, 0, time.UTC), h.Until)
+
+	h, err = bind("since=")
+	assert.NoError(t, err)
+	assert.True(t, h.Since.IsZero())
+	assert.True(t, h.Until.IsZero())
+
+	_, err = bind("since=01/06/2015")
+	assert.EqualError(t, err, "Invalid value for since")
+
+	_, err = bind("until=2015-06-02")
+	assert.EqualError(t, err, "Invalid value for until")
+}
+
+type MockConvertHandler struct {
+	Count  int       `schema:"count"`
+	Small  int8      `schema:"small"`
+	Size   uint      `schema:"size"`
+	Ratio  float64   `schema:"ratio"`
+	Flag   bool      `schema:"flag"`
+	Since  time.Time `schema:"since"`
+	Ids    []int     `schema:"ids" sep:","`
+	Scores []float32 `schema:"scores" sep:","`
+	Limit  *int64    `schema:"limit"`
+}
+
+// panickyParam is an Unmarshaler failing in the ways user code may fail
+type panickyParam struct {
+	Value string
+}
+
+func (panickyParam) UnmarshalRequestData(data string) interface{} {
+	switch data {
+	case "panic":
+		panic("boom")
+	case "nil":
+		return nil
+	case "wrong":
+		return data
+	}
+	return panickyParam{data}
+}
+
+func TestMalformedParams(t *testing.T) {
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockConvertHandler{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	bind := func(query string) (*MockConvertHandler, error) {
+		req, _ := http.NewRequest("GET", "http://example.com/foo?"+query, nil)
+		h := &MockConvertHandler{}
+		return h, parseInput(req, h, v)
+	}
+
+	h, err := bind("count=-5&small=127&size=7&ratio=0.25&flag=true&since=2015-06-02T10:00:00Z&ids=1,2&scores=0.5&limit=3")
+	assert.NoError(t, err)
+	assert.Equal(t, -5, h.Count)
+	assert.EqualValues(t, 127, h.Small)
+	assert.Equal(t, []float32{0.5}, h.Scores)
+	assert.EqualValues(t, 3, *h.Limit)
+
+	for _, query := range []string{
+		"count=99999999999999999999999999",
+		"small=128",
+		"size=-1",
+		"ratio=NaN",
+		"ratio=-Inf",
+		"scores=1e39",
+		"scores=0.5,NaN",
+		"ids=1,99999999999999999999",
+		"flag=maybe",
+		"since=yesterday",
+		"limit=9223372036854775808",
+		"count=0x10",
+	} {
+		_, err := bind(query)
+		if assert.Error(t, err, query) {
+			code, _ := httpError(err)
+			assert.Equal(t, http.StatusBadRequest, code, query)
+		}
+	}
+
+	// malformed percent-encoding
+	_, err = bind("count=%zz")
+	code, _ := httpError(err)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	var p panickyParam
+	field := reflect.ValueOf(&p).Elem()
+	assert.NoError(t, convertField(field, []string{"ok"}, ""))
+	assert.Equal(t, "ok", p.Value)
+	for _, data := range []string{"panic", "nil", "wrong"} {
+		assert.Error(t, convertField(field, []string{data}, ""), data)
+	}
+	assert.Equal(t, "ok", p.Value)
+}
+
+func TestMalformedQuery(t *testing.T) {
+
+	a := &API{
+		Root:          "/malformed",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/foo", Handler: &MockConvertHandler{}, Methods: GET | POST},
+		},
+	}
+
+	s := httptest.NewServer(a.configure(nil))
+	defer s.Close()
+
+	res, err := http.Get(s.URL + "/malformed/foo?count=%zz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, err = http.Post(s.URL+"/malformed/foo", "application/x-www-form-urlencoded", strings.NewReader("count=1%"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func (h *MockConvertHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return h, nil
+}
+
+// FuzzParamBinding checks that binding arbitrary query strings never panics, and fails with 400 errors only
+func FuzzParamBinding(f *testing.F) {
+
+	for _, seed := range []string{
+		"count=1&small=2&size=3&ratio=0.5&flag=1&since=2015-06-02T10:00:00Z&ids=1,2&scores=1.5&limit=7",
+		"count=99999999999999999999&small=-129&ratio=Inf&scores=NaN",
+		"count=%zz&ids=%&limit=%%",
+		"ids=,,,&scores=1e400&since=2015-13-45T99:99:99Z",
+		"flag=&count=&limit=",
+		"count.0=1&ids.99999999=1&Count[0]=1",
+		";;&&==",
+	} {
+		f.Add(seed)
+	}
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockConvertHandler{}), "/foo", "bar", nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	f.Fuzz(func(t *testing.T, query string) {
+
+		req := &http.Request{Method: "GET", URL: &url.URL{Path: "/foo", RawQuery: query}, Header: http.Header{}}
+		err := parseInput(req, &MockConvertHandler{}, v)
+
+		switch err.(type) {
+		case nil:
+		case *internalError, *ValidationError:
+			if code, _ := httpError(err); code != http.StatusBadRequest {
+				t.Errorf("Binding %q failed with %d: %s", query, code, err)
+			}
+		default:
+			t.Errorf("Binding %q failed with a non vertex error: %s", query, err)
+		}
+	})
+}
+
+func TestValidationErrors(t *testing.T) {
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockHandlerRange{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	req, _ := http.NewRequest("GET", "http://example.com/foo?age=130&ratio=foo", nil)
+	err = parseInput(req, &MockHandlerRange{}, v)
+
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a validation error, got %#v", err)
+	}
+	assert.Equal(t, []FieldError{
+		{Param: "ratio", Message: "Invalid value for ratio"},
+		{Param: "age", Message: "Value too large for age"},
+		{Param: "count", Message: "missing required param 'count'"},
+	}, verr.Errors)
+	assert.Equal(t, "Invalid value for ratio; Value too large for age; missing required param 'count'", err.Error())
+
+	code, _ := httpError(err)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, err, NewError(err))
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, JSONRenderer{}.Render(nil, err, w, NewRequest(req)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var body struct {
+		Errors []FieldError `json:"errors"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, verr.Errors, body.Errors)
+}
+
+type MockValidatingHandler struct {
+	Start int `schema:"start"`
+	End   int `schema:"end"`
+}
+
+func (h MockValidatingHandler) Validate() error {
+	if h.Start < 0 {
+		return UnauthorizedError("negative start")
+	}
+	if h.Start > h.End {
+		return errors.New("start must be before end")
+	}
+	return nil
+}
+
+func (h MockValidatingHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return h.End - h.Start, nil
+}
+
+func TestValidatingHandler(t *testing.T) {
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockValidatingHandler{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	check := func(query string) error {
+		req, _ := http.NewRequest("GET", "http://example.com/foo?"+query, nil)
+		return parseInput(req, &MockValidatingHandler{}, v)
+	}
+
+	assert.NoError(t, check("start=1&end=2"))
+
+	err = check("start=3&end=2")
+	assert.EqualError(t, err, "start must be before end")
+	code, msg := httpError(err)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "start must be before end", msg)
+
+	err = check("start=-1&end=2")
+	code, _ = httpError(err)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+type MockSensitiveHandler struct {
+	User     string `schema:"user"`
+	Password string `schema:"password" sensitive:"true" minlen:"8"`
+}
+
+func (h MockSensitiveHandler) Validate() error {
+	if h.Password == "hunter222" {
+		return fmt.Errorf("password %s was used before", h.Password)
+	}
+	return nil
+}
+
+func (h MockSensitiveHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return nil, InvalidParamError("wrong password %s for %s", h.Password, h.User)
+}
+
+type MockSensitivePinHandler struct {
+	Pin int `header:"X-Pin" sensitive:"true"`
+}
+
+func (h MockSensitivePinHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error) {
+	return nil, nil
+}
+
+func TestSensitiveParams(t *testing.T) {
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockSensitiveHandler{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+	assert.Equal(t, []string{"password"}, v.sensitive)
+
+	check := func(query string) error {
+		req, _ := http.NewRequest("GET", "http://example.com/foo?"+query, nil)
+		return parseInput(req, &MockSensitiveHandler{}, v)
+	}
+
+	assert.EqualError(t, check("user=foo&password=hunter222"), "password [redacted] was used before")
+	assert.EqualError(t, check("user=foo&password=short"), "password is too short (min length 8)")
+
+	// errors of the handler are masked when they are rendered, and logging middleware can mask the request
+	var logged string
+	a := &API{
+		Root:          "/sensitive",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Middleware: []Middleware{MiddlewareFunc(func(w http.ResponseWriter, r *Request, next HandlerFunc) (interface{}, error) {
+			assert.Equal(t, []string{"password"}, r.SensitiveParams())
+			logged = r.RedactedURL()
+			return next(w, r)
+		})},
+		Routes: Routes{
+			{Path: "/login", Handler: MockSensitiveHandler{}, Methods: GET},
+		},
+	}
+
+	srv := NewServer(":9965")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	res, err := http.Get(s.URL + a.FullPath("/login") + "?user=foo&password=s3cr3tpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, "wrong password [redacted] for foo", strings.TrimSpace(string(b)))
+	assert.Equal(t, "/sensitive/login?password=[redacted]&user=foo", logged)
+
+	// params that cannot be bound are logged without their values
+	logger := &mockLogger{}
+	SetLogger(logger)
+	defer SetLogger(nil)
+	ri, err = schema.NewRequestInfo(reflect.TypeOf(MockSensitivePinHandler{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/foo", nil)
+	req.Header.Set("X-Pin", "12ab34")
+	assert.Error(t, parseInput(req, &MockSensitivePinHandler{}, NewRequestValidator(ri)))
+	assert.Contains(t, strings.Join(logger.lines, "\n"), "Could not bind X-Pin")
+	assert.NotContains(t, strings.Join(logger.lines, "\n"), "12ab34")
+
+	// errors without sensitive values are left as they are
+	cause := errors.New("foo")
+	assert.Equal(t, cause, redactError(cause, []string{"bar"}))
+	assert.Equal(t, "[redacted] or [redacted]", redactString("ab or a", []string{"ab", "a"}))
+}
+
+type MockLengthHandler struct {
+	User string `schema:"user" required:"true" minlen:"3" maxlen:"8"`
+	Nick string `schema:"nick" minlen:"2"`
+}
+
+func TestLengthValidation(t *testing.T) {
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockLengthHandler{}), "/foo", "bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewRequestValidator(ri)
+
+	check := func(query string) error {
+		req, _ := http.NewRequest("GET", "http://example.com/foo?"+query, nil)
+		return parseInput(req, &MockLengthHandler{}, v)
+	}
+
+	assert.NoError(t, check("user=foo"))
+
+	// lengths are counted in runes - 8 characters, 16 bytes
+	assert.NoError(t, check("user="+url.QueryEscape("שלוםשלום")))
+	assert.EqualError(t, check("user="+url.QueryEscape("שלוםשלוםש")), "user is too long (max length 8)")
+
+	assert.EqualError(t, check("user=fo"), "user is too short (min length 3)")
+
+	// an empty value that was sent is still checked
+	assert.EqualError(t, check("user=foo&nick="), "nick is too short (min length 2)")
+
+	err = check("user=foobarbaz")
+	code, _ := httpError(err)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestRequest(t *testing.T) {
+
+	req, err := http.NewRequest("GET", "http://example.com?callback=foo", nil)
+
+	assert.NoError(t, err)
+	req.Header.Set("X-Forwarded-For", "1.1.1.1,2.2.2.2,,,")
+	req.Header.Set("Accept-Language", "en-GB,en;q=0.8,he;q=0.6,da;q=0.4")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set(HeaderGeoPosition, "32.4,31.8")
+	req.Header.Set("User-Agent", "Vertex/test")
+	r := NewRequest(req)
+
+	assert.True(t, r.Secure)
+	assert.Equal(t, "2.2.2.2", r.RemoteIP)
+	assert.Equal(t, "en-GB", r.Locale)
+	assert.Equal(t, "foo", r.Callback)
+	assert.Equal(t, 32.4, r.Location.Lat)
+	assert.Equal(t, 31.8, r.Location.Long)
+	assert.NotEmpty(t, r.UserAgent)
+	assert.NotEmpty(t, r.RequestId)
+
+	// Test attributes
+	r.SetAttribute("Foo", 123)
+	v, found := r.Attribute("Foo")
+	assert.True(t, found)
+	assert.Equal(t, 123, v)
+
+	// Test Secure parsing
+	req.Header.Del("X-Forwarded-Proto")
+	assert.False(t, NewRequest(req).Secure)
+	req.Header.Set("X-Scheme", "https")
+	assert.True(t, NewRequest(req).Secure)
+	req, _ = http.NewRequest("GET", "https://example.com?callback=foo", nil)
+	req.RequestURI = req.URL.String()
+	assert.True(t, NewRequest(req).Secure)
+
+	// default locale if no header set
+	assert.Equal(t, "en-US", NewRequest(req).Locale)
+
+	// try fucked up ips in XFF
+	req.Header.Set("X-Forwarded-For", "1.1.1.1,2.2.2.2,word up")
+	assert.Empty(t, NewRequest(req).RemoteIP)
+	req.Header.Set("X-Real-Ip", "1.1.1.1")
+	assert.Equal(t, "1.1.1.1", NewRequest(req).RemoteIP)
+}
+
+func TestRunCLIClient(t *testing.T) {
+	srv := NewServer(":9947")
+	srv.AddAPI(mockAPI)
+
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	builder := func() *API {
+		return mockAPI
+	}
+
+	Register("testung", builder, nil)
+
+	buf := bytes.NewBuffer(nil)
 	success := RunCLITest("testung", s.URL, AllTests, TestFormatText, buf)
 	if success != true {
 		t.Fail()
@@ -680,3 +4405,384 @@ func TestRunCLIClient(t *testing.T) {
 	}
 
 }
+
+func TestHeadRequests(t *testing.T) {
+
+	calls := 0
+	handler := HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+		calls++
+		w.Header().Set("X-Foo", "bar")
+		return map[string]string{"foo": "bar"}, nil
+	})
+
+	a := &API{
+		Root:          "/head",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/foo", Handler: handler, Methods: GET},
+			{Path: "/nohead", Handler: handler, Methods: GET, NoHead: true},
+			{Path: "/post", Handler: handler, Methods: POST},
+		},
+	}
+
+	srv := NewServer(":9969")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	do := func(method, pth string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, s.URL+a.FullPath(pth), nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	res, body := do("GET", "/foo")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	length := len(body)
+
+	// HEAD runs the GET handler, keeping its headers but not its body
+	res, body = do("HEAD", "/foo")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, "bar", res.Header.Get("X-Foo"))
+	assert.Equal(t, strconv.Itoa(length), res.Header.Get("Content-Length"))
+	assert.NotEmpty(t, res.Header.Get(HeaderProcessingTime))
+	assert.Equal(t, 2, calls)
+
+	res, _ = do("HEAD", "/nohead")
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+	res, _ = do("HEAD", "/post")
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	assert.Equal(t, 2, calls)
+}
+
+func TestOptionsRequests(t *testing.T) {
+
+	a := &API{
+		Root:          "/options",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/foo", Handler: VoidHandler{}, Methods: GET | PUT},
+			{Path: "/bar", Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+				return "custom", nil
+			}), Methods: POST | OPTIONS},
+		},
+	}
+
+	srv := NewServer(":9970")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	options := func(pth string) (*http.Response, string) {
+		req, _ := http.NewRequest("OPTIONS", s.URL+pth, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	// paths without an OPTIONS route get the allowed methods with no content
+	res, body := options(a.FullPath("/foo"))
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.Equal(t, "GET, HEAD, OPTIONS, PUT", res.Header.Get("Allow"))
+	assert.NotEmpty(t, res.Header.Get(HeaderXRequestId))
+	assert.Empty(t, body)
+
+	// routes handling OPTIONS themselves are not answered automatically
+	res, body = options(a.FullPath("/bar"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `"custom"`, body)
+
+	res, _ = options(a.FullPath("/baz"))
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	srv.SetOptionsHandler(HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+		return nil, ForbiddenError("no discovery")
+	}))
+	res, _ = options(a.FullPath("/foo"))
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestURLLengthLimits(t *testing.T) {
+
+	defer func(maxURL, maxValue int) {
+		Config.Server.MaxURLLength, Config.Server.MaxQueryValueLength = maxURL, maxValue
+	}(Config.Server.MaxURLLength, Config.Server.MaxQueryValueLength)
+	Config.Server.MaxURLLength = 100
+	Config.Server.MaxQueryValueLength = 10
+
+	a := &API{
+		Root:          "/limits",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/foo", Handler: VoidHandler{}, Methods: GET},
+		},
+	}
+
+	srv := NewServer(":9971")
+	srv.AddAPI(a)
+	s := httptest.NewServer(srv.Handler())
+	defer s.Close()
+
+	get := func(query string) int {
+		res, err := http.Get(s.URL + a.FullPath("/foo") + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, get("foo=bar&baz=0123456789"))
+	assert.Equal(t, http.StatusBadRequest, get("foo=bar&baz=0123456789a"))
+	assert.Equal(t, http.StatusRequestURITooLong, get(strings.Repeat("a=b&", 30)))
+
+	// zero limits are not checked
+	Config.Server.MaxURLLength, Config.Server.MaxQueryValueLength = 0, 0
+	assert.Equal(t, http.StatusOK, get(strings.Repeat("a=b&", 30)+"baz="+strings.Repeat("x", 100)))
+
+	assert.Equal(t, http.DefaultMaxHeaderBytes, srv.newHTTPServer().MaxHeaderBytes)
+}
+
+type MockUploadHandler struct {
+	Name   string                  `schema:"name" required:"true"`
+	Avatar *multipart.FileHeader   `file:"avatar" required:"true"`
+	Extras []*multipart.FileHeader `file:"extra"`
+}
+
+func (h MockUploadHandler) Handle(w http.ResponseWriter, r *Request) (interface{}, error) {
+
+	f, err := h.Avatar.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, _ := ioutil.ReadAll(f)
+
+	return map[string]interface{}{"name": h.Name, "filename": h.Avatar.Filename, "avatar": string(b),
+		"extras": len(h.Extras)}, nil
+}
+
+func TestFileUploads(t *testing.T) {
+
+	a := &API{
+		Root:          "/uploads",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{Path: "/avatar/{id}", Handler: MockUploadHandler{}, Methods: POST},
+		},
+	}
+
+	s := httptest.NewServer(a.configure(nil))
+	defer s.Close()
+
+	upload := func(fields map[string]string, files map[string][]string) (int, map[string]interface{}) {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		for k, v := range fields {
+			mw.WriteField(k, v)
+		}
+		for k, contents := range files {
+			for i, c := range contents {
+				fw, _ := mw.CreateFormFile(k, fmt.Sprintf("%s%d.txt", k, i))
+				fw.Write([]byte(c))
+			}
+		}
+		mw.Close()
+
+		res, err := http.Post(s.URL+a.FullPath("/avatar/5"), mw.FormDataContentType(), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var ret map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&ret)
+		return res.StatusCode, ret
+	}
+
+	code, ret := upload(map[string]string{"name": "foo"}, map[string][]string{"avatar": {"pixels"}, "extra": {"a", "b"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"name": "foo", "filename": "avatar0.txt", "avatar": "pixels", "extras": 2.0}, ret)
+
+	// required files are validated like other params
+	code, ret = upload(map[string]string{"name": "foo"}, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "avatar", ret["errors"].([]interface{})[0].(map[string]interface{})["param"])
+
+	ri, err := schema.NewRequestInfo(reflect.TypeOf(MockUploadHandler{}), "/avatar/{id}", "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, ParamDescription{Name: "avatar", In: "formData", Type: "file", Required: true}, describeParam(ri.Params[1]))
+	assert.Equal(t, ParamDescription{Name: "extra", In: "formData", Type: "array", Items: "file"}, describeParam(ri.Params[2]))
+}
+
+func TestBatch(t *testing.T) {
+
+	type ctxKey struct{}
+
+	a := &API{
+		Root:          "/batched",
+		Renderer:      JSONRenderer{},
+		AllowInsecure: true,
+		Routes: Routes{
+			{
+				Path:    "/users/{id}/{name}",
+				Handler: MockPathHandler{},
+				Methods: GET,
+			},
+			{
+				Path: "/whoami",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					return map[string]interface{}{
+						"auth":   r.Header.Get("Authorization"),
+						"cookie": r.Header.Get("Cookie"),
+						"id":     r.RequestId,
+						"trace":  r.Context().Value(ctxKey{}),
+					}, nil
+				}),
+				Methods: GET,
+			},
+			{
+				Path: "/echo",
+				Handler: HandlerFunc(func(w http.ResponseWriter, r *Request) (interface{}, error) {
+					b, _ := ioutil.ReadAll(r.Body)
+					return StatusResponse{Status: http.StatusCreated, Body: r.Header.Get("Content-Type") + " " + string(b)}, nil
+				}),
+				Methods: POST,
+			},
+		},
+	}
+
+	srv := NewServer(":9977")
+	srv.AddAPI(a)
+	srv.ExposeBatch(4)
+
+	postAs := func(contentType, body string) (*httptest.ResponseRecorder, []BatchResponse) {
+		hr, _ := http.NewRequest("POST", BatchPath, strings.NewReader(body))
+		hr.Header.Set("Content-Type", contentType)
+		hr.Header.Set("Authorization", "Bearer foo")
+		hr.Header.Set("Cookie", "session=victim")
+		hr.Header.Set(HeaderXRequestId, "batch1")
+		hr = hr.WithContext(context.WithValue(hr.Context(), ctxKey{}, "parent"))
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, hr)
+
+		var ret []BatchResponse
+		if w.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &ret))
+		}
+		return w, ret
+	}
+	post := func(body string) (*httptest.ResponseRecorder, []BatchResponse) {
+		return postAs("application/json; charset=utf-8", body)
+	}
+
+	w, res := post(`[
+		{"method": "GET", "path": "/batched/users/12/foo"},
+		{"path": "/batched/whoami"},
+		{"method": "POST", "path": "/batched/echo", "body": {"foo": "bar"}},
+		{"method": "post", "path": "/batched/echo", "headers": {"Content-Type": "text/plain"}, "body": "raw"}
+	]`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	if !assert.Len(t, res, 4) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, http.StatusOK, res[0].Status)
+	assert.JSONEq(t, `{"id": 12, "name": "foo"}`, string(res[0].Body))
+	assert.Equal(t, "application/json; charset=utf-8", res[0].Headers["Content-Type"])
+
+	// sub-requests get the auth and context of the batch request
+	assert.Equal(t, http.StatusOK, res[1].Status)
+	assert.JSONEq(t, `{"auth": "Bearer foo", "cookie": "", "id": "batch1-1", "trace": "parent"}`, string(res[1].Body))
+	assert.Equal(t, "batch1-1", res[1].Headers[http.CanonicalHeaderKey(HeaderXRequestId)])
+
+	assert.Equal(t, http.StatusCreated, res[2].Status)
+	assert.Equal(t, `"application/json {\"foo\": \"bar\"}"`, string(res[2].Body))
+	assert.Equal(t, http.StatusCreated, res[3].Status)
+	assert.Equal(t, `"text/plain raw"`, string(res[3].Body))
+
+	// failed sub-requests do not fail the batch
+	w, res = post(`[
+		{"path": "/batched/users/abc/foo"},
+		{"path": "/batched/nope"},
+		{"method": "DELETE", "path": "/batched/whoami"},
+		{"path": "batched/whoami"}
+	]`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	if !assert.Len(t, res, 4) {
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusBadRequest, res[0].Status)
+	assert.Equal(t, http.StatusNotFound, res[1].Status)
+	assert.Equal(t, http.StatusMethodNotAllowed, res[2].Status)
+	assert.Equal(t, http.StatusBadRequest, res[3].Status)
+	assert.NotEmpty(t, res[3].Body)
+
+	// batches cannot be nested
+	_, res = post(`[{"method": "POST", "path": "/batch", "body": [{"path": "/batched/whoami"}]}]`)
+	if assert.Len(t, res, 1) {
+		assert.Equal(t, http.StatusBadRequest, res[0].Status)
+	}
+
+	w, _ = post(`[{}, {}, {}, {}, {}]`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	w, _ = post(`{"path": "/batched/whoami"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// long batch ids are cut to fit the index of the sub-request
+	hr, _ := http.NewRequest("POST", BatchPath, strings.NewReader(`[{"path": "/batched/whoami"}]`))
+	hr.Header.Set("Content-Type", "application/json")
+	hr.Header.Set(HeaderXRequestId, strings.Repeat("a", 128))
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, hr)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	if assert.Len(t, res, 1) {
+		assert.Equal(t, strings.Repeat("a", 126)+"-0", res[0].Headers[http.CanonicalHeaderKey(HeaderXRequestId)])
+	}
+
+	// batches that browsers could send from other sites without a preflight request are rejected
+	w, _ = postAs("text/plain", `[{"method": "POST", "path": "/batched/echo", "body": "foo"}]`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	w, _ = postAs("", `[{"path": "/batched/whoami"}]`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	w, _ = post(`[{"method": "POST", "path": "/batched/echo", "body": "` + strings.Repeat("x", MaxBatchBodySize) + `"}]`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// the content type of a sub-request is found whatever the case of its header
+	_, res = post(`[{"method": "POST", "path": "/batched/echo", "headers": {"content-type": "text/plain"}, "body": "raw"}]`)
+	if assert.Len(t, res, 1) {
+		assert.Equal(t, `"text/plain raw"`, string(res[0].Body))
+	}
+
+	// sub-responses that do not fit in what is left of the batch response size are replaced with errors
+	defer func(size int64) { MaxBatchResponseSize = size }(MaxBatchResponseSize)
+	MaxBatchResponseSize = 40
+	_, res = post(`[
+		{"method": "POST", "path": "/batched/echo", "headers": {"Content-Type": "text/plain"}, "body": "aaaaaaaaaa"},
+		{"method": "POST", "path": "/batched/echo", "headers": {"Content-Type": "text/plain"}, "body": "bbbbbbbbbb"},
+		{"method": "POST", "path": "/batched/echo", "headers": {"Content-Type": "text/plain"}, "body": "c"}
+	]`)
+	if assert.Len(t, res, 3) {
+		assert.Equal(t, http.StatusCreated, res[0].Status)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res[1].Status)
+		assert.Equal(t, http.StatusCreated, res[2].Status)
+	}
+}